@@ -2,6 +2,8 @@
 export interface User {
   Username: string;
   DisplayName?: string;
+  Email?: string; // only returned to the user themselves
+  EmailVerified?: boolean;
 }
 
 // User object sent to the API when registering/editing a user
@@ -9,9 +11,20 @@ export interface UserWithPassword {
   Username: string;
   Password: string;
   DisplayName?: string;
+  Email?: string;
 }
 
 export interface Blog {
   Slug: string;
   DisplayName?: string;
 }
+
+// Session object returned by the API when listing sessions
+export interface Session {
+  ID: string;
+  Created: string;
+  LastSeen: string;
+  Address: string;
+  UserAgent: string;
+  Current: boolean;
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net/http"
+
+	_ "gocloud.dev/blob/fileblob"
+	_ "gocloud.dev/blob/s3blob"
+
+	"github.com/abustany/moblog-cloud/pkg/blogoutput"
+	"github.com/abustany/moblog-cloud/pkg/middlewares"
+)
+
+func main() {
+	listenAddress := flag.String("listen", "127.0.0.1:8080", "Address to listen on, of the form IP:PORT")
+	blogOutputURL := flag.String("blogOutput", "", "Where the generated blog files are stored. See https://gocloud.dev/howto/blob/ for supported URLs.")
+
+	flag.Parse()
+
+	if *blogOutputURL == "" {
+		log.Fatalf("Missing option: -blogOutput")
+	}
+
+	blogOutput, err := blogoutput.Open(context.Background(), *blogOutputURL)
+
+	if err != nil {
+		log.Fatalf("Error while opening blog output: %s", err)
+	}
+
+	defer blogOutput.Close()
+
+	log.Printf("Listening on %s", *listenAddress)
+	err = http.ListenAndServe(*listenAddress, middlewares.WithLogging(blogoutput.NewHandler(blogOutput)))
+
+	log.Fatalf("Error listening on %s: %s", *listenAddress, err)
+}
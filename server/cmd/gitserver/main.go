@@ -5,7 +5,11 @@ import (
 	"log"
 	"net/http"
 
+	_ "github.com/lib/pq"
+
+	"github.com/abustany/moblog-cloud/pkg/audit"
 	"github.com/abustany/moblog-cloud/pkg/gitserver"
+	"github.com/abustany/moblog-cloud/pkg/grants"
 	"github.com/abustany/moblog-cloud/pkg/workqueue"
 )
 
@@ -15,6 +19,10 @@ func main() {
 	repositoryBase := flag.String("repositoryBase", "", "Base path where user repositories are stored")
 	adminServerURL := flag.String("adminServer", "", "URL to the admin server")
 	redisJobQueueURL := flag.String("redisJobQueue", "", "URL to the Redis server to use for the job queue")
+	dbJobQueueURL := flag.String("dbJobQueue", "", "URL to the PostgreSQL server to use for the job queue, instead of Redis")
+	auditDBURL := flag.String("auditDB", "", "URL to the PostgreSQL server holding the audit log, usually the database of the admin server. If not set, the purges of deleted blogs are only recorded in memory.")
+	grantKeyString := flag.String("grantKey", "", "Key used to sign the grants given to workers (64 hex encoded bytes). Must be the same as the one of the admin server.")
+	flag.DurationVar(&gitserver.RenderGrantValidity, "renderGrantValidity", gitserver.RenderGrantValidity, "How long the grants of render jobs are valid. They must cover the time the jobs wait in the queue, their retries, and the -maxJobDuration of the workers.")
 
 	flag.Parse()
 
@@ -26,34 +34,97 @@ func main() {
 		log.Fatalf("Missing option: -adminServer")
 	}
 
+	if *grantKeyString == "" {
+		log.Fatalf("Missing option: -grantKey")
+	}
+
+	grantKey, err := grants.ParseKey(*grantKeyString)
+
+	if err != nil {
+		log.Fatalf("Invalid grant key: %s", err)
+	}
+
+	grantSigner, err := grants.NewSigner(grantKey)
+
+	if err != nil {
+		log.Fatalf("Error while creating grant signer: %s", err)
+	}
+
 	var jobQueue workqueue.Queue
-	var err error
 
-	if *redisJobQueueURL == "" {
+	if *dbJobQueueURL != "" {
+		jobQueue, err = workqueue.NewSQLQueue("postgres", *dbJobQueueURL, workqueue.PushQueueName)
+
+		if err == nil {
+			defer jobQueue.(*workqueue.SQLQueue).Stop()
+		}
+	} else if *redisJobQueueURL != "" {
+		jobQueue, err = workqueue.NewRedisQueue(*redisJobQueueURL, workqueue.PushQueueName)
+
+		if err == nil {
+			defer jobQueue.(*workqueue.RedisQueue).Stop()
+		}
+	} else {
 		log.Printf("Warning: using an in-memory work queue, render jobs will not be triggered")
 		jobQueue, err = workqueue.NewMemoryQueue()
 
 		if err == nil {
 			defer jobQueue.(*workqueue.MemoryQueue).Stop()
 		}
+	}
+
+	if err != nil {
+		log.Fatalf("Error while creating job queue: %s", err)
+	}
+
+	var repositoryQueue workqueue.Queue
+
+	if *dbJobQueueURL != "" {
+		repositoryQueue, err = workqueue.NewSQLQueue("postgres", *dbJobQueueURL, workqueue.RepositoryQueueName)
+
+		if err == nil {
+			defer repositoryQueue.(*workqueue.SQLQueue).Stop()
+		}
+	} else if *redisJobQueueURL != "" {
+		repositoryQueue, err = workqueue.NewRedisQueue(*redisJobQueueURL, workqueue.RepositoryQueueName)
+
+		if err == nil {
+			defer repositoryQueue.(*workqueue.RedisQueue).Stop()
+		}
 	} else {
-		jobQueue, err = workqueue.NewRedisQueue(*redisJobQueueURL)
+		repositoryQueue, err = workqueue.NewMemoryQueue()
 
 		if err == nil {
-			defer jobQueue.(*workqueue.RedisQueue).Stop()
+			defer repositoryQueue.(*workqueue.MemoryQueue).Stop()
 		}
 	}
 
 	if err != nil {
-		log.Fatalf("Error while creating job queue: %s", err)
+		log.Fatalf("Error while creating repository job queue: %s", err)
+	}
+
+	var auditLog audit.Log
+
+	if *auditDBURL != "" {
+		auditLog, err = audit.NewSQLLog("postgres", *auditDBURL)
+	} else {
+		log.Printf("Warning: using an in-memory audit log, purges of deleted blogs will only be logged")
+		auditLog, err = audit.NewMemoryLog()
 	}
 
-	s, err := gitserver.New(*baseAPIPath, *repositoryBase, *adminServerURL, jobQueue)
+	if err != nil {
+		log.Fatalf("Error while creating audit log: %s", err)
+	}
+
+	s, err := gitserver.New(*baseAPIPath, *repositoryBase, *adminServerURL, grantSigner, jobQueue)
 
 	if err != nil {
 		log.Fatalf("Error while creating gitserver: %s", err)
 	}
 
+	cleaner := gitserver.NewCleaner(*repositoryBase, repositoryQueue, auditLog, s)
+	defer cleaner.Stop()
+
 	log.Printf("Listening on %s", *listenAddress)
 	err = http.ListenAndServe(*listenAddress, s)
 
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io"
+	"log"
+	"os"
+
+	_ "github.com/lib/pq"
+
+	"github.com/abustany/moblog-cloud/pkg/userstore"
+)
+
+// importedUser is read from the standard input, one JSON object per line
+type importedUser struct {
+	Username     string
+	DisplayName  string
+	Email        string
+	PasswordHash string // bcrypt
+}
+
+func main() {
+	dbURL := flag.String("db", "", "URL to the PostgreSQL server. If not set, the DB_URL environment variable is used.")
+	skipExisting := flag.Bool("skipExisting", false, "Skip users whose username is already taken instead of stopping")
+
+	flag.Parse()
+
+	if *dbURL == "" {
+		*dbURL = os.Getenv("DB_URL")
+	}
+
+	if *dbURL == "" {
+		log.Fatal("No database URL set. Use -db or the DB_URL environment variable.")
+	}
+
+	userStore, err := userstore.NewSQLUserStore("postgres", *dbURL)
+
+	if err != nil {
+		log.Fatalf("Error while initializing user store: %s", err)
+	}
+
+	decoder := json.NewDecoder(os.Stdin)
+	imported := 0
+
+	for {
+		var user importedUser
+
+		err := decoder.Decode(&user)
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			log.Fatalf("Error while decoding user: %s", err)
+		}
+
+		err = userStore.ImportUser(userstore.User{
+			Username:    user.Username,
+			DisplayName: user.DisplayName,
+			Email:       user.Email,
+		}, user.PasswordHash)
+
+		if err == userstore.ErrAlreadyExists && *skipExisting {
+			log.Printf("Skipping existing user %s", user.Username)
+			continue
+		}
+
+		if err != nil {
+			log.Fatalf("Error while importing user %s: %s", user.Username, err)
+		}
+
+		imported++
+	}
+
+	log.Printf("Imported %d users", imported)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	_ "github.com/lib/pq"
+	"github.com/pkg/errors"
+
+	"github.com/abustany/moblog-cloud/pkg/jobs"
+	"github.com/abustany/moblog-cloud/pkg/workqueue"
+)
+
+const usage = `Usage: queuectl (-redisJobQueue URL | -dbJobQueue URL) [-queue NAME] COMMAND [ARGS...]
+
+Commands:
+  stats           Show the number of jobs in each state
+  list STATE      List the jobs in the given state (pending, delayed,
+                  followup, reserved or dead)
+  show ID         Show the details of a job
+  dead            List the jobs that failed too many times
+  cancel ID...    Delete jobs that are not running yet
+  requeue ID...   Move dead or reserved jobs back to the pending jobs
+`
+
+func main() {
+	redisJobQueueURL := flag.String("redisJobQueue", "", "URL to the Redis server used for the job queue")
+	dbJobQueueURL := flag.String("dbJobQueue", "", "URL to the PostgreSQL server used for the job queue")
+	queueName := flag.String("queue", workqueue.PushQueueName, "Name of the queue to manage")
+
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+
+	if *redisJobQueueURL == "" && *dbJobQueueURL == "" {
+		log.Fatalf("Missing option: -redisJobQueue or -dbJobQueue")
+	}
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var queue inspectableQueue
+	var stopQueue func()
+	var err error
+
+	if *dbJobQueueURL != "" {
+		var sqlQueue *workqueue.SQLQueue
+		sqlQueue, err = workqueue.NewSQLQueue("postgres", *dbJobQueueURL, *queueName)
+		queue, stopQueue = sqlQueue, func() { sqlQueue.Stop() }
+	} else {
+		var redisQueue *workqueue.RedisQueue
+		redisQueue, err = workqueue.NewRedisQueue(*redisJobQueueURL, *queueName)
+		queue, stopQueue = redisQueue, func() { redisQueue.Stop() }
+	}
+
+	if err != nil {
+		log.Fatalf("Error while initializing work queue: %s", err)
+	}
+
+	err = run(queue, flag.Arg(0), flag.Args()[1:])
+
+	// Don't defer this, log.Fatalf would skip it and the Redis queue would
+	// keep its grooming lock until it expires
+	stopQueue()
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+type inspectableQueue interface {
+	workqueue.Queue
+	workqueue.Inspector
+}
+
+func run(queue inspectableQueue, command string, args []string) error {
+	switch command {
+	case "stats":
+		return showCounts(queue)
+	case "list":
+		if len(args) != 1 {
+			return errors.New("list needs a job state")
+		}
+
+		return listJobs(queue, workqueue.JobState(args[0]))
+	case "show":
+		if len(args) != 1 {
+			return errors.New("show needs a job ID")
+		}
+
+		return showJob(queue, args[0])
+	case "dead":
+		return listJobs(queue, workqueue.JobDead)
+	case "cancel":
+		return forEachID("cancel", args, queue.Cancel, "Cancelled")
+	case "requeue":
+		return forEachID("requeue", args, func(id string) error {
+			if err := queue.RequeueDead(id); err != workqueue.ErrJobNotFound {
+				return err
+			}
+
+			return queue.Requeue(id)
+		}, "Requeued")
+	default:
+		return errors.Errorf("Unknown command: %s", command)
+	}
+}
+
+// forEachID runs do on each of the job IDs given to a command
+func forEachID(command string, ids []string, do func(id string) error, done string) error {
+	if len(ids) == 0 {
+		return errors.Errorf("%s needs at least one job ID", command)
+	}
+
+	for _, id := range ids {
+		if err := do(id); err != nil {
+			return errors.Wrapf(err, "Error while running %s on job %s", command, id)
+		}
+
+		log.Printf("%s job %s", done, id)
+	}
+
+	return nil
+}
+
+func showCounts(queue workqueue.Inspector) error {
+	counts, err := queue.Counts()
+
+	if err != nil {
+		return errors.Wrap(err, "Error while counting jobs")
+	}
+
+	for _, state := range workqueue.JobStates {
+		fmt.Printf("%s\t%d\n", state, counts[state])
+	}
+
+	return nil
+}
+
+func listJobs(queue workqueue.Inspector, state workqueue.JobState) error {
+	entries, err := queue.Jobs(state)
+
+	if err != nil {
+		return errors.Wrapf(err, "Error while listing %s jobs", state)
+	}
+
+	for _, entry := range entries {
+		fmt.Printf("%s\tattempts=%d\t%s\t%s\n", entry.ID, entry.Attempts, describeJob(entry.Data), entry.LastError)
+	}
+
+	return nil
+}
+
+func showJob(queue workqueue.Inspector, id string) error {
+	entry, state, err := queue.Job(id)
+
+	if err != nil {
+		return errors.Wrapf(err, "Error while retrieving job %s", id)
+	}
+
+	fmt.Printf("ID:         %s\n", entry.ID)
+	fmt.Printf("State:      %s\n", state)
+	fmt.Printf("Job:        %s\n", describeJob(entry.Data))
+	fmt.Printf("Key:        %s\n", entry.Key)
+	fmt.Printf("TTR:        %s\n", entry.TTR)
+	fmt.Printf("Attempts:   %d\n", entry.Attempts)
+	fmt.Printf("Last error: %s\n", entry.LastError)
+
+	return nil
+}
+
+func describeJob(data interface{}) string {
+	switch job := data.(type) {
+	case jobs.RenderJob:
+		return fmt.Sprintf("render %s/%s", job.Username, job.Repository)
+	case jobs.ScheduledRenderJob:
+		return fmt.Sprintf("scheduled render %s/%s", job.Username, job.Repository)
+	case jobs.CleanupJob:
+		return fmt.Sprintf("cleanup of %s, deleted at %s", job.Target(), job.Deleted.Format(time.RFC3339))
+	default:
+		return fmt.Sprintf("%T", data)
+	}
+}
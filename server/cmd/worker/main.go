@@ -1,28 +1,49 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	_ "github.com/lib/pq"
 
 	_ "gocloud.dev/blob/fileblob"
 	_ "gocloud.dev/blob/s3blob"
 
+	"github.com/pkg/errors"
+
+	"github.com/abustany/moblog-cloud/pkg/audit"
+	"github.com/abustany/moblog-cloud/pkg/blogoutput"
 	"github.com/abustany/moblog-cloud/pkg/worker"
 	"github.com/abustany/moblog-cloud/pkg/workqueue"
 )
 
 func main() {
 	redisJobQueueURL := flag.String("redisJobQueue", "", "URL to the Redis server to use for the job queue")
+	dbJobQueueURL := flag.String("dbJobQueue", "", "URL to the PostgreSQL server to use for the job queue, instead of Redis")
+	queueNames := flag.String("queues", workqueue.DefaultWorkerQueues, "Comma separated list of the queues to consume, highest priority first. Each name can be followed by :WEIGHT to give the queue a bigger share of the jobs picked when all queues are busy (default weight is 1).")
 	adminServerURL := flag.String("adminServer", "", "URL of the admin server")
 	gitServerURL := flag.String("gitServer", "", "URL of the git server")
 	workDir := flag.String("workDir", "", "Directory where to checkout the blog source and do the rendering work")
 	themeRepositoryURL := flag.String("themeRepository", "", "URL of the Git repository holding the blog theme")
+	auditDBURL := flag.String("auditDB", "", "URL to the PostgreSQL server holding the audit log, usually the database of the admin server. If not set, the purges of deleted blogs are only recorded in memory.")
 	blogOutputURL := flag.String("blogOutput", "", "Where to store the generated blog files. See https://gocloud.dev/howto/blob/ for supported URLs.")
+	flag.IntVar(&blogoutput.KeepVersions, "keepVersions", blogoutput.KeepVersions, "Number of rendered versions to keep for each blog")
+	flag.IntVar(&worker.MaxBuildLogSize, "maxBuildLogSize", worker.MaxBuildLogSize, "Maximum size of the log of a build, in bytes")
+	flag.IntVar(&worker.Concurrency, "concurrency", worker.Concurrency, "Number of render jobs to run at the same time")
+	flag.DurationVar(&worker.MaxJobDuration, "maxJobDuration", worker.MaxJobDuration, "Maximum time a render job can run")
+	shutdownGracePeriod := flag.Duration("shutdownGracePeriod", 20*time.Second, "How long to wait for the running jobs to complete when receiving SIGINT or SIGTERM, before handing them back to the queue")
 
 	flag.Parse()
 
-	if *redisJobQueueURL == "" {
-		log.Fatalf("Missing option: -redisJobQueue")
+	if *redisJobQueueURL == "" && *dbJobQueueURL == "" {
+		log.Fatalf("Missing option: -redisJobQueue or -dbJobQueue")
 	}
 
 	if *adminServerURL == "" {
@@ -45,21 +66,124 @@ func main() {
 		log.Fatalf("Missing option: -blogOutput")
 	}
 
-	queue, err := workqueue.NewRedisQueue(*redisJobQueueURL)
+	weightedNames, err := parseQueueNames(*queueNames)
 
 	if err != nil {
-		log.Fatalf("Error while initializing Redis work queue: %s", err)
+		log.Fatalf("Invalid -queues option: %s", err)
 	}
 
-	defer queue.Stop()
+	var stopQueues []func()
+
+	defer func() {
+		for _, stop := range stopQueues {
+			stop()
+		}
+	}()
+
+	openQueue := func(name string) workqueue.Queue {
+		if *dbJobQueueURL != "" {
+			queue, err := workqueue.NewSQLQueue("postgres", *dbJobQueueURL, name)
+
+			if err != nil {
+				log.Fatalf("Error while initializing work queue %s: %s", name, err)
+			}
+
+			stopQueues = append(stopQueues, queue.Stop)
+			return queue
+		}
 
-	worker, err := worker.New(queue, *adminServerURL, *gitServerURL, *workDir, *themeRepositoryURL, *blogOutputURL)
+		queue, err := workqueue.NewRedisQueue(*redisJobQueueURL, name)
+
+		if err != nil {
+			log.Fatalf("Error while initializing work queue %s: %s", name, err)
+		}
+
+		stopQueues = append(stopQueues, queue.Stop)
+		return queue
+	}
+
+	var weightedQueues []workqueue.WeightedQueue
+
+	for _, weightedName := range weightedNames {
+		weightedQueues = append(weightedQueues, workqueue.WeightedQueue{Queue: openQueue(weightedName.name), Weight: weightedName.weight})
+	}
+
+	// Scheduled renders are posted to the queue of the gitservers, which sign
+	// their grants
+	repositoryQueue := openQueue(workqueue.RepositoryQueueName)
+
+	var queue workqueue.Queue = weightedQueues[0].Queue
+
+	if len(weightedQueues) > 1 {
+		if queue, err = workqueue.NewMultiQueue(weightedQueues...); err != nil {
+			log.Fatalf("Error while initializing work queue: %s", err)
+		}
+	}
+
+	blogOutput, err := blogoutput.Open(context.Background(), *blogOutputURL)
+
+	if err != nil {
+		log.Fatalf("Error while opening blog output: %s", err)
+	}
+
+	defer blogOutput.Close()
+
+	var auditLog audit.Log
+
+	if *auditDBURL != "" {
+		auditLog, err = audit.NewSQLLog("postgres", *auditDBURL)
+	} else {
+		log.Printf("Warning: using an in-memory audit log, purges of deleted blogs will only be logged")
+		auditLog, err = audit.NewMemoryLog()
+	}
+
+	if err != nil {
+		log.Fatalf("Error while creating audit log: %s", err)
+	}
+
+	worker, err := worker.New(queue, *adminServerURL, *gitServerURL, *workDir, *themeRepositoryURL, blogOutput, repositoryQueue, auditLog)
 
 	if err != nil {
 		log.Fatalf("Error while initializing worker: %s", err)
 	}
 
-	defer worker.Stop()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	log.Printf("Received %s, shutting down", <-signals)
+
+	worker.Shutdown(*shutdownGracePeriod)
+}
+
+type weightedQueueName struct {
+	name   string
+	weight int
+}
+
+// parseQueueNames parses the value of the -queues option
+func parseQueueNames(value string) ([]weightedQueueName, error) {
+	var names []weightedQueueName
+
+	for _, item := range strings.Split(value, ",") {
+		parts := strings.SplitN(strings.TrimSpace(item), ":", 2)
+		weightedName := weightedQueueName{name: parts[0], weight: 1}
+
+		if weightedName.name == "" {
+			return nil, errors.New("Queue names cannot be empty")
+		}
+
+		if len(parts) == 2 {
+			weight, err := strconv.Atoi(parts[1])
+
+			if err != nil || weight <= 0 {
+				return nil, errors.Errorf("Invalid weight for queue %s: %s", weightedName.name, parts[1])
+			}
+
+			weightedName.weight = weight
+		}
+
+		names = append(names, weightedName)
+	}
 
-	worker.Wait()
+	return names, nil
 }
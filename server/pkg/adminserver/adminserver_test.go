@@ -1,16 +1,31 @@
 package adminserver_test
 
 import (
+	"context"
+	"io/ioutil"
+	"net/http"
 	"net/http/httptest"
+	"os"
+	"path"
+	"regexp"
 	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	_ "github.com/lib/pq"
+	"github.com/pkg/errors"
 
 	"github.com/abustany/moblog-cloud/pkg/adminserver"
+	"github.com/abustany/moblog-cloud/pkg/audit"
+	"github.com/abustany/moblog-cloud/pkg/blogoutput"
+	"github.com/abustany/moblog-cloud/pkg/jobs"
+	"github.com/abustany/moblog-cloud/pkg/mailer"
 	"github.com/abustany/moblog-cloud/pkg/testutils"
+	"github.com/abustany/moblog-cloud/pkg/totp"
 	"github.com/abustany/moblog-cloud/pkg/userstore"
+	"github.com/abustany/moblog-cloud/pkg/workqueue"
 )
 
 type LoginFunc func(username, password string) error
@@ -20,9 +35,15 @@ type RPCFunc func(method string, param interface{}, reply interface{}) error
 func TestUserService(t *testing.T) {
 	testutils.FlushDB(t)
 
-	server := httptest.NewServer(testutils.NewAdminServer(t))
+	blogOutput := testutils.NewBlogOutput(t)
+	defer blogOutput.Close()
+
+	server := httptest.NewServer(testutils.NewAdminServer(t, blogOutput))
 	defer server.Close()
 
+	blogServer := httptest.NewServer(blogoutput.NewHandler(blogOutput))
+	defer blogServer.Close()
+
 	client, err := adminserver.NewClient(server.URL)
 
 	if err != nil {
@@ -35,6 +56,12 @@ func TestUserService(t *testing.T) {
 		}
 	}
 
+	withBlogServer := func(f func(*testing.T, *adminserver.Client, string)) func(*testing.T) {
+		return func(t *testing.T) {
+			f(t, client, blogServer.URL)
+		}
+	}
+
 	t.Run("Create a new user", withClient(testCreateUser))
 	t.Run("Get a user", withClient(testGetUser))
 	t.Run("Update a user", withClient(testUpdateUser))
@@ -45,10 +72,22 @@ func TestUserService(t *testing.T) {
 	t.Run("Create a blog", withClient(testCreateBlog))
 	t.Run("Get a blog", withClient(testGetBlog))
 	t.Run("Update a blog", withClient(testUpdateBlog))
-	t.Run("Delete a blog", withClient(testDeleteBlog))
+	t.Run("Roll back a blog", func(t *testing.T) {
+		testRollbackBlog(t, client, blogOutput)
+	})
+	t.Run("Delete a blog", withBlogServer(testDeleteBlog))
 	t.Run("List blogs", withClient(testListBlogs))
+	t.Run("Restore deleted blogs and users", withBlogServer(testRestore))
 
 	t.Run("Refresh a session", withClient(testRefreshSession))
+
+	t.Run("Access tokens", func(t *testing.T) {
+		testAccessTokens(t, client, server.URL)
+	})
+
+	t.Run("Builds", func(t *testing.T) {
+		testBuilds(t, client, server.URL)
+	})
 }
 
 func testCreateUser(t *testing.T, c *adminserver.Client) {
@@ -259,15 +298,84 @@ func testUpdateBlog(t *testing.T, c *adminserver.Client) {
 	}
 }
 
-func testDeleteBlog(t *testing.T, c *adminserver.Client) {
+func publishTestBlog(t *testing.T, blogOutput *blogoutput.Output, content string) string {
+	sourceDir := testutils.TempDir(t, "blog-output")
+	defer os.RemoveAll(sourceDir)
+
+	if err := ioutil.WriteFile(path.Join(sourceDir, "index.html"), []byte(content), 0600); err != nil {
+		t.Fatalf("Error while writing blog file: %s", err)
+	}
+
+	version, err := blogOutput.Publish(context.Background(), "john", "blog", sourceDir)
+
+	if err != nil {
+		t.Fatalf("Error while publishing blog: %s", err)
+	}
+
+	return version
+}
+
+func testRollbackBlog(t *testing.T, c *adminserver.Client, blogOutput *blogoutput.Output) {
+	if _, err := c.ListBlogVersions("nothinghere"); err == nil {
+		t.Errorf("Expected an error when listing the versions of a non existing blog")
+	}
+
+	firstVersion := publishTestBlog(t, blogOutput, "first")
+	secondVersion := publishTestBlog(t, blogOutput, "second")
+
+	versions, err := c.ListBlogVersions("blog")
+
+	if err != nil {
+		t.Fatalf("Blogs.ListVersions returned an error: %s", err)
+	}
+
+	if len(versions) != 2 || versions[0].ID != secondVersion || !versions[0].Current || versions[1].ID != firstVersion || versions[1].Current {
+		t.Fatalf("Unexpected versions after publishing: %+v", versions)
+	}
+
+	if err := c.RollbackBlog("blog", "nothinghere"); err == nil {
+		t.Errorf("Expected an error when rolling back to a non existing version")
+	}
+
+	if err := c.RollbackBlog("blog", firstVersion); err != nil {
+		t.Fatalf("Blogs.Rollback returned an error: %s", err)
+	}
+
+	if current, err := blogOutput.CurrentVersion(context.Background(), "john", "blog"); err != nil {
+		t.Errorf("Error while retrieving current version: %s", err)
+	} else if current != firstVersion {
+		t.Errorf("Expected current version to be %s after rollback, got %s", firstVersion, current)
+	}
+}
+
+func checkBlogStatus(t *testing.T, blogServerURL string, expectedStatus int) {
+	res, err := http.Get(blogServerURL + "/john/blog/")
+
+	if err != nil {
+		t.Fatalf("Error while getting the blog: %s", err)
+	}
+
+	res.Body.Close()
+
+	if res.StatusCode != expectedStatus {
+		t.Errorf("Unexpected status for the blog: expected %d, got %d", expectedStatus, res.StatusCode)
+	}
+}
+
+func testDeleteBlog(t *testing.T, c *adminserver.Client, blogServerURL string) {
 	if err := c.DeleteBlog("nothinghere"); err == nil {
 		t.Errorf("Expected an error when deleting a non existing blog")
 	}
 
+	checkBlogStatus(t, blogServerURL, http.StatusOK)
+
 	if err := c.DeleteBlog("blog"); err != nil {
 		t.Errorf("Blogs.Delete returned an error: %s", err)
 	}
 
+	// Deleted blogs are not served anymore, even though they can be restored
+	checkBlogStatus(t, blogServerURL, http.StatusNotFound)
+
 	if err := c.DeleteBlog("blog"); err == nil {
 		t.Errorf("Expected an error when deleting a deleted blog")
 	}
@@ -315,6 +423,62 @@ func testListBlogs(t *testing.T, c *adminserver.Client) {
 	}
 }
 
+func testRestore(t *testing.T, c *adminserver.Client, blogServerURL string) {
+	deleted, err := c.ListDeletedBlogs()
+
+	if err != nil {
+		t.Fatalf("Blogs.ListDeleted returned an error: %s", err)
+	}
+
+	if len(deleted) != 1 || deleted[0].Slug != "blog" || deleted[0].Deleted == nil {
+		t.Fatalf("Unexpected deleted blogs: %+v", deleted)
+	}
+
+	if err := c.CreateBlog(userstore.Blog{Slug: "blog"}); err == nil {
+		t.Errorf("Expected an error when creating a blog with the slug of a deleted blog")
+	}
+
+	if err := c.RestoreBlog("blog"); err != nil {
+		t.Fatalf("Blogs.Restore returned an error: %s", err)
+	}
+
+	checkBlogStatus(t, blogServerURL, http.StatusOK)
+
+	if blog, err := c.GetBlog("blog"); err != nil {
+		t.Errorf("Blogs.Get returned an error for a restored blog: %s", err)
+	} else {
+		verifyBlog(t, blog, "blog", "A more modern name")
+	}
+
+	if err := c.RestoreBlog("blog"); err == nil {
+		t.Errorf("Expected an error when restoring a blog that is not deleted")
+	}
+
+	if err := c.DeleteBlog("blog"); err != nil {
+		t.Errorf("Blogs.Delete returned an error: %s", err)
+	}
+
+	if err := c.Login("hello", "mundo"); err == nil {
+		t.Errorf("Expected an error when logging in as a deleted user")
+	}
+
+	if err := c.RestoreUser("hello", "wrong"); err == nil {
+		t.Errorf("Expected an error when restoring a user with a wrong password")
+	}
+
+	if err := c.RestoreUser("hello", "mundo"); err != nil {
+		t.Fatalf("Users.Restore returned an error: %s", err)
+	}
+
+	if err := c.Login("hello", "mundo"); err != nil {
+		t.Errorf("Error while logging in as a restored user: %s", err)
+	}
+
+	if err := c.Login("john", "foo"); err != nil {
+		t.Errorf("Error while logging in as john: %s", err)
+	}
+}
+
 func testRefreshSession(t *testing.T, c *adminserver.Client) {
 	user := userstore.User{
 		Username: "refresh-me",
@@ -352,3 +516,982 @@ func testRefreshSession(t *testing.T, c *adminserver.Client) {
 		t.Errorf("Refreshed cookie expiration time (%v) is not greater than original cookie expiration time (%v)", refreshedCookie.Expires, authCookie.Expires)
 	}
 }
+
+func testAccessTokens(t *testing.T, c *adminserver.Client, serverURL string) {
+	user := userstore.User{
+		Username: "tokenizer",
+		Password: "opensesame",
+	}
+
+	if err := c.CreateUser(user); err != nil {
+		t.Fatalf("Error while creating user: %s", err)
+	}
+
+	if err := c.Login(user.Username, user.Password); err != nil {
+		t.Fatalf("Error while logging in: %s", err)
+	}
+
+	if _, err := c.CreateToken("", []string{userstore.TokenScopeRepoRead}); err == nil {
+		t.Errorf("Expected an error when creating a token without a name")
+	}
+
+	if _, err := c.CreateToken("phone", []string{"everything"}); err == nil {
+		t.Errorf("Expected an error when creating a token with an invalid scope")
+	}
+
+	created, err := c.CreateToken("phone", []string{userstore.TokenScopeRepoRead})
+
+	if err != nil {
+		t.Fatalf("Tokens.Create returned an error: %s", err)
+	}
+
+	if created.Secret == "" {
+		t.Errorf("Tokens.Create returned an empty secret")
+	}
+
+	if tokens, err := c.ListTokens(); err != nil {
+		t.Errorf("Tokens.List returned an error: %s", err)
+	} else if len(tokens) != 1 || tokens[0].ID != created.Token.ID || tokens[0].Name != "phone" {
+		t.Errorf("Unexpected token list: %+v", tokens)
+	}
+
+	tokenClient, err := adminserver.NewClient(serverURL)
+
+	if err != nil {
+		t.Fatalf("Error while creating RPC client: %s", err)
+	}
+
+	tokenClient.SetBasicAuth(user.Username, created.Secret)
+
+	if me, err := tokenClient.Whoami(); err != nil {
+		t.Errorf("Users.Whoami with an access token returned an error: %s", err)
+	} else if me.Username != user.Username {
+		t.Errorf("Unexpected username, got %s, expected %s", me.Username, user.Username)
+	}
+
+	if scopes, err := tokenClient.SessionScopes(); err != nil {
+		t.Errorf("Tokens.SessionScopes returned an error: %s", err)
+	} else if !scopes.Restricted || len(scopes.Scopes) != 1 || scopes.Scopes[0] != userstore.TokenScopeRepoRead {
+		t.Errorf("Unexpected session scopes: %+v", scopes)
+	}
+
+	if err := tokenClient.CreateBlog(userstore.Blog{Slug: "sneaky"}); err == nil {
+		t.Errorf("Expected an error when creating a blog with an access token")
+	}
+
+	if _, err := tokenClient.CreateToken("another", []string{userstore.TokenScopeRepoWrite}); err == nil {
+		t.Errorf("Expected an error when creating a token with an access token")
+	}
+
+	if err := c.RevokeToken(created.Token.ID); err != nil {
+		t.Errorf("Tokens.Revoke returned an error: %s", err)
+	}
+
+	if err := c.RevokeToken(created.Token.ID); err == nil {
+		t.Errorf("Expected an error when revoking a revoked token")
+	}
+
+	if _, err := tokenClient.Whoami(); err == nil {
+		t.Errorf("Expected an error when using a revoked token")
+	}
+}
+
+func testBuilds(t *testing.T, c *adminserver.Client, serverURL string) {
+	user := userstore.User{
+		Username: "builder",
+		Password: "bobthe",
+	}
+
+	if err := c.CreateUser(user); err != nil {
+		t.Fatalf("Error while creating user: %s", err)
+	}
+
+	if err := c.Login(user.Username, user.Password); err != nil {
+		t.Fatalf("Error while logging in: %s", err)
+	}
+
+	for _, slug := range []string{"built", "other"} {
+		if err := c.CreateBlog(userstore.Blog{Slug: slug, DisplayName: slug}); err != nil {
+			t.Fatalf("Error while creating blog %s: %s", slug, err)
+		}
+	}
+
+	if _, err := c.CreateBuild("built"); err == nil {
+		t.Errorf("Expected an error when creating a build with a user session")
+	}
+
+	newGrantClient := func(slug string) *adminserver.Client {
+		grant, err := testutils.GrantSigner(t).Sign(user.Username, slug, time.Minute)
+
+		if err != nil {
+			t.Fatalf("Error while signing grant: %s", err)
+		}
+
+		client, err := adminserver.NewClient(serverURL)
+
+		if err != nil {
+			t.Fatalf("Error while creating RPC client: %s", err)
+		}
+
+		client.SetGrant(grant)
+
+		return client
+	}
+
+	grantClient := newGrantClient("built")
+
+	if _, err := grantClient.CreateBuild("other"); err == nil {
+		t.Errorf("Expected an error when creating a build for another blog than the one of the grant")
+	}
+
+	build, err := grantClient.CreateBuild("built")
+
+	if err != nil {
+		t.Fatalf("Builds.Create returned an error: %s", err)
+	}
+
+	if build.Status != userstore.BuildQueued || build.Blog != "built" {
+		t.Errorf("Unexpected new build: %+v", build)
+	}
+
+	if err := newGrantClient("other").StartBuild(build.ID); err == nil {
+		t.Errorf("Expected an error when starting a build with a grant for another blog")
+	}
+
+	if err := c.StartBuild(build.ID); err == nil {
+		t.Errorf("Expected an error when starting a build with a user session")
+	}
+
+	if err := grantClient.StartBuild(build.ID); err != nil {
+		t.Fatalf("Builds.Start returned an error: %s", err)
+	}
+
+	if got, err := c.GetBuild(build.ID); err != nil {
+		t.Errorf("Builds.Get returned an error: %s", err)
+	} else if got.Status != userstore.BuildRunning || got.Started == nil {
+		t.Errorf("Unexpected running build: %+v", got)
+	}
+
+	if _, err := c.GetBuildLog(build.ID); err == nil {
+		t.Errorf("Expected an error when getting the log of a build without log")
+	}
+
+	if err := grantClient.FinishBuild(build.ID, "abc123", "Hugo exploded"); err != nil {
+		t.Fatalf("Builds.Finish returned an error: %s", err)
+	}
+
+	if err := grantClient.FinishBuild(build.ID, "abc123", ""); err == nil {
+		t.Errorf("Expected an error when finishing a build twice")
+	}
+
+	builds, err := c.ListBuilds("built", 0)
+
+	if err != nil {
+		t.Fatalf("Builds.List returned an error: %s", err)
+	}
+
+	if len(builds) != 1 {
+		t.Fatalf("Expected 1 build, got %+v", builds)
+	}
+
+	if b := builds[0]; b.ID != build.ID || b.Status != userstore.BuildFailed || b.Commit != "abc123" || b.Error != "Hugo exploded" || b.Finished == nil {
+		t.Errorf("Unexpected finished build: %+v", b)
+	}
+
+	if builds, err := c.ListBuilds("other", 0); err != nil {
+		t.Errorf("Builds.List returned an error: %s", err)
+	} else if len(builds) != 0 {
+		t.Errorf("Expected no builds for the other blog, got %+v", builds)
+	}
+
+	if _, err := newGrantClient("other").GetBuild(build.ID); err == nil {
+		t.Errorf("Expected an error when getting a build with a grant for another blog")
+	}
+
+	supersededBuild, err := grantClient.CreateBuild("built")
+
+	if err != nil {
+		t.Fatalf("Builds.Create returned an error: %s", err)
+	}
+
+	if err := c.SupersedeBuild(supersededBuild.ID); err == nil {
+		t.Errorf("Expected an error when superseding a build with a user session")
+	}
+
+	if err := grantClient.SupersedeBuild(supersededBuild.ID); err != nil {
+		t.Fatalf("Builds.Supersede returned an error: %s", err)
+	}
+
+	if got, err := c.GetBuild(supersededBuild.ID); err != nil {
+		t.Errorf("Builds.Get returned an error: %s", err)
+	} else if got.Status != userstore.BuildSuperseded || got.Finished == nil {
+		t.Errorf("Unexpected superseded build: %+v", got)
+	}
+
+	if err := grantClient.SupersedeBuild(build.ID); err == nil {
+		t.Errorf("Expected an error when superseding a finished build")
+	}
+}
+
+// unavailableQueue refuses the jobs posted with PostUnique while unavailable is
+// set
+type unavailableQueue struct {
+	workqueue.Queue
+	unavailable bool
+}
+
+func (q *unavailableQueue) PostUnique(key string, job interface{}, ttr time.Duration) (interface{}, error) {
+	if q.unavailable {
+		return nil, errors.New("Queue unavailable")
+	}
+
+	return q.Queue.PostUnique(key, job, ttr)
+}
+
+func TestPurgeDeleted(t *testing.T) {
+	testutils.FlushDB(t)
+
+	blogOutput := testutils.NewBlogOutput(t)
+	defer blogOutput.Close()
+
+	jobQueue := testutils.NewMemoryQueue(t)
+	defer jobQueue.Stop()
+
+	repositoryQueue := testutils.NewMemoryQueue(t)
+	defer repositoryQueue.Stop()
+
+	unavailableRepositoryQueue := &unavailableQueue{Queue: repositoryQueue}
+
+	auditLog := testutils.NewMemoryAuditLog(t)
+
+	adminServer := testutils.NewAdminServerWithQueues(t, blogOutput, jobQueue, unavailableRepositoryQueue, auditLog)
+	server := httptest.NewServer(adminServer)
+	defer server.Close()
+
+	client, err := adminserver.NewClient(server.URL)
+
+	if err != nil {
+		t.Fatalf("Error while creating RPC client: %s", err)
+	}
+
+	if err := client.CreateUser(userstore.User{Username: "purged", Password: "secret"}); err != nil {
+		t.Fatalf("Error while creating user: %s", err)
+	}
+
+	if err := client.Login("purged", "secret"); err != nil {
+		t.Fatalf("Error while logging in: %s", err)
+	}
+
+	if err := client.CreateBlog(userstore.Blog{Slug: "blog"}); err != nil {
+		t.Fatalf("Error while creating blog: %s", err)
+	}
+
+	if err := client.DeleteBlog("blog"); err != nil {
+		t.Fatalf("Error while deleting blog: %s", err)
+	}
+
+	// Nothing to purge before the end of the retention period
+	if err := adminServer.PurgeDeleted(); err != nil {
+		t.Fatalf("Error while purging: %s", err)
+	}
+
+	if deleted, err := client.ListDeletedBlogs(); err != nil || len(deleted) != 1 {
+		t.Fatalf("Unexpected deleted blogs before purging: %+v, %v", deleted, err)
+	}
+
+	oldRetention := adminserver.DeletedRetention
+	adminserver.DeletedRetention = 0
+	defer func() { adminserver.DeletedRetention = oldRetention }()
+
+	// The blog is kept until the gitservers accept the cleanup job
+	unavailableRepositoryQueue.unavailable = true
+
+	if err := adminServer.PurgeDeleted(); err == nil {
+		t.Errorf("Purging should fail while a queue is unavailable")
+	}
+
+	if deleted, err := client.ListDeletedBlogs(); err != nil || len(deleted) != 1 {
+		t.Fatalf("Unexpected deleted blogs after a failed purge: %+v, %v", deleted, err)
+	}
+
+	if events, err := auditLog.Events(10); err != nil || len(events) != 0 {
+		t.Errorf("Unexpected audit events after a failed purge: %+v, %v", events, err)
+	}
+
+	unavailableRepositoryQueue.unavailable = false
+
+	if err := adminServer.PurgeDeleted(); err != nil {
+		t.Fatalf("Error while purging: %s", err)
+	}
+
+	if deleted, err := client.ListDeletedBlogs(); err != nil || len(deleted) != 0 {
+		t.Errorf("Unexpected deleted blogs after purging: %+v, %v", deleted, err)
+	}
+
+	if events, err := auditLog.Events(10); err != nil || len(events) != 1 || events[0].Type != audit.CleanupScheduled || events[0].Username != "purged" || events[0].Repository != "blog" {
+		t.Errorf("Unexpected audit events after purging: %+v, %v", events, err)
+	}
+
+	for _, queue := range []*workqueue.MemoryQueue{jobQueue, repositoryQueue} {
+		entry, err := queue.Pick(time.Second)
+
+		if err != nil {
+			t.Fatalf("Error while picking cleanup job: %s", err)
+		}
+
+		if entry == nil {
+			t.Fatalf("No cleanup job was posted")
+		}
+
+		if job, ok := entry.Data.(jobs.CleanupJob); !ok || job.Username != "purged" || job.Repository != "blog" {
+			t.Errorf("Unexpected cleanup job: %+v", entry.Data)
+		}
+
+		// The job posted by the failed purge got coalesced with the new one
+		if entry, err := queue.Pick(10 * time.Millisecond); err != nil || entry != nil {
+			t.Errorf("Unexpected second cleanup job: %+v, %v", entry, err)
+		}
+	}
+
+	// The slug of a purged blog can be used again
+	if err := client.CreateBlog(userstore.Blog{Slug: "blog"}); err != nil {
+		t.Errorf("Error while creating a blog with the slug of a purged blog: %s", err)
+	}
+}
+
+// mailbox records the emails sent by the admin server
+type mailbox struct {
+	sync.Mutex
+	messages []mailer.Message
+}
+
+func (m *mailbox) Send(msg mailer.Message) error {
+	m.Lock()
+	defer m.Unlock()
+
+	m.messages = append(m.messages, msg)
+
+	return nil
+}
+
+var oneTimeTokenRE = regexp.MustCompile(`\n\n([0-9a-f]+)\n\n`)
+
+// lastToken returns the code of the last email sent to the given address
+func (m *mailbox) lastToken(t *testing.T, to, subject string) string {
+	m.Lock()
+	defer m.Unlock()
+
+	if len(m.messages) == 0 {
+		t.Fatalf("No email was sent")
+	}
+
+	msg := m.messages[len(m.messages)-1]
+
+	if msg.To != to || msg.Subject != subject {
+		t.Fatalf("Unexpected email: %+v", msg)
+	}
+
+	match := oneTimeTokenRE.FindStringSubmatch(msg.Body)
+
+	if match == nil {
+		t.Fatalf("No token in email: %s", msg.Body)
+	}
+
+	return match[1]
+}
+
+func (m *mailbox) count() int {
+	m.Lock()
+	defer m.Unlock()
+
+	return len(m.messages)
+}
+
+func TestEmails(t *testing.T) {
+	testutils.FlushDB(t)
+
+	blogOutput := testutils.NewBlogOutput(t)
+	defer blogOutput.Close()
+
+	mails := &mailbox{}
+	server := httptest.NewServer(testutils.NewAdminServerWithMailer(t, blogOutput, mails))
+	defer server.Close()
+
+	client, err := adminserver.NewClient(server.URL)
+
+	if err != nil {
+		t.Fatalf("Error while creating RPC client: %s", err)
+	}
+
+	anonymousClient, err := adminserver.NewClient(server.URL)
+
+	if err != nil {
+		t.Fatalf("Error while creating RPC client: %s", err)
+	}
+
+	if err := client.CreateUser(userstore.User{Username: "mailer", Password: "secret", Email: "Mailer <mailer@example.com>"}); err == nil {
+		t.Errorf("Expected an error when creating a user with an invalid email")
+	}
+
+	if err := client.CreateUser(userstore.User{Username: "mailer", Password: "secret", Email: "mailer@example.com"}); err != nil {
+		t.Fatalf("Error while creating user: %s", err)
+	}
+
+	token := mails.lastToken(t, "mailer@example.com", "Verify your email address")
+
+	if err := client.Login("mailer", "secret"); err != nil {
+		t.Fatalf("Error while logging in: %s", err)
+	}
+
+	if user, err := client.Whoami(); err != nil || user.Email != "mailer@example.com" || user.EmailVerified {
+		t.Errorf("Unexpected user before verification: %+v, %v", user, err)
+	}
+
+	if user, err := anonymousClient.GetUser("mailer"); err != nil || user.Email != "" {
+		t.Errorf("Email addresses should only be shown to their owner: %+v, %v", user, err)
+	}
+
+	// Only verified addresses receive password reset codes
+	if err := anonymousClient.RequestPasswordReset("mailer"); err != nil {
+		t.Errorf("Error while requesting password reset: %s", err)
+	}
+
+	if n := mails.count(); n != 1 {
+		t.Errorf("No password reset email should be sent to an unverified address, got %d emails", n)
+	}
+
+	if err := anonymousClient.VerifyEmail("mailer", "bogus"); err == nil {
+		t.Errorf("Expected an error when verifying an email with a bogus token")
+	}
+
+	if err := anonymousClient.VerifyEmail("mailer", token); err != nil {
+		t.Errorf("Error while verifying email: %s", err)
+	}
+
+	if err := anonymousClient.VerifyEmail("mailer", token); err == nil {
+		t.Errorf("Expected an error when reusing a verification token")
+	}
+
+	if user, err := client.Whoami(); err != nil || !user.EmailVerified {
+		t.Errorf("Unexpected user after verification: %+v, %v", user, err)
+	}
+
+	// Changing the address requires verifying it again
+	if err := client.UpdateUser(userstore.User{Username: "mailer", Password: "secret", Email: "new@example.com"}); err != nil {
+		t.Fatalf("Error while updating user: %s", err)
+	}
+
+	if user, err := client.Whoami(); err != nil || user.Email != "new@example.com" || user.EmailVerified {
+		t.Errorf("Unexpected user after changing email: %+v, %v", user, err)
+	}
+
+	mails.lastToken(t, "new@example.com", "Verify your email address")
+
+	if err := client.RequestEmailVerification(); err != nil {
+		t.Fatalf("Error while requesting email verification: %s", err)
+	}
+
+	if err := anonymousClient.VerifyEmail("mailer", mails.lastToken(t, "new@example.com", "Verify your email address")); err != nil {
+		t.Errorf("Error while verifying new email: %s", err)
+	}
+
+	if err := anonymousClient.RequestPasswordReset("mailer"); err != nil {
+		t.Fatalf("Error while requesting password reset: %s", err)
+	}
+
+	token = mails.lastToken(t, "new@example.com", "Reset your password")
+
+	if err := anonymousClient.ResetPassword("mailer", "bogus", "hacked"); err == nil {
+		t.Errorf("Expected an error when resetting a password with a bogus token")
+	}
+
+	if err := anonymousClient.ResetPassword("mailer", token, "new secret"); err != nil {
+		t.Fatalf("Error while resetting password: %s", err)
+	}
+
+	if err := anonymousClient.ResetPassword("mailer", token, "hacked"); err == nil {
+		t.Errorf("Expected an error when reusing a password reset token")
+	}
+
+	if _, err := client.Whoami(); err == nil {
+		t.Errorf("Resetting the password should log out all sessions")
+	}
+
+	if err := anonymousClient.Login("mailer", "secret"); err == nil {
+		t.Errorf("The old password should not work anymore")
+	}
+
+	if err := anonymousClient.Login("mailer", "new secret"); err != nil {
+		t.Errorf("Error while logging in with the new password: %s", err)
+	}
+}
+
+func TestEmailLockout(t *testing.T) {
+	testutils.FlushDB(t)
+
+	oldPolicy := adminserver.UsernameLockoutPolicy
+	adminserver.UsernameLockoutPolicy.FreeAttempts = 2
+	defer func() { adminserver.UsernameLockoutPolicy = oldPolicy }()
+
+	blogOutput := testutils.NewBlogOutput(t)
+	defer blogOutput.Close()
+
+	mails := &mailbox{}
+	server := httptest.NewServer(testutils.NewAdminServerWithMailer(t, blogOutput, mails))
+	defer server.Close()
+
+	client, err := adminserver.NewClient(server.URL)
+
+	if err != nil {
+		t.Fatalf("Error while creating RPC client: %s", err)
+	}
+
+	if err := client.CreateUser(userstore.User{Username: "target", Password: "secret", Email: "target@example.com"}); err != nil {
+		t.Fatalf("Error while creating user: %s", err)
+	}
+
+	token := mails.lastToken(t, "target@example.com", "Verify your email address")
+
+	for i := 0; i < 3; i++ {
+		if err := client.VerifyEmail("target", "bogus"); err == nil {
+			t.Fatalf("Expected an error when verifying an email with a bogus token")
+		}
+	}
+
+	// Even the right code is refused during the lockout
+	if err := client.VerifyEmail("target", token); err == nil || !strings.Contains(err.Error(), "Too many failed attempts") {
+		t.Errorf("Expected verifying the email to be locked out, got %v", err)
+	}
+
+	if err := client.ResetPassword("target", "bogus", "hacked"); err == nil || !strings.Contains(err.Error(), "Too many failed attempts") {
+		t.Errorf("Expected resetting the password to be locked out, got %v", err)
+	}
+
+	// Asking for password reset codes counts as failing, so that the mailbox
+	// of a user cannot be flooded
+	for i := 0; i < 3; i++ {
+		if err := client.RequestPasswordReset("flooded"); err != nil {
+			t.Fatalf("Error while requesting password reset: %s", err)
+		}
+	}
+
+	if err := client.RequestPasswordReset("flooded"); err == nil || !strings.Contains(err.Error(), "Too many failed attempts") {
+		t.Errorf("Expected requesting a password reset to be locked out, got %v", err)
+	}
+}
+
+func TestTwoFactor(t *testing.T) {
+	testutils.FlushDB(t)
+
+	blogOutput := testutils.NewBlogOutput(t)
+	defer blogOutput.Close()
+
+	server := httptest.NewServer(testutils.NewAdminServer(t, blogOutput))
+	defer server.Close()
+
+	newClient := func() *adminserver.Client {
+		client, err := adminserver.NewClient(server.URL)
+
+		if err != nil {
+			t.Fatalf("Error while creating RPC client: %s", err)
+		}
+
+		return client
+	}
+
+	client := newClient()
+
+	if err := client.CreateUser(userstore.User{Username: "careful", Password: "secret"}); err != nil {
+		t.Fatalf("Error while creating user: %s", err)
+	}
+
+	if err := client.Login("careful", "secret"); err != nil {
+		t.Fatalf("Error while logging in: %s", err)
+	}
+
+	if _, err := client.ConfirmTOTP("123456"); err == nil {
+		t.Errorf("Expected an error when confirming TOTP before enrolling")
+	}
+
+	enrolment, err := client.EnrolTOTP("")
+
+	if err != nil {
+		t.Fatalf("Error while enrolling TOTP: %s", err)
+	}
+
+	if !strings.HasPrefix(enrolment.URI, "otpauth://totp/moblog:careful?") {
+		t.Errorf("Unexpected TOTP URI: %s", enrolment.URI)
+	}
+
+	code := func(offset int64) string {
+		code, err := totp.Code(enrolment.Secret, totp.Step(time.Now())+offset)
+
+		if err != nil {
+			t.Fatalf("Error while computing TOTP code: %s", err)
+		}
+
+		return code
+	}
+
+	if _, err := client.ConfirmTOTP("bogus"); err == nil {
+		t.Errorf("Expected an error when confirming TOTP with a bogus code")
+	}
+
+	recoveryCodes, err := client.ConfirmTOTP(code(0))
+
+	if err != nil {
+		t.Fatalf("Error while confirming TOTP: %s", err)
+	}
+
+	if len(recoveryCodes) != userstore.RecoveryCodeCount {
+		t.Errorf("Expected %d recovery codes, got %d", userstore.RecoveryCodeCount, len(recoveryCodes))
+	}
+
+	if user, err := client.Whoami(); err != nil || !user.TwoFactorEnabled {
+		t.Errorf("Two-factor authentication should be enabled: %+v, %v", user, err)
+	}
+
+	// The password alone only gives a session that cannot be used yet
+	pendingClient := newClient()
+
+	if err := pendingClient.Login("careful", "secret"); err != adminserver.ErrSecondFactorRequired {
+		t.Fatalf("Expected login to require a second factor, got %v", err)
+	}
+
+	if _, err := pendingClient.Whoami(); err == nil {
+		t.Errorf("Sessions waiting for the second factor should not be usable")
+	}
+
+	if err := pendingClient.RefreshSession(); err == nil {
+		t.Errorf("Sessions waiting for the second factor should not be refreshable")
+	}
+
+	if err := pendingClient.LoginSecondFactor("bogus"); err == nil {
+		t.Errorf("Expected an error when logging in with a bogus code")
+	}
+
+	// Codes cannot be replayed
+	if err := pendingClient.LoginSecondFactor(code(0)); err == nil {
+		t.Errorf("Expected an error when reusing the code used for confirming TOTP")
+	}
+
+	if err := pendingClient.LoginSecondFactor(code(1)); err != nil {
+		t.Fatalf("Error while sending second factor: %s", err)
+	}
+
+	if user, err := pendingClient.Whoami(); err != nil || user.Username != "careful" {
+		t.Errorf("Unexpected user after completing login: %+v, %v", user, err)
+	}
+
+	recoveryClient := newClient()
+
+	if err := recoveryClient.Login("careful", "secret"); err != adminserver.ErrSecondFactorRequired {
+		t.Fatalf("Expected login to require a second factor, got %v", err)
+	}
+
+	if err := recoveryClient.LoginSecondFactor(recoveryCodes[0]); err != nil {
+		t.Fatalf("Error while logging in with a recovery code: %s", err)
+	}
+
+	if err := client.DisableTOTP(recoveryCodes[0]); err == nil {
+		t.Errorf("Recovery codes should only be usable once")
+	}
+
+	// Replacing the secret requires the second factor once it is enabled
+	if _, err := client.EnrolTOTP(""); err == nil {
+		t.Errorf("Expected an error when re-enrolling TOTP without a code")
+	}
+
+	if _, err := client.EnrolTOTP("bogus"); err == nil {
+		t.Errorf("Expected an error when re-enrolling TOTP with a bogus code")
+	}
+
+	if _, err := client.EnrolTOTP(recoveryCodes[2]); err != nil {
+		t.Fatalf("Error while re-enrolling TOTP: %s", err)
+	}
+
+	if err := client.DisableTOTP(recoveryCodes[1]); err != nil {
+		t.Fatalf("Error while disabling TOTP: %s", err)
+	}
+
+	if err := newClient().Login("careful", "secret"); err != nil {
+		t.Errorf("Error while logging in after disabling TOTP: %s", err)
+	}
+}
+
+func TestTwoFactorLockout(t *testing.T) {
+	testutils.FlushDB(t)
+
+	oldPolicy := adminserver.UsernameLockoutPolicy
+	adminserver.UsernameLockoutPolicy.FreeAttempts = 2
+	defer func() { adminserver.UsernameLockoutPolicy = oldPolicy }()
+
+	blogOutput := testutils.NewBlogOutput(t)
+	defer blogOutput.Close()
+
+	server := httptest.NewServer(testutils.NewAdminServer(t, blogOutput))
+	defer server.Close()
+
+	client, err := adminserver.NewClient(server.URL)
+
+	if err != nil {
+		t.Fatalf("Error while creating RPC client: %s", err)
+	}
+
+	if err := client.CreateUser(userstore.User{Username: "guessed", Password: "secret"}); err != nil {
+		t.Fatalf("Error while creating user: %s", err)
+	}
+
+	if err := client.Login("guessed", "secret"); err != nil {
+		t.Fatalf("Error while logging in: %s", err)
+	}
+
+	enrolment, err := client.EnrolTOTP("")
+
+	if err != nil {
+		t.Fatalf("Error while enrolling TOTP: %s", err)
+	}
+
+	code := func(offset int64) string {
+		code, err := totp.Code(enrolment.Secret, totp.Step(time.Now())+offset)
+
+		if err != nil {
+			t.Fatalf("Error while computing TOTP code: %s", err)
+		}
+
+		return code
+	}
+
+	// Successful confirmations reset the count of failures
+	for i := 0; i < 2; i++ {
+		if _, err := client.ConfirmTOTP("bogus"); err == nil {
+			t.Fatalf("Confirming TOTP with a bogus code should fail")
+		}
+	}
+
+	recoveryCodes, err := client.ConfirmTOTP(code(0))
+
+	if err != nil {
+		t.Fatalf("Error while confirming TOTP: %s", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := client.DisableTOTP("bogus"); err == nil {
+			t.Fatalf("Disabling TOTP with a bogus code should fail")
+		}
+	}
+
+	if err := client.DisableTOTP(recoveryCodes[0]); err == nil || !strings.Contains(err.Error(), "Too many failed attempts") {
+		t.Errorf("Expected disabling TOTP to be locked out, got %v", err)
+	}
+
+	if _, err := client.EnrolTOTP(recoveryCodes[0]); err == nil || !strings.Contains(err.Error(), "Too many failed attempts") {
+		t.Errorf("Expected re-enrolling TOTP to be locked out, got %v", err)
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	testutils.FlushDB(t)
+
+	oldPolicy := adminserver.UsernameLockoutPolicy
+	adminserver.UsernameLockoutPolicy.FreeAttempts = 2
+	defer func() { adminserver.UsernameLockoutPolicy = oldPolicy }()
+
+	blogOutput := testutils.NewBlogOutput(t)
+	defer blogOutput.Close()
+
+	auditLog := testutils.NewMemoryAuditLog(t)
+
+	server := httptest.NewServer(testutils.NewAdminServerWithAuditLog(t, blogOutput, auditLog))
+	defer server.Close()
+
+	client, err := adminserver.NewClient(server.URL)
+
+	if err != nil {
+		t.Fatalf("Error while creating RPC client: %s", err)
+	}
+
+	for _, username := range []string{"target", "bystander"} {
+		if err := client.CreateUser(userstore.User{Username: username, Password: "secret"}); err != nil {
+			t.Fatalf("Error while creating user %s: %s", username, err)
+		}
+	}
+
+	// Successful logins reset the count of failures
+	for i := 0; i < 2; i++ {
+		if err := client.Login("target", "guess"); err == nil {
+			t.Fatalf("Login with a wrong password should fail")
+		}
+	}
+
+	if err := client.Login("target", "secret"); err != nil {
+		t.Fatalf("Error while logging in: %s", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := client.Login("target", "guess"); err == nil {
+			t.Fatalf("Login with a wrong password should fail")
+		}
+	}
+
+	if err := client.Login("target", "secret"); err == nil || !strings.Contains(err.Error(), "Too many failed logins") {
+		t.Errorf("Expected the user to be locked out, got %v", err)
+	}
+
+	events, err := auditLog.Events(10)
+
+	if err != nil {
+		t.Fatalf("Error while listing audit events: %s", err)
+	}
+
+	if len(events) != 1 || events[0].Type != audit.UserLockout || events[0].Username != "target" || events[0].Address == "" || events[0].Duration != adminserver.UsernameLockoutPolicy.BaseLockout {
+		t.Errorf("Unexpected audit events after the lockout: %+v", events)
+	}
+
+	if err := client.RestoreUser("target", "secret"); err == nil || !strings.Contains(err.Error(), "Too many failed attempts") {
+		t.Errorf("Expected restoring the user to be locked out too, got %v", err)
+	}
+
+	if err := client.Login("bystander", "secret"); err != nil {
+		t.Errorf("Other users should not be locked out: %s", err)
+	}
+}
+
+func TestSessions(t *testing.T) {
+	testutils.FlushDB(t)
+
+	blogOutput := testutils.NewBlogOutput(t)
+	defer blogOutput.Close()
+
+	server := httptest.NewServer(testutils.NewAdminServer(t, blogOutput))
+	defer server.Close()
+
+	login := func(password string) *adminserver.Client {
+		client, err := adminserver.NewClient(server.URL)
+
+		if err != nil {
+			t.Fatalf("Error while creating RPC client: %s", err)
+		}
+
+		if err := client.Login("traveler", password); err != nil {
+			t.Fatalf("Error while logging in: %s", err)
+		}
+
+		return client
+	}
+
+	checkLoggedIn := func(client *adminserver.Client, expected bool) {
+		t.Helper()
+
+		if _, err := client.Whoami(); (err == nil) != expected {
+			t.Errorf("Unexpected session state: expected logged in %v, got error %v", expected, err)
+		}
+	}
+
+	anonymousClient, err := adminserver.NewClient(server.URL)
+
+	if err != nil {
+		t.Fatalf("Error while creating RPC client: %s", err)
+	}
+
+	if err := anonymousClient.CreateUser(userstore.User{Username: "traveler", Password: "secret"}); err != nil {
+		t.Fatalf("Error while creating user: %s", err)
+	}
+
+	if _, err := anonymousClient.ListSessions(); err == nil {
+		t.Errorf("Listing sessions should require authentication")
+	}
+
+	laptop := login("secret")
+	phone := login("secret")
+	tablet := login("secret")
+
+	sessions, err := laptop.ListSessions()
+
+	if err != nil {
+		t.Fatalf("Error while listing sessions: %s", err)
+	}
+
+	if len(sessions) != 3 {
+		t.Fatalf("Expected 3 sessions, got %+v", sessions)
+	}
+
+	if !sessions[0].Current || sessions[1].Current || sessions[2].Current {
+		t.Errorf("Only the first session should be the current one: %+v", sessions)
+	}
+
+	for _, session := range sessions {
+		if session.ID == "" || session.Created.IsZero() || session.LastSeen.IsZero() {
+			t.Errorf("Incomplete session info: %+v", session)
+		}
+
+		if session.Address != "127.0.0.1" {
+			t.Errorf("Unexpected session address: %s", session.Address)
+		}
+
+		if !strings.HasPrefix(session.UserAgent, "Go-http-client/") {
+			t.Errorf("Unexpected session user agent: %s", session.UserAgent)
+		}
+	}
+
+	if err := laptop.RevokeSession("bogus"); err == nil {
+		t.Errorf("Expected an error when revoking an unknown session")
+	}
+
+	if err := laptop.RevokeSession(sessions[1].ID); err != nil {
+		t.Fatalf("Error while revoking session: %s", err)
+	}
+
+	checkLoggedIn(laptop, true)
+	checkLoggedIn(phone, false)
+	checkLoggedIn(tablet, true)
+
+	phone = login("secret")
+
+	if err := tablet.RevokeOtherSessions(); err != nil {
+		t.Fatalf("Error while revoking other sessions: %s", err)
+	}
+
+	checkLoggedIn(laptop, false)
+	checkLoggedIn(phone, false)
+	checkLoggedIn(tablet, true)
+
+	// Changing the password logs out everywhere else, but access tokens
+	// remain valid until they get revoked
+	laptop = login("secret")
+
+	created, err := tablet.CreateToken("phone", []string{userstore.TokenScopeRepoRead})
+
+	if err != nil {
+		t.Fatalf("Error while creating token: %s", err)
+	}
+
+	tokenClient, err := adminserver.NewClient(server.URL)
+
+	if err != nil {
+		t.Fatalf("Error while creating RPC client: %s", err)
+	}
+
+	tokenClient.SetBasicAuth("traveler", created.Secret)
+
+	if err := tablet.UpdateUser(userstore.User{Username: "traveler", Password: "new secret"}); err != nil {
+		t.Fatalf("Error while changing password: %s", err)
+	}
+
+	checkLoggedIn(laptop, false)
+	checkLoggedIn(tablet, true)
+	checkLoggedIn(tokenClient, true)
+
+	// Changing the display name does not
+	laptop = login("new secret")
+
+	if err := tablet.UpdateUser(userstore.User{Username: "traveler", DisplayName: "Traveler"}); err != nil {
+		t.Fatalf("Error while updating user: %s", err)
+	}
+
+	checkLoggedIn(laptop, true)
+
+	if sessions, err := tablet.ListSessions(); err != nil || len(sessions) != 2 {
+		t.Errorf("Expected 2 sessions, got %+v, %v", sessions, err)
+	}
+}
@@ -0,0 +1,276 @@
+package adminserver
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/pkg/errors"
+
+	"github.com/abustany/moblog-cloud/pkg/blogoutput"
+	"github.com/abustany/moblog-cloud/pkg/sessionstore"
+	"github.com/abustany/moblog-cloud/pkg/userstore"
+)
+
+// Scope given to the sessions created from grants, allowing the services
+// holding a grant to report the progress of the builds of its blog. It cannot
+// be given to access tokens.
+const scopeReportBuilds = "builds:report"
+
+var errUnknownBuild = errors.New("No build with this ID")
+var errReportBuildsForbidden = errors.New("Only services can report build progress")
+var errNoBuildLog = errors.New("This build has no log")
+
+type buildsService struct {
+	store      userstore.UserStore
+	blogOutput *blogoutput.Output
+}
+
+// reporterSession returns the session associated to the request, making sure
+// that it can report build progress for the given blog.
+func reporterSession(r *http.Request, blogSlug string) (*sessionstore.Session, error) {
+	session := SessionFromContext(r.Context())
+
+	if session == nil {
+		return nil, errRequireAuthentication
+	}
+
+	if !session.Restricted() || !session.HasScope(scopeReportBuilds) || session.Blog != blogSlug {
+		return nil, errReportBuildsForbidden
+	}
+
+	return session, nil
+}
+
+// getSessionBuild returns a build of the session's user, making sure that the
+// session can access the build's blog.
+func (s *buildsService) getSessionBuild(session *sessionstore.Session, buildID string) (*userstore.Build, error) {
+	build, err := s.store.GetBuild(session.Username, buildID)
+
+	if err != nil {
+		log.Printf("Error retrieving build %s for user %s: %s", buildID, session.Username, err)
+		return nil, err
+	}
+
+	if build == nil || (session.Blog != "" && session.Blog != build.Blog) {
+		return nil, errUnknownBuild
+	}
+
+	return build, nil
+}
+
+type CreateBuildArgs struct {
+	Slug string
+}
+
+func (s *buildsService) Create(r *http.Request, args *CreateBuildArgs, reply *userstore.Build) error {
+	session, err := reporterSession(r, args.Slug)
+
+	if err != nil {
+		return err
+	}
+
+	build, err := s.store.CreateBuild(session.Username, args.Slug)
+
+	if err != nil {
+		log.Printf("Error while creating build for blog %s of user %s: %s", args.Slug, session.Username, err)
+		return err
+	}
+
+	log.Printf("Created build %s for blog %s of user %s", build.ID, args.Slug, session.Username)
+
+	*reply = *build
+
+	return nil
+}
+
+type StartBuildArgs struct {
+	ID string
+}
+
+type StartBuildReply struct{}
+
+func (s *buildsService) Start(r *http.Request, args *StartBuildArgs, reply *StartBuildReply) error {
+	session := SessionFromContext(r.Context())
+
+	if session == nil {
+		return errRequireAuthentication
+	}
+
+	build, err := s.getSessionBuild(session, args.ID)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := reporterSession(r, build.Blog); err != nil {
+		return err
+	}
+
+	if err := s.store.StartBuild(session.Username, args.ID); err != nil {
+		log.Printf("Error while starting build %s for user %s: %s", args.ID, session.Username, err)
+		return err
+	}
+
+	return nil
+}
+
+type FinishBuildArgs struct {
+	ID     string
+	Commit string
+	Error  string // empty if the build succeeded
+}
+
+type FinishBuildReply struct{}
+
+func (s *buildsService) Finish(r *http.Request, args *FinishBuildArgs, reply *FinishBuildReply) error {
+	session := SessionFromContext(r.Context())
+
+	if session == nil {
+		return errRequireAuthentication
+	}
+
+	build, err := s.getSessionBuild(session, args.ID)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := reporterSession(r, build.Blog); err != nil {
+		return err
+	}
+
+	if err := s.store.FinishBuild(session.Username, args.ID, args.Commit, args.Error); err != nil {
+		log.Printf("Error while finishing build %s for user %s: %s", args.ID, session.Username, err)
+		return err
+	}
+
+	return nil
+}
+
+type SupersedeBuildArgs struct {
+	ID string
+}
+
+type SupersedeBuildReply struct{}
+
+// Supersede marks a build that has not finished as replaced by a more recent
+// build of the same blog.
+func (s *buildsService) Supersede(r *http.Request, args *SupersedeBuildArgs, reply *SupersedeBuildReply) error {
+	session := SessionFromContext(r.Context())
+
+	if session == nil {
+		return errRequireAuthentication
+	}
+
+	build, err := s.getSessionBuild(session, args.ID)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := reporterSession(r, build.Blog); err != nil {
+		return err
+	}
+
+	if err := s.store.SupersedeBuild(session.Username, args.ID); err != nil {
+		log.Printf("Error while superseding build %s for user %s: %s", args.ID, session.Username, err)
+		return err
+	}
+
+	return nil
+}
+
+type GetBuildArgs struct {
+	ID string
+}
+
+func (s *buildsService) Get(r *http.Request, args *GetBuildArgs, reply *userstore.Build) error {
+	session := SessionFromContext(r.Context())
+
+	if session == nil {
+		return errRequireAuthentication
+	}
+
+	build, err := s.getSessionBuild(session, args.ID)
+
+	if err != nil {
+		return err
+	}
+
+	*reply = *build
+
+	return nil
+}
+
+type ListBuildsArgs struct {
+	Slug  string
+	Limit int
+}
+
+type ListBuildsReply []userstore.Build
+
+func (s *buildsService) List(r *http.Request, args *ListBuildsArgs, reply *ListBuildsReply) error {
+	session := SessionFromContext(r.Context())
+
+	if session == nil {
+		return errRequireAuthentication
+	}
+
+	if session.Blog != "" && session.Blog != args.Slug {
+		return errUnknownBlog
+	}
+
+	if err := checkBlogExists(s.store, session.Username, args.Slug); err != nil {
+		return err
+	}
+
+	builds, err := s.store.ListBuilds(session.Username, args.Slug, args.Limit)
+
+	if err != nil {
+		log.Printf("Error retrieving builds of blog %s for user %s: %s", args.Slug, session.Username, err)
+		return err
+	}
+
+	*reply = builds
+
+	return nil
+}
+
+type GetBuildLogArgs struct {
+	ID string
+}
+
+type GetBuildLogReply struct {
+	Log string
+}
+
+// GetLog returns the output of the commands run by a build. Logs are only
+// available once the build has finished.
+func (s *buildsService) GetLog(r *http.Request, args *GetBuildLogArgs, reply *GetBuildLogReply) error {
+	session := SessionFromContext(r.Context())
+
+	if session == nil {
+		return errRequireAuthentication
+	}
+
+	build, err := s.getSessionBuild(session, args.ID)
+
+	if err != nil {
+		return err
+	}
+
+	buildLog, err := s.blogOutput.BuildLog(r.Context(), session.Username, build.ID)
+
+	if err != nil {
+		log.Printf("Error retrieving log of build %s for user %s: %s", build.ID, session.Username, err)
+		return err
+	}
+
+	if buildLog == nil {
+		return errNoBuildLog
+	}
+
+	reply.Log = string(buildLog)
+
+	return nil
+}
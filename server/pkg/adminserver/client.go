@@ -1,6 +1,7 @@
 package adminserver
 
 import (
+	"encoding/base64"
 	"net"
 	"net/http"
 	"net/http/cookiejar"
@@ -13,6 +14,8 @@ import (
 
 	"github.com/pkg/errors"
 
+	"github.com/abustany/moblog-cloud/pkg/blogoutput"
+	"github.com/abustany/moblog-cloud/pkg/grants"
 	"github.com/abustany/moblog-cloud/pkg/rpcclient"
 	"github.com/abustany/moblog-cloud/pkg/userstore"
 )
@@ -127,12 +130,24 @@ func (c *Client) SetAuthCookie(cookie *http.Cookie) error {
 	return nil
 }
 
-func (c *Client) login(username, password string) error {
-	values := url.Values{
-		"username": []string{username},
-		"password": []string{password},
-	}
+// SetBasicAuth makes the client authenticate its calls with an access token
+// instead of a session cookie.
+func (c *Client) SetBasicAuth(username, secret string) {
+	credentials := base64.StdEncoding.EncodeToString([]byte(username + ":" + secret))
+	c.client.Header.Set("Authorization", "Basic "+credentials)
+}
+
+// SetGrant makes the client authenticate its calls with a grant
+func (c *Client) SetGrant(encodedGrant string) {
+	c.client.Header.Set("Authorization", grants.AuthorizationHeader(encodedGrant))
+}
+
+// ErrSecondFactorRequired is returned by Login for users who enabled
+// two-factor authentication. The login must be completed by calling
+// LoginSecondFactor.
+var ErrSecondFactorRequired = errors.New("Two-factor authentication code required")
 
+func (c *Client) login(values url.Values) error {
 	res, err := c.client.Client.Post(c.url+"/login", "application/x-www-form-urlencoded", strings.NewReader(values.Encode()))
 
 	if err != nil {
@@ -141,9 +156,13 @@ func (c *Client) login(username, password string) error {
 
 	defer res.Body.Close()
 
-	if res.StatusCode != http.StatusOK {
+	if res.StatusCode == http.StatusTooManyRequests {
+		return errors.Errorf("Too many failed logins, retry in %s seconds", res.Header.Get("Retry-After"))
+	}
+
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusAccepted {
 		c.resetCachedAuthCookie()
-		return errors.Errorf("Invalid username or password (status code %d)", res.StatusCode)
+		return errors.Errorf("Invalid credentials (status code %d)", res.StatusCode)
 	}
 
 	for _, cookie := range res.Cookies() {
@@ -154,15 +173,27 @@ func (c *Client) login(username, password string) error {
 		}
 	}
 
+	if res.StatusCode == http.StatusAccepted {
+		return ErrSecondFactorRequired
+	}
+
 	return nil
 }
 
 func (c *Client) Login(username, password string) error {
-	return c.login(username, password)
+	return c.login(url.Values{
+		"username": []string{username},
+		"password": []string{password},
+	})
+}
+
+// LoginSecondFactor completes a login with a TOTP or recovery code
+func (c *Client) LoginSecondFactor(code string) error {
+	return c.login(url.Values{"code": []string{code}})
 }
 
 func (c *Client) RefreshSession() error {
-	return c.login("", "")
+	return c.login(url.Values{})
 }
 
 func (c *Client) Logout() error {
@@ -205,6 +236,57 @@ func (c *Client) DeleteUser(username string) error {
 	return c.client.Call("Users.Delete", &DeleteUserArgs{username}, &DeleteUserReply{})
 }
 
+func (c *Client) RestoreUser(username, password string) error {
+	return c.client.Call("Users.Restore", &RestoreUserArgs{Username: username, Password: password}, &RestoreUserReply{})
+}
+
+func (c *Client) RequestEmailVerification() error {
+	return c.client.Call("Users.RequestEmailVerification", &RequestEmailVerificationArgs{}, &RequestEmailVerificationReply{})
+}
+
+func (c *Client) VerifyEmail(username, token string) error {
+	return c.client.Call("Users.VerifyEmail", &VerifyEmailArgs{Username: username, Token: token}, &VerifyEmailReply{})
+}
+
+func (c *Client) RequestPasswordReset(username string) error {
+	return c.client.Call("Users.RequestPasswordReset", &RequestPasswordResetArgs{username}, &RequestPasswordResetReply{})
+}
+
+func (c *Client) ResetPassword(username, token, password string) error {
+	return c.client.Call("Users.ResetPassword", &ResetPasswordArgs{Username: username, Token: token, Password: password}, &ResetPasswordReply{})
+}
+
+// EnrolTOTP generates a new TOTP secret. The code of the current secret is
+// only needed if two-factor authentication is already enabled.
+func (c *Client) EnrolTOTP(code string) (reply EnrolTOTPReply, err error) {
+	err = c.client.Call("Users.EnrolTOTP", &EnrolTOTPArgs{code}, &reply)
+	return
+}
+
+func (c *Client) ConfirmTOTP(code string) (recoveryCodes []string, err error) {
+	var reply ConfirmTOTPReply
+	err = c.client.Call("Users.ConfirmTOTP", &ConfirmTOTPArgs{code}, &reply)
+	return reply.RecoveryCodes, err
+}
+
+func (c *Client) DisableTOTP(code string) error {
+	return c.client.Call("Users.DisableTOTP", &DisableTOTPArgs{code}, &DisableTOTPReply{})
+}
+
+func (c *Client) ListSessions() ([]SessionInfo, error) {
+	var reply ListSessionsReply
+	err := c.client.Call("Sessions.List", &ListSessionsArgs{}, &reply)
+	return reply.Sessions, err
+}
+
+func (c *Client) RevokeSession(id string) error {
+	return c.client.Call("Sessions.Revoke", &RevokeSessionArgs{id}, &RevokeSessionReply{})
+}
+
+func (c *Client) RevokeOtherSessions() error {
+	return c.client.Call("Sessions.RevokeAllOthers", &RevokeOtherSessionsArgs{}, &RevokeOtherSessionsReply{})
+}
+
 func (c *Client) CreateBlog(blog userstore.Blog) error {
 	return c.client.Call("Blogs.Create", &blog, &CreateBlogReply{})
 }
@@ -231,3 +313,73 @@ func (c *Client) ListBlogs() (blogs []userstore.Blog, err error) {
 func (c *Client) DeleteBlog(slug string) error {
 	return c.client.Call("Blogs.Delete", &DeleteBlogArgs{slug}, &DeleteBlogReply{})
 }
+
+func (c *Client) ListDeletedBlogs() (blogs []userstore.Blog, err error) {
+	err = c.client.Call("Blogs.ListDeleted", &ListDeletedBlogsArgs{}, &blogs)
+	return
+}
+
+func (c *Client) RestoreBlog(slug string) error {
+	return c.client.Call("Blogs.Restore", &RestoreBlogArgs{slug}, &RestoreBlogReply{})
+}
+
+func (c *Client) ListBlogVersions(slug string) (versions []blogoutput.Version, err error) {
+	err = c.client.Call("Blogs.ListVersions", &ListBlogVersionsArgs{slug}, &versions)
+	return
+}
+
+func (c *Client) RollbackBlog(slug, version string) error {
+	return c.client.Call("Blogs.Rollback", &RollbackBlogArgs{Slug: slug, Version: version}, &RollbackBlogReply{})
+}
+
+func (c *Client) CreateBuild(slug string) (build userstore.Build, err error) {
+	err = c.client.Call("Builds.Create", &CreateBuildArgs{slug}, &build)
+	return
+}
+
+func (c *Client) StartBuild(id string) error {
+	return c.client.Call("Builds.Start", &StartBuildArgs{id}, &StartBuildReply{})
+}
+
+func (c *Client) FinishBuild(id, commit, buildErr string) error {
+	return c.client.Call("Builds.Finish", &FinishBuildArgs{ID: id, Commit: commit, Error: buildErr}, &FinishBuildReply{})
+}
+
+func (c *Client) SupersedeBuild(id string) error {
+	return c.client.Call("Builds.Supersede", &SupersedeBuildArgs{id}, &SupersedeBuildReply{})
+}
+
+func (c *Client) GetBuild(id string) (build userstore.Build, err error) {
+	err = c.client.Call("Builds.Get", &GetBuildArgs{id}, &build)
+	return
+}
+
+func (c *Client) ListBuilds(slug string, limit int) (builds []userstore.Build, err error) {
+	err = c.client.Call("Builds.List", &ListBuildsArgs{Slug: slug, Limit: limit}, &builds)
+	return
+}
+
+func (c *Client) GetBuildLog(id string) (string, error) {
+	var reply GetBuildLogReply
+	err := c.client.Call("Builds.GetLog", &GetBuildLogArgs{id}, &reply)
+	return reply.Log, err
+}
+
+func (c *Client) CreateToken(name string, scopes []string) (reply CreateTokenReply, err error) {
+	err = c.client.Call("Tokens.Create", &CreateTokenArgs{Name: name, Scopes: scopes}, &reply)
+	return
+}
+
+func (c *Client) ListTokens() (tokens []userstore.Token, err error) {
+	err = c.client.Call("Tokens.List", &ListTokensArgs{}, &tokens)
+	return
+}
+
+func (c *Client) RevokeToken(id string) error {
+	return c.client.Call("Tokens.Revoke", &RevokeTokenArgs{id}, &RevokeTokenReply{})
+}
+
+func (c *Client) SessionScopes() (reply SessionScopesReply, err error) {
+	err = c.client.Call("Tokens.SessionScopes", &SessionScopesArgs{}, &reply)
+	return
+}
@@ -0,0 +1,186 @@
+package adminserver
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/abustany/moblog-cloud/pkg/mailer"
+	"github.com/abustany/moblog-cloud/pkg/userstore"
+)
+
+var oneTimeTokenSubjects = map[userstore.OneTimeTokenPurpose]string{
+	userstore.OneTimeTokenVerifyEmail:   "Verify your email address",
+	userstore.OneTimeTokenResetPassword: "Reset your password",
+}
+
+var oneTimeTokenActions = map[userstore.OneTimeTokenPurpose]string{
+	userstore.OneTimeTokenVerifyEmail:   "verify your email address",
+	userstore.OneTimeTokenResetPassword: "choose a new password",
+}
+
+// sendOneTimeToken creates a one time token for a user, and mails it to them
+func (s *usersService) sendOneTimeToken(username string, purpose userstore.OneTimeTokenPurpose) error {
+	secret, email, err := s.store.CreateOneTimeToken(username, purpose)
+
+	if err != nil {
+		return err
+	}
+
+	body := fmt.Sprintf("Hello %s,\n\nUse the following code to %s:\n\n%s\n\nThe code can be used once, until %s. If you didn't ask for it, you can ignore this email.\n",
+		username, oneTimeTokenActions[purpose], secret, time.Now().Add(userstore.OneTimeTokenValidity[purpose]).Format(time.RFC1123))
+
+	if err := s.mailer.Send(mailer.Message{To: email, Subject: oneTimeTokenSubjects[purpose], Body: body}); err != nil {
+		return errors.Wrap(err, "Error while sending email")
+	}
+
+	log.Printf("Sent %s token to user %s", purpose, username)
+
+	return nil
+}
+
+// sendEmailVerification sends a verification code to a new address. Users
+// can ask for a new code if this fails, so errors are only logged.
+func (s *usersService) sendEmailVerification(username string) {
+	if err := s.sendOneTimeToken(username, userstore.OneTimeTokenVerifyEmail); err != nil {
+		log.Printf("Error while sending email verification to user %s: %s", username, err)
+	}
+}
+
+// checkLockout refuses the requests of a client locked out after too many
+// failed logins, for the user or from its address
+func (s *usersService) checkLockout(username, address string) error {
+	if wait := s.loginLimiter.check(username, address); wait > 0 {
+		return errors.Errorf("Too many failed attempts, retry in %s", wait.Round(time.Second))
+	}
+
+	return nil
+}
+
+// failOneTimeToken records a failed login if a one time token was refused
+// because it is wrong, or because the user doesn't exist
+func (s *usersService) failOneTimeToken(username, address string, err error) {
+	if err == userstore.ErrOneTimeTokenInvalid || err == userstore.ErrDoesNotExist {
+		s.loginLimiter.fail(username, address)
+	}
+}
+
+type RequestEmailVerificationArgs struct{}
+
+type RequestEmailVerificationReply struct{}
+
+// RequestEmailVerification sends a new verification code to the address of
+// the logged in user
+func (s *usersService) RequestEmailVerification(r *http.Request, args *RequestEmailVerificationArgs, reply *RequestEmailVerificationReply) error {
+	session, err := accountSession(r)
+
+	if err != nil {
+		return err
+	}
+
+	if err := s.sendOneTimeToken(session.Username, userstore.OneTimeTokenVerifyEmail); err != nil {
+		log.Printf("Error while sending email verification to user %s: %s", session.Username, err)
+		return err
+	}
+
+	return nil
+}
+
+type VerifyEmailArgs struct {
+	Username string
+	Token    string
+}
+
+type VerifyEmailReply struct{}
+
+// VerifyEmail doesn't require a session, so that the code can be used from
+// any device. Wrong codes count as failed logins.
+func (s *usersService) VerifyEmail(r *http.Request, args *VerifyEmailArgs, reply *VerifyEmailReply) error {
+	address := clientAddress(r)
+
+	if err := s.checkLockout(args.Username, address); err != nil {
+		return err
+	}
+
+	if err := s.store.VerifyEmail(args.Username, args.Token); err != nil {
+		s.failOneTimeToken(args.Username, address, err)
+		log.Printf("Error while verifying email of user %s: %s", args.Username, err)
+		return err
+	}
+
+	log.Printf("Verified email of user %s", args.Username)
+
+	return nil
+}
+
+type RequestPasswordResetArgs struct {
+	Username string
+}
+
+type RequestPasswordResetReply struct{}
+
+// RequestPasswordReset mails a password reset code to the verified address of
+// a user. To avoid telling who has a verified address, it doesn't fail when
+// nothing is sent. Every request counts as a failed login, so that users
+// cannot be flooded with emails.
+func (s *usersService) RequestPasswordReset(r *http.Request, args *RequestPasswordResetArgs, reply *RequestPasswordResetReply) error {
+	address := clientAddress(r)
+
+	if err := s.checkLockout(args.Username, address); err != nil {
+		return err
+	}
+
+	s.loginLimiter.fail(args.Username, address)
+
+	err := s.sendOneTimeToken(args.Username, userstore.OneTimeTokenResetPassword)
+
+	switch err {
+	case nil:
+		return nil
+	case userstore.ErrDoesNotExist, userstore.ErrEmailEmpty, userstore.ErrEmailNotVerified:
+		log.Printf("Not sending password reset to user %s: %s", args.Username, err)
+		return nil
+	default:
+		log.Printf("Error while sending password reset to user %s: %s", args.Username, err)
+		return err
+	}
+}
+
+type ResetPasswordArgs struct {
+	Username string
+	Token    string
+	Password string
+}
+
+type ResetPasswordReply struct{}
+
+// ResetPassword sets a new password using a token sent by email, and deletes
+// all the sessions of the user. Like with Update, access tokens and grants
+// remain valid. Wrong codes count as failed logins.
+func (s *usersService) ResetPassword(r *http.Request, args *ResetPasswordArgs, reply *ResetPasswordReply) error {
+	address := clientAddress(r)
+
+	if err := s.checkLockout(args.Username, address); err != nil {
+		return err
+	}
+
+	if err := s.store.ResetPassword(args.Username, args.Token, args.Password); err != nil {
+		s.failOneTimeToken(args.Username, address, err)
+		log.Printf("Error while resetting password of user %s: %s", args.Username, err)
+		return err
+	}
+
+	s.loginLimiter.succeed(args.Username)
+
+	log.Printf("Reset password of user %s", args.Username)
+
+	if err := s.sessionStore.DeleteUserSessions(args.Username, ""); err != nil {
+		log.Printf("Error while deleting the sessions of user %s after a password reset: %s", args.Username, err)
+		return err
+	}
+
+	return nil
+}
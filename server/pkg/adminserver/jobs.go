@@ -0,0 +1,114 @@
+package adminserver
+
+import (
+	"log"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/abustany/moblog-cloud/pkg/audit"
+	"github.com/abustany/moblog-cloud/pkg/jobs"
+	"github.com/abustany/moblog-cloud/pkg/userstore"
+	"github.com/abustany/moblog-cloud/pkg/workqueue"
+)
+
+// How long deleted users and blogs can be restored, before they get purged
+// along with their repositories and rendered files
+var DeletedRetention = 30 * 24 * time.Hour
+
+// How often the adminserver looks for deleted users and blogs to purge
+var PurgeInterval = time.Hour
+
+const cleanupJobTTR = 10 * time.Minute
+
+// jobQueues are the queues of the workers and of the gitservers. The cleanups
+// scheduled there are recorded in the audit log.
+type jobQueues struct {
+	jobs         workqueue.Queue
+	repositories workqueue.Queue
+	auditLog     audit.Log
+}
+
+func (q *jobQueues) all() []workqueue.Queue {
+	return []workqueue.Queue{q.jobs, q.repositories}
+}
+
+// cancelRenderJobs cancels the pending and running render jobs of a deleted
+// blog, as well as its scheduled renders waiting in the queue of the
+// gitservers. The blog is already gone, so errors are only logged: the
+// workers fail to render it anyway.
+func (q *jobQueues) cancelRenderJobs(username, slug string) {
+	for _, queue := range q.all() {
+		if err := queue.CancelKey(jobs.RenderJobKey(username, slug)); err != nil {
+			log.Printf("Error while cancelling render jobs of blog %s for user %s: %s", slug, username, err)
+		}
+	}
+}
+
+// scheduleCleanup posts the jobs deleting the data of a purged blog or user.
+// It tries every queue even if one fails, since the cleanup gets scheduled
+// again at the next purge and cleanup jobs can safely run twice.
+func (q *jobQueues) scheduleCleanup(purged userstore.Purged) error {
+	job := jobs.CleanupJob{
+		Username:   purged.Username,
+		Repository: purged.Slug,
+		Deleted:    purged.Deleted,
+	}
+
+	var firstErr error
+
+	for _, queue := range q.all() {
+		if _, err := queue.PostUnique(jobs.CleanupJobKey(job.Username, job.Repository), job, cleanupJobTTR); err != nil {
+			log.Printf("Error while scheduling cleanup of %s: %s", job.Target(), err)
+
+			if firstErr == nil {
+				firstErr = errors.Wrapf(err, "Error while scheduling cleanup of %s", job.Target())
+			}
+		}
+	}
+
+	if firstErr != nil {
+		return firstErr
+	}
+
+	event := audit.Event{
+		Type:       audit.CleanupScheduled,
+		Username:   job.Username,
+		Repository: job.Repository,
+	}
+
+	if err := q.auditLog.Record(event); err != nil {
+		return errors.Wrapf(err, "Error while recording cleanup of %s in the audit log", job.Target())
+	}
+
+	log.Printf("Purged %s, deleted at %s", job.Target(), job.Deleted.Format(time.RFC3339))
+
+	return nil
+}
+
+// PurgeDeleted deletes for good the users and blogs deleted more than
+// DeletedRetention ago, once the jobs deleting their repositories and rendered
+// files are posted. Users and blogs whose jobs couldn't be posted are retried
+// at the next purge.
+func (s *Server) PurgeDeleted() error {
+	_, err := s.userStore.PurgeDeleted(time.Now().Add(-DeletedRetention), s.jobQueues.scheduleCleanup)
+	return err
+}
+
+// PurgeDeletedEvery calls PurgeDeleted periodically, until stop is closed
+func (s *Server) PurgeDeletedEvery(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.PurgeDeleted(); err != nil {
+			log.Printf("Error while purging deleted users and blogs: %s", err)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package adminserver
+
+import (
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/abustany/moblog-cloud/pkg/audit"
+	"github.com/abustany/moblog-cloud/pkg/lockout"
+)
+
+// Lockout policies for failed logins. Addresses get more attempts than
+// usernames, since several users can share an address.
+var UsernameLockoutPolicy = lockout.Policy{
+	FreeAttempts: 5,
+	BaseLockout:  time.Minute,
+	MaxLockout:   time.Hour,
+	Memory:       24 * time.Hour,
+}
+
+var AddressLockoutPolicy = lockout.Policy{
+	FreeAttempts: 20,
+	BaseLockout:  time.Minute,
+	MaxLockout:   time.Hour,
+	Memory:       24 * time.Hour,
+}
+
+// TrustForwardedFor makes the login limiter use the client address added by
+// a reverse proxy to the X-Forwarded-For header. Without a proxy, clients
+// could set any address there.
+var TrustForwardedFor = false
+
+// loginLimiter throttles the attempts to guess passwords, second factors and
+// email codes, per username and per client address. Lockouts are recorded in the audit log.
+type loginLimiter struct {
+	limiter  lockout.Limiter
+	auditLog audit.Log
+}
+
+func usernameLockoutKey(username string) string {
+	return "user:" + username
+}
+
+func addressLockoutKey(address string) string {
+	return "address:" + address
+}
+
+func clientAddress(r *http.Request) string {
+	if TrustForwardedFor {
+		// The last address is the one added by the proxy
+		if forwardedFor := r.Header.Get("X-Forwarded-For"); forwardedFor != "" {
+			addresses := strings.Split(forwardedFor, ",")
+			return strings.TrimSpace(addresses[len(addresses)-1])
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// check returns how long a client must wait before trying to log in as a user.
+// Errors are only logged, so that a Redis outage doesn't prevent logging in.
+func (l *loginLimiter) check(username, address string) time.Duration {
+	var wait time.Duration
+
+	for _, key := range []string{usernameLockoutKey(username), addressLockoutKey(address)} {
+		remaining, err := l.limiter.Check(key)
+
+		if err != nil {
+			log.Printf("Error while checking lockout of %s: %s", key, err)
+			continue
+		}
+
+		if remaining > wait {
+			wait = remaining
+		}
+	}
+
+	return wait
+}
+
+// fail records a failed login, and reports the lockouts it triggered
+func (l *loginLimiter) fail(username, address string) {
+	if lockout, err := l.limiter.Fail(usernameLockoutKey(username), UsernameLockoutPolicy); err != nil {
+		log.Printf("Error while recording failed login of user %s: %s", username, err)
+	} else if lockout > 0 {
+		log.Printf("Locked out user %s for %s after too many failed logins, the last one from %s", username, lockout, address)
+		l.recordLockout(audit.UserLockout, username, address, lockout)
+	}
+
+	if lockout, err := l.limiter.Fail(addressLockoutKey(address), AddressLockoutPolicy); err != nil {
+		log.Printf("Error while recording failed login from %s: %s", address, err)
+	} else if lockout > 0 {
+		log.Printf("Locked out address %s for %s after too many failed logins, the last one as user %s", address, lockout, username)
+		l.recordLockout(audit.AddressLockout, username, address, lockout)
+	}
+}
+
+// recordLockout adds a lockout to the audit log. Errors are only logged, the
+// lockout applies anyway.
+func (l *loginLimiter) recordLockout(eventType, username, address string, lockout time.Duration) {
+	event := audit.Event{
+		Type:     eventType,
+		Username: username,
+		Address:  address,
+		Duration: lockout,
+	}
+
+	if err := l.auditLog.Record(event); err != nil {
+		log.Printf("Error while recording %s of %s from %s in the audit log: %s", eventType, username, address, err)
+	}
+}
+
+// succeed forgets the failed logins of a user. Those of the address are kept,
+// so that logging in to one's own account doesn't allow guessing more
+// passwords of other accounts.
+func (l *loginLimiter) succeed(username string) {
+	if err := l.limiter.Reset(usernameLockoutKey(username)); err != nil {
+		log.Printf("Error while resetting failed logins of user %s: %s", username, err)
+	}
+}
+
+// writeLockedOut replies to a login attempt made during a lockout
+func writeLockedOut(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	w.WriteHeader(http.StatusTooManyRequests)
+}
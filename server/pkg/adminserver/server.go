@@ -12,14 +12,24 @@ import (
 	"github.com/gorilla/securecookie"
 	"github.com/pkg/errors"
 
+	"github.com/abustany/moblog-cloud/pkg/audit"
+	"github.com/abustany/moblog-cloud/pkg/blogoutput"
+	"github.com/abustany/moblog-cloud/pkg/grants"
+	"github.com/abustany/moblog-cloud/pkg/lockout"
+	"github.com/abustany/moblog-cloud/pkg/mailer"
 	"github.com/abustany/moblog-cloud/pkg/middlewares"
 	"github.com/abustany/moblog-cloud/pkg/sessionstore"
 	"github.com/abustany/moblog-cloud/pkg/userstore"
+	"github.com/abustany/moblog-cloud/pkg/workqueue"
 )
 
 type usersService struct {
 	store        userstore.UserStore
 	sessionStore sessionstore.SessionStore
+	blogOutput   *blogoutput.Output
+	jobQueues    *jobQueues
+	mailer       mailer.Sender
+	loginLimiter *loginLimiter
 }
 
 var errInvalidParameter = errors.New("Invalid parameters")
@@ -30,6 +40,24 @@ var errDeleteInvalidUser = errors.New("You cannot update this user")
 
 var errUnknownBlog = errors.New("No blog with this slug")
 
+var errRestrictedSession = errors.New("This method cannot be called with an access token")
+
+// accountSession returns the session associated to the request, making sure
+// that it gives full access to the user account.
+func accountSession(r *http.Request) (*sessionstore.Session, error) {
+	session := SessionFromContext(r.Context())
+
+	if session == nil {
+		return nil, errRequireAuthentication
+	}
+
+	if session.Restricted() {
+		return nil, errRestrictedSession
+	}
+
+	return session, nil
+}
+
 type CreateUserReply struct{}
 
 func (s *usersService) Create(r *http.Request, user *userstore.User, reply *CreateUserReply) error {
@@ -44,16 +72,24 @@ func (s *usersService) Create(r *http.Request, user *userstore.User, reply *Crea
 
 	log.Printf("Created user %s", user.Username)
 
+	if user.Email != "" {
+		s.sendEmailVerification(user.Username)
+	}
+
 	return nil
 }
 
 type UpdateUserReply struct{}
 
+// Update changes the details of the logged in user. Changing the password
+// deletes the other sessions of the user, but neither the access tokens, which
+// have to be revoked separately, nor the grants already given to workers,
+// which expire on their own.
 func (s *usersService) Update(r *http.Request, user *userstore.User, reply *UpdateUserReply) error {
-	session := SessionFromContext(r.Context())
+	session, err := accountSession(r)
 
-	if session == nil {
-		return errRequireAuthentication
+	if err != nil {
+		return err
 	}
 
 	if user == nil {
@@ -64,6 +100,17 @@ func (s *usersService) Update(r *http.Request, user *userstore.User, reply *Upda
 		return errUpdateInvalidUser
 	}
 
+	oldUser, err := s.store.GetUser(user.Username)
+
+	if err != nil {
+		log.Printf("Error while retrieving user %s: %s", user.Username, err)
+		return err
+	}
+
+	if oldUser == nil {
+		return errGetUnknownUser
+	}
+
 	if err := s.store.UpdateUser(*user); err != nil {
 		log.Printf("Error while updating user %s: %s", user.Username, err)
 		return err
@@ -71,6 +118,20 @@ func (s *usersService) Update(r *http.Request, user *userstore.User, reply *Upda
 
 	log.Printf("Updated user %s", user.Username)
 
+	if user.Password != "" {
+		// Whoever knew the old password shouldn't remain logged in
+		if err := s.sessionStore.DeleteUserSessions(user.Username, session.Sid); err != nil {
+			log.Printf("Error while deleting the other sessions of user %s after a password change: %s", user.Username, err)
+			return err
+		}
+
+		log.Printf("Deleted the other sessions of user %s after a password change", user.Username)
+	}
+
+	if user.Email != "" && user.Email != oldUser.Email {
+		s.sendEmailVerification(user.Username)
+	}
+
 	return nil
 }
 
@@ -90,6 +151,12 @@ func (s *usersService) Get(r *http.Request, args *GetUserArgs, reply *userstore.
 		return errGetUnknownUser
 	}
 
+	// Email addresses are only shown to their owner
+	if session := SessionFromContext(r.Context()); session == nil || session.Username != user.Username {
+		user.Email = ""
+		user.EmailVerified = false
+	}
+
 	*reply = *user
 
 	return nil
@@ -114,21 +181,40 @@ type DeleteUserArgs struct {
 type DeleteUserReply struct{}
 
 func (s *usersService) Delete(r *http.Request, args *DeleteUserArgs, reply *DeleteUserReply) error {
-	session := SessionFromContext(r.Context())
+	session, err := accountSession(r)
 
-	if session == nil {
-		return errRequireAuthentication
+	if err != nil {
+		return err
 	}
 
 	if session.Username != args.Username {
 		return errDeleteInvalidUser
 	}
 
+	blogs, err := s.store.ListBlogs(args.Username)
+
+	if err != nil {
+		log.Printf("Error while listing blogs of user %s: %s", args.Username, err)
+		return err
+	}
+
 	if err := s.store.DeleteUser(args.Username); err != nil {
 		log.Printf("Error while deleting user %s: %s", args.Username, err)
 		return err
 	}
 
+	for _, blog := range blogs {
+		s.jobQueues.cancelRenderJobs(args.Username, blog.Slug)
+	}
+
+	// The blogs stay unpublished until the user is restored or purged
+	for _, blog := range blogs {
+		if err := s.blogOutput.Unpublish(r.Context(), args.Username, blog.Slug); err != nil {
+			log.Printf("Error while unpublishing blog %s of deleted user %s: %s", blog.Slug, args.Username, err)
+			return err
+		}
+	}
+
 	if err := s.sessionStore.Delete(session.Sid); err != nil {
 		log.Printf("Error while deleting session after deleting user %s: %s", args.Username, err)
 		return err
@@ -139,17 +225,66 @@ func (s *usersService) Delete(r *http.Request, args *DeleteUserArgs, reply *Dele
 	return nil
 }
 
+type RestoreUserArgs struct {
+	Username string
+	Password string
+}
+
+type RestoreUserReply struct{}
+
+// Restore undeletes a user that wasn't purged yet. It doesn't require a
+// session, since deleted users cannot log in.
+func (s *usersService) Restore(r *http.Request, args *RestoreUserArgs, reply *RestoreUserReply) error {
+	// Restoring checks the password, so it gets throttled like logins
+	address := clientAddress(r)
+
+	if err := s.checkLockout(args.Username, address); err != nil {
+		return err
+	}
+
+	if err := s.store.RestoreUser(args.Username, args.Password); err != nil {
+		if err == userstore.ErrDoesNotExist {
+			s.loginLimiter.fail(args.Username, address)
+		}
+
+		log.Printf("Error while restoring user %s: %s", args.Username, err)
+		return err
+	}
+
+	s.loginLimiter.succeed(args.Username)
+
+	blogs, err := s.store.ListBlogs(args.Username)
+
+	if err != nil {
+		log.Printf("Error while listing blogs of restored user %s: %s", args.Username, err)
+		return err
+	}
+
+	for _, blog := range blogs {
+		if err := s.blogOutput.Republish(r.Context(), args.Username, blog.Slug); err != nil {
+			log.Printf("Error while republishing blog %s of restored user %s: %s", blog.Slug, args.Username, err)
+			return err
+		}
+	}
+
+	log.Printf("Restored user %s", args.Username)
+
+	return nil
+}
+
 type blogsService struct {
-	store userstore.UserStore
+	store      userstore.UserStore
+	blogOutput *blogoutput.Output
+	jobQueues  *jobQueues
 }
 
 type CreateBlogReply struct{}
 
 func (s *blogsService) Create(r *http.Request, blog *userstore.Blog, reply *CreateBlogReply) error {
-	session := SessionFromContext(r.Context())
+	session, err := accountSession(r)
 
-	if session == nil {
-		return errRequireAuthentication
+	if err != nil {
+		return err
 	}
 
 	if blog == nil {
@@ -169,10 +304,10 @@ func (s *blogsService) Create(r *http.Request, blog *userstore.Blog, reply *Crea
 type UpdateBlogReply struct{}
 
 func (s *blogsService) Update(r *http.Request, blog *userstore.Blog, reply *UpdateBlogReply) error {
-	session := SessionFromContext(r.Context())
+	session, err := accountSession(r)
 
-	if session == nil {
-		return errRequireAuthentication
+	if err != nil {
+		return err
 	}
 
 	if blog == nil {
@@ -204,6 +339,10 @@ func (s *blogsService) Get(r *http.Request, args *GetBlogArgs, reply *userstore.
 			return errRequireAuthentication
 		}
 
+		if session.Blog != "" && session.Blog != args.Slug {
+			return errUnknownBlog
+		}
+
 		username = session.Username
 	} else {
 		username = args.Username
@@ -243,11 +382,25 @@ func (s *blogsService) List(r *http.Request, args *ListBlogsArgs, reply *ListBlo
 		return err
 	}
 
+	if session.Blog != "" {
+		blogs = filterBlogs(blogs, session.Blog)
+	}
+
 	*reply = blogs
 
 	return nil
 }
 
+func filterBlogs(blogs []userstore.Blog, slug string) []userstore.Blog {
+	for _, blog := range blogs {
+		if blog.Slug == slug {
+			return []userstore.Blog{blog}
+		}
+	}
+
+	return []userstore.Blog{}
+}
+
 type DeleteBlogArgs struct {
 	Slug string
 }
@@ -255,10 +408,10 @@ type DeleteBlogArgs struct {
 type DeleteBlogReply struct{}
 
 func (s *blogsService) Delete(r *http.Request, args *DeleteBlogArgs, reply *DeleteBlogReply) error {
-	session := SessionFromContext(r.Context())
+	session, err := accountSession(r)
 
-	if session == nil {
-		return errRequireAuthentication
+	if err != nil {
+		return err
 	}
 
 	if err := s.store.DeleteBlog(session.Username, args.Slug); err != nil {
@@ -266,35 +419,193 @@ func (s *blogsService) Delete(r *http.Request, args *DeleteBlogArgs, reply *Dele
 		return err
 	}
 
+	s.jobQueues.cancelRenderJobs(session.Username, args.Slug)
+
+	// The blog stays unpublished until it is restored or purged
+	if err := s.blogOutput.Unpublish(r.Context(), session.Username, args.Slug); err != nil {
+		log.Printf("Error while unpublishing deleted blog %s for user %s: %s", args.Slug, session.Username, err)
+		return err
+	}
+
 	log.Printf("Deleted blog %s for user %s", args.Slug, session.Username)
 
 	return nil
 }
 
+type ListDeletedBlogsArgs struct{}
+
+type ListDeletedBlogsReply []userstore.Blog
+
+func (s *blogsService) ListDeleted(r *http.Request, args *ListDeletedBlogsArgs, reply *ListDeletedBlogsReply) error {
+	session, err := accountSession(r)
+
+	if err != nil {
+		return err
+	}
+
+	blogs, err := s.store.ListDeletedBlogs(session.Username)
+
+	if err != nil {
+		log.Printf("Error while listing deleted blogs for user %s: %s", session.Username, err)
+		return err
+	}
+
+	if blogs == nil {
+		blogs = []userstore.Blog{}
+	}
+
+	*reply = blogs
+
+	return nil
+}
+
+type RestoreBlogArgs struct {
+	Slug string
+}
+
+type RestoreBlogReply struct{}
+
+func (s *blogsService) Restore(r *http.Request, args *RestoreBlogArgs, reply *RestoreBlogReply) error {
+	session, err := accountSession(r)
+
+	if err != nil {
+		return err
+	}
+
+	if err := s.store.RestoreBlog(session.Username, args.Slug); err != nil {
+		log.Printf("Error while restoring blog %s for user %s: %s", args.Slug, session.Username, err)
+		return err
+	}
+
+	if err := s.blogOutput.Republish(r.Context(), session.Username, args.Slug); err != nil {
+		log.Printf("Error while republishing restored blog %s for user %s: %s", args.Slug, session.Username, err)
+		return err
+	}
+
+	log.Printf("Restored blog %s for user %s", args.Slug, session.Username)
+
+	return nil
+}
+
+type ListBlogVersionsArgs struct {
+	Slug string
+}
+
+type ListBlogVersionsReply []blogoutput.Version
+
+func (s *blogsService) ListVersions(r *http.Request, args *ListBlogVersionsArgs, reply *ListBlogVersionsReply) error {
+	session := SessionFromContext(r.Context())
+
+	if session == nil {
+		return errRequireAuthentication
+	}
+
+	if session.Blog != "" && session.Blog != args.Slug {
+		return errUnknownBlog
+	}
+
+	if err := checkBlogExists(s.store, session.Username, args.Slug); err != nil {
+		return err
+	}
+
+	versions, err := s.blogOutput.ListVersions(r.Context(), session.Username, args.Slug)
+
+	if err != nil {
+		log.Printf("Error retrieving versions of blog %s for user %s: %s", args.Slug, session.Username, err)
+		return err
+	}
+
+	*reply = versions
+
+	return nil
+}
+
+type RollbackBlogArgs struct {
+	Slug    string
+	Version string
+}
+
+type RollbackBlogReply struct{}
+
+func (s *blogsService) Rollback(r *http.Request, args *RollbackBlogArgs, reply *RollbackBlogReply) error {
+	session, err := accountSession(r)
+
+	if err != nil {
+		return err
+	}
+
+	if err := checkBlogExists(s.store, session.Username, args.Slug); err != nil {
+		return err
+	}
+
+	if err := s.blogOutput.Rollback(r.Context(), session.Username, args.Slug, args.Version); err != nil {
+		log.Printf("Error rolling back blog %s for user %s to version %s: %s", args.Slug, session.Username, args.Version, err)
+		return err
+	}
+
+	log.Printf("Rolled back blog %s for user %s to version %s", args.Slug, session.Username, args.Version)
+
+	return nil
+}
+
+func checkBlogExists(store userstore.UserStore, username, slug string) error {
+	blog, err := store.GetBlog(username, slug)
+
+	if err != nil {
+		log.Printf("Error retrieving blog %s for user %s: %s", slug, username, err)
+		return err
+	}
+
+	if blog == nil {
+		return errUnknownBlog
+	}
+
+	return nil
+}
+
 type Server struct {
 	router       *mux.Router
 	secureCookie *securecookie.SecureCookie
 	userStore    userstore.UserStore
 	sessionStore sessionstore.SessionStore
+	jobQueues    *jobQueues
+	loginLimiter *loginLimiter
 }
 
-func New(basePath string, secureCookie *securecookie.SecureCookie, userStore userstore.UserStore, sessionStore sessionstore.SessionStore) (*Server, error) {
+func New(basePath string, secureCookie *securecookie.SecureCookie, grantSigner *grants.Signer, userStore userstore.UserStore, sessionStore sessionstore.SessionStore, blogOutput *blogoutput.Output, jobQueue, repositoryQueue workqueue.Queue, mailSender mailer.Sender, limiter lockout.Limiter, auditLog audit.Log) (*Server, error) {
+	queues := &jobQueues{jobQueue, repositoryQueue, auditLog}
+	loginLimiter := &loginLimiter{limiter, auditLog}
+
 	s := Server{
 		router:       mux.NewRouter(),
 		secureCookie: secureCookie,
 		userStore:    userStore,
 		sessionStore: sessionStore,
+		jobQueues:    queues,
+		loginLimiter: loginLimiter,
 	}
 
 	rpcServer := rpc.NewServer()
-	if err := rpcServer.RegisterService(&usersService{userStore, sessionStore}, "Users"); err != nil {
+	if err := rpcServer.RegisterService(&usersService{userStore, sessionStore, blogOutput, queues, mailSender, loginLimiter}, "Users"); err != nil {
 		return nil, errors.Wrap(err, "Error while registering users service")
 	}
 
-	if err := rpcServer.RegisterService(&blogsService{userStore}, "Blogs"); err != nil {
+	if err := rpcServer.RegisterService(&sessionsService{sessionStore}, "Sessions"); err != nil {
+		return nil, errors.Wrap(err, "Error while registering sessions service")
+	}
+
+	if err := rpcServer.RegisterService(&blogsService{userStore, blogOutput, queues}, "Blogs"); err != nil {
 		return nil, errors.Wrap(err, "Error while registering blogs service")
 	}
 
+	if err := rpcServer.RegisterService(&tokensService{userStore}, "Tokens"); err != nil {
+		return nil, errors.Wrap(err, "Error while registering tokens service")
+	}
+
+	if err := rpcServer.RegisterService(&buildsService{userStore, blogOutput}, "Builds"); err != nil {
+		return nil, errors.Wrap(err, "Error while registering builds service")
+	}
+
 	rpcServer.RegisterCodec(rpcJson.NewCodec(), "application/json")
 
 	router := s.router
@@ -304,13 +615,13 @@ func New(basePath string, secureCookie *securecookie.SecureCookie, userStore use
 	}
 
 	withSession := func(requiresAuth bool, h http.Handler) http.Handler {
-		return WithSession(secureCookie, sessionStore, requiresAuth, h)
+		return WithSession(secureCookie, grantSigner, sessionStore, userStore, requiresAuth, h)
 	}
 
 	router.Methods("POST").Path("/login").Handler(middlewares.WithLogging(withSession(false, http.HandlerFunc(s.loginHandler))))
 	router.Methods("POST").Path("/logout").Handler(middlewares.WithLogging(withSession(false, http.HandlerFunc(s.logoutHandler))))
 
-	router.Methods("POST").Handler(middlewares.WithLogging(WithSession(secureCookie, sessionStore, false, rpcServer)))
+	router.Methods("POST").Handler(middlewares.WithLogging(withSession(false, rpcServer)))
 
 	s.router.
 		PathPrefix("/").
@@ -330,6 +641,10 @@ func sessionExpiryTime() time.Time {
 	return time.Now().Add(30 * 24 * time.Hour)
 }
 
+// SecondFactorTimeout is how long users have to send their second factor
+// after logging in with their password
+var SecondFactorTimeout = 5 * time.Minute
+
 func (s *Server) loginHandler(w http.ResponseWriter, r *http.Request) {
 	if err := r.ParseForm(); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
@@ -339,19 +654,72 @@ func (s *Server) loginHandler(w http.ResponseWriter, r *http.Request) {
 
 	username := r.Form.Get("username")
 	password := r.Form.Get("password")
+	code := r.Form.Get("code")
+	address := clientAddress(r)
 
 	var session sessionstore.Session
 	var newSession bool
 
-	// Special case: session refresh with an existing cookie
-	if username == "" && password == "" {
-		if s := SessionFromContext(r.Context()); s != nil {
+	if code != "" {
+		// Second step of a login with two-factor authentication
+		pendingSession := pendingSessionFromContext(r.Context())
+
+		if pendingSession == nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		username = pendingSession.Username
+
+		if wait := s.loginLimiter.check(username, address); wait > 0 {
+			writeLockedOut(w, wait)
+			return
+		}
+
+		authenticated, err := s.userStore.AuthenticateSecondFactor(username, code)
+
+		if err != nil {
+			log.Printf("Error while authenticating second factor of user %s: %s", username, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		if !authenticated {
+			s.loginLimiter.fail(username, address)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		s.loginLimiter.succeed(username)
+
+		if err := s.sessionStore.Delete(pendingSession.Sid); err != nil {
+			log.Printf("Error while deleting pending session %s for user %s: %s", pendingSession.Sid, username, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		session = sessionstore.Session{
+			Sid:      sessionstore.GenerateSessionID(),
+			Username: username,
+		}
+
+		newSession = true
+	} else if username == "" && password == "" {
+		// Special case: session refresh with an existing cookie
+		// Sessions created from access tokens cannot be turned into cookies
+		if s := SessionFromContext(r.Context()); s != nil && !s.Restricted() {
 			session = *s
 		} else {
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
 	} else {
+		// Hashing passwords is expensive, so throttle before checking them
+		if wait := s.loginLimiter.check(username, address); wait > 0 {
+			writeLockedOut(w, wait)
+			return
+		}
+
 		authenticated, err := s.userStore.AuthenticateUser(username, password)
 
 		if err != nil {
@@ -361,13 +729,29 @@ func (s *Server) loginHandler(w http.ResponseWriter, r *http.Request) {
 		}
 
 		if !authenticated {
+			s.loginLimiter.fail(username, address)
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
 
+		user, err := s.userStore.GetUser(username)
+
+		if err != nil {
+			log.Printf("Error while retrieving user %s: %s", username, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
 		session = sessionstore.Session{
-			Sid:      sessionstore.GenerateSessionID(),
-			Username: username,
+			Sid:                 sessionstore.GenerateSessionID(),
+			Username:            username,
+			SecondFactorPending: user != nil && user.TwoFactorEnabled,
+		}
+
+		// The second factor could otherwise be guessed by logging in with the
+		// password between the attempts
+		if !session.SecondFactorPending {
+			s.loginLimiter.succeed(username)
 		}
 
 		newSession = true
@@ -375,13 +759,27 @@ func (s *Server) loginHandler(w http.ResponseWriter, r *http.Request) {
 
 	session.Expires = sessionExpiryTime()
 
+	if session.SecondFactorPending {
+		session.Expires = time.Now().Add(SecondFactorTimeout)
+	}
+
+	if newSession {
+		session.Created = time.Now()
+		session.UserAgent = r.UserAgent()
+	}
+
+	session.LastSeen = time.Now()
+	session.Address = address
+
 	if err := s.sessionStore.Set(session); err != nil {
 		log.Printf("Error while saving session for user %s: %s", username, err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	if newSession {
+	if session.SecondFactorPending {
+		log.Printf("Created session %s for user %s, waiting for the second factor", session.Sid, session.Username)
+	} else if newSession {
 		log.Printf("Created new session %s for user %s", session.Sid, session.Username)
 	} else {
 		log.Printf("Refreshed session %s for user %s", session.Sid, session.Username)
@@ -400,12 +798,22 @@ func (s *Server) loginHandler(w http.ResponseWriter, r *http.Request) {
 	authCookie.Expires = session.Expires
 
 	http.SetCookie(w, &authCookie)
-	w.WriteHeader(http.StatusOK)
+
+	if session.SecondFactorPending {
+		w.WriteHeader(http.StatusAccepted)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
 }
 
 func (s *Server) logoutHandler(w http.ResponseWriter, r *http.Request) {
 	session := SessionFromContext(r.Context())
 
+	if session == nil || session.Restricted() {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
 	if err := s.sessionStore.Delete(session.Sid); err != nil {
 		log.Printf("Error while deleting session %s for %s: %s", session.Sid, session.Username, err)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -9,7 +9,9 @@ import (
 	"github.com/gorilla/securecookie"
 	"github.com/pkg/errors"
 
+	"github.com/abustany/moblog-cloud/pkg/grants"
 	"github.com/abustany/moblog-cloud/pkg/sessionstore"
+	"github.com/abustany/moblog-cloud/pkg/userstore"
 )
 
 const AuthCookieName = "auth"
@@ -47,9 +49,62 @@ type contextKey int
 
 const (
 	sessionKey contextKey = iota
+	pendingSessionKey
 )
 
-func sessionFromRequest(sc *securecookie.SecureCookie, sessionStore sessionstore.SessionStore, r *http.Request) (*sessionstore.Session, error) {
+var errInvalidCredentials = errors.New("Invalid credentials")
+
+// sessionFromToken creates a session restricted to the scopes of an access
+// token. Such sessions are never stored, they last for a single request.
+func sessionFromToken(userStore userstore.UserStore, username, secret string) (*sessionstore.Session, error) {
+	token, err := userStore.AuthenticateToken(username, secret)
+
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error while authenticating token for user %s", username)
+	}
+
+	if token == nil {
+		log.Printf("Invalid access token for user %s", username)
+		return nil, errInvalidCredentials
+	}
+
+	log.Printf("Authenticated user %s with access token %s", username, token.ID)
+
+	return &sessionstore.Session{
+		Username: username,
+		Scopes:   token.Scopes,
+	}, nil
+}
+
+// sessionFromGrant creates a read-only session for the blog of a grant, that
+// can also report the progress of the blog's builds. Like token sessions, those
+// are never stored.
+func sessionFromGrant(grantSigner *grants.Signer, encodedGrant string) (*sessionstore.Session, error) {
+	grant, err := grantSigner.Verify(encodedGrant)
+
+	if err != nil {
+		log.Printf("Error while verifying grant: %s", err)
+		return nil, errInvalidCredentials
+	}
+
+	log.Printf("Authenticated grant for %s/%s", grant.Username, grant.Repository)
+
+	return &sessionstore.Session{
+		Username: grant.Username,
+		Scopes:   []string{userstore.TokenScopeRepoRead, scopeReportBuilds},
+		Blog:     grant.Repository,
+	}, nil
+}
+
+func sessionFromRequest(sc *securecookie.SecureCookie, grantSigner *grants.Signer, sessionStore sessionstore.SessionStore, userStore userstore.UserStore, r *http.Request) (*sessionstore.Session, error) {
+	if encodedGrant, ok := grants.FromRequest(r); ok {
+		return sessionFromGrant(grantSigner, encodedGrant)
+	}
+
+	if username, secret, ok := r.BasicAuth(); ok {
+		return sessionFromToken(userStore, username, secret)
+	}
+
 	authCookie, err := r.Cookie(AuthCookieName)
 
 	if err == http.ErrNoCookie {
@@ -79,6 +134,7 @@ func sessionFromRequest(sc *securecookie.SecureCookie, sessionStore sessionstore
 
 	if session != nil {
 		log.Printf("Associated to session %s for user %s", decoded.SessionID, session.Username)
+		touchSession(sessionStore, session, r)
 	} else {
 		log.Printf("No session found with ID %s", decoded.SessionID)
 	}
@@ -86,9 +142,14 @@ func sessionFromRequest(sc *securecookie.SecureCookie, sessionStore sessionstore
 	return session, nil
 }
 
-func WithSession(sc *securecookie.SecureCookie, sessionStore sessionstore.SessionStore, requireAuth bool, handler http.Handler) http.Handler {
+func WithSession(sc *securecookie.SecureCookie, grantSigner *grants.Signer, sessionStore sessionstore.SessionStore, userStore userstore.UserStore, requireAuth bool, handler http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		session, err := sessionFromRequest(sc, sessionStore, r)
+		session, err := sessionFromRequest(sc, grantSigner, sessionStore, userStore, r)
+
+		if err == errInvalidCredentials {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
 
 		if err != nil {
 			log.Printf("Error while decoding session: %s", err)
@@ -96,6 +157,12 @@ func WithSession(sc *securecookie.SecureCookie, sessionStore sessionstore.Sessio
 			return
 		}
 
+		if session != nil && session.SecondFactorPending {
+			// Only the login handler may use those
+			r = r.WithContext(context.WithValue(r.Context(), pendingSessionKey, session))
+			session = nil
+		}
+
 		if session == nil {
 			if requireAuth {
 				w.WriteHeader(http.StatusUnauthorized)
@@ -116,3 +183,13 @@ func SessionFromContext(ctx context.Context) *sessionstore.Session {
 
 	return nil
 }
+
+// pendingSessionFromContext returns the session of a user who logged in with
+// their password, but didn't send their second factor yet
+func pendingSessionFromContext(ctx context.Context) *sessionstore.Session {
+	if value := ctx.Value(pendingSessionKey); value != nil {
+		return value.(*sessionstore.Session)
+	}
+
+	return nil
+}
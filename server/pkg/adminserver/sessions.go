@@ -0,0 +1,157 @@
+package adminserver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/abustany/moblog-cloud/pkg/sessionstore"
+)
+
+var errUnknownSession = errors.New("No session with this ID")
+
+// sessionTouchInterval is how often the last seen time of a session gets saved
+const sessionTouchInterval = time.Minute
+
+// touchSession records that a stored session was used. Failing to do so
+// doesn't prevent using the session.
+func touchSession(sessionStore sessionstore.SessionStore, session *sessionstore.Session, r *http.Request) {
+	address := clientAddress(r)
+
+	if time.Since(session.LastSeen) < sessionTouchInterval && session.Address == address {
+		return
+	}
+
+	session.LastSeen = time.Now()
+	session.Address = address
+
+	if err := sessionStore.Update(*session); err != nil {
+		log.Printf("Error while updating session %s: %s", session.Sid, err)
+	}
+}
+
+// sessionPublicID identifies a session in the API. Session IDs themselves
+// are never returned, since they are what the auth cookie holds.
+func sessionPublicID(sid string) string {
+	hash := sha256.Sum256([]byte(sid))
+	return hex.EncodeToString(hash[:16])
+}
+
+type sessionsService struct {
+	sessionStore sessionstore.SessionStore
+}
+
+type SessionInfo struct {
+	ID        string
+	Created   time.Time
+	LastSeen  time.Time
+	Address   string
+	UserAgent string
+	// Current is true for the session used for listing the sessions
+	Current bool
+}
+
+type ListSessionsArgs struct{}
+
+type ListSessionsReply struct {
+	Sessions []SessionInfo
+}
+
+// List returns the sessions of the logged in user, oldest first. Sessions
+// waiting for a second factor are included.
+func (s *sessionsService) List(r *http.Request, args *ListSessionsArgs, reply *ListSessionsReply) error {
+	session, err := accountSession(r)
+
+	if err != nil {
+		return err
+	}
+
+	sessions, err := s.sessionStore.List(session.Username)
+
+	if err != nil {
+		log.Printf("Error while listing sessions of user %s: %s", session.Username, err)
+		return err
+	}
+
+	reply.Sessions = make([]SessionInfo, len(sessions))
+
+	for i, ss := range sessions {
+		reply.Sessions[i] = SessionInfo{
+			ID:        sessionPublicID(ss.Sid),
+			Created:   ss.Created,
+			LastSeen:  ss.LastSeen,
+			Address:   ss.Address,
+			UserAgent: ss.UserAgent,
+			Current:   ss.Sid == session.Sid,
+		}
+	}
+
+	return nil
+}
+
+type RevokeSessionArgs struct {
+	ID string
+}
+
+type RevokeSessionReply struct{}
+
+// Revoke logs out one of the sessions of the logged in user, which can be the
+// current one
+func (s *sessionsService) Revoke(r *http.Request, args *RevokeSessionArgs, reply *RevokeSessionReply) error {
+	session, err := accountSession(r)
+
+	if err != nil {
+		return err
+	}
+
+	sessions, err := s.sessionStore.List(session.Username)
+
+	if err != nil {
+		log.Printf("Error while listing sessions of user %s: %s", session.Username, err)
+		return err
+	}
+
+	for _, ss := range sessions {
+		if sessionPublicID(ss.Sid) != args.ID {
+			continue
+		}
+
+		if err := s.sessionStore.Delete(ss.Sid); err != nil {
+			log.Printf("Error while revoking session %s of user %s: %s", ss.Sid, session.Username, err)
+			return err
+		}
+
+		log.Printf("Revoked session %s of user %s", ss.Sid, session.Username)
+
+		return nil
+	}
+
+	return errUnknownSession
+}
+
+type RevokeOtherSessionsArgs struct{}
+
+type RevokeOtherSessionsReply struct{}
+
+// RevokeAllOthers logs out all the sessions of the logged in user, except the
+// current one
+func (s *sessionsService) RevokeAllOthers(r *http.Request, args *RevokeOtherSessionsArgs, reply *RevokeOtherSessionsReply) error {
+	session, err := accountSession(r)
+
+	if err != nil {
+		return err
+	}
+
+	if err := s.sessionStore.DeleteUserSessions(session.Username, session.Sid); err != nil {
+		log.Printf("Error while revoking the other sessions of user %s: %s", session.Username, err)
+		return err
+	}
+
+	log.Printf("Revoked all sessions of user %s except %s", session.Username, session.Sid)
+
+	return nil
+}
@@ -0,0 +1,114 @@
+package adminserver
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/abustany/moblog-cloud/pkg/userstore"
+)
+
+type tokensService struct {
+	store userstore.UserStore
+}
+
+type CreateTokenArgs struct {
+	Name   string
+	Scopes []string
+}
+
+type CreateTokenReply struct {
+	Token  userstore.Token
+	Secret string
+}
+
+func (s *tokensService) Create(r *http.Request, args *CreateTokenArgs, reply *CreateTokenReply) error {
+	session, err := accountSession(r)
+
+	if err != nil {
+		return err
+	}
+
+	token, secret, err := s.store.CreateToken(session.Username, userstore.Token{Name: args.Name, Scopes: args.Scopes})
+
+	if err != nil {
+		log.Printf("Error while creating token for user %s: %s", session.Username, err)
+		return err
+	}
+
+	log.Printf("Created token %s for user %s", token.ID, session.Username)
+
+	reply.Token = *token
+	reply.Secret = secret
+
+	return nil
+}
+
+type ListTokensArgs struct{}
+
+type ListTokensReply []userstore.Token
+
+func (s *tokensService) List(r *http.Request, args *ListTokensArgs, reply *ListTokensReply) error {
+	session, err := accountSession(r)
+
+	if err != nil {
+		return err
+	}
+
+	tokens, err := s.store.ListTokens(session.Username)
+
+	if err != nil {
+		log.Printf("Error retrieving tokens for user %s: %s", session.Username, err)
+		return err
+	}
+
+	*reply = tokens
+
+	return nil
+}
+
+type RevokeTokenArgs struct {
+	ID string
+}
+
+type RevokeTokenReply struct{}
+
+func (s *tokensService) Revoke(r *http.Request, args *RevokeTokenArgs, reply *RevokeTokenReply) error {
+	session, err := accountSession(r)
+
+	if err != nil {
+		return err
+	}
+
+	if err := s.store.DeleteToken(session.Username, args.ID); err != nil {
+		log.Printf("Error revoking token %s for user %s: %s", args.ID, session.Username, err)
+		return err
+	}
+
+	log.Printf("Revoked token %s for user %s", args.ID, session.Username)
+
+	return nil
+}
+
+type SessionScopesArgs struct{}
+
+type SessionScopesReply struct {
+	// Restricted is false if the session gives full access to the account, in
+	// which case Scopes is empty.
+	Restricted bool
+	Scopes     []string
+}
+
+// SessionScopes returns what the caller's session may be used for. It is used
+// by the git server to check the scopes of access tokens.
+func (s *tokensService) SessionScopes(r *http.Request, args *SessionScopesArgs, reply *SessionScopesReply) error {
+	session := SessionFromContext(r.Context())
+
+	if session == nil {
+		return errRequireAuthentication
+	}
+
+	reply.Restricted = session.Restricted()
+	reply.Scopes = session.Scopes
+
+	return nil
+}
@@ -0,0 +1,168 @@
+package adminserver
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/abustany/moblog-cloud/pkg/totp"
+	"github.com/abustany/moblog-cloud/pkg/userstore"
+)
+
+// TOTPIssuer is the name under which authenticator apps list the accounts
+const TOTPIssuer = "moblog"
+
+type EnrolTOTPArgs struct {
+	// Code is a TOTP or recovery code, required if two-factor authentication
+	// is already enabled so that a stolen session cannot replace the secret
+	Code string
+}
+
+type EnrolTOTPReply struct {
+	Secret string
+	// URI is the otpauth:// URI of the secret, to display as a QR code
+	URI string
+}
+
+// EnrolTOTP generates a new TOTP secret for the logged in user. Two-factor
+// authentication is only enabled once ConfirmTOTP receives a valid code for
+// the secret.
+func (s *usersService) EnrolTOTP(r *http.Request, args *EnrolTOTPArgs, reply *EnrolTOTPReply) error {
+	session, err := accountSession(r)
+
+	if err != nil {
+		return err
+	}
+
+	user, err := s.store.GetUser(session.Username)
+
+	if err != nil {
+		log.Printf("Error while retrieving user %s: %s", session.Username, err)
+		return err
+	}
+
+	if user == nil {
+		return errRequireAuthentication
+	}
+
+	if user.TwoFactorEnabled {
+		if err := s.authenticateSecondFactor(r, session.Username, args.Code); err != nil {
+			return err
+		}
+	}
+
+	secret, err := s.store.EnrolTOTP(session.Username)
+
+	if err != nil {
+		log.Printf("Error while enrolling TOTP secret for user %s: %s", session.Username, err)
+		return err
+	}
+
+	log.Printf("Enrolled TOTP secret for user %s", session.Username)
+
+	reply.Secret = secret
+	reply.URI = totp.KeyURI(TOTPIssuer, session.Username, secret)
+
+	return nil
+}
+
+type ConfirmTOTPArgs struct {
+	Code string
+}
+
+type ConfirmTOTPReply struct {
+	// RecoveryCodes can each be used once instead of a TOTP code. They cannot
+	// be retrieved later.
+	RecoveryCodes []string
+}
+
+func (s *usersService) ConfirmTOTP(r *http.Request, args *ConfirmTOTPArgs, reply *ConfirmTOTPReply) error {
+	session, err := accountSession(r)
+
+	if err != nil {
+		return err
+	}
+
+	// Confirming checks a code, so it gets throttled like logins
+	address := clientAddress(r)
+
+	if wait := s.loginLimiter.check(session.Username, address); wait > 0 {
+		return errors.Errorf("Too many failed attempts, retry in %s", wait.Round(time.Second))
+	}
+
+	recoveryCodes, err := s.store.ConfirmTOTP(session.Username, args.Code)
+
+	if err == userstore.ErrTOTPCodeInvalid {
+		s.loginLimiter.fail(session.Username, address)
+	}
+
+	if err != nil {
+		log.Printf("Error while confirming TOTP secret for user %s: %s", session.Username, err)
+		return err
+	}
+
+	s.loginLimiter.succeed(session.Username)
+
+	log.Printf("Enabled two-factor authentication for user %s", session.Username)
+
+	reply.RecoveryCodes = recoveryCodes
+
+	return nil
+}
+
+type DisableTOTPArgs struct {
+	// Code is a TOTP or recovery code, so that a stolen session cannot
+	// disable two-factor authentication
+	Code string
+}
+
+type DisableTOTPReply struct{}
+
+func (s *usersService) DisableTOTP(r *http.Request, args *DisableTOTPArgs, reply *DisableTOTPReply) error {
+	session, err := accountSession(r)
+
+	if err != nil {
+		return err
+	}
+
+	if err := s.authenticateSecondFactor(r, session.Username, args.Code); err != nil {
+		return err
+	}
+
+	if err := s.store.DisableTOTP(session.Username); err != nil {
+		log.Printf("Error while disabling two-factor authentication for user %s: %s", session.Username, err)
+		return err
+	}
+
+	log.Printf("Disabled two-factor authentication for user %s", session.Username)
+
+	return nil
+}
+
+// authenticateSecondFactor checks a TOTP or recovery code of a logged in user,
+// throttled like logins
+func (s *usersService) authenticateSecondFactor(r *http.Request, username, code string) error {
+	address := clientAddress(r)
+
+	if wait := s.loginLimiter.check(username, address); wait > 0 {
+		return errors.Errorf("Too many failed attempts, retry in %s", wait.Round(time.Second))
+	}
+
+	authenticated, err := s.store.AuthenticateSecondFactor(username, code)
+
+	if err != nil {
+		log.Printf("Error while authenticating second factor of user %s: %s", username, err)
+		return err
+	}
+
+	if !authenticated {
+		s.loginLimiter.fail(username, address)
+		return userstore.ErrTOTPCodeInvalid
+	}
+
+	s.loginLimiter.succeed(username)
+
+	return nil
+}
@@ -0,0 +1,41 @@
+// Package audit keeps an append-only record of the security relevant events,
+// like lockouts after failed logins, for the administrators to review.
+package audit
+
+import (
+	"time"
+)
+
+// Types of events
+const (
+	// A username got locked out after too many failed logins, Address is
+	// the address of the last attempt
+	UserLockout = "user-lockout"
+	// An address got locked out after too many failed logins, Username is
+	// the user of the last attempt
+	AddressLockout = "address-lockout"
+	// The adminserver posted the jobs purging the data of a deleted blog, or
+	// of a deleted user if Repository is empty
+	CleanupScheduled = "cleanup-scheduled"
+	// A worker deleted the rendered files of a deleted blog or user
+	RenderedFilesPurged = "rendered-files-purged"
+	// A gitserver deleted the repositories of a deleted blog or user
+	RepositoriesPurged = "repositories-purged"
+)
+
+type Event struct {
+	Type       string
+	Time       time.Time
+	Username   string
+	Repository string        // empty if the event is not about a blog
+	Address    string        // client address, empty if not relevant
+	Duration   time.Duration // of the lockout, 0 if not relevant
+}
+
+type Log interface {
+	// Record appends an event to the log. Its time is set to the current
+	// time if it is zero.
+	Record(event Event) error
+	// Events returns the most recent events, most recent first
+	Events(limit int) ([]Event, error)
+}
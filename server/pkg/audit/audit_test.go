@@ -0,0 +1,59 @@
+package audit_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/abustany/moblog-cloud/pkg/audit"
+)
+
+func testLog(t *testing.T, l audit.Log) {
+	before := time.Now()
+
+	first := audit.Event{
+		Type:     audit.UserLockout,
+		Username: "user",
+		Address:  "192.0.2.1",
+		Duration: time.Minute,
+	}
+
+	second := audit.Event{
+		Type:     audit.AddressLockout,
+		Time:     time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		Username: "other",
+		Address:  "192.0.2.2",
+		Duration: time.Hour,
+	}
+
+	for _, event := range []audit.Event{first, second} {
+		if err := l.Record(event); err != nil {
+			t.Fatalf("Error while recording event: %s", err)
+		}
+	}
+
+	events, err := l.Events(10)
+
+	if err != nil {
+		t.Fatalf("Error while listing events: %s", err)
+	}
+
+	if len(events) != 2 {
+		t.Fatalf("Unexpected events: %+v", events)
+	}
+
+	if events[0].Type != second.Type || !events[0].Time.Equal(second.Time) || events[0].Username != second.Username || events[0].Address != second.Address || events[0].Duration != second.Duration {
+		t.Errorf("Unexpected most recent event, expected %+v, got %+v", second, events[0])
+	}
+
+	if events[1].Type != first.Type || events[1].Username != first.Username || events[1].Address != first.Address || events[1].Duration != first.Duration {
+		t.Errorf("Unexpected oldest event, expected %+v, got %+v", first, events[1])
+	}
+
+	if events[1].Time.Before(before.Add(-time.Second)) || events[1].Time.After(time.Now().Add(time.Second)) {
+		t.Errorf("Events without a time should be recorded at the current time, got %s", events[1].Time)
+	}
+
+	if events, err := l.Events(1); err != nil || len(events) != 1 || events[0].Type != second.Type {
+		t.Errorf("Unexpected limited events: %+v, %v", events, err)
+	}
+}
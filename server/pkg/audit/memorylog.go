@@ -0,0 +1,44 @@
+package audit
+
+import (
+	"sync"
+	"time"
+)
+
+// MemoryLog keeps the events in memory, so they are lost when the server
+// stops
+type MemoryLog struct {
+	sync.Mutex
+
+	events []Event
+}
+
+func NewMemoryLog() (*MemoryLog, error) {
+	return &MemoryLog{}, nil
+}
+
+func (l *MemoryLog) Record(event Event) error {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	l.events = append(l.events, event)
+
+	return nil
+}
+
+func (l *MemoryLog) Events(limit int) ([]Event, error) {
+	l.Lock()
+	defer l.Unlock()
+
+	var events []Event
+
+	for i := len(l.events) - 1; i >= 0 && len(events) < limit; i-- {
+		events = append(events, l.events[i])
+	}
+
+	return events, nil
+}
@@ -0,0 +1,17 @@
+package audit_test
+
+import (
+	"testing"
+
+	"github.com/abustany/moblog-cloud/pkg/audit"
+)
+
+func TestMemoryLog(t *testing.T) {
+	l, err := audit.NewMemoryLog()
+
+	if err != nil {
+		t.Fatalf("Error while creating audit log: %s", err)
+	}
+
+	testLog(t, l)
+}
@@ -0,0 +1,85 @@
+package audit
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+)
+
+// SQLLog stores the events in the audit_log table, which the servers never
+// update nor delete from
+type SQLLog struct {
+	db *sqlx.DB
+
+	recordStmt *sql.Stmt
+	eventsStmt *sqlx.Stmt
+}
+
+type eventRecord struct {
+	Type       string    `db:"type"`
+	Time       time.Time `db:"time"`
+	Username   string    `db:"username"`
+	Repository string    `db:"repository"`
+	Address    string    `db:"address"`
+	DurationUs int64     `db:"duration"`
+}
+
+func NewSQLLog(driverName, dbURL string) (*SQLLog, error) {
+	db, err := sqlx.Connect(driverName, dbURL)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while connecting to the database")
+	}
+
+	recordStmt, err := db.Prepare(`INSERT INTO audit_log (type, time, username, repository, address, duration) VALUES ($1, $2, $3, $4, $5, $6)`)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while preparing record statement")
+	}
+
+	eventsStmt, err := db.Preparex(`SELECT type, time, username, repository, address, duration FROM audit_log ORDER BY id DESC LIMIT $1`)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while preparing events statement")
+	}
+
+	return &SQLLog{
+		db:         db,
+		recordStmt: recordStmt,
+		eventsStmt: eventsStmt,
+	}, nil
+}
+
+func (l *SQLLog) Record(event Event) error {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	_, err := l.recordStmt.Exec(event.Type, event.Time, event.Username, event.Repository, event.Address, int64(event.Duration/time.Microsecond))
+	return errors.Wrap(err, "Error while recording audit event")
+}
+
+func (l *SQLLog) Events(limit int) ([]Event, error) {
+	var records []eventRecord
+
+	if err := l.eventsStmt.Select(&records, limit); err != nil {
+		return nil, errors.Wrap(err, "Error while listing audit events")
+	}
+
+	events := make([]Event, len(records))
+
+	for i, record := range records {
+		events[i] = Event{
+			Type:       record.Type,
+			Time:       record.Time,
+			Username:   record.Username,
+			Repository: record.Repository,
+			Address:    record.Address,
+			Duration:   time.Duration(record.DurationUs) * time.Microsecond,
+		}
+	}
+
+	return events, nil
+}
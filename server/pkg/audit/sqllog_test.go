@@ -0,0 +1,29 @@
+package audit_test
+
+import (
+	"os"
+	"testing"
+
+	_ "github.com/lib/pq"
+
+	"github.com/abustany/moblog-cloud/pkg/audit"
+	"github.com/abustany/moblog-cloud/pkg/testutils"
+)
+
+func TestSQLLog(t *testing.T) {
+	dbURL := os.Getenv(testutils.DBURLEnvVar)
+
+	if dbURL == "" {
+		t.Skip(testutils.DBURLEnvVar + " environment variable not defined")
+	}
+
+	testutils.FlushDB(t)
+
+	l, err := audit.NewSQLLog("postgres", dbURL)
+
+	if err != nil {
+		t.Fatalf("Error while creating audit log: %s", err)
+	}
+
+	testLog(t, l)
+}
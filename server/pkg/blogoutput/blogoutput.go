@@ -0,0 +1,519 @@
+// Package blogoutput manages the rendered files of the blogs.
+//
+// Each render of a blog is written under its own immutable version prefix,
+// username/slug/versions/VERSION/. Once all the files of a version are
+// uploaded, the small username/slug/current object is updated to point to it,
+// so that readers never see a partially uploaded blog. The last versions are
+// kept around so that a blog can be rolled back instantly.
+//
+// Unpublishing a blog moves its current pointer to username/slug/unpublished,
+// so that it stops being served while its versions are kept until it is
+// published again or deleted.
+package blogoutput
+
+import (
+	"context"
+	"io"
+	"log"
+	"mime"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"gocloud.dev/blob"
+	"gocloud.dev/gcerrors"
+)
+
+// Number of complete versions kept for each blog, including the current one
+var KeepVersions = 10
+
+const versionsDirectory = "versions"
+const currentKey = "current"
+const unpublishedKey = "unpublished"
+
+// Version IDs are timestamps, formatted so that sorting them alphabetically
+// sorts them chronologically.
+const versionIDLayout = "20060102T150405.000000000Z"
+
+var ErrUnknownVersion = errors.New("No such version")
+
+type Version struct {
+	ID      string
+	Created time.Time
+	Current bool
+}
+
+type Output struct {
+	bucket *blob.Bucket
+}
+
+// Open opens the bucket holding the rendered blogs. See
+// https://gocloud.dev/howto/blob/ for supported URLs.
+func Open(ctx context.Context, url string) (*Output, error) {
+	bucket, err := blob.OpenBucket(ctx, url)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while opening bucket")
+	}
+
+	return &Output{bucket}, nil
+}
+
+func (o *Output) Close() error {
+	return o.bucket.Close()
+}
+
+func blogPrefix(username, slug string) string {
+	return path.Join(username, slug)
+}
+
+func versionsPrefix(username, slug string) string {
+	return path.Join(blogPrefix(username, slug), versionsDirectory)
+}
+
+func versionPrefix(username, slug, version string) string {
+	return path.Join(versionsPrefix(username, slug), version)
+}
+
+func newVersionID() string {
+	return time.Now().UTC().Format(versionIDLayout)
+}
+
+func validVersionID(version string) bool {
+	_, err := time.Parse(versionIDLayout, version)
+	return err == nil
+}
+
+// CurrentVersion returns the version of the blog that is being served, or an
+// empty string if the blog was never published.
+func (o *Output) CurrentVersion(ctx context.Context, username, slug string) (string, error) {
+	data, err := o.bucket.ReadAll(ctx, path.Join(blogPrefix(username, slug), currentKey))
+
+	if gcerrors.Code(err) == gcerrors.NotFound {
+		return "", nil
+	}
+
+	if err != nil {
+		return "", errors.Wrap(err, "Error while reading current version")
+	}
+
+	return strings.TrimSpace(string(data)), nil
+}
+
+func (o *Output) setCurrentVersion(ctx context.Context, username, slug, version string) error {
+	return errors.Wrap(o.writePointer(ctx, username, slug, currentKey, version), "Error while writing current version")
+}
+
+func (o *Output) writePointer(ctx context.Context, username, slug, key, version string) error {
+	options := blob.WriterOptions{
+		ContentType: "text/plain",
+	}
+
+	return o.bucket.WriteAll(ctx, path.Join(blogPrefix(username, slug), key), []byte(version), &options)
+}
+
+func (o *Output) deletePointer(ctx context.Context, username, slug, key string) error {
+	if err := o.bucket.Delete(ctx, path.Join(blogPrefix(username, slug), key)); err != nil && gcerrors.Code(err) != gcerrors.NotFound {
+		return err
+	}
+
+	return nil
+}
+
+// Unpublish stops serving a blog, until Republish is called. It does nothing
+// if the blog is not published.
+func (o *Output) Unpublish(ctx context.Context, username, slug string) error {
+	version, err := o.CurrentVersion(ctx, username, slug)
+
+	if err != nil || version == "" {
+		return err
+	}
+
+	if err := o.writePointer(ctx, username, slug, unpublishedKey, version); err != nil {
+		return errors.Wrap(err, "Error while writing unpublished version")
+	}
+
+	if err := o.deletePointer(ctx, username, slug, currentKey); err != nil {
+		return errors.Wrap(err, "Error while deleting current version")
+	}
+
+	log.Printf("Unpublished version %s of blog %s/%s", version, username, slug)
+
+	return nil
+}
+
+// Republish serves again the version of a blog that was current when it got
+// unpublished, unless a newer version was published since. It does nothing if
+// the blog is not unpublished.
+func (o *Output) Republish(ctx context.Context, username, slug string) error {
+	data, err := o.bucket.ReadAll(ctx, path.Join(blogPrefix(username, slug), unpublishedKey))
+
+	if gcerrors.Code(err) == gcerrors.NotFound {
+		return nil
+	}
+
+	if err != nil {
+		return errors.Wrap(err, "Error while reading unpublished version")
+	}
+
+	current, err := o.CurrentVersion(ctx, username, slug)
+
+	if err != nil {
+		return err
+	}
+
+	if current == "" {
+		version := strings.TrimSpace(string(data))
+
+		if err := o.setCurrentVersion(ctx, username, slug, version); err != nil {
+			return err
+		}
+
+		log.Printf("Republished version %s of blog %s/%s", version, username, slug)
+	}
+
+	return errors.Wrap(o.deletePointer(ctx, username, slug, unpublishedKey), "Error while deleting unpublished version")
+}
+
+// Publish uploads the files in sourceDir as a new version of the blog, and
+// makes it the current version. Files that did not change since the current
+// version are copied within the bucket instead of being uploaded again.
+func (o *Output) Publish(ctx context.Context, username, slug, sourceDir string) (string, error) {
+	previousVersion, err := o.CurrentVersion(ctx, username, slug)
+
+	if err != nil {
+		return "", err
+	}
+
+	previousManifest := manifest{}
+	previousPrefix := versionPrefix(username, slug, previousVersion)
+
+	if previousVersion != "" {
+		if previousManifest, err = loadManifest(ctx, o.bucket, previousPrefix); err != nil {
+			return "", errors.Wrap(err, "Error while loading previous manifest")
+		}
+	}
+
+	newManifest, err := buildManifest(sourceDir)
+
+	if err != nil {
+		return "", errors.Wrap(err, "Error while building manifest")
+	}
+
+	version := newVersionID()
+	prefix := versionPrefix(username, slug, version)
+	uploaded := 0
+
+	for key, hash := range newManifest {
+		if previousManifest[key] == hash {
+			if err := o.bucket.Copy(ctx, path.Join(prefix, key), path.Join(previousPrefix, key), nil); err != nil {
+				return "", errors.Wrapf(err, "Error while copying %s from version %s", key, previousVersion)
+			}
+
+			continue
+		}
+
+		if err := uploadFile(ctx, o.bucket, path.Join(prefix, key), path.Join(sourceDir, key)); err != nil {
+			return "", errors.Wrapf(err, "Error while uploading %s", key)
+		}
+
+		uploaded++
+	}
+
+	// The manifest is written last, its presence marks the version as complete
+	if err := newManifest.save(ctx, o.bucket, prefix); err != nil {
+		return "", err
+	}
+
+	if err := o.setCurrentVersion(ctx, username, slug, version); err != nil {
+		return "", err
+	}
+
+	log.Printf("Published version %s of blog %s/%s (uploaded %d files, %d unchanged)", version, username, slug, uploaded, len(newManifest)-uploaded)
+
+	// The new version is online at this point, failing to clean up old ones is
+	// not worth failing the publication for.
+	if err := o.prune(ctx, username, slug, version); err != nil {
+		log.Printf("Error while pruning old versions of blog %s/%s: %s", username, slug, err)
+	}
+
+	return version, nil
+}
+
+// listVersionIDs returns the IDs of all the versions of a blog, complete or
+// not, newest first.
+func (o *Output) listVersionIDs(ctx context.Context, username, slug string) ([]string, error) {
+	prefix := versionsPrefix(username, slug) + "/"
+	iter := o.bucket.List(&blob.ListOptions{Prefix: prefix, Delimiter: "/"})
+
+	var versions []string
+
+	for {
+		obj, err := iter.Next(ctx)
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return nil, errors.Wrap(err, "Error while listing versions")
+		}
+
+		if !obj.IsDir {
+			continue
+		}
+
+		version := strings.TrimSuffix(obj.Key[len(prefix):], "/")
+
+		if validVersionID(version) {
+			versions = append(versions, version)
+		}
+	}
+
+	sort.Sort(sort.Reverse(sort.StringSlice(versions)))
+
+	return versions, nil
+}
+
+func (o *Output) isComplete(ctx context.Context, username, slug, version string) (bool, error) {
+	exists, err := o.bucket.Exists(ctx, path.Join(versionPrefix(username, slug, version), manifestKey))
+
+	return exists, errors.Wrapf(err, "Error while checking manifest of version %s", version)
+}
+
+// ListVersions returns the complete versions of a blog, newest first
+func (o *Output) ListVersions(ctx context.Context, username, slug string) ([]Version, error) {
+	current, err := o.CurrentVersion(ctx, username, slug)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ids, err := o.listVersionIDs(ctx, username, slug)
+
+	if err != nil {
+		return nil, err
+	}
+
+	versions := []Version{}
+
+	for _, id := range ids {
+		complete, err := o.isComplete(ctx, username, slug, id)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if !complete {
+			continue
+		}
+
+		created, _ := time.Parse(versionIDLayout, id)
+
+		versions = append(versions, Version{
+			ID:      id,
+			Created: created,
+			Current: id == current,
+		})
+	}
+
+	return versions, nil
+}
+
+// Rollback makes a previously published version the current one
+func (o *Output) Rollback(ctx context.Context, username, slug, version string) error {
+	if !validVersionID(version) {
+		return ErrUnknownVersion
+	}
+
+	complete, err := o.isComplete(ctx, username, slug, version)
+
+	if err != nil {
+		return err
+	}
+
+	if !complete {
+		return ErrUnknownVersion
+	}
+
+	if err := o.setCurrentVersion(ctx, username, slug, version); err != nil {
+		return err
+	}
+
+	log.Printf("Rolled back blog %s/%s to version %s", username, slug, version)
+
+	return nil
+}
+
+// prune deletes the versions older than the last KeepVersions complete ones,
+// as well as the files left over from before blogs were versioned. The current
+// version and the unpublished pointer are never deleted.
+func (o *Output) prune(ctx context.Context, username, slug, current string) error {
+	ids, err := o.listVersionIDs(ctx, username, slug)
+
+	if err != nil {
+		return err
+	}
+
+	// Incomplete versions that are newer than the oldest kept version might
+	// still be uploading, leave them alone.
+	keep := map[string]bool{current: true}
+	complete := 0
+
+	for _, id := range ids {
+		if complete >= KeepVersions {
+			break
+		}
+
+		keep[id] = true
+
+		isComplete, err := o.isComplete(ctx, username, slug, id)
+
+		if err != nil {
+			return err
+		}
+
+		if isComplete {
+			complete++
+		}
+	}
+
+	prefix := blogPrefix(username, slug) + "/"
+	iter := o.bucket.List(&blob.ListOptions{Prefix: prefix})
+
+	var staleKeys []string
+
+	for {
+		obj, err := iter.Next(ctx)
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return errors.Wrap(err, "Error while listing files")
+		}
+
+		key := obj.Key[len(prefix):]
+
+		if strings.HasPrefix(key, versionsDirectory+"/") {
+			version := strings.SplitN(key[len(versionsDirectory)+1:], "/", 2)[0]
+
+			if keep[version] {
+				continue
+			}
+		} else if key == currentKey || key == unpublishedKey {
+			continue
+		}
+
+		staleKeys = append(staleKeys, obj.Key)
+	}
+
+	for _, key := range staleKeys {
+		if err := o.bucket.Delete(ctx, key); err != nil {
+			return errors.Wrapf(err, "Error while deleting %s", key)
+		}
+	}
+
+	if len(staleKeys) > 0 {
+		log.Printf("Deleted %d stale files of blog %s/%s", len(staleKeys), username, slug)
+	}
+
+	return nil
+}
+
+// DeleteBlog deletes all the rendered versions of a blog
+func (o *Output) DeleteBlog(ctx context.Context, username, slug string) error {
+	count, err := o.deletePrefix(ctx, blogPrefix(username, slug)+"/")
+
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Deleted %d files of blog %s/%s", count, username, slug)
+
+	return nil
+}
+
+// DeleteUser deletes the rendered blogs and the build logs of a user
+func (o *Output) DeleteUser(ctx context.Context, username string) error {
+	count, err := o.deletePrefix(ctx, username+"/")
+
+	if err != nil {
+		return err
+	}
+
+	logCount, err := o.deletePrefix(ctx, path.Join(buildLogsDirectory, username)+"/")
+
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Deleted %d files and %d build logs of user %s", count, logCount, username)
+
+	return nil
+}
+
+// deletePrefix deletes all the files under a prefix, and returns how many it
+// deleted
+func (o *Output) deletePrefix(ctx context.Context, prefix string) (int, error) {
+	iter := o.bucket.List(&blob.ListOptions{Prefix: prefix})
+
+	var keys []string
+
+	for {
+		obj, err := iter.Next(ctx)
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return 0, errors.Wrap(err, "Error while listing files")
+		}
+
+		keys = append(keys, obj.Key)
+	}
+
+	for _, key := range keys {
+		if err := o.bucket.Delete(ctx, key); err != nil && gcerrors.Code(err) != gcerrors.NotFound {
+			return 0, errors.Wrapf(err, "Error while deleting %s", key)
+		}
+	}
+
+	return len(keys), nil
+}
+
+func uploadFile(ctx context.Context, bucket *blob.Bucket, key, srcPath string) (err error) {
+	srcFd, err := os.OpenFile(srcPath, os.O_RDONLY, 0)
+
+	if err != nil {
+		return errors.Wrap(err, "Error while opening source file")
+	}
+
+	defer srcFd.Close()
+
+	options := blob.WriterOptions{
+		ContentType: mime.TypeByExtension(path.Ext(srcPath)),
+	}
+
+	writer, err := bucket.NewWriter(ctx, key, &options)
+
+	if err != nil {
+		return errors.Wrap(err, "Error while creating writer")
+	}
+
+	if _, err = io.Copy(writer, srcFd); err != nil {
+		return errors.Wrap(err, "Error while copying file data")
+	}
+
+	if err = errors.Wrap(writer.Close(), "Error while finalizing upload"); err != nil {
+		return errors.Wrap(err, "Error while finalizing upload")
+	}
+
+	return nil
+}
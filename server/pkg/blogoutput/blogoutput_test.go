@@ -0,0 +1,246 @@
+package blogoutput_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/abustany/moblog-cloud/pkg/blogoutput"
+	"github.com/abustany/moblog-cloud/pkg/testutils"
+)
+
+func publish(t *testing.T, output *blogoutput.Output, files map[string]string) string {
+	sourceDir := testutils.TempDir(t, "blog-output")
+	defer os.RemoveAll(sourceDir)
+
+	for name, content := range files {
+		filePath := path.Join(sourceDir, name)
+
+		if err := os.MkdirAll(path.Dir(filePath), 0700); err != nil {
+			t.Fatalf("Error while creating directory for %s: %s", name, err)
+		}
+
+		if err := ioutil.WriteFile(filePath, []byte(content), 0600); err != nil {
+			t.Fatalf("Error while writing %s: %s", name, err)
+		}
+	}
+
+	version, err := output.Publish(context.Background(), "user", "blog", sourceDir)
+
+	if err != nil {
+		t.Fatalf("Error while publishing: %s", err)
+	}
+
+	return version
+}
+
+func checkGet(t *testing.T, serverURL, urlPath string, expectedStatus int, expectedBody string) {
+	res, err := http.Get(serverURL + urlPath)
+
+	if err != nil {
+		t.Fatalf("Error while getting %s: %s", urlPath, err)
+	}
+
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+
+	if err != nil {
+		t.Fatalf("Error while reading response for %s: %s", urlPath, err)
+	}
+
+	if res.StatusCode != expectedStatus {
+		t.Errorf("Unexpected status for %s: expected %d, got %d", urlPath, expectedStatus, res.StatusCode)
+		return
+	}
+
+	if expectedStatus == http.StatusOK && string(body) != expectedBody {
+		t.Errorf("Unexpected body for %s: expected %q, got %q", urlPath, expectedBody, string(body))
+	}
+}
+
+func TestPublishRollback(t *testing.T) {
+	output := testutils.NewBlogOutput(t)
+	defer output.Close()
+
+	server := httptest.NewServer(blogoutput.NewHandler(output))
+	defer server.Close()
+
+	checkGet(t, server.URL, "/user/blog/", http.StatusNotFound, "")
+
+	firstVersion := publish(t, output, map[string]string{
+		"index.html":            "first index",
+		"post/first/index.html": "first post",
+	})
+
+	checkGet(t, server.URL, "/user/blog/", http.StatusOK, "first index")
+	checkGet(t, server.URL, "/user/blog/post/first/", http.StatusOK, "first post")
+	checkGet(t, server.URL, "/user/blog/../../user/blog/index.html", http.StatusOK, "first index")
+	checkGet(t, server.URL, "/user/blog/.manifest.json", http.StatusNotFound, "")
+
+	secondVersion := publish(t, output, map[string]string{
+		"index.html":             "first index",
+		"post/second/index.html": "second post",
+	})
+
+	checkGet(t, server.URL, "/user/blog/", http.StatusOK, "first index")
+	checkGet(t, server.URL, "/user/blog/post/first/", http.StatusNotFound, "")
+	checkGet(t, server.URL, "/user/blog/post/second/", http.StatusOK, "second post")
+
+	versions, err := output.ListVersions(context.Background(), "user", "blog")
+
+	if err != nil {
+		t.Fatalf("Error while listing versions: %s", err)
+	}
+
+	if len(versions) != 2 || versions[0].ID != secondVersion || !versions[0].Current || versions[1].ID != firstVersion {
+		t.Fatalf("Unexpected versions: %+v", versions)
+	}
+
+	if err := output.Rollback(context.Background(), "user", "blog", "../../other"); err != blogoutput.ErrUnknownVersion {
+		t.Errorf("Expected ErrUnknownVersion when rolling back to an invalid version, got %v", err)
+	}
+
+	if err := output.Rollback(context.Background(), "user", "blog", firstVersion); err != nil {
+		t.Fatalf("Error while rolling back: %s", err)
+	}
+
+	checkGet(t, server.URL, "/user/blog/post/first/", http.StatusOK, "first post")
+	checkGet(t, server.URL, "/user/blog/post/second/", http.StatusNotFound, "")
+}
+
+func TestPruneVersions(t *testing.T) {
+	output := testutils.NewBlogOutput(t)
+	defer output.Close()
+
+	oldKeepVersions := blogoutput.KeepVersions
+	blogoutput.KeepVersions = 2
+	defer func() { blogoutput.KeepVersions = oldKeepVersions }()
+
+	firstVersion := publish(t, output, map[string]string{"index.html": "1"})
+	publish(t, output, map[string]string{"index.html": "2"})
+	lastVersion := publish(t, output, map[string]string{"index.html": "3"})
+
+	versions, err := output.ListVersions(context.Background(), "user", "blog")
+
+	if err != nil {
+		t.Fatalf("Error while listing versions: %s", err)
+	}
+
+	if len(versions) != 2 || versions[0].ID != lastVersion {
+		t.Fatalf("Unexpected versions after pruning: %+v", versions)
+	}
+
+	if err := output.Rollback(context.Background(), "user", "blog", firstVersion); err != blogoutput.ErrUnknownVersion {
+		t.Errorf("Expected ErrUnknownVersion when rolling back to a pruned version, got %v", err)
+	}
+}
+
+func TestUnpublish(t *testing.T) {
+	output := testutils.NewBlogOutput(t)
+	defer output.Close()
+
+	server := httptest.NewServer(blogoutput.NewHandler(output))
+	defer server.Close()
+
+	ctx := context.Background()
+
+	if err := output.Unpublish(ctx, "user", "blog"); err != nil {
+		t.Errorf("Error while unpublishing a blog that was never published: %s", err)
+	}
+
+	if err := output.Republish(ctx, "user", "blog"); err != nil {
+		t.Errorf("Error while republishing a blog that was never unpublished: %s", err)
+	}
+
+	publish(t, output, map[string]string{"index.html": "first"})
+
+	if err := output.Unpublish(ctx, "user", "blog"); err != nil {
+		t.Fatalf("Error while unpublishing: %s", err)
+	}
+
+	checkGet(t, server.URL, "/user/blog/", http.StatusNotFound, "")
+
+	if versions, err := output.ListVersions(ctx, "user", "blog"); err != nil || len(versions) != 1 || versions[0].Current {
+		t.Errorf("Expected the version to be kept but not current, got %+v, %v", versions, err)
+	}
+
+	if err := output.Republish(ctx, "user", "blog"); err != nil {
+		t.Fatalf("Error while republishing: %s", err)
+	}
+
+	checkGet(t, server.URL, "/user/blog/", http.StatusOK, "first")
+
+	// A version published in the meantime is not replaced
+	if err := output.Unpublish(ctx, "user", "blog"); err != nil {
+		t.Fatalf("Error while unpublishing: %s", err)
+	}
+
+	publish(t, output, map[string]string{"index.html": "second"})
+
+	if err := output.Republish(ctx, "user", "blog"); err != nil {
+		t.Fatalf("Error while republishing: %s", err)
+	}
+
+	checkGet(t, server.URL, "/user/blog/", http.StatusOK, "second")
+}
+
+func TestBuildLogs(t *testing.T) {
+	output := testutils.NewBlogOutput(t)
+	defer output.Close()
+
+	if data, err := output.BuildLog(context.Background(), "user", "build"); err != nil || data != nil {
+		t.Errorf("Expected no log and no error for an unknown build, got %q, %v", data, err)
+	}
+
+	if err := output.SaveBuildLog(context.Background(), "user", "build", []byte("all good")); err != nil {
+		t.Fatalf("Error while saving build log: %s", err)
+	}
+
+	if data, err := output.BuildLog(context.Background(), "user", "build"); err != nil {
+		t.Errorf("Error while reading build log: %s", err)
+	} else if string(data) != "all good" {
+		t.Errorf("Unexpected build log: %q", data)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	output := testutils.NewBlogOutput(t)
+	defer output.Close()
+
+	server := httptest.NewServer(blogoutput.NewHandler(output))
+	defer server.Close()
+
+	publish(t, output, map[string]string{"index.html": "index"})
+	checkGet(t, server.URL, "/user/blog/", http.StatusOK, "index")
+
+	if err := output.DeleteBlog(context.Background(), "user", "blog"); err != nil {
+		t.Fatalf("Error while deleting blog: %s", err)
+	}
+
+	checkGet(t, server.URL, "/user/blog/", http.StatusNotFound, "")
+
+	if versions, err := output.ListVersions(context.Background(), "user", "blog"); err != nil || len(versions) != 0 {
+		t.Errorf("Expected no versions after deleting the blog, got %+v, %v", versions, err)
+	}
+
+	publish(t, output, map[string]string{"index.html": "index"})
+
+	if err := output.SaveBuildLog(context.Background(), "user", "build", []byte("all good")); err != nil {
+		t.Fatalf("Error while saving build log: %s", err)
+	}
+
+	if err := output.DeleteUser(context.Background(), "user"); err != nil {
+		t.Fatalf("Error while deleting user: %s", err)
+	}
+
+	checkGet(t, server.URL, "/user/blog/", http.StatusNotFound, "")
+
+	if data, err := output.BuildLog(context.Background(), "user", "build"); err != nil || data != nil {
+		t.Errorf("Expected no build log after deleting the user, got %q, %v", data, err)
+	}
+}
@@ -0,0 +1,45 @@
+package blogoutput
+
+import (
+	"context"
+	"path"
+
+	"github.com/pkg/errors"
+
+	"gocloud.dev/blob"
+	"gocloud.dev/gcerrors"
+)
+
+// Build logs are stored outside of the blog prefixes, so that they are not
+// served nor deleted when pruning versions. The leading underscore guarantees
+// that the directory cannot clash with a username.
+const buildLogsDirectory = "_buildlogs"
+
+func buildLogKey(username, buildID string) string {
+	return path.Join(buildLogsDirectory, username, buildID+".log")
+}
+
+func (o *Output) SaveBuildLog(ctx context.Context, username, buildID string, data []byte) error {
+	options := blob.WriterOptions{
+		ContentType: "text/plain; charset=utf-8",
+	}
+
+	err := o.bucket.WriteAll(ctx, buildLogKey(username, buildID), data, &options)
+
+	return errors.Wrap(err, "Error while writing build log")
+}
+
+// BuildLog returns the log of a build, or nil if there is none
+func (o *Output) BuildLog(ctx context.Context, username, buildID string) ([]byte, error) {
+	data, err := o.bucket.ReadAll(ctx, buildLogKey(username, buildID))
+
+	if gcerrors.Code(err) == gcerrors.NotFound {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while reading build log")
+	}
+
+	return data, nil
+}
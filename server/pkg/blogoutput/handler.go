@@ -0,0 +1,100 @@
+package blogoutput
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"gocloud.dev/gcerrors"
+)
+
+type handler struct {
+	output *Output
+}
+
+// NewHandler returns a HTTP handler serving the current version of each blog
+// under /username/slug/.
+func NewHandler(output *Output) http.Handler {
+	return &handler{output}
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	cleanPath := path.Clean("/" + r.URL.Path)
+	isDirectory := strings.HasSuffix(r.URL.Path, "/")
+	parts := strings.SplitN(cleanPath[1:], "/", 3)
+
+	if len(parts) < 2 {
+		http.NotFound(w, r)
+		return
+	}
+
+	username, slug := parts[0], parts[1]
+
+	if len(parts) == 2 && !isDirectory {
+		http.Redirect(w, r, "/"+username+"/"+slug+"/", http.StatusFound)
+		return
+	}
+
+	var key string
+
+	if len(parts) == 3 {
+		key = parts[2]
+	}
+
+	if isDirectory {
+		key = path.Join(key, "index.html")
+	}
+
+	if key == manifestKey {
+		http.NotFound(w, r)
+		return
+	}
+
+	ctx := r.Context()
+	version, err := h.output.CurrentVersion(ctx, username, slug)
+
+	if err != nil {
+		log.Printf("Error while getting current version of blog %s/%s: %s", username, slug, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if version == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	reader, err := h.output.bucket.NewReader(ctx, path.Join(versionPrefix(username, slug, version), key), nil)
+
+	if gcerrors.Code(err) == gcerrors.NotFound {
+		http.NotFound(w, r)
+		return
+	}
+
+	if err != nil {
+		log.Printf("Error while opening %s of blog %s/%s: %s", key, username, slug, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	defer reader.Close()
+
+	w.Header().Set("Content-Type", reader.ContentType())
+	w.Header().Set("Content-Length", strconv.FormatInt(reader.Size(), 10))
+
+	if r.Method == "HEAD" {
+		return
+	}
+
+	if _, err := io.Copy(w, reader); err != nil {
+		log.Printf("Error while sending %s of blog %s/%s: %s", key, username, slug, err)
+	}
+}
@@ -0,0 +1,118 @@
+package blogoutput
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+
+	"gocloud.dev/blob"
+	"gocloud.dev/gcerrors"
+)
+
+// Name of the object listing the content hashes of the files of a rendered
+// blog, stored alongside those files.
+const manifestKey = ".manifest.json"
+
+// manifest maps the keys of the files of a rendered blog, relative to the blog
+// prefix, to the SHA-256 of their content.
+type manifest map[string]string
+
+func loadManifest(ctx context.Context, bucket *blob.Bucket, prefix string) (manifest, error) {
+	data, err := bucket.ReadAll(ctx, path.Join(prefix, manifestKey))
+
+	if gcerrors.Code(err) == gcerrors.NotFound {
+		return manifest{}, nil
+	}
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while reading manifest")
+	}
+
+	m := manifest{}
+
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, errors.Wrap(err, "Error while decoding manifest")
+	}
+
+	return m, nil
+}
+
+func (m manifest) save(ctx context.Context, bucket *blob.Bucket, prefix string) error {
+	data, err := json.Marshal(m)
+
+	if err != nil {
+		return errors.Wrap(err, "Error while encoding manifest")
+	}
+
+	options := blob.WriterOptions{
+		ContentType: "application/json",
+	}
+
+	return errors.Wrap(bucket.WriteAll(ctx, path.Join(prefix, manifestKey), data, &options), "Error while writing manifest")
+}
+
+// buildManifest hashes all the files under sourceDir
+func buildManifest(sourceDir string) (manifest, error) {
+	m := manifest{}
+
+	hashFunc := func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			return nil
+		}
+
+		if !info.Mode().IsRegular() {
+			return errors.Errorf("Don't know how to copy %s: unknown file type", p)
+		}
+
+		relPath, err := filepath.Rel(sourceDir, p)
+
+		if err != nil {
+			return errors.Wrapf(err, "Error while computing relative path of %s", p)
+		}
+
+		hash, err := hashFile(p)
+
+		if err != nil {
+			return errors.Wrapf(err, "Error while hashing %s", p)
+		}
+
+		m[filepath.ToSlash(relPath)] = hash
+
+		return nil
+	}
+
+	if err := filepath.Walk(sourceDir, hashFunc); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func hashFile(p string) (string, error) {
+	fd, err := os.Open(p)
+
+	if err != nil {
+		return "", err
+	}
+
+	defer fd.Close()
+
+	hash := sha256.New()
+
+	if _, err := io.Copy(hash, fd); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
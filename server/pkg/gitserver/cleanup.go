@@ -0,0 +1,147 @@
+package gitserver
+
+import (
+	"log"
+	"os"
+	"path"
+	"regexp"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/abustany/moblog-cloud/pkg/audit"
+	"github.com/abustany/moblog-cloud/pkg/jobs"
+	"github.com/abustany/moblog-cloud/pkg/workqueue"
+)
+
+var CleanupPickTimeout = time.Second
+
+var validIDRE = regexp.MustCompile("^" + validIDStringRE + "$")
+
+// Cleaner deletes the repositories of deleted blogs, by consuming the cleanup
+// jobs of a queue, and records the cleanups in the audit log. The workers
+// delete the rendered files.
+//
+// The workers also post their scheduled renders to this queue, since only the
+// gitservers can sign the grants of render jobs. The Cleaner posts them to the
+// queue of the workers through the server when they become due.
+type Cleaner struct {
+	baseDir     string
+	queue       workqueue.Queue
+	auditLog    audit.Log
+	server      *Server
+	stopChannel chan struct{}
+	doneChannel chan struct{}
+}
+
+func NewCleaner(baseDir string, queue workqueue.Queue, auditLog audit.Log, server *Server) *Cleaner {
+	c := &Cleaner{
+		baseDir:     baseDir,
+		queue:       queue,
+		auditLog:    auditLog,
+		server:      server,
+		stopChannel: make(chan struct{}),
+		doneChannel: make(chan struct{}),
+	}
+
+	go c.consumeJobs()
+
+	return c
+}
+
+func (c *Cleaner) Stop() {
+	close(c.stopChannel)
+	<-c.doneChannel
+}
+
+func (c *Cleaner) consumeJobs() {
+	defer close(c.doneChannel)
+
+	for {
+		select {
+		case <-c.stopChannel:
+			return
+		default:
+		}
+
+		if err := c.consumeOneJob(); err != nil {
+			log.Printf("Error while consuming repository job: %s", err)
+		}
+	}
+}
+
+func (c *Cleaner) consumeOneJob() error {
+	entry, err := c.queue.Pick(CleanupPickTimeout)
+
+	if err != nil {
+		return errors.Wrap(err, "Error while picking job")
+	}
+
+	if entry == nil {
+		return nil
+	}
+
+	if err := c.handleJob(entry); err != nil {
+		log.Printf("Repository job %s failed: %s", entry.ID, err)
+
+		if err := c.queue.Fail(entry, err); err != nil {
+			log.Printf("Error while failing repository job %s: %s", entry.ID, err)
+		}
+
+		return nil
+	}
+
+	if err := c.queue.Finish(entry); err != nil {
+		log.Printf("Error while finishing repository job %s: %s", entry.ID, err)
+	}
+
+	return nil
+}
+
+func (c *Cleaner) handleJob(entry *workqueue.JobEntry) error {
+	// The blog came back, or got deleted, while the job was being picked
+	if cancelled, err := c.queue.Cancelled(entry); err != nil {
+		return errors.Wrap(err, "Error while checking if job is cancelled")
+	} else if cancelled {
+		log.Printf("Job %s cancelled", entry.ID)
+		return nil
+	}
+
+	switch job := entry.Data.(type) {
+	case jobs.CleanupJob:
+		return c.cleanup(&job)
+	case jobs.ScheduledRenderJob:
+		log.Printf("Posting scheduled render of %s/%s", job.Username, job.Repository)
+		return c.server.postRenderJob(job.Username, job.Repository)
+	default:
+		return errors.Errorf("Unknown job type: %+v", entry.Data)
+	}
+}
+
+func (c *Cleaner) cleanup(job *jobs.CleanupJob) error {
+	// Don't let a bogus job delete the whole base directory
+	if !validIDRE.MatchString(job.Username) || (job.Repository != "" && !validIDRE.MatchString(job.Repository)) {
+		return errors.Errorf("Invalid cleanup target: %s", job.Target())
+	}
+
+	dir := path.Join(c.baseDir, job.Username, job.Repository)
+
+	if err := os.RemoveAll(dir); err != nil {
+		return errors.Wrap(err, "Error while deleting repository")
+	}
+
+	event := audit.Event{
+		Type:       audit.RepositoriesPurged,
+		Username:   job.Username,
+		Repository: job.Repository,
+	}
+
+	// Failing the job records the cleanup again when it is retried
+	if err := c.auditLog.Record(event); err != nil {
+		return errors.Wrap(err, "Error while recording cleanup in the audit log")
+	}
+
+	log.Printf("Purged repositories of %s, deleted at %s", job.Target(), job.Deleted.Format(time.RFC3339))
+
+	return nil
+}
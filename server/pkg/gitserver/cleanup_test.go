@@ -0,0 +1,84 @@
+package gitserver_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/abustany/moblog-cloud/pkg/audit"
+	"github.com/abustany/moblog-cloud/pkg/gitserver"
+	"github.com/abustany/moblog-cloud/pkg/jobs"
+	"github.com/abustany/moblog-cloud/pkg/testutils"
+)
+
+func TestCleaner(t *testing.T) {
+	baseDir := testutils.TempDir(t, "gitserver-cleanup")
+	defer os.RemoveAll(baseDir)
+
+	for _, repository := range []string{"blog", "other"} {
+		repoPath := path.Join(baseDir, "user", repository)
+
+		if err := os.MkdirAll(repoPath, 0700); err != nil {
+			t.Fatalf("Error while creating repository directory: %s", err)
+		}
+
+		if err := ioutil.WriteFile(path.Join(repoPath, "HEAD"), []byte("ref: refs/heads/master"), 0600); err != nil {
+			t.Fatalf("Error while writing repository file: %s", err)
+		}
+	}
+
+	queue := testutils.NewMemoryQueue(t)
+	defer queue.Stop()
+
+	auditLog := testutils.NewMemoryAuditLog(t)
+
+	// Only cleanup jobs are posted, which don't need a server
+	cleaner := gitserver.NewCleaner(baseDir, queue, auditLog, nil)
+	defer cleaner.Stop()
+
+	// Invalid targets must not delete anything
+	for _, job := range []jobs.CleanupJob{{Username: ""}, {Username: "user", Repository: ".."}} {
+		if err := queue.Post(job, time.Minute); err != nil {
+			t.Fatalf("Error while posting cleanup job: %s", err)
+		}
+	}
+
+	if err := queue.Post(jobs.CleanupJob{Username: "user", Repository: "blog", Deleted: time.Now()}, time.Minute); err != nil {
+		t.Fatalf("Error while posting cleanup job: %s", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	// The cleanup is recorded once the repository is deleted
+	for {
+		events, err := auditLog.Events(10)
+
+		if err != nil {
+			t.Fatalf("Error while listing audit events: %s", err)
+		}
+
+		if len(events) > 0 {
+			if len(events) != 1 || events[0].Type != audit.RepositoriesPurged || events[0].Username != "user" || events[0].Repository != "blog" {
+				t.Errorf("Unexpected audit events: %+v", events)
+			}
+
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("Cleanup was not recorded in the audit log")
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if _, err := os.Stat(path.Join(baseDir, "user", "blog")); !os.IsNotExist(err) {
+		t.Errorf("Repository was not deleted: %v", err)
+	}
+
+	if _, err := os.Stat(path.Join(baseDir, "user", "other", "HEAD")); err != nil {
+		t.Errorf("Other repository of the user was deleted: %s", err)
+	}
+}
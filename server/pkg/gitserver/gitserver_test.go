@@ -10,11 +10,13 @@ import (
 	"path"
 	"strings"
 	"testing"
+	"time"
 
 	"golang.org/x/net/publicsuffix"
 
 	"github.com/abustany/moblog-cloud/pkg/adminserver"
 	"github.com/abustany/moblog-cloud/pkg/gitserver"
+	"github.com/abustany/moblog-cloud/pkg/grants"
 	"github.com/abustany/moblog-cloud/pkg/jobs"
 	"github.com/abustany/moblog-cloud/pkg/testutils"
 	"github.com/abustany/moblog-cloud/pkg/userstore"
@@ -44,19 +46,20 @@ func makeJarWithCookie(t *testing.T, serverURL string, cookie http.Cookie) http.
 }
 
 type Context struct {
-	gitServerURL   string
-	httpClient     *http.Client
-	adminClient    *adminserver.Client
-	username       string
-	workDir        string
-	authCookieFile string
-	jobQueue       workqueue.Queue
+	gitServerURL    string
+	httpClient      *http.Client
+	adminClient     *adminserver.Client
+	username        string
+	workDir         string
+	authCookieFile  string
+	jobQueue        workqueue.Queue
+	repositoryQueue workqueue.Queue
 }
 
 func TestGitService(t *testing.T) {
 	testutils.FlushDB(t)
 
-	adminServer := httptest.NewServer(testutils.NewAdminServer(t))
+	adminServer := httptest.NewServer(testutils.NewAdminServer(t, testutils.NewBlogOutput(t)))
 	defer adminServer.Close()
 
 	repositoriesDir := testutils.TempDir(t, "gitserver-repositories")
@@ -70,7 +73,7 @@ func TestGitService(t *testing.T) {
 
 	defer jobQueue.Stop()
 
-	gitServerHandler, err := gitserver.New("/", repositoriesDir, adminServer.URL, jobQueue)
+	gitServerHandler, err := gitserver.New("/", repositoriesDir, adminServer.URL, testutils.GrantSigner(t), jobQueue)
 
 	if err != nil {
 		t.Fatalf("Error while creating git server: %s", err)
@@ -79,6 +82,12 @@ func TestGitService(t *testing.T) {
 	gitServer := httptest.NewServer(gitServerHandler)
 	defer gitServer.Close()
 
+	repositoryQueue := testutils.NewMemoryQueue(t)
+	defer repositoryQueue.Stop()
+
+	cleaner := gitserver.NewCleaner(repositoriesDir, repositoryQueue, testutils.NewMemoryAuditLog(t), gitServerHandler)
+	defer cleaner.Stop()
+
 	adminClient, err := adminserver.NewClient(adminServer.URL)
 
 	if err != nil {
@@ -119,13 +128,14 @@ func TestGitService(t *testing.T) {
 	withContext := func(f func(*testing.T, Context)) func(*testing.T) {
 		return func(t *testing.T) {
 			ctx := Context{
-				gitServerURL:   gitServer.URL,
-				httpClient:     httpClient,
-				adminClient:    adminClient,
-				username:       user.Username,
-				workDir:        workDir,
-				authCookieFile: authCookieFile,
-				jobQueue:       jobQueue,
+				gitServerURL:    gitServer.URL,
+				httpClient:      httpClient,
+				adminClient:     adminClient,
+				username:        user.Username,
+				workDir:         workDir,
+				authCookieFile:  authCookieFile,
+				jobQueue:        jobQueue,
+				repositoryQueue: repositoryQueue,
 			}
 
 			f(t, ctx)
@@ -135,6 +145,9 @@ func TestGitService(t *testing.T) {
 	t.Run("Authentication", withContext(testAuthentication))
 	t.Run("Clone", withContext(testClone))
 	t.Run("Push", withContext(testPush))
+	t.Run("Scheduled renders", withContext(testScheduledRender))
+	t.Run("Access tokens", withContext(testAccessTokens))
+	t.Run("Grants", withContext(testGrants))
 }
 
 func testAuthentication(t *testing.T, ctx Context) {
@@ -203,6 +216,15 @@ func testPush(t *testing.T, ctx Context) {
 		t.Errorf("Unexpected remote HEAD, got %s, expected %s", remoteHead, localHead)
 	}
 
+	// A second push before the first one gets rendered should not trigger a
+	// second render
+	if err := ioutil.WriteFile(path.Join(blogPath, "README"), []byte("Changed by myself again"), 0600); err != nil {
+		t.Fatalf("Error while writing README: %s", err)
+	}
+
+	testutils.Git(t, "-C", blogPath, "-c", "user.name=Tester", "-c", "user.email=tester@qa.org", "commit", "-am", "Change the README again")
+	testutils.Git(t, "-C", blogPath, "-c", "http.cookieFile="+ctx.authCookieFile, "push", "origin", "master")
+
 	job, err := ctx.jobQueue.Pick(0)
 
 	if err != nil {
@@ -222,6 +244,154 @@ func testPush(t *testing.T, ctx Context) {
 			if data.Repository != "my-blog" {
 				t.Errorf("Unexpected job repository name, got %s, expected my-blog", data.Repository)
 			}
+
+			if grant, err := testutils.GrantSigner(t).Verify(data.Grant); err != nil {
+				t.Errorf("Error while verifying job grant: %s", err)
+			} else if grant.Username != ctx.username || grant.Repository != "my-blog" {
+				t.Errorf("Unexpected job grant: %+v", grant)
+			}
+
+			builds, err := ctx.adminClient.ListBuilds("my-blog", 0)
+
+			if err != nil {
+				t.Errorf("Error while listing builds: %s", err)
+			} else if len(builds) != 2 || builds[0].ID != data.BuildID || builds[1].Status != userstore.BuildSuperseded {
+				t.Errorf("Expected the build of the first push to be superseded, got %+v", builds)
+			}
+		}
+
+		if err := ctx.jobQueue.Finish(job); err != nil {
+			t.Errorf("Error while finishing job: %s", err)
 		}
 	}
+
+	if job, err := ctx.jobQueue.Pick(0); err != nil {
+		t.Errorf("Error while picking from job queue: %s", err)
+	} else if job != nil {
+		t.Errorf("Pushes were not coalesced into a single job")
+	}
+}
+
+func testScheduledRender(t *testing.T, ctx Context) {
+	scheduledJob := jobs.ScheduledRenderJob{Username: ctx.username, Repository: "my-blog"}
+
+	if err := ctx.repositoryQueue.PostAt(jobs.RenderJobKey(ctx.username, "my-blog"), scheduledJob, time.Minute, time.Now()); err != nil {
+		t.Fatalf("Error while posting scheduled render job: %s", err)
+	}
+
+	// The scheduled render is posted as a render job with a fresh grant
+	job, err := ctx.jobQueue.Pick(10 * time.Second)
+
+	if err != nil {
+		t.Fatalf("Error while picking from job queue: %s", err)
+	}
+
+	if job == nil {
+		t.Fatalf("Scheduled render did not trigger a job")
+	}
+
+	defer func() {
+		if err := ctx.jobQueue.Finish(job); err != nil {
+			t.Errorf("Error while finishing job: %s", err)
+		}
+	}()
+
+	data, ok := job.Data.(jobs.RenderJob)
+
+	if !ok {
+		t.Fatalf("Job data is not a RenderJob: %+v", job.Data)
+	}
+
+	if grant, err := testutils.GrantSigner(t).Verify(data.Grant); err != nil {
+		t.Errorf("Error while verifying job grant: %s", err)
+	} else if grant.Username != ctx.username || grant.Repository != "my-blog" {
+		t.Errorf("Unexpected job grant: %+v", grant)
+	}
+
+	builds, err := ctx.adminClient.ListBuilds("my-blog", 0)
+
+	if err != nil {
+		t.Errorf("Error while listing builds: %s", err)
+	} else if len(builds) == 0 || builds[0].ID != data.BuildID || data.BuildID == "" {
+		t.Errorf("Expected a build for the scheduled render, got %+v", builds)
+	}
+}
+
+func testAccessTokens(t *testing.T, ctx Context) {
+	readToken, err := ctx.adminClient.CreateToken("read", []string{userstore.TokenScopeRepoRead})
+
+	if err != nil {
+		t.Fatalf("Error while creating read token: %s", err)
+	}
+
+	writeToken, err := ctx.adminClient.CreateToken("write", []string{userstore.TokenScopeRepoRead, userstore.TokenScopeRepoWrite})
+
+	if err != nil {
+		t.Fatalf("Error while creating write token: %s", err)
+	}
+
+	blogURL := func(secret string) string {
+		parsedURL, err := url.Parse(ctx.gitServerURL + "/" + ctx.username + "/my-blog")
+
+		if err != nil {
+			t.Fatalf("Error while parsing blog URL: %s", err)
+		}
+
+		parsedURL.User = url.UserPassword(ctx.username, secret)
+
+		return parsedURL.String()
+	}
+
+	if _, err := testutils.GitErr(t, "ls-remote", blogURL("not a token")); err == nil {
+		t.Errorf("Expected an error when using an invalid token")
+	}
+
+	blogPath := path.Join(ctx.workDir, "my-blog-token")
+	testutils.Git(t, "clone", blogURL(readToken.Secret), blogPath)
+
+	if err := ioutil.WriteFile(path.Join(blogPath, "README"), []byte("Changed with a token"), 0600); err != nil {
+		t.Fatalf("Error while writing README: %s", err)
+	}
+
+	testutils.Git(t, "-C", blogPath, "-c", "user.name=Tester", "-c", "user.email=tester@qa.org", "commit", "-am", "Change the README again")
+
+	if _, err := testutils.GitErr(t, "-C", blogPath, "push", blogURL(readToken.Secret), "master"); err == nil {
+		t.Errorf("Expected an error when pushing with a read only token")
+	}
+
+	testutils.Git(t, "-C", blogPath, "push", blogURL(writeToken.Secret), "master")
+}
+
+func testGrants(t *testing.T, ctx Context) {
+	blogURL := ctx.gitServerURL + "/" + ctx.username + "/my-blog"
+	grantHeader := func(repository string, validity time.Duration) string {
+		grant, err := testutils.GrantSigner(t).Sign(ctx.username, repository, validity)
+
+		if err != nil {
+			t.Fatalf("Error while signing grant: %s", err)
+		}
+
+		return "http.extraHeader=Authorization: " + grants.AuthorizationHeader(grant)
+	}
+
+	if _, err := testutils.GitErr(t, "-c", grantHeader("another-blog", time.Hour), "ls-remote", blogURL); err == nil {
+		t.Errorf("Expected an error when using a grant for another repository")
+	}
+
+	if _, err := testutils.GitErr(t, "-c", grantHeader("my-blog", -time.Second), "ls-remote", blogURL); err == nil {
+		t.Errorf("Expected an error when using an expired grant")
+	}
+
+	blogPath := path.Join(ctx.workDir, "my-blog-grant")
+	testutils.Git(t, "-c", grantHeader("my-blog", time.Hour), "clone", blogURL, blogPath)
+
+	if err := ioutil.WriteFile(path.Join(blogPath, "README"), []byte("Changed with a grant"), 0600); err != nil {
+		t.Fatalf("Error while writing README: %s", err)
+	}
+
+	testutils.Git(t, "-C", blogPath, "-c", "user.name=Tester", "-c", "user.email=tester@qa.org", "commit", "-am", "Change the README with a grant")
+
+	if _, err := testutils.GitErr(t, "-C", blogPath, "-c", grantHeader("my-blog", time.Hour), "push", "origin", "master"); err == nil {
+		t.Errorf("Expected an error when pushing with a grant")
+	}
 }
@@ -19,8 +19,11 @@ import (
 	"github.com/pkg/errors"
 
 	"github.com/abustany/moblog-cloud/pkg/adminserver"
+	"github.com/abustany/moblog-cloud/pkg/grants"
 	"github.com/abustany/moblog-cloud/pkg/jobs"
 	"github.com/abustany/moblog-cloud/pkg/middlewares"
+	"github.com/abustany/moblog-cloud/pkg/rpcclient"
+	"github.com/abustany/moblog-cloud/pkg/userstore"
 	"github.com/abustany/moblog-cloud/pkg/workqueue"
 )
 
@@ -34,13 +37,36 @@ type Server struct {
 	baseDir        string
 	router         *mux.Router
 	adminServerURL *url.URL
+	grantSigner    *grants.Signer
 	jobQueue       workqueue.Queue
 }
 
+// Validity of the grants given to render jobs. This should be enough for the
+// job to wait in the queue, including its retries, and to run for as long as
+// the -maxJobDuration of the workers.
+var RenderGrantValidity = 3 * time.Hour
+
+const renderJobTTR = 10 * time.Minute
+
 type userSession struct {
-	authCookie *http.Cookie
 	username   string
 	blogs      []string
+	restricted bool
+	scopes     []string
+}
+
+func (s *userSession) hasScope(scope string) bool {
+	if !s.restricted {
+		return true
+	}
+
+	for _, sc := range s.scopes {
+		if sc == scope {
+			return true
+		}
+	}
+
+	return false
 }
 
 type contextKey int
@@ -49,15 +75,27 @@ const (
 	sessionKey contextKey = iota
 )
 
-func userSessionFromRequest(r *http.Request, adminServerURL *url.URL) (*userSession, error) {
-	authCookie, err := r.Cookie(adminserver.AuthCookieName)
+// sessionFromGrant creates a session from a grant passed by a service. Grants
+// are checked locally, without asking the admin server.
+func sessionFromGrant(grantSigner *grants.Signer, encodedGrant string) *userSession {
+	grant, err := grantSigner.Verify(encodedGrant)
 
-	if err == http.ErrNoCookie {
-		return nil, nil
+	if err != nil {
+		log.Printf("Error while verifying grant: %s", err)
+		return nil
 	}
 
-	if err != nil {
-		return nil, errors.Wrap(err, "Error while decoding auth cookie")
+	return &userSession{
+		username:   grant.Username,
+		blogs:      []string{grant.Repository},
+		restricted: true,
+		scopes:     []string{userstore.TokenScopeRepoRead},
+	}
+}
+
+func userSessionFromRequest(r *http.Request, adminServerURL *url.URL, grantSigner *grants.Signer) (*userSession, error) {
+	if encodedGrant, ok := grants.FromRequest(r); ok {
+		return sessionFromGrant(grantSigner, encodedGrant), nil
 	}
 
 	adminClient, err := adminserver.NewClient(adminServerURL.String())
@@ -66,29 +104,64 @@ func userSessionFromRequest(r *http.Request, adminServerURL *url.URL) (*userSess
 		return nil, errors.Wrap(err, "Error while creating admin server client")
 	}
 
-	if err := adminClient.SetAuthCookie(authCookie); err != nil {
-		return nil, errors.Wrap(err, "Error while setting auth cookie")
+	session := &userSession{}
+	usesToken := false
+
+	if username, secret, ok := r.BasicAuth(); ok {
+		adminClient.SetBasicAuth(username, secret)
+		usesToken = true
+	} else {
+		authCookie, err := r.Cookie(adminserver.AuthCookieName)
+
+		if err == http.ErrNoCookie {
+			return nil, nil
+		}
+
+		if err != nil {
+			return nil, errors.Wrap(err, "Error while decoding auth cookie")
+		}
+
+		if err := adminClient.SetAuthCookie(authCookie); err != nil {
+			return nil, errors.Wrap(err, "Error while setting auth cookie")
+		}
 	}
 
 	me, err := adminClient.Whoami()
 
+	if errors.Cause(err) == rpcclient.ErrUnauthorized {
+		return nil, nil
+	}
+
 	if err != nil {
 		return nil, errors.Wrap(err, "Error while retrieving user information")
 	}
 
+	session.username = me.Username
+
+	if usesToken {
+		scopes, err := adminClient.SessionScopes()
+
+		if err != nil {
+			return nil, errors.Wrap(err, "Error while retrieving access token scopes")
+		}
+
+		session.restricted = scopes.Restricted
+		session.scopes = scopes.Scopes
+	}
+
 	blogs, err := adminClient.ListBlogs()
 
 	if err != nil {
 		return nil, errors.Wrap(err, "Error while retrieving blog list")
 	}
 
-	blogNames := make([]string, len(blogs))
+	session.blogs = make([]string, len(blogs))
 
 	for i, blog := range blogs {
-		blogNames[i] = blog.Slug
+		session.blogs[i] = blog.Slug
 	}
 
-	return &userSession{authCookie, me.Username, blogNames}, nil
+	return session, nil
 }
 
 func sessionFromContext(ctx context.Context) *userSession {
@@ -99,7 +172,7 @@ func sessionFromContext(ctx context.Context) *userSession {
 	return nil
 }
 
-func New(basePath, baseDir, adminServerURL string, jobQueue workqueue.Queue) (*Server, error) {
+func New(basePath, baseDir, adminServerURL string, grantSigner *grants.Signer, jobQueue workqueue.Queue) (*Server, error) {
 	adminServerURLParsed, err := url.Parse(adminServerURL)
 
 	if err != nil {
@@ -110,6 +183,7 @@ func New(basePath, baseDir, adminServerURL string, jobQueue workqueue.Queue) (*S
 		baseDir:        baseDir,
 		router:         mux.NewRouter(),
 		adminServerURL: adminServerURLParsed,
+		grantSigner:    grantSigner,
 		jobQueue:       jobQueue,
 	}
 
@@ -197,7 +271,7 @@ func blogExists(blogs []string, blog string) bool {
 func (s *Server) withValidRepository(handler http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		username, repository := getRequestUsernameRepository(r)
-		session, err := userSessionFromRequest(r, s.adminServerURL)
+		session, err := userSessionFromRequest(r, s.adminServerURL, s.grantSigner)
 
 		if err != nil {
 			log.Printf("Error while handling session: %s", err)
@@ -206,10 +280,17 @@ func (s *Server) withValidRepository(handler http.Handler) http.Handler {
 		}
 
 		if session == nil || session.username != username {
+			// Let git clients know that they can retry with an access token
+			w.Header().Set("WWW-Authenticate", `Basic realm="moblog"`)
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
 
+		if !session.hasScope(requiredScope(r)) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
 		if !blogExists(session.blogs, repository) {
 			w.WriteHeader(http.StatusNotFound)
 			return
@@ -228,6 +309,15 @@ func (s *Server) withValidRepository(handler http.Handler) http.Handler {
 	})
 }
 
+// requiredScope returns the access token scope needed to serve a request
+func requiredScope(r *http.Request) string {
+	if path.Base(r.URL.Path) == "git-receive-pack" || r.URL.Query().Get("service") == "git-receive-pack" {
+		return userstore.TokenScopeRepoWrite
+	}
+
+	return userstore.TokenScopeRepoRead
+}
+
 func removeGitRepositorySuffix(repository string) string {
 	const gitSuffix = ".git"
 
@@ -363,24 +453,80 @@ func (s *Server) serveGitServiceHTTP(w http.ResponseWriter, r *http.Request, ser
 	}
 
 	if isPush {
-		const renderJobTTR = 10 * time.Minute
-
 		session := sessionFromContext(r.Context())
 
 		if session == nil {
 			panic("No session on push request")
 		}
 
-		renderJob := jobs.RenderJob{
-			Username:   session.username,
-			AuthCookie: *session.authCookie,
-			Repository: repository,
+		if err := s.postRenderJob(session.username, repository); err != nil {
+			log.Printf("Error while triggering render of %s/%s: %s", username, repository, err)
+		}
+	}
+}
+
+// postRenderJob creates a build for a blog, and posts a job rendering it along
+// with a grant for its repository
+func (s *Server) postRenderJob(username, repository string) error {
+	grant, err := s.grantSigner.Sign(username, repository, RenderGrantValidity)
+
+	if err != nil {
+		return errors.Wrap(err, "Error while creating grant for render job")
+	}
+
+	renderJob := jobs.RenderJob{
+		Username:   username,
+		Repository: repository,
+		Grant:      grant,
+	}
+
+	// Failing to record the build should not prevent the blog from being
+	// rendered.
+	adminClient, err := s.adminClientWithGrant(grant)
+
+	if err != nil {
+		log.Printf("Error while creating admin client for render job of %s/%s: %s", username, repository, err)
+	} else if build, err := adminClient.CreateBuild(repository); err != nil {
+		log.Printf("Error while creating build for %s/%s: %s", username, repository, err)
+	} else {
+		renderJob.BuildID = build.ID
+	}
+
+	// Renders always use the latest commit of the repository, so a single
+	// pending render per blog is enough.
+	replaced, err := s.jobQueue.PostUnique(jobs.RenderJobKey(username, repository), renderJob, renderJobTTR)
+
+	if err != nil {
+		if renderJob.BuildID != "" {
+			if err := adminClient.FinishBuild(renderJob.BuildID, "", "Error while queuing render job"); err != nil {
+				log.Printf("Error while marking build %s as failed: %s", renderJob.BuildID, err)
+			}
 		}
 
-		if err := s.jobQueue.Post(renderJob, renderJobTTR); err != nil {
-			log.Printf("Error while posting render job for %s/%s: %s", username, repository, err)
+		return errors.Wrap(err, "Error while posting render job")
+	}
+
+	if replacedJob, ok := replaced.(jobs.RenderJob); ok && replacedJob.BuildID != "" && adminClient != nil {
+		log.Printf("Render job of build %s for %s/%s superseded by build %s", replacedJob.BuildID, username, repository, renderJob.BuildID)
+
+		if err := adminClient.SupersedeBuild(replacedJob.BuildID); err != nil {
+			log.Printf("Error while marking build %s as superseded: %s", replacedJob.BuildID, err)
 		}
 	}
+
+	return nil
+}
+
+func (s *Server) adminClientWithGrant(grant string) (*adminserver.Client, error) {
+	adminClient, err := adminserver.NewClient(s.adminServerURL.String())
+
+	if err != nil {
+		return nil, err
+	}
+
+	adminClient.SetGrant(grant)
+
+	return adminClient, nil
 }
 
 func (s *Server) serveUploadPackHTTP(w http.ResponseWriter, r *http.Request) {
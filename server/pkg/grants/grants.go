@@ -0,0 +1,106 @@
+// Package grants implements the credentials that services use to talk to each
+// other on behalf of a user. A grant gives read-only access to a single
+// repository for a short amount of time, and is signed with a key shared by the
+// services.
+package grants
+
+import (
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/pkg/errors"
+)
+
+const KeyLength = 64 // bytes
+
+const encodingName = "grant"
+const authorizationPrefix = "Bearer "
+
+type Grant struct {
+	Username   string
+	Repository string
+	Expires    time.Time
+}
+
+var ErrInvalid = errors.New("Invalid grant")
+var ErrExpired = errors.New("Grant has expired")
+
+// ParseKey decodes a hex encoded grant key, as passed on the command line of
+// the services that share it
+func ParseKey(encoded string) ([]byte, error) {
+	key, err := hex.DecodeString(strings.TrimSpace(encoded))
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while decoding grant key")
+	}
+
+	if len(key) != KeyLength {
+		return nil, errors.Errorf("Invalid key length: expected %d bytes, got %d", KeyLength, len(key))
+	}
+
+	return key, nil
+}
+
+type Signer struct {
+	sc *securecookie.SecureCookie
+}
+
+func NewSigner(key []byte) (*Signer, error) {
+	if len(key) != KeyLength {
+		return nil, errors.Errorf("Invalid key length: expected %d bytes, got %d", KeyLength, len(key))
+	}
+
+	// Grants carry their own expiration time, so disable the one of
+	// securecookie.
+	sc := securecookie.New(key, nil).MaxAge(0)
+
+	return &Signer{sc}, nil
+}
+
+// Sign returns a grant for the given repository, valid for the given duration
+func (s *Signer) Sign(username, repository string, validity time.Duration) (string, error) {
+	grant := Grant{
+		Username:   username,
+		Repository: repository,
+		Expires:    time.Now().Add(validity),
+	}
+
+	encoded, err := s.sc.Encode(encodingName, &grant)
+
+	return encoded, errors.Wrap(err, "Error while encoding grant")
+}
+
+func (s *Signer) Verify(encoded string) (*Grant, error) {
+	var grant Grant
+
+	if err := s.sc.Decode(encodingName, encoded, &grant); err != nil {
+		return nil, ErrInvalid
+	}
+
+	if time.Now().After(grant.Expires) {
+		return nil, ErrExpired
+	}
+
+	return &grant, nil
+}
+
+// AuthorizationHeader returns the value of the HTTP Authorization header used
+// to pass an encoded grant.
+func AuthorizationHeader(encoded string) string {
+	return authorizationPrefix + encoded
+}
+
+// FromRequest returns the encoded grant passed in the Authorization header of
+// a request, if any.
+func FromRequest(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+
+	if !strings.HasPrefix(header, authorizationPrefix) {
+		return "", false
+	}
+
+	return header[len(authorizationPrefix):], true
+}
@@ -0,0 +1,100 @@
+package grants_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/securecookie"
+
+	"github.com/abustany/moblog-cloud/pkg/grants"
+)
+
+func newSigner(t *testing.T) *grants.Signer {
+	signer, err := grants.NewSigner(securecookie.GenerateRandomKey(grants.KeyLength))
+
+	if err != nil {
+		t.Fatalf("Error while creating signer: %s", err)
+	}
+
+	return signer
+}
+
+func TestSignVerify(t *testing.T) {
+	signer := newSigner(t)
+
+	encoded, err := signer.Sign("user", "blog", time.Hour)
+
+	if err != nil {
+		t.Fatalf("Error while signing grant: %s", err)
+	}
+
+	grant, err := signer.Verify(encoded)
+
+	if err != nil {
+		t.Fatalf("Error while verifying grant: %s", err)
+	}
+
+	if grant.Username != "user" || grant.Repository != "blog" {
+		t.Errorf("Unexpected grant: %+v", grant)
+	}
+
+	if _, err := newSigner(t).Verify(encoded); err != grants.ErrInvalid {
+		t.Errorf("Expected ErrInvalid when verifying with another key, got %v", err)
+	}
+
+	if _, err := signer.Verify(encoded + "x"); err != grants.ErrInvalid {
+		t.Errorf("Expected ErrInvalid when verifying a tampered grant, got %v", err)
+	}
+}
+
+func TestExpiration(t *testing.T) {
+	signer := newSigner(t)
+
+	encoded, err := signer.Sign("user", "blog", -time.Second)
+
+	if err != nil {
+		t.Fatalf("Error while signing grant: %s", err)
+	}
+
+	if _, err := signer.Verify(encoded); err != grants.ErrExpired {
+		t.Errorf("Expected ErrExpired, got %v", err)
+	}
+}
+
+func TestFromRequest(t *testing.T) {
+	r, err := http.NewRequest("GET", "http://localhost", nil)
+
+	if err != nil {
+		t.Fatalf("Error while creating request: %s", err)
+	}
+
+	if _, ok := grants.FromRequest(r); ok {
+		t.Errorf("FromRequest found a grant in a request without one")
+	}
+
+	r.Header.Set("Authorization", grants.AuthorizationHeader("hello"))
+
+	if encoded, ok := grants.FromRequest(r); !ok || encoded != "hello" {
+		t.Errorf("Unexpected FromRequest result: %s, %v", encoded, ok)
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	key := securecookie.GenerateRandomKey(grants.KeyLength)
+	encoded := hex.EncodeToString(key)
+
+	if parsed, err := grants.ParseKey(encoded + "\n"); err != nil || !bytes.Equal(parsed, key) {
+		t.Errorf("Error while parsing key: %v", err)
+	}
+
+	if _, err := grants.ParseKey(encoded[2:]); err == nil {
+		t.Errorf("Parsing a short key should fail")
+	}
+
+	if _, err := grants.ParseKey("not hex"); err == nil {
+		t.Errorf("Parsing an invalid key should fail")
+	}
+}
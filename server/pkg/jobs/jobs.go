@@ -2,16 +2,64 @@ package jobs
 
 import (
 	"encoding/gob"
-	"net/http"
+	"time"
 )
 
 func init() {
+	Register("render", 1, RenderJob{})
+	Register("scheduled-render", 1, ScheduledRenderJob{})
+	Register("cleanup", 1, CleanupJob{})
+
+	// Jobs used to be encoded with gob, the work queues still decode those
+	// that are in the queue during an upgrade
 	gob.Register(RenderJob{})
+	gob.Register(ScheduledRenderJob{})
 }
 
-// RenderJob describes a job to render a blog into HTML pages
+// RenderJob describes a job to render a blog into HTML pages. Its grant is
+// signed by the gitserver posting the job, workers don't hold the grant key.
 type RenderJob struct {
-	Username   string // for debugging purposes
-	AuthCookie http.Cookie
-	Repository string
+	Username   string `json:"username"`
+	Repository string `json:"repository"`
+	Grant      string `json:"grant"`             // gives read access to the repository, see package grants
+	BuildID    string `json:"buildId,omitempty"` // build to report progress to, empty if none
+}
+
+// RenderJobKey returns the key used to coalesce the render jobs of a blog in
+// the work queue
+func RenderJobKey(username, repository string) string {
+	return username + "/" + repository
+}
+
+// ScheduledRenderJob is posted by the workers to the queue of the gitservers,
+// for the publication date of a post dated in the future. When it becomes due,
+// a gitserver signs a new grant and posts a render job, like for a push.
+type ScheduledRenderJob struct {
+	Username   string `json:"username"`
+	Repository string `json:"repository"`
+}
+
+// CleanupJob purges the data of a purged blog. It is posted both to the
+// workers, which delete the rendered files, and to the gitservers, which
+// delete the repository. An empty repository purges all the blogs of a purged
+// user.
+type CleanupJob struct {
+	Username   string    `json:"username"`
+	Repository string    `json:"repository,omitempty"`
+	Deleted    time.Time `json:"deleted"` // when the blog or user was deleted
+}
+
+// CleanupJobKey returns the key used to coalesce the cleanup jobs of a blog in
+// the work queues
+func CleanupJobKey(username, repository string) string {
+	return "cleanup/" + username + "/" + repository
+}
+
+// Target returns a description of what a cleanup job purges, for logging
+func (j *CleanupJob) Target() string {
+	if j.Repository == "" {
+		return "user " + j.Username
+	}
+
+	return "blog " + j.Username + "/" + j.Repository
 }
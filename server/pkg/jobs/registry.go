@@ -0,0 +1,113 @@
+package jobs
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Envelope is the serialized form of a job, as stored in the work queues. The
+// payload is the JSON encoding of the job, its schema is identified by the
+// type name and version.
+type Envelope struct {
+	Type    string          `json:"type"`
+	Version int             `json:"version"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+type registeredType struct {
+	name    string
+	version int
+	goType  reflect.Type
+}
+
+var registry = struct {
+	sync.RWMutex
+	byName map[string]registeredType
+	byType map[reflect.Type]registeredType
+}{
+	byName: map[string]registeredType{},
+	byType: map[reflect.Type]registeredType{},
+}
+
+// Register associates a type name and the current version of its schema to
+// the type of job. Like gob.Register, it panics if the name or the type is
+// already registered.
+//
+// The version should be increased when the meaning of existing fields
+// changes. Adding fields doesn't require a new version, since decoding
+// ignores unknown fields and leaves missing ones to their zero value.
+func Register(name string, version int, job interface{}) {
+	goType := reflect.TypeOf(job)
+
+	registry.Lock()
+	defer registry.Unlock()
+
+	if _, exists := registry.byName[name]; exists {
+		panic(fmt.Sprintf("Job type name %s registered twice", name))
+	}
+
+	if _, exists := registry.byType[goType]; exists {
+		panic(fmt.Sprintf("Job type %s registered twice", goType))
+	}
+
+	t := registeredType{name: name, version: version, goType: goType}
+	registry.byName[name] = t
+	registry.byType[goType] = t
+}
+
+// Marshal serializes a job of a registered type into an envelope
+func Marshal(job interface{}) ([]byte, error) {
+	registry.RLock()
+	t, exists := registry.byType[reflect.TypeOf(job)]
+	registry.RUnlock()
+
+	if !exists {
+		return nil, errors.Errorf("Unregistered job type: %T", job)
+	}
+
+	payload, err := json.Marshal(job)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while encoding job")
+	}
+
+	data, err := json.Marshal(&Envelope{Type: t.name, Version: t.version, Payload: payload})
+
+	return data, errors.Wrap(err, "Error while encoding job envelope")
+}
+
+// Unmarshal decodes an envelope created by Marshal, and returns the job it
+// contains. Payloads of older versions are decoded into the registered type.
+// Payloads of newer versions, posted by a more recent release, are refused
+// since their fields may not mean what this release expects.
+func Unmarshal(data []byte) (interface{}, error) {
+	var envelope Envelope
+
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return nil, errors.Wrap(err, "Error while decoding job envelope")
+	}
+
+	registry.RLock()
+	t, exists := registry.byName[envelope.Type]
+	registry.RUnlock()
+
+	if !exists {
+		return nil, errors.Errorf("Unknown job type: %s", envelope.Type)
+	}
+
+	if envelope.Version > t.version {
+		return nil, errors.Errorf("Unsupported version %d of %s job, this release supports up to version %d", envelope.Version, envelope.Type, t.version)
+	}
+
+	job := reflect.New(t.goType)
+
+	if err := json.Unmarshal(envelope.Payload, job.Interface()); err != nil {
+		return nil, errors.Wrapf(err, "Error while decoding %s job (version %d)", envelope.Type, envelope.Version)
+	}
+
+	return job.Elem().Interface(), nil
+}
@@ -0,0 +1,62 @@
+package jobs_test
+
+import (
+	"testing"
+
+	"github.com/abustany/moblog-cloud/pkg/jobs"
+)
+
+func TestMarshalUnmarshal(t *testing.T) {
+	job := jobs.RenderJob{Username: "user", Repository: "blog", Grant: "grant", BuildID: "build"}
+
+	data, err := jobs.Marshal(job)
+
+	if err != nil {
+		t.Fatalf("Error while marshaling job: %s", err)
+	}
+
+	decoded, err := jobs.Unmarshal(data)
+
+	if err != nil {
+		t.Fatalf("Error while unmarshaling job: %s", err)
+	}
+
+	if decoded != job {
+		t.Errorf("Unexpected decoded job, expected %+v, got %+v", job, decoded)
+	}
+}
+
+func TestUnmarshalUnknownFields(t *testing.T) {
+	// As posted by a newer release with an additional field
+	data := `{"type": "scheduled-render", "version": 1, "payload": {"username": "user", "repository": "blog", "priority": 3}}`
+
+	decoded, err := jobs.Unmarshal([]byte(data))
+
+	if err != nil {
+		t.Fatalf("Error while unmarshaling job: %s", err)
+	}
+
+	expected := jobs.ScheduledRenderJob{Username: "user", Repository: "blog"}
+
+	if decoded != expected {
+		t.Errorf("Unexpected decoded job, expected %+v, got %+v", expected, decoded)
+	}
+}
+
+func TestUnmarshalFutureVersion(t *testing.T) {
+	data := `{"type": "scheduled-render", "version": 2, "payload": {"username": "user", "repository": "blog"}}`
+
+	if _, err := jobs.Unmarshal([]byte(data)); err == nil {
+		t.Errorf("Unmarshaling a job of a newer version should fail")
+	}
+}
+
+func TestUnregisteredTypes(t *testing.T) {
+	if _, err := jobs.Marshal(struct{}{}); err == nil {
+		t.Errorf("Marshaling an unregistered type should fail")
+	}
+
+	if _, err := jobs.Unmarshal([]byte(`{"type": "unknown", "version": 1, "payload": {}}`)); err == nil {
+		t.Errorf("Unmarshaling an unknown type should fail")
+	}
+}
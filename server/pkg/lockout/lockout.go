@@ -0,0 +1,48 @@
+// Package lockout counts failed login attempts, and locks out the usernames or
+// addresses that fail too often, for an exponentially increasing time.
+package lockout
+
+import (
+	"time"
+)
+
+type Limiter interface {
+	// Check returns how long a key is still locked out, or 0 if it isn't
+	Check(key string) (time.Duration, error)
+	// Fail records a failed attempt for a key, and returns the lockout it
+	// triggered, or 0 if the key can still try again right away
+	Fail(key string, policy Policy) (time.Duration, error)
+	// Reset forgets the failed attempts of a key
+	Reset(key string) error
+}
+
+type Policy struct {
+	// FreeAttempts is the number of failures allowed before locking out
+	FreeAttempts int
+	// BaseLockout is how long the first failure after the free attempts locks
+	// out. Each further failure doubles it, up to MaxLockout.
+	BaseLockout time.Duration
+	MaxLockout  time.Duration
+	// Memory is how long failures are remembered after the last one. It should
+	// be longer than MaxLockout.
+	Memory time.Duration
+}
+
+// Lockout returns how long the given number of failures locks out
+func (p Policy) Lockout(failures int) time.Duration {
+	if failures <= p.FreeAttempts {
+		return 0
+	}
+
+	lockout := p.BaseLockout
+
+	for i := p.FreeAttempts + 1; i < failures && lockout < p.MaxLockout; i++ {
+		lockout *= 2
+	}
+
+	if lockout > p.MaxLockout {
+		lockout = p.MaxLockout
+	}
+
+	return lockout
+}
@@ -0,0 +1,88 @@
+package lockout_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/abustany/moblog-cloud/pkg/lockout"
+)
+
+var testPolicy = lockout.Policy{
+	FreeAttempts: 2,
+	BaseLockout:  100 * time.Millisecond,
+	MaxLockout:   400 * time.Millisecond,
+	Memory:       time.Second,
+}
+
+func TestPolicy(t *testing.T) {
+	expected := []time.Duration{0, 0, 0, 100, 200, 400, 400}
+
+	for failures, lockout := range expected {
+		if actual := testPolicy.Lockout(failures); actual != lockout*time.Millisecond {
+			t.Errorf("Expected %d failures to lock out for %dms, got %s", failures, lockout, actual)
+		}
+	}
+}
+
+func testLimiter(t *testing.T, l lockout.Limiter) {
+	check := func(key string, locked bool) {
+		remaining, err := l.Check(key)
+
+		if err != nil {
+			t.Fatalf("Error while checking %s: %s", key, err)
+		}
+
+		if (remaining > 0) != locked {
+			t.Errorf("Expected %s to be locked out: %t, remaining lockout is %s", key, locked, remaining)
+		}
+	}
+
+	fail := func(key string, expected time.Duration) {
+		lockout, err := l.Fail(key, testPolicy)
+
+		if err != nil {
+			t.Fatalf("Error while recording failure for %s: %s", key, err)
+		}
+
+		if lockout != expected {
+			t.Errorf("Expected failure to lock %s out for %s, got %s", key, expected, lockout)
+		}
+	}
+
+	fail("alice", 0)
+	fail("alice", 0)
+	check("alice", false)
+
+	fail("alice", 100*time.Millisecond)
+	check("alice", true)
+	check("bob", false)
+
+	fail("alice", 200*time.Millisecond)
+
+	if err := l.Reset("alice"); err != nil {
+		t.Fatalf("Error while resetting: %s", err)
+	}
+
+	check("alice", false)
+	fail("alice", 0)
+
+	fail("bob", 0)
+	fail("bob", 0)
+	fail("bob", 100*time.Millisecond)
+
+	time.Sleep(150 * time.Millisecond)
+	check("bob", false)
+
+	// Failures are remembered even once the lockout is over
+	fail("bob", 200*time.Millisecond)
+}
+
+func TestMemoryLimiter(t *testing.T) {
+	l, err := lockout.NewMemoryLimiter()
+
+	if err != nil {
+		t.Fatalf("Error while creating limiter: %s", err)
+	}
+
+	testLimiter(t, l)
+}
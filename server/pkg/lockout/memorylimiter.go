@@ -0,0 +1,103 @@
+package lockout
+
+import (
+	"sync"
+	"time"
+)
+
+type memoryEntry struct {
+	failures    int
+	lastFailure time.Time
+	memory      time.Duration
+	lockedUntil time.Time
+}
+
+func (e *memoryEntry) forgotten(now time.Time) bool {
+	return now.Sub(e.lastFailure) > e.memory
+}
+
+// MemoryLimiter keeps its state in memory, so it cannot be shared by several
+// servers
+type MemoryLimiter struct {
+	sync.Mutex
+
+	entries   map[string]*memoryEntry
+	lastPrune time.Time
+}
+
+// How often the forgotten entries are removed from memory
+const pruneInterval = time.Minute
+
+func NewMemoryLimiter() (*MemoryLimiter, error) {
+	return &MemoryLimiter{
+		entries:   map[string]*memoryEntry{},
+		lastPrune: time.Now(),
+	}, nil
+}
+
+func (l *MemoryLimiter) Check(key string) (time.Duration, error) {
+	l.Lock()
+	defer l.Unlock()
+
+	entry, exists := l.entries[key]
+
+	if !exists {
+		return 0, nil
+	}
+
+	if remaining := time.Until(entry.lockedUntil); remaining > 0 {
+		return remaining, nil
+	}
+
+	return 0, nil
+}
+
+func (l *MemoryLimiter) Fail(key string, policy Policy) (time.Duration, error) {
+	l.Lock()
+	defer l.Unlock()
+
+	now := time.Now()
+
+	if now.Sub(l.lastPrune) > pruneInterval {
+		l.prune(now)
+	}
+
+	entry, exists := l.entries[key]
+
+	if !exists || entry.forgotten(now) {
+		entry = &memoryEntry{}
+		l.entries[key] = entry
+	}
+
+	entry.failures++
+	entry.lastFailure = now
+	entry.memory = policy.Memory
+
+	lockout := policy.Lockout(entry.failures)
+
+	if lockout > 0 {
+		entry.lockedUntil = now.Add(lockout)
+	}
+
+	return lockout, nil
+}
+
+func (l *MemoryLimiter) Reset(key string) error {
+	l.Lock()
+	defer l.Unlock()
+
+	delete(l.entries, key)
+
+	return nil
+}
+
+// prune removes the forgotten entries. The limiter must be locked.
+func (l *MemoryLimiter) prune(now time.Time) {
+	for key, entry := range l.entries {
+		if entry.forgotten(now) {
+			delete(l.entries, key)
+		}
+	}
+
+	l.lastPrune = now
+}
@@ -0,0 +1,85 @@
+package lockout
+
+import (
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/pkg/errors"
+)
+
+const redisKeyPrefixLockouts = "lockout-"
+
+const (
+	redisFieldFailures    = "failures"
+	redisFieldLockedUntil = "until" // Unix time in milliseconds
+)
+
+// RedisLimiter keeps its state in Redis, so that several servers can share
+// it. Each key is a hash that expires when its failures are forgotten.
+type RedisLimiter struct {
+	client *redis.Client
+}
+
+func NewRedisLimiter(redisURL string) (*RedisLimiter, error) {
+	options, err := redis.ParseURL(redisURL)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while parsing redis URL")
+	}
+
+	return &RedisLimiter{redis.NewClient(options)}, nil
+}
+
+func unixMilliseconds(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func (l *RedisLimiter) Check(key string) (time.Duration, error) {
+	lockedUntil, err := l.client.HGet(redisKeyPrefixLockouts+key, redisFieldLockedUntil).Int64()
+
+	if err == redis.Nil {
+		return 0, nil
+	}
+
+	if err != nil {
+		return 0, errors.Wrap(err, "Error while retrieving lockout from Redis")
+	}
+
+	if remaining := time.Duration(lockedUntil-unixMilliseconds(time.Now())) * time.Millisecond; remaining > 0 {
+		return remaining, nil
+	}
+
+	return 0, nil
+}
+
+func (l *RedisLimiter) Fail(key string, policy Policy) (time.Duration, error) {
+	redisKey := redisKeyPrefixLockouts + key
+
+	var failures *redis.IntCmd
+
+	_, err := l.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		failures = pipe.HIncrBy(redisKey, redisFieldFailures, 1)
+		pipe.PExpire(redisKey, policy.Memory)
+		return nil
+	})
+
+	if err != nil {
+		return 0, errors.Wrap(err, "Error while recording failure in Redis")
+	}
+
+	lockout := policy.Lockout(int(failures.Val()))
+
+	if lockout > 0 {
+		lockedUntil := unixMilliseconds(time.Now().Add(lockout))
+
+		if err := l.client.HSet(redisKey, redisFieldLockedUntil, lockedUntil).Err(); err != nil {
+			return 0, errors.Wrap(err, "Error while saving lockout into Redis")
+		}
+	}
+
+	return lockout, nil
+}
+
+func (l *RedisLimiter) Reset(key string) error {
+	return errors.Wrap(l.client.Del(redisKeyPrefixLockouts+key).Err(), "Error while deleting lockout from Redis")
+}
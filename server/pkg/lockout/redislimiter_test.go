@@ -0,0 +1,30 @@
+package lockout_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/abustany/moblog-cloud/pkg/lockout"
+)
+
+func TestRedisLimiter(t *testing.T) {
+	redisURL := os.Getenv("REDIS_URL")
+
+	if redisURL == "" {
+		t.Skip("REDIS_URL environment variable not defined")
+	}
+
+	l, err := lockout.NewRedisLimiter(redisURL)
+
+	if err != nil {
+		t.Fatalf("Error while creating limiter: %s", err)
+	}
+
+	for _, key := range []string{"alice", "bob"} {
+		if err := l.Reset(key); err != nil {
+			t.Fatalf("Error while resetting %s: %s", key, err)
+		}
+	}
+
+	testLimiter(t, l)
+}
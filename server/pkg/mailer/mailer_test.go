@@ -0,0 +1,65 @@
+package mailer_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/abustany/moblog-cloud/pkg/mailer"
+	"github.com/abustany/moblog-cloud/pkg/testutils"
+)
+
+func TestFileSender(t *testing.T) {
+	dir := testutils.TempDir(t, "mailer")
+	defer os.RemoveAll(dir)
+
+	sender, err := mailer.Open("file://" + path.Join(dir, "mails"))
+
+	if err != nil {
+		t.Fatalf("Error while opening file sender: %s", err)
+	}
+
+	msg := mailer.Message{To: "jane@example.com", Subject: "Hello", Body: "How are you?"}
+
+	if err := sender.Send(msg); err != nil {
+		t.Fatalf("Error while sending message: %s", err)
+	}
+
+	files, err := ioutil.ReadDir(path.Join(dir, "mails"))
+
+	if err != nil {
+		t.Fatalf("Error while listing mails: %s", err)
+	}
+
+	if len(files) != 1 {
+		t.Fatalf("Expected one mail, got %d", len(files))
+	}
+
+	data, err := ioutil.ReadFile(path.Join(dir, "mails", files[0].Name()))
+
+	if err != nil {
+		t.Fatalf("Error while reading mail: %s", err)
+	}
+
+	for _, expected := range []string{"To: jane@example.com\r\n", "Subject: Hello\r\n", "\r\n\r\nHow are you?"} {
+		if !strings.Contains(string(data), expected) {
+			t.Errorf("Expected mail to contain %q, got %q", expected, data)
+		}
+	}
+}
+
+func TestOpen(t *testing.T) {
+	if _, err := mailer.Open("log"); err != nil {
+		t.Errorf("Error while opening log sender: %s", err)
+	}
+
+	if _, err := mailer.Open("smtp://localhost:25"); err == nil {
+		t.Errorf("Opening an SMTP sender without from address should fail")
+	}
+
+	if _, err := mailer.Open("carrier-pigeon://home"); err == nil {
+		t.Errorf("Opening an unknown sender should fail")
+	}
+}
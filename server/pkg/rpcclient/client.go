@@ -15,10 +15,15 @@ type Client struct {
 	idGenerator *idgenerator.StringIdGenerator
 
 	Client *http.Client
+
+	// Header holds extra headers sent with each call
+	Header http.Header
 }
 
+var ErrUnauthorized = errors.New("Unauthorized")
+
 func New(url string) *Client {
-	return &Client{url, &idgenerator.StringIdGenerator{}, nil}
+	return &Client{url, &idgenerator.StringIdGenerator{}, nil, http.Header{}}
 }
 
 func (c *Client) Call(method string, params interface{}, result interface{}) error {
@@ -46,7 +51,19 @@ func (c *Client) Call(method string, params interface{}, result interface{}) err
 		httpClient = http.DefaultClient
 	}
 
-	res, err := httpClient.Post(c.url, "application/json", &body)
+	req, err := http.NewRequest("POST", c.url, &body)
+
+	if err != nil {
+		return errors.Wrap(err, "Error while creating request")
+	}
+
+	for name, values := range c.Header {
+		req.Header[name] = values
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := httpClient.Do(req)
 
 	if err != nil {
 		return errors.Wrap(err, "Error while sending request")
@@ -54,6 +71,10 @@ func (c *Client) Call(method string, params interface{}, result interface{}) err
 
 	defer res.Body.Close()
 
+	if res.StatusCode == http.StatusUnauthorized {
+		return ErrUnauthorized
+	}
+
 	if res.StatusCode != http.StatusOK {
 		return errors.Errorf("Invalid HTTP reply status: %d", res.StatusCode)
 	}
@@ -7,12 +7,15 @@ import (
 
 type MemorySessionStore struct {
 	sync.Mutex
+
 	sessions map[string]Session
+	byUser   map[string]map[string]bool // username -> session IDs
 }
 
 func NewMemorySessionStore() (*MemorySessionStore, error) {
 	return &MemorySessionStore{
 		sessions: make(map[string]Session),
+		byUser:   make(map[string]map[string]bool),
 	}, nil
 }
 
@@ -24,10 +27,29 @@ func (s *MemorySessionStore) Set(session Session) error {
 		panic("Empty session ID")
 	}
 
+	if previous, exists := s.sessions[session.Sid]; exists && previous.Username != session.Username {
+		s.unindex(previous)
+	}
+
 	s.sessions[session.Sid] = session
+
+	if s.byUser[session.Username] == nil {
+		s.byUser[session.Username] = make(map[string]bool)
+	}
+
+	s.byUser[session.Username][session.Sid] = true
+
 	return nil
 }
 
+func (s *MemorySessionStore) unindex(session Session) {
+	delete(s.byUser[session.Username], session.Sid)
+
+	if len(s.byUser[session.Username]) == 0 {
+		delete(s.byUser, session.Username)
+	}
+}
+
 func (s *MemorySessionStore) Get(sid string) (*Session, error) {
 	s.Lock()
 	defer s.Unlock()
@@ -35,7 +57,7 @@ func (s *MemorySessionStore) Get(sid string) (*Session, error) {
 	session := s.sessions[sid]
 
 	if time.Now().After(session.Expires) {
-		delete(s.sessions, sid)
+		s.delete(sid)
 		return nil, nil
 	}
 
@@ -46,7 +68,61 @@ func (s *MemorySessionStore) Delete(sid string) error {
 	s.Lock()
 	defer s.Unlock()
 
-	delete(s.sessions, sid)
+	s.delete(sid)
+
+	return nil
+}
+
+func (s *MemorySessionStore) delete(sid string) {
+	if session, exists := s.sessions[sid]; exists {
+		s.unindex(session)
+		delete(s.sessions, sid)
+	}
+}
+
+func (s *MemorySessionStore) Update(session Session) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if previous, exists := s.sessions[session.Sid]; exists && previous.Username == session.Username {
+		s.sessions[session.Sid] = session
+	}
+
+	return nil
+}
+
+func (s *MemorySessionStore) List(username string) ([]Session, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	now := time.Now()
+	sessions := []Session{}
+
+	for sid := range s.byUser[username] {
+		session := s.sessions[sid]
+
+		if now.After(session.Expires) {
+			s.delete(sid)
+			continue
+		}
+
+		sessions = append(sessions, session)
+	}
+
+	sortSessions(sessions)
+
+	return sessions, nil
+}
+
+func (s *MemorySessionStore) DeleteUserSessions(username, exceptSid string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	for sid := range s.byUser[username] {
+		if sid != exceptSid {
+			s.delete(sid)
+		}
+	}
 
 	return nil
 }
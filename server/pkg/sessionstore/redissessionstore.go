@@ -2,6 +2,7 @@ package sessionstore
 
 import (
 	"encoding/json"
+	"strconv"
 	"time"
 
 	"github.com/go-redis/redis"
@@ -10,8 +11,14 @@ import (
 
 const redisKeyPrefixSessions = "session-"
 
+// The sessions of each user are indexed in a sorted set, scored by their
+// expiry time in milliseconds. The set expires with the last of them.
+const redisKeyPrefixUserSessions = "user-sessions-"
+
 type RedisSessionStore struct {
 	client *redis.Client
+
+	setScriptSha string
 }
 
 func NewRedisSessionStore(redisURL string) (*RedisSessionStore, error) {
@@ -21,9 +28,41 @@ func NewRedisSessionStore(redisURL string) (*RedisSessionStore, error) {
 		return nil, errors.Wrap(err, "Error while parsing redis URL")
 	}
 
-	return &RedisSessionStore{redis.NewClient(options)}, nil
+	client := redis.NewClient(options)
+
+	setScriptSha, err := client.ScriptLoad(setScript).Result()
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while uploading set script to Redis")
+	}
+
+	return &RedisSessionStore{client, setScriptSha}, nil
+}
+
+func redisMilliseconds(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
 }
 
+// Saves a session and indexes it, pruning the expired sessions of the index
+const setScript = `
+local sessionKey, indexKey = KEYS[1], KEYS[2]
+local sid, data, expires, now = ARGV[1], ARGV[2], ARGV[3], ARGV[4]
+
+redis.call('zremrangebyscore', indexKey, '-inf', now)
+
+if tonumber(expires) <= tonumber(now) then
+	redis.call('del', sessionKey)
+	redis.call('zrem', indexKey, sid)
+	return
+end
+
+redis.call('set', sessionKey, data, 'px', tonumber(expires) - tonumber(now))
+redis.call('zadd', indexKey, expires, sid)
+
+local last = redis.call('zrange', indexKey, -1, -1, 'withscores')
+redis.call('pexpireat', indexKey, last[2])
+`
+
 func (s *RedisSessionStore) Set(session Session) error {
 	data, err := json.Marshal(&session)
 
@@ -31,7 +70,11 @@ func (s *RedisSessionStore) Set(session Session) error {
 		return errors.Wrap(err, "Error while encoding session data")
 	}
 
-	if err := s.client.Set(redisKeyPrefixSessions+session.Sid, data, time.Until(session.Expires)).Err(); err != nil {
+	keys := []string{redisKeyPrefixSessions + session.Sid, redisKeyPrefixUserSessions + session.Username}
+	expires := strconv.FormatInt(redisMilliseconds(session.Expires), 10)
+	now := strconv.FormatInt(redisMilliseconds(time.Now()), 10)
+
+	if err := s.client.EvalSha(s.setScriptSha, keys, session.Sid, data, expires, now).Err(); err != nil && err != redis.Nil {
 		return errors.Wrap(err, "Error while saving session into Redis")
 	}
 
@@ -64,5 +107,120 @@ func (s *RedisSessionStore) Get(sid string) (*Session, error) {
 }
 
 func (s *RedisSessionStore) Delete(sid string) error {
-	return errors.Wrap(s.client.Del(redisKeyPrefixSessions+sid).Err(), "Error while deleting session from Redis")
+	session, err := s.Get(sid)
+
+	if err != nil {
+		return err
+	}
+
+	if session == nil {
+		return errors.Wrap(s.client.Del(redisKeyPrefixSessions+sid).Err(), "Error while deleting session from Redis")
+	}
+
+	_, err = s.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.Del(redisKeyPrefixSessions + sid)
+		pipe.ZRem(redisKeyPrefixUserSessions+session.Username, sid)
+		return nil
+	})
+
+	return errors.Wrap(err, "Error while deleting session from Redis")
+}
+
+func (s *RedisSessionStore) Update(session Session) error {
+	ttl := time.Until(session.Expires)
+
+	if ttl <= 0 {
+		return nil
+	}
+
+	data, err := json.Marshal(&session)
+
+	if err != nil {
+		return errors.Wrap(err, "Error while encoding session data")
+	}
+
+	// The expiry time doesn't change, so the index remains valid
+	if err := s.client.SetXX(redisKeyPrefixSessions+session.Sid, data, ttl).Err(); err != nil {
+		return errors.Wrap(err, "Error while updating session in Redis")
+	}
+
+	return nil
+}
+
+func (s *RedisSessionStore) List(username string) ([]Session, error) {
+	now := time.Now()
+
+	sids, err := s.client.ZRangeByScore(redisKeyPrefixUserSessions+username, redis.ZRangeBy{
+		Min: "(" + strconv.FormatInt(redisMilliseconds(now), 10),
+		Max: "+inf",
+	}).Result()
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while listing sessions from Redis")
+	}
+
+	sessions := []Session{}
+
+	if len(sids) == 0 {
+		return sessions, nil
+	}
+
+	keys := make([]string, len(sids))
+
+	for i, sid := range sids {
+		keys[i] = redisKeyPrefixSessions + sid
+	}
+
+	values, err := s.client.MGet(keys...).Result()
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while retrieving session data from Redis")
+	}
+
+	for _, value := range values {
+		// Sessions deleted without going through the index
+		data, ok := value.(string)
+
+		if !ok {
+			continue
+		}
+
+		var session Session
+
+		if err := json.Unmarshal([]byte(data), &session); err != nil {
+			return nil, errors.Wrap(err, "Error while decoding session data")
+		}
+
+		if session.Username == username && now.Before(session.Expires) {
+			sessions = append(sessions, session)
+		}
+	}
+
+	sortSessions(sessions)
+
+	return sessions, nil
+}
+
+func (s *RedisSessionStore) DeleteUserSessions(username, exceptSid string) error {
+	indexKey := redisKeyPrefixUserSessions + username
+	sids, err := s.client.ZRange(indexKey, 0, -1).Result()
+
+	if err != nil {
+		return errors.Wrap(err, "Error while listing sessions from Redis")
+	}
+
+	_, err = s.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		for _, sid := range sids {
+			if sid == exceptSid {
+				continue
+			}
+
+			pipe.Del(redisKeyPrefixSessions + sid)
+			pipe.ZRem(indexKey, sid)
+		}
+
+		return nil
+	})
+
+	return errors.Wrap(err, "Error while deleting sessions from Redis")
 }
@@ -1,6 +1,7 @@
 package sessionstore
 
 import (
+	"sort"
 	"time"
 
 	uuid "github.com/satori/go.uuid"
@@ -10,12 +11,73 @@ type Session struct {
 	Sid      string
 	Expires  time.Time
 	Username string
+
+	// Scopes is only set for sessions that were created from an access token,
+	// and lists what the session may be used for. Sessions created by logging
+	// in with a password give full access to the user account.
+	Scopes []string `json:",omitempty"`
+
+	// Blog is only set for sessions that were created from a grant, which give
+	// access to a single blog.
+	Blog string `json:",omitempty"`
+
+	// SecondFactorPending is set for sessions created by logging in with the
+	// password of a user who enabled two-factor authentication. They can only
+	// be used for sending the second factor, which replaces them with a full
+	// session.
+	SecondFactorPending bool `json:",omitempty"`
+
+	// Those let users recognize their sessions when listing them. Address and
+	// LastSeen are updated as the session gets used.
+	Created   time.Time
+	LastSeen  time.Time
+	Address   string `json:",omitempty"`
+	UserAgent string `json:",omitempty"`
+}
+
+// Restricted returns true if the session does not give full access to the
+// user account.
+func (s *Session) Restricted() bool {
+	return len(s.Scopes) > 0 || s.SecondFactorPending
+}
+
+func (s *Session) HasScope(scope string) bool {
+	if !s.Restricted() {
+		return true
+	}
+
+	for _, sc := range s.Scopes {
+		if sc == scope {
+			return true
+		}
+	}
+
+	return false
 }
 
 type SessionStore interface {
 	Set(session Session) error
 	Get(sid string) (*Session, error)
 	Delete(sid string) error
+	// Update saves a session only if it still exists, so that a session
+	// deleted while it was being used doesn't come back
+	Update(session Session) error
+	// List returns the sessions of a user that haven't expired, oldest first
+	List(username string) ([]Session, error)
+	// DeleteUserSessions deletes all the sessions of a user, except the one
+	// with ID exceptSid if it is not empty
+	DeleteUserSessions(username, exceptSid string) error
+}
+
+// sortSessions sorts sessions by creation time, oldest first
+func sortSessions(sessions []Session) {
+	sort.Slice(sessions, func(i, j int) bool {
+		if sessions[i].Created.Equal(sessions[j].Created) {
+			return sessions[i].Sid < sessions[j].Sid
+		}
+
+		return sessions[i].Created.Before(sessions[j].Created)
+	})
 }
 
 func GenerateSessionID() string {
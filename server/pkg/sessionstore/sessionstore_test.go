@@ -1,6 +1,7 @@
 package sessionstore_test
 
 import (
+	"strings"
 	"testing"
 	"time"
 
@@ -16,6 +17,8 @@ func testSessionStore(t *testing.T, s sessionstore.SessionStore) {
 
 	t.Run("Set Get Delete", withStore(testSetGetDelete))
 	t.Run("Expiration", withStore(testExpiration))
+	t.Run("Update", withStore(testUpdate))
+	t.Run("User sessions", withStore(testUserSessions))
 }
 
 func testSetGetDelete(t *testing.T, store sessionstore.SessionStore) {
@@ -112,3 +115,122 @@ func testExpiration(t *testing.T, store sessionstore.SessionStore) {
 		}
 	}
 }
+
+func testUpdate(t *testing.T, store sessionstore.SessionStore) {
+	session := sessionstore.Session{
+		Sid:      "updated",
+		Expires:  time.Now().Add(time.Hour),
+		Username: "user",
+	}
+
+	session.Address = "192.0.2.1"
+
+	if err := store.Update(session); err != nil {
+		t.Fatalf("Error while updating a non-existing session: %s", err)
+	}
+
+	if s, err := store.Get(session.Sid); err != nil {
+		t.Fatalf("Error while retrieving session: %s", err)
+	} else if s != nil {
+		t.Errorf("Update should not create sessions")
+	}
+
+	if err := store.Set(session); err != nil {
+		t.Fatalf("Error while saving session: %s", err)
+	}
+
+	session.Address = "192.0.2.2"
+
+	if err := store.Update(session); err != nil {
+		t.Fatalf("Error while updating session: %s", err)
+	}
+
+	if s, err := store.Get(session.Sid); err != nil {
+		t.Fatalf("Error while retrieving session: %s", err)
+	} else if s == nil || s.Address != session.Address {
+		t.Errorf("Session was not updated: %+v", s)
+	}
+
+	if err := store.Delete(session.Sid); err != nil {
+		t.Fatalf("Error while deleting session: %s", err)
+	}
+}
+
+func testUserSessions(t *testing.T, store sessionstore.SessionStore) {
+	now := time.Now()
+
+	sessions := []sessionstore.Session{
+		{Sid: "first", Expires: now.Add(time.Hour), Username: "alice", Created: now.Add(-2 * time.Minute)},
+		{Sid: "second", Expires: now.Add(time.Hour), Username: "alice", Created: now.Add(-time.Minute), UserAgent: "curl"},
+		{Sid: "third", Expires: now.Add(time.Hour), Username: "alice", Created: now},
+		{Sid: "other", Expires: now.Add(time.Hour), Username: "bob", Created: now},
+		{Sid: "expired", Expires: now.Add(100 * time.Millisecond), Username: "alice", Created: now},
+	}
+
+	for _, session := range sessions {
+		if err := store.Set(session); err != nil {
+			t.Fatalf("Error while saving session %s: %s", session.Sid, err)
+		}
+	}
+
+	time.Sleep(300 * time.Millisecond)
+
+	checkSessions := func(username string, expected ...string) {
+		t.Helper()
+
+		listed, err := store.List(username)
+
+		if err != nil {
+			t.Fatalf("Error while listing sessions of %s: %s", username, err)
+		}
+
+		sids := []string{}
+
+		for _, session := range listed {
+			sids = append(sids, session.Sid)
+		}
+
+		if strings.Join(sids, ",") != strings.Join(expected, ",") {
+			t.Errorf("Unexpected sessions for %s: expected %v, got %v", username, expected, sids)
+		}
+	}
+
+	checkSessions("alice", "first", "second", "third")
+	checkSessions("bob", "other")
+	checkSessions("nobody")
+
+	if listed, err := store.List("alice"); err != nil {
+		t.Fatalf("Error while listing sessions: %s", err)
+	} else if listed[1].UserAgent != "curl" || !listed[1].Created.Equal(sessions[1].Created) {
+		t.Errorf("Listed session does not match the saved one: %+v", listed[1])
+	}
+
+	if err := store.Delete("first"); err != nil {
+		t.Fatalf("Error while deleting session: %s", err)
+	}
+
+	checkSessions("alice", "second", "third")
+
+	if err := store.DeleteUserSessions("alice", "third"); err != nil {
+		t.Fatalf("Error while deleting sessions: %s", err)
+	}
+
+	checkSessions("alice", "third")
+	checkSessions("bob", "other")
+
+	if s, err := store.Get("second"); err != nil {
+		t.Fatalf("Error while retrieving session: %s", err)
+	} else if s != nil {
+		t.Errorf("Session should have been deleted")
+	}
+
+	if err := store.DeleteUserSessions("alice", ""); err != nil {
+		t.Fatalf("Error while deleting sessions: %s", err)
+	}
+
+	checkSessions("alice")
+
+	if err := store.DeleteUserSessions("bob", ""); err != nil {
+		t.Fatalf("Error while deleting sessions: %s", err)
+	}
+}
@@ -9,9 +9,15 @@ import (
 	"github.com/gorilla/securecookie"
 
 	"github.com/abustany/moblog-cloud/pkg/adminserver"
+	"github.com/abustany/moblog-cloud/pkg/audit"
+	"github.com/abustany/moblog-cloud/pkg/blogoutput"
+	"github.com/abustany/moblog-cloud/pkg/grants"
+	"github.com/abustany/moblog-cloud/pkg/lockout"
+	"github.com/abustany/moblog-cloud/pkg/mailer"
 	"github.com/abustany/moblog-cloud/pkg/netscapecookies"
 	"github.com/abustany/moblog-cloud/pkg/sessionstore"
 	"github.com/abustany/moblog-cloud/pkg/userstore"
+	"github.com/abustany/moblog-cloud/pkg/workqueue"
 )
 
 func generateSecureCookie(t *testing.T) *securecookie.SecureCookie {
@@ -25,9 +31,46 @@ func generateSecureCookie(t *testing.T) *securecookie.SecureCookie {
 	return securecookie.New(signKey, encryptKey)
 }
 
+// Shared by all the servers created in a test binary, so that the git server
+// can verify the grants of the admin server and vice versa.
+var grantKey = securecookie.GenerateRandomKey(grants.KeyLength)
+
+func GrantSigner(t *testing.T) *grants.Signer {
+	signer, err := grants.NewSigner(grantKey)
+
+	if err != nil {
+		t.Fatalf("Error while creating grant signer: %s", err)
+	}
+
+	return signer
+}
+
 const DBURLEnvVar = "DB_URL"
 
-func NewAdminServer(t *testing.T) *adminserver.Server {
+func NewAdminServer(t *testing.T, blogOutput *blogoutput.Output) *adminserver.Server {
+	return NewAdminServerWithQueues(t, blogOutput, NewMemoryQueue(t), NewMemoryQueue(t), NewMemoryAuditLog(t))
+}
+
+// NewAdminServerWithQueues creates an admin server that posts and cancels the
+// jobs of deleted blogs in the given queues, and records the cleanups in the
+// given audit log
+func NewAdminServerWithQueues(t *testing.T, blogOutput *blogoutput.Output, jobQueue, repositoryQueue workqueue.Queue, auditLog audit.Log) *adminserver.Server {
+	return newAdminServer(t, blogOutput, jobQueue, repositoryQueue, mailer.LogSender{}, auditLog)
+}
+
+// NewAdminServerWithMailer creates an admin server that sends its emails
+// through the given sender
+func NewAdminServerWithMailer(t *testing.T, blogOutput *blogoutput.Output, mailSender mailer.Sender) *adminserver.Server {
+	return newAdminServer(t, blogOutput, NewMemoryQueue(t), NewMemoryQueue(t), mailSender, NewMemoryAuditLog(t))
+}
+
+// NewAdminServerWithAuditLog creates an admin server that records its audit
+// events in the given log
+func NewAdminServerWithAuditLog(t *testing.T, blogOutput *blogoutput.Output, auditLog audit.Log) *adminserver.Server {
+	return newAdminServer(t, blogOutput, NewMemoryQueue(t), NewMemoryQueue(t), mailer.LogSender{}, auditLog)
+}
+
+func newAdminServer(t *testing.T, blogOutput *blogoutput.Output, jobQueue, repositoryQueue workqueue.Queue, mailSender mailer.Sender, auditLog audit.Log) *adminserver.Server {
 	dbURL := os.Getenv(DBURLEnvVar)
 
 	var userStore userstore.UserStore
@@ -51,7 +94,13 @@ func NewAdminServer(t *testing.T) *adminserver.Server {
 		t.Fatalf("Error while creating session store: %s", err)
 	}
 
-	s, err := adminserver.New("", generateSecureCookie(t), userStore, sessionStore)
+	limiter, err := lockout.NewMemoryLimiter()
+
+	if err != nil {
+		t.Fatalf("Error while creating login limiter: %s", err)
+	}
+
+	s, err := adminserver.New("", generateSecureCookie(t), GrantSigner(t), userStore, sessionStore, blogOutput, jobQueue, repositoryQueue, mailSender, limiter, auditLog)
 
 	if err != nil {
 		t.Fatalf("Error while creating admin server: %s", err)
@@ -77,3 +126,23 @@ func SaveAdminClientAuthCookieToFile(t *testing.T, client *adminserver.Client, p
 		t.Fatalf("Error while writing auth cookie to file: %s", err)
 	}
 }
+
+func NewMemoryAuditLog(t *testing.T) *audit.MemoryLog {
+	auditLog, err := audit.NewMemoryLog()
+
+	if err != nil {
+		t.Fatalf("Error while creating audit log: %s", err)
+	}
+
+	return auditLog
+}
+
+func NewMemoryQueue(t *testing.T) *workqueue.MemoryQueue {
+	queue, err := workqueue.NewMemoryQueue()
+
+	if err != nil {
+		t.Fatalf("Error while creating job queue: %s", err)
+	}
+
+	return queue
+}
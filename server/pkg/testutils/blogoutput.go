@@ -0,0 +1,21 @@
+package testutils
+
+import (
+	"context"
+	"testing"
+
+	_ "gocloud.dev/blob/memblob"
+
+	"github.com/abustany/moblog-cloud/pkg/blogoutput"
+)
+
+// NewBlogOutput returns a blog output backed by an in-memory bucket
+func NewBlogOutput(t *testing.T) *blogoutput.Output {
+	output, err := blogoutput.Open(context.Background(), "mem://")
+
+	if err != nil {
+		t.Fatalf("Error while opening blog output: %s", err)
+	}
+
+	return output
+}
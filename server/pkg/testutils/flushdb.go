@@ -22,7 +22,7 @@ func clearDB(t *testing.T, dbURL string) {
 
 	defer db.Close()
 
-	tables := []string{"users", "blogs"}
+	tables := []string{"users", "blogs", "tokens", "builds", "jobs", "audit_log"}
 
 	tx, err := db.Begin()
 
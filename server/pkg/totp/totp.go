@@ -0,0 +1,109 @@
+// Package totp implements the time-based one-time passwords of RFC 6238, as
+// generated by authenticator apps.
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Parameters understood by all the authenticator apps
+const (
+	Period    = 30 * time.Second
+	Digits    = 6
+	secretLen = 20 // bytes, the size of a SHA1 hash
+)
+
+// How many periods before and after the current one are accepted, to account
+// for clock drift and slow typists
+const skew = 1
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateSecret returns a new random secret, base32 encoded
+func GenerateSecret() (string, error) {
+	secret := make([]byte, secretLen)
+
+	if _, err := rand.Read(secret); err != nil {
+		return "", errors.Wrap(err, "Error while generating TOTP secret")
+	}
+
+	return encoding.EncodeToString(secret), nil
+}
+
+// Step returns the time step of a given time
+func Step(t time.Time) int64 {
+	return t.Unix() / int64(Period/time.Second)
+}
+
+// Code returns the code of a secret for a given time step
+func Code(secret string, step int64) (string, error) {
+	key, err := encoding.DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+
+	if err != nil {
+		return "", errors.Wrap(err, "Error while decoding TOTP secret")
+	}
+
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation, see RFC 4226 section 5.3
+	offset := sum[len(sum)-1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	modulo := uint32(1)
+
+	for i := 0; i < Digits; i++ {
+		modulo *= 10
+	}
+
+	return fmt.Sprintf("%0*d", Digits, value%modulo), nil
+}
+
+// Validate checks a code around the given time, and returns the time step it
+// matched. Callers should refuse steps that were already used, so that a code
+// cannot be replayed.
+func Validate(secret, code string, t time.Time) (int64, bool) {
+	current := Step(t)
+
+	for step := current - skew; step <= current+skew; step++ {
+		expected, err := Code(secret, step)
+
+		if err != nil {
+			return 0, false
+		}
+
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+
+	return 0, false
+}
+
+// KeyURI returns the otpauth:// URI of a secret, that authenticator apps can
+// import, usually from a QR code.
+func KeyURI(issuer, account, secret string) string {
+	params := url.Values{
+		"secret": []string{secret},
+		"issuer": []string{issuer},
+	}
+
+	label := url.PathEscape(issuer + ":" + account)
+
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
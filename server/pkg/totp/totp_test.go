@@ -0,0 +1,66 @@
+package totp_test
+
+import (
+	"encoding/base32"
+	"testing"
+	"time"
+
+	"github.com/abustany/moblog-cloud/pkg/totp"
+)
+
+func TestCode(t *testing.T) {
+	// Test vectors of RFC 6238, truncated to 6 digits
+	secret := base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+
+	vectors := map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1111111111:  "050471",
+		1234567890:  "005924",
+		2000000000:  "279037",
+		20000000000: "353130",
+	}
+
+	for unix, expected := range vectors {
+		code, err := totp.Code(secret, totp.Step(time.Unix(unix, 0)))
+
+		if err != nil {
+			t.Fatalf("Error while computing code: %s", err)
+		}
+
+		if code != expected {
+			t.Errorf("Expected code %s at %d, got %s", expected, unix, code)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	secret, err := totp.GenerateSecret()
+
+	if err != nil {
+		t.Fatalf("Error while generating secret: %s", err)
+	}
+
+	now := time.Now()
+	code, err := totp.Code(secret, totp.Step(now))
+
+	if err != nil {
+		t.Fatalf("Error while computing code: %s", err)
+	}
+
+	if step, ok := totp.Validate(secret, code, now); !ok || step != totp.Step(now) {
+		t.Errorf("Current code should be valid")
+	}
+
+	if _, ok := totp.Validate(secret, code, now.Add(totp.Period)); !ok {
+		t.Errorf("Code of the previous period should be valid")
+	}
+
+	if _, ok := totp.Validate(secret, code, now.Add(5*totp.Period)); ok {
+		t.Errorf("Old codes should not be valid")
+	}
+
+	if _, ok := totp.Validate(secret, "", now); ok {
+		t.Errorf("Empty codes should not be valid")
+	}
+}
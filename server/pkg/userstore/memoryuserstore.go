@@ -1,12 +1,39 @@
 package userstore
 
 import (
+	"crypto/subtle"
+	"encoding/hex"
+	"sort"
 	"sync"
+	"time"
+
+	"github.com/abustany/moblog-cloud/pkg/totp"
 )
 
+type memoryToken struct {
+	token Token
+	hash  []byte
+}
+
+type memoryOneTimeToken struct {
+	hash    []byte
+	email   string
+	expires time.Time
+}
+
 type memoryRecord struct {
-	user  User
-	blogs map[string]Blog
+	user          User
+	passwordHash  string
+	blogs         map[string]Blog
+	tokens        map[string]memoryToken
+	oneTimeTokens map[OneTimeTokenPurpose]memoryOneTimeToken
+	builds        map[string]Build
+	deleted       time.Time // zero unless the user was deleted
+
+	totpSecret        string
+	totpPendingSecret string
+	totpLastStep      int64
+	recoveryCodes     map[string]bool // hex encoded hashes
 }
 
 type MemoryUserStore struct {
@@ -21,11 +48,45 @@ func NewMemoryUserStore() (*MemoryUserStore, error) {
 	}, nil
 }
 
+// liveRecord returns the record of a user that exists and is not deleted
+func (s *MemoryUserStore) liveRecord(username string) (memoryRecord, bool) {
+	record, exists := s.users[username]
+	return record, exists && record.deleted.IsZero()
+}
+
+// liveBlog returns true if a user has a blog that is not deleted
+func liveBlog(record memoryRecord, blogSlug string) bool {
+	blog, exists := record.blogs[blogSlug]
+	return exists && blog.Deleted == nil
+}
+
 func (s *MemoryUserStore) CreateUser(user User) error {
 	if err := validateUser(user, false); err != nil {
 		return err
 	}
 
+	passwordHash, err := hashNewPassword(user.Password)
+
+	if err != nil {
+		return err
+	}
+
+	return s.addUser(user, passwordHash)
+}
+
+func (s *MemoryUserStore) ImportUser(user User, passwordHash string) error {
+	if err := validateUser(user, true); err != nil {
+		return err
+	}
+
+	if err := validateImportedHash(passwordHash); err != nil {
+		return err
+	}
+
+	return s.addUser(user, passwordHash)
+}
+
+func (s *MemoryUserStore) addUser(user User, passwordHash string) error {
 	s.Lock()
 	defer s.Unlock()
 
@@ -33,7 +94,10 @@ func (s *MemoryUserStore) CreateUser(user User) error {
 		return ErrAlreadyExists
 	}
 
-	s.users[user.Username] = memoryRecord{user: user, blogs: map[string]Blog{}}
+	user.Password = ""
+	user.EmailVerified = false
+	user.TwoFactorEnabled = false
+	s.users[user.Username] = memoryRecord{user: user, passwordHash: passwordHash, blogs: map[string]Blog{}, tokens: map[string]memoryToken{}, oneTimeTokens: map[OneTimeTokenPurpose]memoryOneTimeToken{}, builds: map[string]Build{}}
 
 	return nil
 }
@@ -43,15 +107,32 @@ func (s *MemoryUserStore) UpdateUser(user User) error {
 		return err
 	}
 
+	var passwordHash string
+
+	if user.Password != "" {
+		var err error
+
+		if passwordHash, err = hashNewPassword(user.Password); err != nil {
+			return err
+		}
+	}
+
 	s.Lock()
 	defer s.Unlock()
 
-	record, exists := s.users[user.Username]
+	record, exists := s.liveRecord(user.Username)
 
 	if !exists {
 		return ErrDoesNotExist
 	}
 
+	if passwordHash != "" {
+		record.passwordHash = passwordHash
+	}
+
+	user.Password = ""
+	user.EmailVerified = record.user.EmailVerified && user.Email == record.user.Email
+	user.TwoFactorEnabled = record.user.TwoFactorEnabled
 	record.user = user
 	s.users[user.Username] = record
 
@@ -62,10 +143,9 @@ func (s *MemoryUserStore) GetUser(username string) (*User, error) {
 	s.Lock()
 	defer s.Unlock()
 
-	record, exists := s.users[username]
+	record, exists := s.liveRecord(username)
 
 	if exists {
-		record.user.Password = ""
 		return &record.user, nil
 	} else {
 		return nil, nil
@@ -76,24 +156,277 @@ func (s *MemoryUserStore) AuthenticateUser(username, password string) (bool, err
 	s.Lock()
 	defer s.Unlock()
 
-	record, exists := s.users[username]
+	record, exists := s.liveRecord(username)
 
-	if exists {
-		return record.user.Password == password, nil
-	} else {
+	if !exists {
 		return false, nil
 	}
+
+	valid, needsRehash, err := verifyPassword(password, record.passwordHash)
+
+	if err != nil || !valid {
+		return false, err
+	}
+
+	if needsRehash {
+		if record.passwordHash, err = hashNewPassword(password); err != nil {
+			return false, err
+		}
+
+		s.users[username] = record
+	}
+
+	return true, nil
 }
 
 func (s *MemoryUserStore) DeleteUser(username string) error {
 	s.Lock()
 	defer s.Unlock()
 
-	if _, exists := s.users[username]; !exists {
+	record, exists := s.liveRecord(username)
+
+	if !exists {
+		return ErrDoesNotExist
+	}
+
+	record.deleted = time.Now()
+	s.users[username] = record
+
+	return nil
+}
+
+func (s *MemoryUserStore) RestoreUser(username, password string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	record, exists := s.users[username]
+
+	if !exists || record.deleted.IsZero() {
+		return ErrDoesNotExist
+	}
+
+	if valid, _, err := verifyPassword(password, record.passwordHash); err != nil {
+		return err
+	} else if !valid {
+		return ErrDoesNotExist
+	}
+
+	record.deleted = time.Time{}
+	s.users[username] = record
+
+	return nil
+}
+
+func (s *MemoryUserStore) CreateOneTimeToken(username string, purpose OneTimeTokenPurpose) (string, string, error) {
+	secret, err := generateTokenSecret()
+
+	if err != nil {
+		return "", "", err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	record, exists := s.liveRecord(username)
+
+	if !exists {
+		return "", "", ErrDoesNotExist
+	}
+
+	if err := checkOneTimeTokenEmail(record.user, purpose); err != nil {
+		return "", "", err
+	}
+
+	record.oneTimeTokens[purpose] = memoryOneTimeToken{
+		hash:    hashTokenSecret(secret),
+		email:   record.user.Email,
+		expires: time.Now().Add(OneTimeTokenValidity[purpose]),
+	}
+
+	return secret, record.user.Email, nil
+}
+
+// consumeOneTimeToken deletes a one time token if the secret matches, and
+// returns the address it was sent to
+func consumeOneTimeToken(record memoryRecord, purpose OneTimeTokenPurpose, secret string) (string, error) {
+	token, exists := record.oneTimeTokens[purpose]
+
+	if !exists || subtle.ConstantTimeCompare(token.hash, hashTokenSecret(secret)) != 1 {
+		return "", ErrOneTimeTokenInvalid
+	}
+
+	delete(record.oneTimeTokens, purpose)
+
+	if time.Now().After(token.expires) {
+		return "", ErrOneTimeTokenInvalid
+	}
+
+	return token.email, nil
+}
+
+func (s *MemoryUserStore) VerifyEmail(username, secret string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	record, exists := s.liveRecord(username)
+
+	if !exists {
+		return ErrOneTimeTokenInvalid
+	}
+
+	email, err := consumeOneTimeToken(record, OneTimeTokenVerifyEmail, secret)
+
+	if err != nil {
+		return err
+	}
+
+	// The address changed since the token was sent
+	if email != record.user.Email {
+		return ErrOneTimeTokenInvalid
+	}
+
+	record.user.EmailVerified = true
+	s.users[username] = record
+
+	return nil
+}
+
+func (s *MemoryUserStore) ResetPassword(username, secret, password string) error {
+	if password == "" {
+		return ErrPasswordEmpty
+	}
+
+	passwordHash, err := hashNewPassword(password)
+
+	if err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	record, exists := s.liveRecord(username)
+
+	if !exists {
+		return ErrOneTimeTokenInvalid
+	}
+
+	if _, err := consumeOneTimeToken(record, OneTimeTokenResetPassword, secret); err != nil {
+		return err
+	}
+
+	record.passwordHash = passwordHash
+	s.users[username] = record
+
+	return nil
+}
+
+func (s *MemoryUserStore) EnrolTOTP(username string) (string, error) {
+	secret, err := totp.GenerateSecret()
+
+	if err != nil {
+		return "", err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	record, exists := s.liveRecord(username)
+
+	if !exists {
+		return "", ErrDoesNotExist
+	}
+
+	record.totpPendingSecret = secret
+	s.users[username] = record
+
+	return secret, nil
+}
+
+func (s *MemoryUserStore) ConfirmTOTP(username, code string) ([]string, error) {
+	codes, hashes, err := generateRecoveryCodes()
+
+	if err != nil {
+		return nil, err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	record, exists := s.liveRecord(username)
+
+	if !exists {
+		return nil, ErrDoesNotExist
+	}
+
+	if record.totpPendingSecret == "" {
+		return nil, ErrTOTPNotEnrolled
+	}
+
+	step, ok := totp.Validate(record.totpPendingSecret, code, time.Now())
+
+	if !ok {
+		return nil, ErrTOTPCodeInvalid
+	}
+
+	record.totpSecret = record.totpPendingSecret
+	record.totpPendingSecret = ""
+	record.totpLastStep = step
+	record.recoveryCodes = map[string]bool{}
+	record.user.TwoFactorEnabled = true
+
+	for _, hash := range hashes {
+		record.recoveryCodes[hex.EncodeToString(hash)] = true
+	}
+
+	s.users[username] = record
+
+	return codes, nil
+}
+
+func (s *MemoryUserStore) AuthenticateSecondFactor(username, code string) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	record, exists := s.liveRecord(username)
+
+	if !exists || record.totpSecret == "" {
+		return false, nil
+	}
+
+	if step, ok := totp.Validate(record.totpSecret, code, time.Now()); ok && step > record.totpLastStep {
+		record.totpLastStep = step
+		s.users[username] = record
+		return true, nil
+	}
+
+	hash := hex.EncodeToString(hashRecoveryCode(code))
+
+	if record.recoveryCodes[hash] {
+		delete(record.recoveryCodes, hash)
+		return true, nil
+	}
+
+	return false, nil
+}
+
+func (s *MemoryUserStore) DisableTOTP(username string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	record, exists := s.liveRecord(username)
+
+	if !exists {
 		return ErrDoesNotExist
 	}
 
-	delete(s.users, username)
+	record.totpSecret = ""
+	record.totpPendingSecret = ""
+	record.totpLastStep = 0
+	record.recoveryCodes = nil
+	record.user.TwoFactorEnabled = false
+	s.users[username] = record
+
 	return nil
 }
 
@@ -105,7 +438,7 @@ func (s *MemoryUserStore) AddBlog(username string, blog Blog) error {
 	s.Lock()
 	defer s.Unlock()
 
-	record, exists := s.users[username]
+	record, exists := s.liveRecord(username)
 
 	if !exists {
 		return ErrDoesNotExist
@@ -115,6 +448,7 @@ func (s *MemoryUserStore) AddBlog(username string, blog Blog) error {
 		return ErrBlogAlreadyExists
 	}
 
+	blog.Deleted = nil
 	record.blogs[blog.Slug] = blog
 	s.users[username] = record
 
@@ -129,16 +463,17 @@ func (s *MemoryUserStore) UpdateBlog(username string, blog Blog) error {
 	s.Lock()
 	defer s.Unlock()
 
-	record, exists := s.users[username]
+	record, exists := s.liveRecord(username)
 
 	if !exists {
 		return ErrDoesNotExist
 	}
 
-	if _, exists := record.blogs[blog.Slug]; !exists {
+	if !liveBlog(record, blog.Slug) {
 		return ErrBlogDoesNotExist
 	}
 
+	blog.Deleted = nil
 	record.blogs[blog.Slug] = blog
 	s.users[username] = record
 
@@ -149,13 +484,14 @@ func (s *MemoryUserStore) GetBlog(username, blogSlug string) (*Blog, error) {
 	s.Lock()
 	defer s.Unlock()
 
-	record, exists := s.users[username]
+	record, exists := s.liveRecord(username)
 
 	if !exists {
 		return nil, ErrDoesNotExist
 	}
 
-	if blog, exists := record.blogs[blogSlug]; exists {
+	if liveBlog(record, blogSlug) {
+		blog := record.blogs[blogSlug]
 		return &blog, nil
 	}
 
@@ -166,7 +502,7 @@ func (s *MemoryUserStore) ListBlogs(username string) ([]Blog, error) {
 	s.Lock()
 	defer s.Unlock()
 
-	record, exists := s.users[username]
+	record, exists := s.liveRecord(username)
 
 	if !exists {
 		return nil, ErrDoesNotExist
@@ -175,7 +511,9 @@ func (s *MemoryUserStore) ListBlogs(username string) ([]Blog, error) {
 	blogs := make([]Blog, 0, len(record.blogs))
 
 	for _, blog := range record.blogs {
-		blogs = append(blogs, blog)
+		if blog.Deleted == nil {
+			blogs = append(blogs, blog)
+		}
 	}
 
 	return blogs, nil
@@ -185,17 +523,342 @@ func (s *MemoryUserStore) DeleteBlog(username, blogSlug string) error {
 	s.Lock()
 	defer s.Unlock()
 
-	record, exists := s.users[username]
+	record, exists := s.liveRecord(username)
 
 	if !exists {
 		return ErrDoesNotExist
 	}
 
-	if _, exists := record.blogs[blogSlug]; !exists {
+	blog, exists := record.blogs[blogSlug]
+
+	if !exists || blog.Deleted != nil {
 		return ErrBlogDoesNotExist
 	}
 
-	delete(record.blogs, blogSlug)
+	now := time.Now()
+	blog.Deleted = &now
+	record.blogs[blogSlug] = blog
 
 	return nil
 }
+
+func (s *MemoryUserStore) ListDeletedBlogs(username string) ([]Blog, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	record, exists := s.liveRecord(username)
+
+	if !exists {
+		return nil, ErrDoesNotExist
+	}
+
+	var blogs []Blog
+
+	for _, blog := range record.blogs {
+		if blog.Deleted != nil {
+			blogs = append(blogs, blog)
+		}
+	}
+
+	sort.Slice(blogs, func(i, j int) bool {
+		return blogs[i].Deleted.After(*blogs[j].Deleted)
+	})
+
+	return blogs, nil
+}
+
+func (s *MemoryUserStore) RestoreBlog(username, blogSlug string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	record, exists := s.liveRecord(username)
+
+	if !exists {
+		return ErrDoesNotExist
+	}
+
+	blog, exists := record.blogs[blogSlug]
+
+	if !exists || blog.Deleted == nil {
+		return ErrBlogDoesNotExist
+	}
+
+	blog.Deleted = nil
+	record.blogs[blogSlug] = blog
+
+	return nil
+}
+
+func (s *MemoryUserStore) PurgeDeleted(before time.Time, schedule func(Purged) error) ([]Purged, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	var purged []Purged
+	var scheduleErr error
+
+	// Users and blogs are deleted only if schedule succeeds, holding the lock
+	// keeps them from being restored meanwhile
+	tryPurge := func(p Purged) bool {
+		if err := schedule(p); err != nil {
+			if scheduleErr == nil {
+				scheduleErr = err
+			}
+
+			return false
+		}
+
+		purged = append(purged, p)
+
+		return true
+	}
+
+	for username, record := range s.users {
+		if !record.deleted.IsZero() && record.deleted.Before(before) {
+			if tryPurge(Purged{Username: username, Deleted: record.deleted}) {
+				delete(s.users, username)
+			}
+
+			continue
+		}
+
+		for slug, blog := range record.blogs {
+			if blog.Deleted == nil || !blog.Deleted.Before(before) {
+				continue
+			}
+
+			if !tryPurge(Purged{Username: username, Slug: slug, Deleted: *blog.Deleted}) {
+				continue
+			}
+
+			delete(record.blogs, slug)
+
+			for id, build := range record.builds {
+				if build.Blog == slug {
+					delete(record.builds, id)
+				}
+			}
+		}
+	}
+
+	return purged, scheduleErr
+}
+
+func (s *MemoryUserStore) CreateToken(username string, token Token) (*Token, string, error) {
+	if err := validateToken(token); err != nil {
+		return nil, "", err
+	}
+
+	newToken, secret, hash, err := makeToken(token)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	record, exists := s.liveRecord(username)
+
+	if !exists {
+		return nil, "", ErrDoesNotExist
+	}
+
+	record.tokens[newToken.ID] = memoryToken{token: newToken, hash: hash}
+
+	return &newToken, secret, nil
+}
+
+func (s *MemoryUserStore) ListTokens(username string) ([]Token, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	record, exists := s.liveRecord(username)
+
+	if !exists {
+		return nil, ErrDoesNotExist
+	}
+
+	tokens := make([]Token, 0, len(record.tokens))
+
+	for _, t := range record.tokens {
+		tokens = append(tokens, t.token)
+	}
+
+	return tokens, nil
+}
+
+func (s *MemoryUserStore) AuthenticateToken(username, secret string) (*Token, error) {
+	hash := hashTokenSecret(secret)
+
+	s.Lock()
+	defer s.Unlock()
+
+	record, exists := s.liveRecord(username)
+
+	if !exists {
+		return nil, nil
+	}
+
+	for _, t := range record.tokens {
+		if subtle.ConstantTimeCompare(t.hash, hash) == 1 {
+			token := t.token
+			return &token, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (s *MemoryUserStore) DeleteToken(username, tokenID string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	record, exists := s.liveRecord(username)
+
+	if !exists {
+		return ErrDoesNotExist
+	}
+
+	if _, exists := record.tokens[tokenID]; !exists {
+		return ErrTokenDoesNotExist
+	}
+
+	delete(record.tokens, tokenID)
+
+	return nil
+}
+
+func (s *MemoryUserStore) CreateBuild(username, blogSlug string) (*Build, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	record, exists := s.liveRecord(username)
+
+	if !exists {
+		return nil, ErrDoesNotExist
+	}
+
+	if !liveBlog(record, blogSlug) {
+		return nil, ErrBlogDoesNotExist
+	}
+
+	build := newBuild(blogSlug)
+	record.builds[build.ID] = build
+
+	return &build, nil
+}
+
+func (s *MemoryUserStore) StartBuild(username, buildID string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	record, exists := s.liveRecord(username)
+
+	if !exists {
+		return ErrDoesNotExist
+	}
+
+	build, exists := record.builds[buildID]
+
+	if !exists {
+		return ErrBuildDoesNotExist
+	}
+
+	if build.Finished != nil {
+		return ErrBuildFinished
+	}
+
+	now := time.Now()
+	build.Status = BuildRunning
+	build.Started = &now
+	record.builds[buildID] = build
+
+	return nil
+}
+
+func (s *MemoryUserStore) FinishBuild(username, buildID, commit, buildErr string) error {
+	return s.finishBuild(username, buildID, finishedBuildStatus(buildErr), commit, buildErr)
+}
+
+func (s *MemoryUserStore) SupersedeBuild(username, buildID string) error {
+	return s.finishBuild(username, buildID, BuildSuperseded, "", "")
+}
+
+func (s *MemoryUserStore) finishBuild(username, buildID string, status BuildStatus, commit, buildErr string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	record, exists := s.liveRecord(username)
+
+	if !exists {
+		return ErrDoesNotExist
+	}
+
+	build, exists := record.builds[buildID]
+
+	if !exists {
+		return ErrBuildDoesNotExist
+	}
+
+	if build.Finished != nil {
+		return ErrBuildFinished
+	}
+
+	now := time.Now()
+	build.Status = status
+	build.Commit = commit
+	build.Finished = &now
+	build.Error = buildErr
+	build.computeDuration()
+	record.builds[buildID] = build
+
+	return nil
+}
+
+func (s *MemoryUserStore) GetBuild(username, buildID string) (*Build, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	record, exists := s.liveRecord(username)
+
+	if !exists {
+		return nil, nil
+	}
+
+	build, exists := record.builds[buildID]
+
+	if !exists {
+		return nil, nil
+	}
+
+	return &build, nil
+}
+
+func (s *MemoryUserStore) ListBuilds(username, blogSlug string, limit int) ([]Build, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	record, exists := s.liveRecord(username)
+
+	if !exists {
+		return nil, ErrDoesNotExist
+	}
+
+	builds := []Build{}
+
+	for _, build := range record.builds {
+		if build.Blog == blogSlug {
+			builds = append(builds, build)
+		}
+	}
+
+	sort.Slice(builds, func(i, j int) bool {
+		return builds[i].Queued.After(builds[j].Queued)
+	})
+
+	if limit = listBuildsLimit(limit); len(builds) > limit {
+		builds = builds[:limit]
+	}
+
+	return builds, nil
+}
@@ -0,0 +1,167 @@
+package userstore
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Passwords are stored as PHC strings, that hold the algorithm and parameters
+// used for hashing along with the salt and the hash, for example
+// $argon2id$v=19$m=32768,t=3,p=4$c2FsdA$aGFzaA
+//
+// Hashes made with older parameters, or imported from other systems, remain
+// valid, and get replaced by a hash with the current parameters the next time
+// the user logs in.
+
+type Argon2Params struct {
+	Time    uint32
+	Memory  uint32 // kB
+	Threads uint8
+	KeyLen  uint32 // bytes
+	SaltLen uint32 // bytes
+}
+
+// PasswordParams are the parameters used for hashing new passwords
+var PasswordParams = Argon2Params{
+	Time:    3,
+	Memory:  32 * 1024,
+	Threads: 4,
+	KeyLen:  32,
+	SaltLen: 16,
+}
+
+const (
+	algorithmArgon2i  = "argon2i"
+	algorithmArgon2id = "argon2id"
+)
+
+// PHC strings use base64 without padding
+var phcEncoding = base64.RawStdEncoding
+
+func hashNewPassword(password string) (string, error) {
+	params := PasswordParams
+	salt := make([]byte, params.SaltLen)
+
+	if _, err := rand.Read(salt); err != nil {
+		return "", errors.Wrap(err, "Error while generating salt")
+	}
+
+	hash := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, params.KeyLen)
+
+	return encodeArgon2Hash(algorithmArgon2id, params, salt, hash), nil
+}
+
+func encodeArgon2Hash(algorithm string, params Argon2Params, salt, hash []byte) string {
+	return fmt.Sprintf("$%s$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		algorithm, argon2.Version, params.Memory, params.Time, params.Threads,
+		phcEncoding.EncodeToString(salt), phcEncoding.EncodeToString(hash))
+}
+
+// decodeArgon2Hash parses a PHC string of the argon2i or argon2id algorithms
+func decodeArgon2Hash(encoded string) (algorithm string, params Argon2Params, salt, hash []byte, err error) {
+	parts := strings.Split(encoded, "$")
+
+	if len(parts) != 6 || parts[0] != "" {
+		err = ErrPasswordHashInvalid
+		return
+	}
+
+	algorithm = parts[1]
+
+	if algorithm != algorithmArgon2i && algorithm != algorithmArgon2id {
+		err = ErrPasswordHashInvalid
+		return
+	}
+
+	var version int
+
+	if _, err = fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		err = ErrPasswordHashInvalid
+		return
+	}
+
+	if _, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads); err != nil {
+		err = ErrPasswordHashInvalid
+		return
+	}
+
+	// Tolerate padding, that PostgreSQL adds when encoding to base64
+	if salt, err = phcEncoding.DecodeString(strings.TrimRight(parts[4], "=")); err != nil {
+		err = ErrPasswordHashInvalid
+		return
+	}
+
+	if hash, err = phcEncoding.DecodeString(strings.TrimRight(parts[5], "=")); err != nil {
+		err = ErrPasswordHashInvalid
+		return
+	}
+
+	params.SaltLen = uint32(len(salt))
+	params.KeyLen = uint32(len(hash))
+
+	return
+}
+
+func isBcryptHash(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") || strings.HasPrefix(encoded, "$2b$") || strings.HasPrefix(encoded, "$2y$")
+}
+
+// verifyPassword checks a password against a stored hash. needsRehash is true
+// if the password is valid, but the hash wasn't made with the current
+// algorithm and parameters.
+func verifyPassword(password, encoded string) (valid bool, needsRehash bool, err error) {
+	if isBcryptHash(encoded) {
+		err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, false, nil
+		}
+
+		if err != nil {
+			return false, false, errors.Wrap(err, "Error while verifying bcrypt hash")
+		}
+
+		return true, true, nil
+	}
+
+	algorithm, params, salt, hash, err := decodeArgon2Hash(encoded)
+
+	if err != nil {
+		return false, false, err
+	}
+
+	var computed []byte
+
+	if algorithm == algorithmArgon2id {
+		computed = argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, params.KeyLen)
+	} else {
+		computed = argon2.Key([]byte(password), salt, params.Time, params.Memory, params.Threads, params.KeyLen)
+	}
+
+	if subtle.ConstantTimeCompare(computed, hash) != 1 {
+		return false, false, nil
+	}
+
+	return true, algorithm != algorithmArgon2id || params != PasswordParams, nil
+}
+
+// validateImportedHash checks that a hash imported from another system can be
+// verified. Only bcrypt hashes are supported for now.
+func validateImportedHash(encoded string) error {
+	if !isBcryptHash(encoded) {
+		return ErrPasswordHashInvalid
+	}
+
+	if _, err := bcrypt.Cost([]byte(encoded)); err != nil {
+		return ErrPasswordHashInvalid
+	}
+
+	return nil
+}
@@ -0,0 +1,74 @@
+package userstore_test
+
+import (
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/abustany/moblog-cloud/pkg/userstore"
+)
+
+func TestPasswordHashes(t *testing.T) {
+	store, err := userstore.NewMemoryUserStore()
+
+	if err != nil {
+		t.Fatalf("Error while creating user store: %s", err)
+	}
+
+	checkLogin := func(username, password string, expected bool) {
+		t.Helper()
+
+		ok, err := store.AuthenticateUser(username, password)
+
+		if err != nil {
+			t.Fatalf("Error while authenticating %s: %s", username, err)
+		}
+
+		if ok != expected {
+			t.Errorf("Unexpected result when authenticating %s with %s: %v", username, password, ok)
+		}
+	}
+
+	if err := store.CreateUser(userstore.User{Username: "alice", Password: "secret"}); err != nil {
+		t.Fatalf("Error while creating user: %s", err)
+	}
+
+	checkLogin("alice", "secret", true)
+	checkLogin("alice", "wrong", false)
+
+	// Hashes made with former parameters remain valid, and get upgraded
+	oldParams := userstore.PasswordParams
+	userstore.PasswordParams.Time++
+	checkLogin("alice", "secret", true)
+	checkLogin("alice", "secret", true)
+	checkLogin("alice", "wrong", false)
+	userstore.PasswordParams = oldParams
+
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("imported"), bcrypt.MinCost)
+
+	if err != nil {
+		t.Fatalf("Error while hashing password: %s", err)
+	}
+
+	if err := store.ImportUser(userstore.User{Username: "bob"}, "$argon2id$v=19$m=1,t=1,p=1$c2FsdA$aGFzaA"); err != userstore.ErrPasswordHashInvalid {
+		t.Errorf("Importing a non bcrypt hash should fail, got %v", err)
+	}
+
+	if err := store.ImportUser(userstore.User{Username: "bob"}, "$2a$10$tooshort"); err != userstore.ErrPasswordHashInvalid {
+		t.Errorf("Importing an invalid bcrypt hash should fail, got %v", err)
+	}
+
+	if err := store.ImportUser(userstore.User{Username: "bob"}, string(bcryptHash)); err != nil {
+		t.Fatalf("Error while importing user: %s", err)
+	}
+
+	if err := store.ImportUser(userstore.User{Username: "alice"}, string(bcryptHash)); err != userstore.ErrAlreadyExists {
+		t.Errorf("Importing an existing user should fail, got %v", err)
+	}
+
+	checkLogin("bob", "wrong", false)
+	checkLogin("bob", "imported", true)
+	// Now verified against the rehashed password
+	checkLogin("bob", "imported", true)
+	checkLogin("bob", "wrong", false)
+}
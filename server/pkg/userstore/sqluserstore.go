@@ -1,12 +1,15 @@
 package userstore
 
 import (
-	"bytes"
 	"database/sql"
+	"log"
 	"strings"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/pkg/errors"
+
+	"github.com/abustany/moblog-cloud/pkg/totp"
 )
 
 type SQLUserStore struct {
@@ -15,24 +18,106 @@ type SQLUserStore struct {
 	createUserStmt         *sqlx.NamedStmt
 	updateUserDataStmt     *sql.Stmt
 	updateUserPasswordStmt *sql.Stmt
+	rehashPasswordStmt     *sql.Stmt
 	getUserStmt            *sqlx.Stmt
 	authenticateUserStmt   *sql.Stmt
 	deleteUserStmt         *sql.Stmt
-
-	createBlogStmt *sql.Stmt
-	updateBlogStmt *sql.Stmt
-	getBlogStmt    *sqlx.Stmt
-	listBlogsStmt  *sqlx.Stmt
-	deleteBlogStmt *sql.Stmt
+	deletedUserStmt        *sql.Stmt
+	restoreUserStmt        *sql.Stmt
+
+	createOneTimeTokenStmt  *sql.Stmt
+	consumeOneTimeTokenStmt *sql.Stmt
+	verifyEmailStmt         *sql.Stmt
+
+	enrolTOTPStmt           *sql.Stmt
+	getTOTPStmt             *sql.Stmt
+	enableTOTPStmt          *sql.Stmt
+	updateTOTPLastStepStmt  *sql.Stmt
+	disableTOTPStmt         *sql.Stmt
+	createRecoveryCodeStmt  *sql.Stmt
+	consumeRecoveryCodeStmt *sql.Stmt
+	deleteRecoveryCodesStmt *sql.Stmt
+
+	createBlogStmt       *sql.Stmt
+	updateBlogStmt       *sql.Stmt
+	getBlogStmt          *sqlx.Stmt
+	listBlogsStmt        *sqlx.Stmt
+	deleteBlogStmt       *sql.Stmt
+	listDeletedBlogsStmt *sqlx.Stmt
+	restoreBlogStmt      *sql.Stmt
+
+	deletedBlogsStmt *sql.Stmt
+	deletedUsersStmt *sql.Stmt
+	purgeBlogStmt    *sql.Stmt
+	purgeUserStmt    *sql.Stmt
+
+	createTokenStmt       *sql.Stmt
+	listTokensStmt        *sqlx.Stmt
+	authenticateTokenStmt *sqlx.Stmt
+	deleteTokenStmt       *sql.Stmt
+
+	createBuildStmt *sql.Stmt
+	startBuildStmt  *sql.Stmt
+	finishBuildStmt *sql.Stmt
+	getBuildStmt    *sqlx.Stmt
+	listBuildsStmt  *sqlx.Stmt
 }
 
 type userRecord struct {
-	Username    string `db:"username"`
-	DisplayName string `db:"displayname"`
-	Salt        []byte `db:"salt"`
-	Password    []byte `db:"password"`
+	Username      string `db:"username"`
+	DisplayName   string `db:"displayname"`
+	PasswordHash  string `db:"password_hash"`
+	Email         string `db:"email"`
+	EmailVerified bool   `db:"email_verified"`
+	TOTPEnabled   bool   `db:"totp_enabled"`
+}
+
+type tokenRecord struct {
+	ID      string    `db:"id"`
+	Name    string    `db:"name"`
+	Scopes  string    `db:"scopes"` // space separated
+	Created time.Time `db:"created"`
+}
+
+func (r *tokenRecord) token() Token {
+	return Token{
+		ID:      r.ID,
+		Name:    r.Name,
+		Scopes:  strings.Fields(r.Scopes),
+		Created: r.Created,
+	}
+}
+
+type buildRecord struct {
+	ID       string     `db:"id"`
+	Blog     string     `db:"blog"`
+	Status   string     `db:"status"`
+	Commit   string     `db:"commit_sha"`
+	Queued   time.Time  `db:"queued"`
+	Started  *time.Time `db:"started"`
+	Finished *time.Time `db:"finished"`
+	Error    string     `db:"error"`
+}
+
+func (r *buildRecord) build() Build {
+	build := Build{
+		ID:       r.ID,
+		Blog:     r.Blog,
+		Status:   BuildStatus(r.Status),
+		Commit:   r.Commit,
+		Queued:   r.Queued,
+		Started:  r.Started,
+		Finished: r.Finished,
+		Error:    r.Error,
+	}
+
+	build.computeDuration()
+
+	return build
 }
 
+const buildColumns = `id, blog, status, commit_sha, queued, started, finished, error`
+
 func NewSQLUserStore(driverName string, dbUrl string) (*SQLUserStore, error) {
 	db, err := sqlx.Connect(driverName, dbUrl)
 
@@ -40,87 +125,299 @@ func NewSQLUserStore(driverName string, dbUrl string) (*SQLUserStore, error) {
 		return nil, errors.Wrap(err, "Error while connecting to the database")
 	}
 
-	createUserStmt, err := db.PrepareNamed(`INSERT INTO users VALUES (:username, :displayname, :salt, :password)`)
+	createUserStmt, err := db.PrepareNamed(`INSERT INTO users (username, displayname, password_hash, email) VALUES (:username, :displayname, :password_hash, :email)`)
 
 	if err != nil {
 		return nil, errors.Wrap(err, "Error while preparing create user statement")
 	}
 
-	updateUserDataStmt, err := db.Prepare(`UPDATE users SET displayname = $1 WHERE username = $2`)
+	updateUserDataStmt, err := db.Prepare(`UPDATE users SET displayname = $1, email = $2, email_verified = email_verified AND email = $2 WHERE username = $3 AND deleted_at IS NULL`)
 
 	if err != nil {
 		return nil, errors.Wrap(err, "Error while preparing update user data statement")
 	}
 
-	updateUserPasswordStmt, err := db.Prepare(`UPDATE users SET salt = $1, password = $2 WHERE username = $3`)
+	updateUserPasswordStmt, err := db.Prepare(`UPDATE users SET password_hash = $1 WHERE username = $2 AND deleted_at IS NULL`)
 
 	if err != nil {
 		return nil, errors.Wrap(err, "Error while preparing update user password statement")
 	}
 
-	getUserStmt, err := db.Preparex(`SELECT * FROM users WHERE username = $1`)
+	// Only replaces the hash if the password didn't change in the meantime
+	rehashPasswordStmt, err := db.Prepare(`UPDATE users SET password_hash = $1 WHERE username = $2 AND password_hash = $3`)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while preparing rehash password statement")
+	}
+
+	getUserStmt, err := db.Preparex(`SELECT username, displayname, email, email_verified, totp_secret <> '' AS totp_enabled FROM users WHERE username = $1 AND deleted_at IS NULL`)
 
 	if err != nil {
 		return nil, errors.Wrap(err, "Error while preparing get user statement")
 	}
 
-	authenticateUserStmt, err := db.Prepare(`SELECT salt, password FROM users WHERE username = $1`)
+	authenticateUserStmt, err := db.Prepare(`SELECT password_hash FROM users WHERE username = $1 AND deleted_at IS NULL`)
 
 	if err != nil {
 		return nil, errors.Wrap(err, "Error while preparing authenticate user statement")
 	}
 
-	deleteUserStmt, err := db.Prepare(`DELETE FROM users WHERE username = $1`)
+	deleteUserStmt, err := db.Prepare(`UPDATE users SET deleted_at = now() WHERE username = $1 AND deleted_at IS NULL`)
 
 	if err != nil {
 		return nil, errors.Wrap(err, "Error while preparing delete user statement")
 	}
 
+	deletedUserStmt, err := db.Prepare(`SELECT password_hash FROM users WHERE username = $1 AND deleted_at IS NOT NULL`)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while preparing deleted user statement")
+	}
+
+	restoreUserStmt, err := db.Prepare(`UPDATE users SET deleted_at = NULL WHERE username = $1 AND deleted_at IS NOT NULL`)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while preparing restore user statement")
+	}
+
+	createOneTimeTokenStmt, err := db.Prepare(`INSERT INTO one_time_tokens (username, purpose, hash, email, expires) VALUES ($1, $2, $3, $4, $5) ON CONFLICT (username, purpose) DO UPDATE SET hash = EXCLUDED.hash, email = EXCLUDED.email, expires = EXCLUDED.expires`)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while preparing create one time token statement")
+	}
+
+	consumeOneTimeTokenStmt, err := db.Prepare(`DELETE FROM one_time_tokens WHERE username = $1 AND purpose = $2 AND hash = $3 RETURNING email, expires`)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while preparing consume one time token statement")
+	}
+
+	// The address might have changed since the token was sent
+	verifyEmailStmt, err := db.Prepare(`UPDATE users SET email_verified = true WHERE username = $1 AND email = $2 AND deleted_at IS NULL`)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while preparing verify email statement")
+	}
+
+	enrolTOTPStmt, err := db.Prepare(`UPDATE users SET totp_pending_secret = $1 WHERE username = $2 AND deleted_at IS NULL`)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while preparing enrol TOTP statement")
+	}
+
+	getTOTPStmt, err := db.Prepare(`SELECT totp_secret, totp_pending_secret, totp_last_step FROM users WHERE username = $1 AND deleted_at IS NULL FOR UPDATE`)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while preparing get TOTP statement")
+	}
+
+	enableTOTPStmt, err := db.Prepare(`UPDATE users SET totp_secret = totp_pending_secret, totp_pending_secret = '', totp_last_step = $1 WHERE username = $2`)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while preparing enable TOTP statement")
+	}
+
+	updateTOTPLastStepStmt, err := db.Prepare(`UPDATE users SET totp_last_step = $1 WHERE username = $2`)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while preparing update TOTP last step statement")
+	}
+
+	disableTOTPStmt, err := db.Prepare(`UPDATE users SET totp_secret = '', totp_pending_secret = '', totp_last_step = 0 WHERE username = $1 AND deleted_at IS NULL`)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while preparing disable TOTP statement")
+	}
+
+	createRecoveryCodeStmt, err := db.Prepare(`INSERT INTO recovery_codes (username, hash) VALUES ($1, $2)`)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while preparing create recovery code statement")
+	}
+
+	consumeRecoveryCodeStmt, err := db.Prepare(`DELETE FROM recovery_codes WHERE username = $1 AND hash = $2`)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while preparing consume recovery code statement")
+	}
+
+	deleteRecoveryCodesStmt, err := db.Prepare(`DELETE FROM recovery_codes WHERE username = $1`)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while preparing delete recovery codes statement")
+	}
+
 	createBlogStmt, err := db.Prepare(`INSERT INTO blogs VALUES ($1, $2, $3)`)
 
 	if err != nil {
 		return nil, errors.Wrap(err, "Error while preparing create blog statement")
 	}
 
-	updateBlogStmt, err := db.Prepare(`UPDATE blogs SET displayname = $1 WHERE username = $2 AND slug = $3`)
+	updateBlogStmt, err := db.Prepare(`UPDATE blogs SET displayname = $1 WHERE username = $2 AND slug = $3 AND deleted_at IS NULL`)
 
 	if err != nil {
 		return nil, errors.Wrap(err, "Error while preparing update blog statement")
 	}
 
-	getBlogStmt, err := db.Preparex(`SELECT slug, displayname FROM blogs WHERE username = $1 AND slug = $2`)
+	getBlogStmt, err := db.Preparex(`SELECT slug, displayname FROM blogs WHERE username = $1 AND slug = $2 AND deleted_at IS NULL`)
 
 	if err != nil {
 		return nil, errors.Wrap(err, "Error while preparing get blog statement")
 	}
 
-	listBlogsStmt, err := db.Preparex(`SELECT slug, displayname FROM blogs WHERE username = $1`)
+	listBlogsStmt, err := db.Preparex(`SELECT slug, displayname FROM blogs WHERE username = $1 AND deleted_at IS NULL`)
 
 	if err != nil {
 		return nil, errors.Wrap(err, "Error while preparing list blogs statement")
 	}
 
-	deleteBlogStmt, err := db.Prepare(`DELETE FROM blogs WHERE username = $1 AND slug = $2`)
+	deleteBlogStmt, err := db.Prepare(`UPDATE blogs SET deleted_at = now() WHERE username = $1 AND slug = $2 AND deleted_at IS NULL`)
 
 	if err != nil {
 		return nil, errors.Wrap(err, "Error while preparing delete blog statement")
 	}
 
+	listDeletedBlogsStmt, err := db.Preparex(`SELECT slug, displayname, deleted_at AS deleted FROM blogs WHERE username = $1 AND deleted_at IS NOT NULL ORDER BY deleted_at DESC`)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while preparing list deleted blogs statement")
+	}
+
+	restoreBlogStmt, err := db.Prepare(`UPDATE blogs SET deleted_at = NULL WHERE username = $1 AND slug = $2 AND deleted_at IS NOT NULL`)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while preparing restore blog statement")
+	}
+
+	// Locking the rows until they are purged keeps them from being restored
+	deletedBlogsStmt, err := db.Prepare(`SELECT username, slug, deleted_at FROM blogs WHERE deleted_at < $1 FOR UPDATE`)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while preparing deleted blogs statement")
+	}
+
+	deletedUsersStmt, err := db.Prepare(`SELECT username, deleted_at FROM users WHERE deleted_at < $1 FOR UPDATE`)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while preparing deleted users statement")
+	}
+
+	purgeBlogStmt, err := db.Prepare(`DELETE FROM blogs WHERE username = $1 AND slug = $2`)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while preparing purge blog statement")
+	}
+
+	// The blogs, tokens and builds of purged users go away with them
+	purgeUserStmt, err := db.Prepare(`DELETE FROM users WHERE username = $1`)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while preparing purge user statement")
+	}
+
+	createTokenStmt, err := db.Prepare(`INSERT INTO tokens (id, username, name, scopes, hash, created) VALUES ($1, $2, $3, $4, $5, $6)`)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while preparing create token statement")
+	}
+
+	listTokensStmt, err := db.Preparex(`SELECT id, name, scopes, created FROM tokens WHERE username = $1`)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while preparing list tokens statement")
+	}
+
+	authenticateTokenStmt, err := db.Preparex(`SELECT id, name, scopes, created FROM tokens JOIN users USING (username) WHERE username = $1 AND hash = $2 AND deleted_at IS NULL`)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while preparing authenticate token statement")
+	}
+
+	deleteTokenStmt, err := db.Prepare(`DELETE FROM tokens WHERE username = $1 AND id = $2`)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while preparing delete token statement")
+	}
+
+	createBuildStmt, err := db.Prepare(`INSERT INTO builds (id, username, blog, status, queued) VALUES ($1, $2, $3, $4, $5)`)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while preparing create build statement")
+	}
+
+	startBuildStmt, err := db.Prepare(`UPDATE builds SET status = $1, started = $2 WHERE username = $3 AND id = $4 AND finished IS NULL`)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while preparing start build statement")
+	}
+
+	finishBuildStmt, err := db.Prepare(`UPDATE builds SET status = $1, commit_sha = $2, finished = $3, error = $4 WHERE username = $5 AND id = $6 AND finished IS NULL`)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while preparing finish build statement")
+	}
+
+	getBuildStmt, err := db.Preparex(`SELECT ` + buildColumns + ` FROM builds WHERE username = $1 AND id = $2`)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while preparing get build statement")
+	}
+
+	listBuildsStmt, err := db.Preparex(`SELECT ` + buildColumns + ` FROM builds WHERE username = $1 AND blog = $2 ORDER BY queued DESC LIMIT $3`)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while preparing list builds statement")
+	}
+
 	return &SQLUserStore{
 		db,
 
 		createUserStmt,
 		updateUserDataStmt,
 		updateUserPasswordStmt,
+		rehashPasswordStmt,
 		getUserStmt,
 		authenticateUserStmt,
 		deleteUserStmt,
+		deletedUserStmt,
+		restoreUserStmt,
+
+		createOneTimeTokenStmt,
+		consumeOneTimeTokenStmt,
+		verifyEmailStmt,
+
+		enrolTOTPStmt,
+		getTOTPStmt,
+		enableTOTPStmt,
+		updateTOTPLastStepStmt,
+		disableTOTPStmt,
+		createRecoveryCodeStmt,
+		consumeRecoveryCodeStmt,
+		deleteRecoveryCodesStmt,
 
 		createBlogStmt,
 		updateBlogStmt,
 		getBlogStmt,
 		listBlogsStmt,
 		deleteBlogStmt,
+		listDeletedBlogsStmt,
+		restoreBlogStmt,
+
+		deletedBlogsStmt,
+		deletedUsersStmt,
+		purgeBlogStmt,
+		purgeUserStmt,
+
+		createTokenStmt,
+		listTokensStmt,
+		authenticateTokenStmt,
+		deleteTokenStmt,
+
+		createBuildStmt,
+		startBuildStmt,
+		finishBuildStmt,
+		getBuildStmt,
+		listBuildsStmt,
 	}, nil
 }
 
@@ -129,17 +426,33 @@ func (s *SQLUserStore) CreateUser(user User) error {
 		return err
 	}
 
-	salt, password, err := hashNewPassword(user.Password)
+	passwordHash, err := hashNewPassword(user.Password)
 
 	if err != nil {
 		return errors.Wrap(err, "Error while hashing password")
 	}
 
+	return s.insertUser(user, passwordHash)
+}
+
+func (s *SQLUserStore) ImportUser(user User, passwordHash string) error {
+	if err := validateUser(user, true); err != nil {
+		return err
+	}
+
+	if err := validateImportedHash(passwordHash); err != nil {
+		return err
+	}
+
+	return s.insertUser(user, passwordHash)
+}
+
+func (s *SQLUserStore) insertUser(user User, passwordHash string) error {
 	record := userRecord{
-		Username:    user.Username,
-		DisplayName: user.DisplayName,
-		Salt:        salt,
-		Password:    password,
+		Username:     user.Username,
+		DisplayName:  user.DisplayName,
+		PasswordHash: passwordHash,
+		Email:        user.Email,
 	}
 
 	if _, err := s.createUserStmt.Exec(&record); err != nil {
@@ -180,11 +493,21 @@ func (s *SQLUserStore) UpdateUser(user User) error {
 		return err
 	}
 
+	var passwordHash string
+
+	if user.Password != "" {
+		var err error
+
+		if passwordHash, err = hashNewPassword(user.Password); err != nil {
+			return errors.Wrap(err, "Error while hashing password")
+		}
+	}
+
 	err := s.inTx(func(tx *sql.Tx) error {
 		var result sql.Result
 		var err error
 
-		if result, err = tx.Stmt(s.updateUserDataStmt).Exec(user.DisplayName, user.Username); err != nil {
+		if result, err = tx.Stmt(s.updateUserDataStmt).Exec(user.DisplayName, user.Email, user.Username); err != nil {
 			return errors.Wrap(err, "Error while updating user data")
 		}
 
@@ -198,19 +521,8 @@ func (s *SQLUserStore) UpdateUser(user User) error {
 			return ErrDoesNotExist
 		}
 
-		if user.Password != "" {
-			var salt []byte
-			var oldHash []byte
-
-			err := s.authenticateUserStmt.QueryRow(user.Username).Scan(&salt, &oldHash)
-
-			if err == sql.ErrNoRows {
-				return errors.New("No password row!?")
-			}
-
-			password := hashPassword(user.Password, salt)
-
-			if _, err := tx.Stmt(s.updateUserPasswordStmt).Exec(salt, password, user.Username); err != nil {
+		if passwordHash != "" {
+			if _, err := tx.Stmt(s.updateUserPasswordStmt).Exec(passwordHash, user.Username); err != nil {
 				return errors.Wrap(err, "Error while updating user password")
 			}
 		}
@@ -234,28 +546,56 @@ func (s *SQLUserStore) GetUser(username string) (*User, error) {
 	}
 
 	return &User{
-		Username:    record.Username,
-		DisplayName: record.DisplayName,
+		Username:         record.Username,
+		DisplayName:      record.DisplayName,
+		Email:            record.Email,
+		EmailVerified:    record.EmailVerified,
+		TwoFactorEnabled: record.TOTPEnabled,
 	}, nil
 }
 
 func (s *SQLUserStore) AuthenticateUser(username, password string) (bool, error) {
-	var salt []byte
-	var dbHash []byte
+	var dbHash string
 
-	err := s.authenticateUserStmt.QueryRow(username).Scan(&salt, &dbHash)
+	err := s.authenticateUserStmt.QueryRow(username).Scan(&dbHash)
 
 	if err == sql.ErrNoRows {
 		return false, nil
 	}
 
-	hash := hashPassword(password, salt)
+	if err != nil {
+		return false, errors.Wrap(err, "Error while fetching password hash")
+	}
+
+	valid, needsRehash, err := verifyPassword(password, dbHash)
+
+	if err != nil || !valid {
+		return false, errors.Wrapf(err, "Error while verifying password of user %s", username)
+	}
+
+	if needsRehash {
+		// The password is valid anyway, failing to upgrade its hash should not
+		// prevent the user from logging in
+		if err := s.rehashPassword(username, password, dbHash); err != nil {
+			log.Printf("Error while rehashing password of user %s: %s", username, err)
+		}
+	}
+
+	return true, nil
+}
+
+func (s *SQLUserStore) rehashPassword(username, password, oldHash string) error {
+	newHash, err := hashNewPassword(password)
 
 	if err != nil {
-		return false, errors.Wrap(err, "Error while hashing password")
+		return err
+	}
+
+	if _, err := s.rehashPasswordStmt.Exec(newHash, username, oldHash); err != nil {
+		return errors.Wrap(err, "Error while updating password hash")
 	}
 
-	return bytes.Equal(hash, dbHash), nil
+	return nil
 }
 
 func (s *SQLUserStore) DeleteUser(username string) error {
@@ -278,88 +618,712 @@ func (s *SQLUserStore) DeleteUser(username string) error {
 	return nil
 }
 
-func (s *SQLUserStore) AddBlog(username string, blog Blog) error {
-	if err := validateBlog(blog); err != nil {
-		return err
-	}
+func (s *SQLUserStore) RestoreUser(username, password string) error {
+	var dbHash string
 
-	if _, err := s.createBlogStmt.Exec(username, blog.Slug, blog.DisplayName); err != nil {
-		if strings.Contains(err.Error(), "duplicate key value violates unique constraint") {
-			return ErrBlogAlreadyExists
-		}
+	err := s.deletedUserStmt.QueryRow(username).Scan(&dbHash)
 
-		return errors.Wrap(err, "Error while creating blog")
+	if err == sql.ErrNoRows {
+		return ErrDoesNotExist
 	}
 
-	return nil
-}
+	if err != nil {
+		return errors.Wrap(err, "Error while fetching deleted user")
+	}
 
-func (s *SQLUserStore) UpdateBlog(username string, blog Blog) error {
-	if err := validateBlog(blog); err != nil {
-		return err
+	if valid, _, err := verifyPassword(password, dbHash); err != nil {
+		return errors.Wrapf(err, "Error while verifying password of user %s", username)
+	} else if !valid {
+		return ErrDoesNotExist
 	}
 
-	result, err := s.updateBlogStmt.Exec(blog.DisplayName, username, blog.Slug)
+	res, err := s.restoreUserStmt.Exec(username)
 
 	if err != nil {
-		return errors.Wrap(err, "Error while updating blog")
+		return errors.Wrap(err, "Error while restoring user")
 	}
 
-	rowsAffected, err := result.RowsAffected()
+	rowsAffected, err := res.RowsAffected()
 
 	if err != nil {
-		return errors.Wrap(err, "Error counting the affected rows")
+		return errors.Wrap(err, "Error while counting affected rows")
 	}
 
 	if rowsAffected != 1 {
-		return ErrBlogDoesNotExist
+		return ErrDoesNotExist
 	}
 
 	return nil
 }
 
-func (s *SQLUserStore) GetBlog(username, blogSlug string) (*Blog, error) {
-	var blog Blog
-	err := s.getBlogStmt.Get(&blog, username, blogSlug)
+func (s *SQLUserStore) CreateOneTimeToken(username string, purpose OneTimeTokenPurpose) (string, string, error) {
+	user, err := s.GetUser(username)
 
-	if err == sql.ErrNoRows {
-		return nil, nil
+	if err != nil {
+		return "", "", err
+	}
+
+	if user == nil {
+		return "", "", ErrDoesNotExist
+	}
+
+	if err := checkOneTimeTokenEmail(*user, purpose); err != nil {
+		return "", "", err
 	}
 
+	secret, err := generateTokenSecret()
+
 	if err != nil {
-		return nil, errors.Wrap(err, "Error while fetching blog")
+		return "", "", errors.Wrap(err, "Error while generating one time token")
 	}
 
-	return &blog, nil
+	expires := time.Now().Add(OneTimeTokenValidity[purpose])
+
+	if _, err := s.createOneTimeTokenStmt.Exec(username, string(purpose), hashTokenSecret(secret), user.Email, expires); err != nil {
+		return "", "", errors.Wrap(err, "Error while creating one time token")
+	}
+
+	return secret, user.Email, nil
 }
 
-func (s *SQLUserStore) ListBlogs(username string) ([]Blog, error) {
-	var blogs []Blog
-	err := s.listBlogsStmt.Select(&blogs, username)
+// consumeOneTimeToken deletes a one time token if the secret matches, and
+// returns the address it was sent to
+func (s *SQLUserStore) consumeOneTimeToken(tx *sql.Tx, username string, purpose OneTimeTokenPurpose, secret string) (string, error) {
+	var email string
+	var expires time.Time
+
+	err := tx.Stmt(s.consumeOneTimeTokenStmt).QueryRow(username, string(purpose), hashTokenSecret(secret)).Scan(&email, &expires)
+
+	if err == sql.ErrNoRows {
+		return "", ErrOneTimeTokenInvalid
+	}
 
 	if err != nil {
-		return nil, errors.Wrap(err, "Error while fetching blogs")
+		return "", errors.Wrap(err, "Error while consuming one time token")
 	}
 
-	return blogs, nil
+	if time.Now().After(expires) {
+		return "", ErrOneTimeTokenInvalid
+	}
+
+	return email, nil
 }
 
-func (s *SQLUserStore) DeleteBlog(username, blogSlug string) error {
-	res, err := s.deleteBlogStmt.Exec(username, blogSlug)
+func (s *SQLUserStore) VerifyEmail(username, secret string) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		email, err := s.consumeOneTimeToken(tx, username, OneTimeTokenVerifyEmail, secret)
 
-	if err != nil {
-		return errors.Wrap(err, "Error while deleting blog")
+		if err != nil {
+			return err
+		}
+
+		res, err := tx.Stmt(s.verifyEmailStmt).Exec(username, email)
+
+		if err != nil {
+			return errors.Wrap(err, "Error while verifying email")
+		}
+
+		rowsAffected, err := res.RowsAffected()
+
+		if err != nil {
+			return errors.Wrap(err, "Error while counting affected rows")
+		}
+
+		if rowsAffected != 1 {
+			return ErrOneTimeTokenInvalid
+		}
+
+		return nil
+	})
+}
+
+func (s *SQLUserStore) ResetPassword(username, secret, password string) error {
+	if password == "" {
+		return ErrPasswordEmpty
 	}
 
-	rowsAffected, err := res.RowsAffected()
+	passwordHash, err := hashNewPassword(password)
 
 	if err != nil {
-		return errors.Wrap(err, "Error while counting affected rows")
+		return errors.Wrap(err, "Error while hashing password")
 	}
 
-	if rowsAffected != 1 {
-		return ErrBlogDoesNotExist
-	}
+	return s.inTx(func(tx *sql.Tx) error {
+		if _, err := s.consumeOneTimeToken(tx, username, OneTimeTokenResetPassword, secret); err != nil {
+			return err
+		}
 
-	return nil
+		res, err := tx.Stmt(s.updateUserPasswordStmt).Exec(passwordHash, username)
+
+		if err != nil {
+			return errors.Wrap(err, "Error while resetting password")
+		}
+
+		rowsAffected, err := res.RowsAffected()
+
+		if err != nil {
+			return errors.Wrap(err, "Error while counting affected rows")
+		}
+
+		if rowsAffected != 1 {
+			return ErrOneTimeTokenInvalid
+		}
+
+		return nil
+	})
+}
+
+func (s *SQLUserStore) EnrolTOTP(username string) (string, error) {
+	secret, err := totp.GenerateSecret()
+
+	if err != nil {
+		return "", err
+	}
+
+	res, err := s.enrolTOTPStmt.Exec(secret, username)
+
+	if err != nil {
+		return "", errors.Wrap(err, "Error while enrolling TOTP secret")
+	}
+
+	rowsAffected, err := res.RowsAffected()
+
+	if err != nil {
+		return "", errors.Wrap(err, "Error while counting affected rows")
+	}
+
+	if rowsAffected != 1 {
+		return "", ErrDoesNotExist
+	}
+
+	return secret, nil
+}
+
+type totpRecord struct {
+	secret        string
+	pendingSecret string
+	lastStep      int64
+}
+
+// getTOTP locks the user row until the end of the transaction, so that
+// concurrent logins cannot use the same code
+func (s *SQLUserStore) getTOTP(tx *sql.Tx, username string) (*totpRecord, error) {
+	var record totpRecord
+
+	err := tx.Stmt(s.getTOTPStmt).QueryRow(username).Scan(&record.secret, &record.pendingSecret, &record.lastStep)
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while fetching TOTP secret")
+	}
+
+	return &record, nil
+}
+
+func (s *SQLUserStore) ConfirmTOTP(username, code string) ([]string, error) {
+	codes, hashes, err := generateRecoveryCodes()
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while generating recovery codes")
+	}
+
+	err = s.inTx(func(tx *sql.Tx) error {
+		record, err := s.getTOTP(tx, username)
+
+		if err != nil {
+			return err
+		}
+
+		if record == nil {
+			return ErrDoesNotExist
+		}
+
+		if record.pendingSecret == "" {
+			return ErrTOTPNotEnrolled
+		}
+
+		step, ok := totp.Validate(record.pendingSecret, code, time.Now())
+
+		if !ok {
+			return ErrTOTPCodeInvalid
+		}
+
+		if _, err := tx.Stmt(s.enableTOTPStmt).Exec(step, username); err != nil {
+			return errors.Wrap(err, "Error while enabling TOTP")
+		}
+
+		if _, err := tx.Stmt(s.deleteRecoveryCodesStmt).Exec(username); err != nil {
+			return errors.Wrap(err, "Error while deleting recovery codes")
+		}
+
+		for _, hash := range hashes {
+			if _, err := tx.Stmt(s.createRecoveryCodeStmt).Exec(username, hash); err != nil {
+				return errors.Wrap(err, "Error while creating recovery code")
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+func (s *SQLUserStore) AuthenticateSecondFactor(username, code string) (bool, error) {
+	var authenticated bool
+
+	err := s.inTx(func(tx *sql.Tx) error {
+		record, err := s.getTOTP(tx, username)
+
+		if err != nil || record == nil || record.secret == "" {
+			return err
+		}
+
+		if step, ok := totp.Validate(record.secret, code, time.Now()); ok && step > record.lastStep {
+			if _, err := tx.Stmt(s.updateTOTPLastStepStmt).Exec(step, username); err != nil {
+				return errors.Wrap(err, "Error while updating TOTP last step")
+			}
+
+			authenticated = true
+			return nil
+		}
+
+		res, err := tx.Stmt(s.consumeRecoveryCodeStmt).Exec(username, hashRecoveryCode(code))
+
+		if err != nil {
+			return errors.Wrap(err, "Error while consuming recovery code")
+		}
+
+		rowsAffected, err := res.RowsAffected()
+
+		if err != nil {
+			return errors.Wrap(err, "Error while counting affected rows")
+		}
+
+		authenticated = rowsAffected == 1
+
+		return nil
+	})
+
+	if err != nil {
+		return false, err
+	}
+
+	return authenticated, nil
+}
+
+func (s *SQLUserStore) DisableTOTP(username string) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		res, err := tx.Stmt(s.disableTOTPStmt).Exec(username)
+
+		if err != nil {
+			return errors.Wrap(err, "Error while disabling TOTP")
+		}
+
+		rowsAffected, err := res.RowsAffected()
+
+		if err != nil {
+			return errors.Wrap(err, "Error while counting affected rows")
+		}
+
+		if rowsAffected != 1 {
+			return ErrDoesNotExist
+		}
+
+		_, err = tx.Stmt(s.deleteRecoveryCodesStmt).Exec(username)
+
+		return errors.Wrap(err, "Error while deleting recovery codes")
+	})
+}
+
+func (s *SQLUserStore) AddBlog(username string, blog Blog) error {
+	if err := validateBlog(blog); err != nil {
+		return err
+	}
+
+	if _, err := s.createBlogStmt.Exec(username, blog.Slug, blog.DisplayName); err != nil {
+		if strings.Contains(err.Error(), "duplicate key value violates unique constraint") {
+			return ErrBlogAlreadyExists
+		}
+
+		return errors.Wrap(err, "Error while creating blog")
+	}
+
+	return nil
+}
+
+func (s *SQLUserStore) UpdateBlog(username string, blog Blog) error {
+	if err := validateBlog(blog); err != nil {
+		return err
+	}
+
+	result, err := s.updateBlogStmt.Exec(blog.DisplayName, username, blog.Slug)
+
+	if err != nil {
+		return errors.Wrap(err, "Error while updating blog")
+	}
+
+	rowsAffected, err := result.RowsAffected()
+
+	if err != nil {
+		return errors.Wrap(err, "Error counting the affected rows")
+	}
+
+	if rowsAffected != 1 {
+		return ErrBlogDoesNotExist
+	}
+
+	return nil
+}
+
+func (s *SQLUserStore) GetBlog(username, blogSlug string) (*Blog, error) {
+	var blog Blog
+	err := s.getBlogStmt.Get(&blog, username, blogSlug)
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while fetching blog")
+	}
+
+	return &blog, nil
+}
+
+func (s *SQLUserStore) ListBlogs(username string) ([]Blog, error) {
+	var blogs []Blog
+	err := s.listBlogsStmt.Select(&blogs, username)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while fetching blogs")
+	}
+
+	return blogs, nil
+}
+
+func (s *SQLUserStore) DeleteBlog(username, blogSlug string) error {
+	res, err := s.deleteBlogStmt.Exec(username, blogSlug)
+
+	if err != nil {
+		return errors.Wrap(err, "Error while deleting blog")
+	}
+
+	rowsAffected, err := res.RowsAffected()
+
+	if err != nil {
+		return errors.Wrap(err, "Error while counting affected rows")
+	}
+
+	if rowsAffected != 1 {
+		return ErrBlogDoesNotExist
+	}
+
+	return nil
+}
+
+func (s *SQLUserStore) ListDeletedBlogs(username string) ([]Blog, error) {
+	var blogs []Blog
+	err := s.listDeletedBlogsStmt.Select(&blogs, username)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while fetching deleted blogs")
+	}
+
+	return blogs, nil
+}
+
+func (s *SQLUserStore) RestoreBlog(username, blogSlug string) error {
+	res, err := s.restoreBlogStmt.Exec(username, blogSlug)
+
+	if err != nil {
+		return errors.Wrap(err, "Error while restoring blog")
+	}
+
+	rowsAffected, err := res.RowsAffected()
+
+	if err != nil {
+		return errors.Wrap(err, "Error while counting affected rows")
+	}
+
+	if rowsAffected != 1 {
+		return ErrBlogDoesNotExist
+	}
+
+	return nil
+}
+
+func (s *SQLUserStore) PurgeDeleted(before time.Time, schedule func(Purged) error) ([]Purged, error) {
+	var purged []Purged
+	var scheduleErr error
+
+	err := s.inTx(func(tx *sql.Tx) error {
+		deleted, err := listDeleted(tx.Stmt(s.deletedBlogsStmt), before, true)
+
+		if err != nil {
+			return errors.Wrap(err, "Error while listing deleted blogs")
+		}
+
+		deletedUsers, err := listDeleted(tx.Stmt(s.deletedUsersStmt), before, false)
+
+		if err != nil {
+			return errors.Wrap(err, "Error while listing deleted users")
+		}
+
+		for _, p := range append(deleted, deletedUsers...) {
+			if err := schedule(p); err != nil {
+				if scheduleErr == nil {
+					scheduleErr = err
+				}
+
+				continue
+			}
+
+			if p.Slug != "" {
+				_, err = tx.Stmt(s.purgeBlogStmt).Exec(p.Username, p.Slug)
+			} else {
+				_, err = tx.Stmt(s.purgeUserStmt).Exec(p.Username)
+			}
+
+			if err != nil {
+				return errors.Wrap(err, "Error while purging deleted user or blog")
+			}
+
+			purged = append(purged, p)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return purged, scheduleErr
+}
+
+// listDeleted reads the deleted blogs or users returned by stmt
+func listDeleted(stmt *sql.Stmt, before time.Time, blogs bool) ([]Purged, error) {
+	rows, err := stmt.Query(before)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var deleted []Purged
+
+	for rows.Next() {
+		var p Purged
+		var err error
+
+		if blogs {
+			err = rows.Scan(&p.Username, &p.Slug, &p.Deleted)
+		} else {
+			err = rows.Scan(&p.Username, &p.Deleted)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		deleted = append(deleted, p)
+	}
+
+	return deleted, rows.Err()
+}
+
+func (s *SQLUserStore) CreateToken(username string, token Token) (*Token, string, error) {
+	if err := validateToken(token); err != nil {
+		return nil, "", err
+	}
+
+	newToken, secret, hash, err := makeToken(token)
+
+	if err != nil {
+		return nil, "", errors.Wrap(err, "Error while generating token")
+	}
+
+	_, err = s.createTokenStmt.Exec(newToken.ID, username, newToken.Name, strings.Join(newToken.Scopes, " "), hash, newToken.Created)
+
+	if err != nil {
+		if strings.Contains(err.Error(), "violates foreign key constraint") {
+			return nil, "", ErrDoesNotExist
+		}
+
+		return nil, "", errors.Wrap(err, "Error while creating token")
+	}
+
+	return &newToken, secret, nil
+}
+
+func (s *SQLUserStore) ListTokens(username string) ([]Token, error) {
+	var records []tokenRecord
+
+	if err := s.listTokensStmt.Select(&records, username); err != nil {
+		return nil, errors.Wrap(err, "Error while fetching tokens")
+	}
+
+	tokens := make([]Token, len(records))
+
+	for i := range records {
+		tokens[i] = records[i].token()
+	}
+
+	return tokens, nil
+}
+
+func (s *SQLUserStore) AuthenticateToken(username, secret string) (*Token, error) {
+	var record tokenRecord
+	err := s.authenticateTokenStmt.Get(&record, username, hashTokenSecret(secret))
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while fetching token")
+	}
+
+	token := record.token()
+
+	return &token, nil
+}
+
+func (s *SQLUserStore) DeleteToken(username, tokenID string) error {
+	res, err := s.deleteTokenStmt.Exec(username, tokenID)
+
+	if err != nil {
+		return errors.Wrap(err, "Error while deleting token")
+	}
+
+	rowsAffected, err := res.RowsAffected()
+
+	if err != nil {
+		return errors.Wrap(err, "Error while counting affected rows")
+	}
+
+	if rowsAffected != 1 {
+		return ErrTokenDoesNotExist
+	}
+
+	return nil
+}
+
+func (s *SQLUserStore) CreateBuild(username, blogSlug string) (*Build, error) {
+	build := newBuild(blogSlug)
+
+	if _, err := s.createBuildStmt.Exec(build.ID, username, build.Blog, string(build.Status), build.Queued); err != nil {
+		if strings.Contains(err.Error(), "violates foreign key constraint") {
+			return nil, ErrBlogDoesNotExist
+		}
+
+		return nil, errors.Wrap(err, "Error while creating build")
+	}
+
+	return &build, nil
+}
+
+// buildUpdateError returns the error to return when updating a build did not
+// affect any row.
+func (s *SQLUserStore) buildUpdateError(username, buildID string) error {
+	build, err := s.GetBuild(username, buildID)
+
+	if err != nil {
+		return err
+	}
+
+	if build == nil {
+		return ErrBuildDoesNotExist
+	}
+
+	return ErrBuildFinished
+}
+
+func (s *SQLUserStore) StartBuild(username, buildID string) error {
+	res, err := s.startBuildStmt.Exec(string(BuildRunning), time.Now(), username, buildID)
+
+	if err != nil {
+		return errors.Wrap(err, "Error while starting build")
+	}
+
+	rowsAffected, err := res.RowsAffected()
+
+	if err != nil {
+		return errors.Wrap(err, "Error while counting affected rows")
+	}
+
+	if rowsAffected != 1 {
+		return s.buildUpdateError(username, buildID)
+	}
+
+	return nil
+}
+
+func (s *SQLUserStore) FinishBuild(username, buildID, commit, buildErr string) error {
+	return s.finishBuild(username, buildID, finishedBuildStatus(buildErr), commit, buildErr)
+}
+
+func (s *SQLUserStore) SupersedeBuild(username, buildID string) error {
+	return s.finishBuild(username, buildID, BuildSuperseded, "", "")
+}
+
+func (s *SQLUserStore) finishBuild(username, buildID string, status BuildStatus, commit, buildErr string) error {
+	res, err := s.finishBuildStmt.Exec(string(status), commit, time.Now(), buildErr, username, buildID)
+
+	if err != nil {
+		return errors.Wrap(err, "Error while finishing build")
+	}
+
+	rowsAffected, err := res.RowsAffected()
+
+	if err != nil {
+		return errors.Wrap(err, "Error while counting affected rows")
+	}
+
+	if rowsAffected != 1 {
+		return s.buildUpdateError(username, buildID)
+	}
+
+	return nil
+}
+
+func (s *SQLUserStore) GetBuild(username, buildID string) (*Build, error) {
+	var record buildRecord
+	err := s.getBuildStmt.Get(&record, username, buildID)
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while fetching build")
+	}
+
+	build := record.build()
+
+	return &build, nil
+}
+
+func (s *SQLUserStore) ListBuilds(username, blogSlug string, limit int) ([]Build, error) {
+	var records []buildRecord
+
+	if err := s.listBuildsStmt.Select(&records, username, blogSlug, listBuildsLimit(limit)); err != nil {
+		return nil, errors.Wrap(err, "Error while fetching builds")
+	}
+
+	builds := make([]Build, len(records))
+
+	for i := range records {
+		builds[i] = records[i].build()
+	}
+
+	return builds, nil
 }
@@ -2,35 +2,188 @@ package userstore
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/mail"
 	"regexp"
+	"strings"
+	"time"
 
 	"github.com/pkg/errors"
-	"golang.org/x/crypto/argon2"
+	uuid "github.com/satori/go.uuid"
 )
 
 type User struct {
 	Username    string
 	Password    string
 	DisplayName string
+	Email       string
+	// EmailVerified is only set by VerifyEmail, and reset when the email
+	// address changes
+	EmailVerified bool
+	// TwoFactorEnabled is only set by ConfirmTOTP and DisableTOTP
+	TwoFactorEnabled bool
+}
+
+// OneTimeTokenPurpose is what a one time token can be used for
+type OneTimeTokenPurpose string
+
+const (
+	OneTimeTokenVerifyEmail   OneTimeTokenPurpose = "verify-email"
+	OneTimeTokenResetPassword OneTimeTokenPurpose = "reset-password"
+)
+
+// OneTimeTokenValidity is how long a one time token can be used after its
+// creation
+var OneTimeTokenValidity = map[OneTimeTokenPurpose]time.Duration{
+	OneTimeTokenVerifyEmail:   48 * time.Hour,
+	OneTimeTokenResetPassword: time.Hour,
 }
 
 type Blog struct {
 	Slug        string
 	DisplayName string
+	Deleted     *time.Time // only set by ListDeletedBlogs
+}
+
+// Purged is a user or a blog that PurgeDeleted deleted for good
+type Purged struct {
+	Username string
+	Slug     string // empty if the whole user was purged
+	Deleted  time.Time
+}
+
+// Token is a personal access token, that can be used instead of a password to
+// access the repositories of a user.
+type Token struct {
+	ID      string
+	Name    string
+	Scopes  []string
+	Created time.Time
 }
 
+// Scopes that can be granted to a token
+const (
+	TokenScopeRepoRead  = "repo:read"
+	TokenScopeRepoWrite = "repo:write"
+)
+
+type BuildStatus string
+
+const (
+	BuildQueued    BuildStatus = "queued"
+	BuildRunning   BuildStatus = "running"
+	BuildSucceeded BuildStatus = "succeeded"
+	BuildFailed    BuildStatus = "failed"
+	// The build was replaced by a more recent build of the same blog before
+	// it could complete
+	BuildSuperseded BuildStatus = "superseded"
+)
+
+// Build records a render of a blog, from the push that triggered it to its
+// completion.
+type Build struct {
+	ID       string
+	Blog     string
+	Status   BuildStatus
+	Commit   string
+	Queued   time.Time
+	Started  *time.Time
+	Finished *time.Time
+	Duration time.Duration // time between Started and Finished
+	Error    string        // set if the build failed
+}
+
+// MaxListedBuilds is the maximum number of builds returned by ListBuilds
+const MaxListedBuilds = 100
+
 type UserStore interface {
 	CreateUser(user User) error
 	UpdateUser(user User) error
 	GetUser(username string) (*User, error)
 	AuthenticateUser(username, password string) (bool, error)
+	// DeleteUser marks a user as deleted. Deleted users cannot log in and
+	// their username cannot be taken, until PurgeDeleted deletes them for
+	// good.
 	DeleteUser(username string) error
+	// RestoreUser undeletes a user that wasn't purged yet. Since the user
+	// cannot log in, the password is checked. Returns ErrDoesNotExist if
+	// there is no such deleted user, or if the password doesn't match.
+	RestoreUser(username, password string) error
+	// ImportUser creates a user whose password was hashed by another
+	// system. Only bcrypt hashes are supported, they get replaced by a hash
+	// with the current parameters the first time the user logs in. The
+	// password of the user is ignored.
+	ImportUser(user User, passwordHash string) error
+
+	// CreateOneTimeToken creates a secret that can be used once to verify the
+	// email address of a user, or to reset their password. It replaces the
+	// previous token with the same purpose, and returns the secret along
+	// with the address where to send it. Only verified addresses can receive
+	// password reset tokens.
+	CreateOneTimeToken(username string, purpose OneTimeTokenPurpose) (secret, email string, err error)
+	// VerifyEmail marks the email address of a user as verified, if the
+	// secret was sent to that address
+	VerifyEmail(username, secret string) error
+	// ResetPassword changes the password of a user without knowing the old
+	// one, if the secret matches
+	ResetPassword(username, secret, password string) error
+
+	// EnrolTOTP generates a new TOTP secret for a user. Two-factor
+	// authentication is only enabled once ConfirmTOTP gets a valid code for
+	// this secret.
+	EnrolTOTP(username string) (secret string, err error)
+	// ConfirmTOTP enables two-factor authentication with the enrolled secret
+	// if the code is valid, and returns new recovery codes. Only the hashes of
+	// the recovery codes are stored.
+	ConfirmTOTP(username, code string) (recoveryCodes []string, err error)
+	// AuthenticateSecondFactor checks a TOTP code, or consumes a recovery code.
+	// TOTP codes cannot be used twice either.
+	AuthenticateSecondFactor(username, code string) (bool, error)
+	DisableTOTP(username string) error
 
 	AddBlog(username string, blog Blog) error
 	UpdateBlog(username string, blog Blog) error
 	GetBlog(username, blogSlug string) (*Blog, error)
 	ListBlogs(username string) ([]Blog, error)
+	// DeleteBlog marks a blog as deleted. Deleted blogs are hidden, and their
+	// slug cannot be taken, until PurgeDeleted deletes them for good.
 	DeleteBlog(username, blogSlug string) error
+	// ListDeletedBlogs returns the deleted blogs that weren't purged yet,
+	// most recently deleted first
+	ListDeletedBlogs(username string) ([]Blog, error)
+	// RestoreBlog undeletes a blog that wasn't purged yet
+	RestoreBlog(username, blogSlug string) error
+
+	// PurgeDeleted deletes for good the users and blogs deleted before the
+	// given time, along with their tokens and builds, and returns them.
+	// schedule is called for each of them before it gets deleted, while it
+	// cannot be restored anymore. The users and blogs for which it fails are
+	// kept for the next purge, and its first error is returned.
+	PurgeDeleted(before time.Time, schedule func(Purged) error) ([]Purged, error)
+
+	// CreateToken creates a new token for the given user, and returns it along
+	// with its secret. The secret is not stored and cannot be retrieved later.
+	CreateToken(username string, token Token) (*Token, string, error)
+	ListTokens(username string) ([]Token, error)
+	// AuthenticateToken returns the token matching the given secret, or nil if
+	// there is none.
+	AuthenticateToken(username, secret string) (*Token, error)
+	DeleteToken(username, tokenID string) error
+
+	// CreateBuild records a new queued build for the given blog
+	CreateBuild(username, blogSlug string) (*Build, error)
+	StartBuild(username, buildID string) error
+	// FinishBuild marks a queued or running build as succeeded, or as failed if
+	// buildErr is not empty.
+	FinishBuild(username, buildID, commit, buildErr string) error
+	// SupersedeBuild marks a queued or running build as superseded
+	SupersedeBuild(username, buildID string) error
+	// GetBuild returns nil if there is no build with the given ID
+	GetBuild(username, buildID string) (*Build, error)
+	// ListBuilds returns the last builds of a blog, newest first. A limit of 0
+	// or more than MaxListedBuilds returns MaxListedBuilds builds.
+	ListBuilds(username, blogSlug string, limit int) ([]Build, error)
 }
 
 var ErrAlreadyExists = errors.New("User already exists")
@@ -38,12 +191,29 @@ var ErrDoesNotExist = errors.New("User does not exist")
 var ErrUsernameEmpty = errors.New("Username cannot be empty")
 var ErrUsernameInvalid = errors.New("Username contains invalid characters")
 var ErrPasswordEmpty = errors.New("Password cannot be empty")
+var ErrPasswordHashInvalid = errors.New("Unsupported or invalid password hash")
+var ErrEmailInvalid = errors.New("Invalid email address")
+var ErrEmailEmpty = errors.New("User has no email address")
+var ErrEmailNotVerified = errors.New("Email address is not verified")
+
+var ErrOneTimeTokenInvalid = errors.New("Invalid or expired token")
+
+var ErrTOTPNotEnrolled = errors.New("No TOTP secret was enrolled")
+var ErrTOTPCodeInvalid = errors.New("Invalid TOTP code")
 
 var ErrBlogAlreadyExists = errors.New("A blog with this slug already exists")
 var ErrBlogDoesNotExist = errors.New("Blog does not exist")
 var ErrBlogSlugEmpty = errors.New("Blog slug cannot be empty")
 var ErrBlogSlugInvalid = errors.New("Blog slug contains invalid characters")
 
+var ErrTokenDoesNotExist = errors.New("Token does not exist")
+var ErrTokenNameEmpty = errors.New("Token name cannot be empty")
+var ErrTokenScopesEmpty = errors.New("Token must have at least one scope")
+var ErrTokenScopeInvalid = errors.New("Token has an invalid scope")
+
+var ErrBuildDoesNotExist = errors.New("Build does not exist")
+var ErrBuildFinished = errors.New("Build has already finished")
+
 var validAlphanumericRe = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9\.\-_]+$`)
 
 func validateUser(user User, allowEmptyPassword bool) error {
@@ -59,48 +229,154 @@ func validateUser(user User, allowEmptyPassword bool) error {
 		return ErrPasswordEmpty
 	}
 
+	if user.Email != "" {
+		// Only accept plain addresses, not "Name <address>"
+		if address, err := mail.ParseAddress(user.Email); err != nil || address.Address != user.Email {
+			return ErrEmailInvalid
+		}
+	}
+
 	return nil
 }
 
-func hashNewPassword(password string) (salt []byte, hash []byte, err error) {
-	// Argon parameters
-	const time = 3           // seconds
-	const memory = 32 * 1024 // kB
-	const threads = 4
-	const keyLen = 32  // bytes
-	const saltLen = 16 // bytes
+func validateBlog(blog Blog) error {
+	if blog.Slug == "" {
+		return ErrBlogSlugEmpty
+	}
 
-	salt = make([]byte, saltLen)
-	_, err = rand.Read(salt)
+	if !validAlphanumericRe.MatchString(blog.Slug) {
+		return ErrBlogSlugInvalid
+	}
+
+	return nil
+}
+
+func validateToken(token Token) error {
+	if token.Name == "" {
+		return ErrTokenNameEmpty
+	}
+
+	if len(token.Scopes) == 0 {
+		return ErrTokenScopesEmpty
+	}
+
+	for _, scope := range token.Scopes {
+		if scope != TokenScopeRepoRead && scope != TokenScopeRepoWrite {
+			return ErrTokenScopeInvalid
+		}
+	}
+
+	return nil
+}
+
+func generateTokenSecret() (string, error) {
+	const secretLen = 32 // bytes
+
+	secret := make([]byte, secretLen)
+
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(secret), nil
+}
+
+// Token secrets are long random strings, so unlike passwords they don't need
+// a salt nor a slow hash function.
+func hashTokenSecret(secret string) []byte {
+	hash := sha256.Sum256([]byte(secret))
+	return hash[:]
+}
+
+// checkOneTimeTokenEmail checks that a user can receive a one time token for
+// the given purpose
+func checkOneTimeTokenEmail(user User, purpose OneTimeTokenPurpose) error {
+	if _, ok := OneTimeTokenValidity[purpose]; !ok {
+		return errors.Errorf("Invalid one time token purpose: %s", purpose)
+	}
+
+	if user.Email == "" {
+		return ErrEmailEmpty
+	}
+
+	if purpose == OneTimeTokenResetPassword && !user.EmailVerified {
+		return ErrEmailNotVerified
+	}
+
+	return nil
+}
+
+// RecoveryCodeCount is the number of recovery codes returned by ConfirmTOTP
+const RecoveryCodeCount = 10
+
+func generateRecoveryCodes() (codes []string, hashes [][]byte, err error) {
+	const codeLen = 8 // bytes
+
+	for i := 0; i < RecoveryCodeCount; i++ {
+		code := make([]byte, codeLen)
+
+		if _, err = rand.Read(code); err != nil {
+			return
+		}
+
+		codes = append(codes, hex.EncodeToString(code))
+		hashes = append(hashes, hashRecoveryCode(codes[i]))
+	}
+
+	return
+}
+
+// Like token secrets, recovery codes are random enough to not need a salt
+func hashRecoveryCode(code string) []byte {
+	return hashTokenSecret(strings.ToLower(strings.TrimSpace(code)))
+}
+
+func makeToken(token Token) (newToken Token, secret string, hash []byte, err error) {
+	secret, err = generateTokenSecret()
 
 	if err != nil {
 		return
 	}
 
-	hash = hashPassword(password, salt)
+	newToken = Token{
+		ID:      uuid.NewV4().String(),
+		Name:    token.Name,
+		Scopes:  token.Scopes,
+		Created: time.Now(),
+	}
+
+	hash = hashTokenSecret(secret)
 
 	return
 }
 
-func hashPassword(password string, salt []byte) []byte {
-	// Argon parameters
-	const time = 3           // seconds
-	const memory = 32 * 1024 // kB
-	const threads = 4
-	const keyLen = 32  // bytes
-	const saltLen = 16 // bytes
-
-	return argon2.Key([]byte(password), salt, time, memory, threads, keyLen)
+func newBuild(blogSlug string) Build {
+	return Build{
+		ID:     uuid.NewV4().String(),
+		Blog:   blogSlug,
+		Status: BuildQueued,
+		Queued: time.Now(),
+	}
 }
 
-func validateBlog(blog Blog) error {
-	if blog.Slug == "" {
-		return ErrBlogSlugEmpty
+func listBuildsLimit(limit int) int {
+	if limit <= 0 || limit > MaxListedBuilds {
+		return MaxListedBuilds
 	}
 
-	if !validAlphanumericRe.MatchString(blog.Slug) {
-		return ErrBlogSlugInvalid
+	return limit
+}
+
+func finishedBuildStatus(buildErr string) BuildStatus {
+	if buildErr == "" {
+		return BuildSucceeded
 	}
 
-	return nil
+	return BuildFailed
+}
+
+func (b *Build) computeDuration() {
+	if b.Started != nil && b.Finished != nil {
+		b.Duration = b.Finished.Sub(*b.Started)
+	}
 }
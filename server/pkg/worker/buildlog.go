@@ -0,0 +1,64 @@
+package worker
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Maximum size of the log of a build. Anything written past this size is
+// dropped.
+var MaxBuildLogSize = 1024 * 1024 // bytes
+
+const buildLogTruncatedMessage = "\n[log truncated]\n"
+
+// buildLog collects the output of all the commands run during a build
+type buildLog struct {
+	// Commands write their stdout and stderr from different goroutines
+	sync.Mutex
+
+	buffer    bytes.Buffer
+	truncated bool
+}
+
+func (l *buildLog) Write(p []byte) (int, error) {
+	l.Lock()
+	defer l.Unlock()
+
+	if remaining := MaxBuildLogSize - l.buffer.Len(); len(p) > remaining {
+		l.buffer.Write(p[:remaining])
+		l.truncated = true
+	} else {
+		l.buffer.Write(p)
+	}
+
+	// Never fail, that would abort the command writing to the log
+	return len(p), nil
+}
+
+func (l *buildLog) Printf(format string, args ...interface{}) {
+	fmt.Fprintf(l, format+"\n", args...)
+}
+
+func (l *buildLog) Bytes() []byte {
+	l.Lock()
+	defer l.Unlock()
+
+	data := append([]byte{}, l.buffer.Bytes()...)
+
+	if l.truncated {
+		data = append(data, buildLogTruncatedMessage...)
+	}
+
+	return data
+}
+
+// teeWriter returns a writer writing to both w and the build log, w may be nil
+func (l *buildLog) teeWriter(w io.Writer) io.Writer {
+	if w == nil {
+		return l
+	}
+
+	return io.MultiWriter(w, l)
+}
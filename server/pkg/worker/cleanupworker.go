@@ -0,0 +1,47 @@
+package worker
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/abustany/moblog-cloud/pkg/audit"
+	"github.com/abustany/moblog-cloud/pkg/jobs"
+)
+
+// cleanupOutput deletes the rendered files of a deleted blog or user. The
+// gitserver deletes the repositories.
+func (s *slot) cleanupOutput(ctx context.Context, job *jobs.CleanupJob) error {
+	if job.Username == "" {
+		return errors.New("Cleanup job without a username")
+	}
+
+	var err error
+
+	if job.Repository == "" {
+		err = s.blogOutput.DeleteUser(ctx, job.Username)
+	} else {
+		err = s.blogOutput.DeleteBlog(ctx, job.Username, job.Repository)
+	}
+
+	if err != nil {
+		return errors.Wrap(err, "Error while deleting rendered files")
+	}
+
+	event := audit.Event{
+		Type:       audit.RenderedFilesPurged,
+		Username:   job.Username,
+		Repository: job.Repository,
+	}
+
+	// Failing the job records the cleanup again when it is retried
+	if err := s.auditLog.Record(event); err != nil {
+		return errors.Wrap(err, "Error while recording cleanup in the audit log")
+	}
+
+	log.Printf("Purged rendered files of %s, deleted at %s", job.Target(), job.Deleted.Format(time.RFC3339))
+
+	return nil
+}
@@ -3,163 +3,322 @@ package worker
 import (
 	"bytes"
 	"context"
+	"encoding/csv"
 	"encoding/json"
 	"io"
 	"io/ioutil"
 	"log"
-	"mime"
-	"net/url"
 	"os"
 	"os/exec"
 	"path"
-	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 
-	"gocloud.dev/blob"
-
 	"github.com/abustany/moblog-cloud/pkg/adminserver"
+	"github.com/abustany/moblog-cloud/pkg/grants"
 	"github.com/abustany/moblog-cloud/pkg/jobs"
-	"github.com/abustany/moblog-cloud/pkg/netscapecookies"
 	"github.com/abustany/moblog-cloud/pkg/userstore"
+	"github.com/abustany/moblog-cloud/pkg/workqueue"
 )
 
 const blogDirectory = "blog"
-const themeDirectory = "theme"
 const resultDirectory = "html"
 
-func (w *Worker) renderBlog(ctx context.Context, job *jobs.RenderJob) error {
-	adminClient, err := adminserver.NewClient(w.adminServerURL)
+const saveBuildLogTimeout = 30 * time.Second
+
+// renderBlog renders a blog and reports the build progress. If the build fails
+// and it is not the last attempt of the job, or if the worker interrupted it,
+// the build is left running since the job will be retried.
+func (s *slot) renderBlog(ctx context.Context, entry *workqueue.JobEntry, job *jobs.RenderJob) error {
+	adminClient, err := adminserver.NewClient(s.adminServerURL)
 
 	if err != nil {
 		return errors.Wrap(err, "Error while creating adminserver client")
 	}
 
-	if err := adminClient.SetAuthCookie(&job.AuthCookie); err != nil {
-		return errors.Wrap(err, "Error while setting auth cookie on client")
+	adminClient.SetGrant(job.Grant)
+
+	buildLog := &buildLog{}
+
+	if job.BuildID == "" {
+		_, err := s.buildBlog(ctx, buildLog, adminClient, entry, job)
+		return err
+	}
+
+	// Failing to report the build progress should not prevent the blog from
+	// being rendered.
+	if err := adminClient.StartBuild(job.BuildID); err != nil {
+		log.Printf("Error while marking build %s as started: %s", job.BuildID, err)
+	}
+
+	commit, err := s.buildBlog(ctx, buildLog, adminClient, entry, job)
+
+	var buildErr string
+
+	if err != nil {
+		buildErr = err.Error()
+
+		if s.interrupted() {
+			buildLog.Printf("Build interrupted by worker shutdown, will retry: %s", buildErr)
+			s.saveBuildLog(job, buildLog)
+			return err
+		}
+
+		// The blog is being deleted, along with its builds
+		if errors.Cause(err) == errJobCancelled {
+			log.Printf("Build %s cancelled", job.BuildID)
+			return err
+		}
+
+		if !entry.LastAttempt() {
+			buildLog.Printf("Build failed, will retry: %s", buildErr)
+			s.saveBuildLog(job, buildLog)
+			return err
+		}
+
+		buildLog.Printf("Build failed: %s", buildErr)
+	} else {
+		buildLog.Printf("Build succeeded")
+	}
+
+	s.saveBuildLog(job, buildLog)
+
+	if err := adminClient.FinishBuild(job.BuildID, commit, buildErr); err != nil {
+		log.Printf("Error while marking build %s as finished: %s", job.BuildID, err)
 	}
 
-	if err := adminClient.RefreshSession(); err != nil {
-		return errors.Wrap(err, "Error while refreshing client session")
+	return err
+}
+
+// saveBuildLog stores the build log, even if the job ran out of time
+func (s *slot) saveBuildLog(job *jobs.RenderJob, buildLog *buildLog) {
+	ctx, cancel := context.WithTimeout(context.Background(), saveBuildLogTimeout)
+	defer cancel()
+
+	if err := s.blogOutput.SaveBuildLog(ctx, job.Username, job.BuildID, buildLog.Bytes()); err != nil {
+		log.Printf("Error while saving log of build %s: %s", job.BuildID, err)
 	}
+}
 
+// buildBlog renders and publishes a blog, and returns the commit that was
+// rendered. Posts dated in the future are not rendered, a render is scheduled
+// for the publication date of the next one instead. Failing to schedule it
+// doesn't fail the build.
+func (s *slot) buildBlog(ctx context.Context, buildLog *buildLog, adminClient *adminserver.Client, entry *workqueue.JobEntry, job *jobs.RenderJob) (string, error) {
 	blog, err := adminClient.GetUserBlog(job.Username, job.Repository)
 
 	if err != nil {
-		return errors.Wrap(err, "Error while fetching blog information")
+		return "", errors.Wrap(err, "Error while fetching blog information")
 	}
 
-	authCookieFile := path.Join(w.workDir, "auth_cookie.txt")
+	if err := s.cloneBlog(ctx, buildLog, job); err != nil {
+		return "", errors.Wrap(err, "Error while cloning blog")
+	}
 
-	if err := w.writeAuthCookieFile(adminClient, authCookieFile); err != nil {
-		return errors.Wrap(err, "Error while writing auth cookie file")
+	if err := s.checkCancelled(entry); err != nil {
+		return "", err
 	}
 
-	if err := w.cloneBlog(ctx, job, authCookieFile); err != nil {
-		return errors.Wrap(err, "Error while cloning blog")
+	commit, err := s.blogCommit(ctx, buildLog)
+
+	if err != nil {
+		return "", errors.Wrap(err, "Error while getting blog commit")
+	}
+
+	if err := s.themeCache.update(ctx, buildLog); err != nil {
+		return commit, errors.Wrap(err, "Error while updating theme")
 	}
 
-	if err := w.cloneTheme(ctx); err != nil {
-		return errors.Wrap(err, "Error while cloning theme")
+	if err := s.checkCancelled(entry); err != nil {
+		return commit, err
 	}
 
-	configFilePath := path.Join(w.workDir, "config.json")
+	configFilePath := path.Join(s.dir, "config.json")
 
-	if err := w.generateConfigFile(configFilePath, blog); err != nil {
-		return errors.Wrap(err, "Error while generating config file")
+	if err := s.generateConfigFile(configFilePath, blog); err != nil {
+		return commit, errors.Wrap(err, "Error while generating config file")
 	}
 
-	if err := w.runHugo(ctx, configFilePath); err != nil {
-		return errors.Wrap(err, "Error while running Hugo")
+	if err := s.renderHugo(ctx, buildLog, configFilePath); err != nil {
+		return commit, errors.Wrap(err, "Error while running Hugo")
 	}
 
-	if err := w.uploadHTMLFiles(ctx, job.Username, blog.Slug); err != nil {
-		return errors.Wrap(err, "Error while uploading generated files")
+	// Don't publish a blog that is being deleted
+	if err := s.checkCancelled(entry); err != nil {
+		return commit, err
 	}
 
-	return nil
-}
+	buildLog.Printf("Publishing rendered files")
 
-func (w *Worker) writeAuthCookieFile(adminClient *adminserver.Client, authCookieFile string) error {
-	authCookie, err := adminClient.AuthCookie()
+	version, err := s.blogOutput.Publish(ctx, job.Username, blog.Slug, path.Join(s.dir, resultDirectory))
 
 	if err != nil {
-		return errors.Wrap(err, "Error while retrieving auth cookie from admin client")
+		return commit, errors.Wrap(err, "Error while publishing generated files")
 	}
 
-	if authCookie == nil {
-		return errors.New("Admin client has no auth cookie")
-	}
+	buildLog.Printf("Published version %s", version)
 
-	buffer := bytes.Buffer{}
+	if err := s.checkCancelled(entry); err != nil {
+		return commit, err
+	}
 
-	if err := netscapecookies.WriteCookie(&buffer, authCookie); err != nil {
-		return errors.Wrap(err, "Error while serializing admin server cookie")
+	// The blog is published already, failing the job would only render it
+	// again. The next push schedules the render of future posts again.
+	if err := s.scheduleNextRender(ctx, buildLog, job, entry.TTR, configFilePath); err != nil {
+		log.Printf("Error while scheduling the render of future posts of %s/%s: %s", job.Username, job.Repository, err)
+		buildLog.Printf("Error while scheduling the render of future posts: %s", err)
 	}
 
-	// Serialize another copy of this cookie, but for the git server
+	return commit, nil
+}
 
-	gitAuthCookie := *authCookie
-	parsedGitServerURL, err := url.Parse(w.gitServerURL)
+// scheduleNextRender posts a job that renders the blog again at the
+// publication date of its next post dated in the future, if any.
+func (s *slot) scheduleNextRender(ctx context.Context, buildLog *buildLog, job *jobs.RenderJob, ttr time.Duration, configFilePath string) error {
+	next, err := s.nextPublishDate(ctx, buildLog, configFilePath)
 
 	if err != nil {
-		return errors.Wrap(err, "Error while parsing Git server URL")
+		return errors.Wrap(err, "Error while listing future posts")
 	}
 
-	gitAuthCookie.Domain = parsedGitServerURL.Host
+	if next.IsZero() {
+		return nil
+	}
 
-	if err := netscapecookies.WriteCookie(&buffer, &gitAuthCookie); err != nil {
-		return errors.Wrap(err, "Error while serializing git server cookie")
+	// The gitserver picking the job signs a new grant at that time
+	scheduledJob := jobs.ScheduledRenderJob{
+		Username:   job.Username,
+		Repository: job.Repository,
 	}
 
-	if err := ioutil.WriteFile(authCookieFile, buffer.Bytes(), 0600); err != nil {
-		return errors.Wrap(err, "Error while writing auth cookie file")
+	if err := s.repositoryQueue.PostAt(jobs.RenderJobKey(job.Username, job.Repository), scheduledJob, ttr, next); err != nil {
+		return errors.Wrap(err, "Error while posting scheduled render job")
 	}
 
+	buildLog.Printf("Scheduled next render at %s", next.Format(time.RFC3339))
+
 	return nil
 }
 
-func (w *Worker) cloneBlog(ctx context.Context, job *jobs.RenderJob, authCookieFile string) error {
-	repoURL := w.gitServerURL + "/" + job.Username + "/" + job.Repository
-	repoPath := path.Join(w.workDir, blogDirectory)
+// nextPublishDate returns the earliest publication date of the posts dated in
+// the future, or a zero time if there are none.
+func (s *slot) nextPublishDate(ctx context.Context, buildLog *buildLog, configFilePath string) (time.Time, error) {
+	var stdout bytes.Buffer
 
-	if err := os.RemoveAll(repoPath); err != nil {
-		return errors.Wrap(err, "Error while cleaning blog directory")
+	if err := s.runHugo(ctx, buildLog, &stdout, configFilePath, "list", "future"); err != nil {
+		return time.Time{}, err
 	}
 
-	err := runGit(ctx, nil, "-c", "http.cookieFile="+authCookieFile, "clone", "--depth", "1", repoURL, repoPath)
+	// Hugo 0.56 prints the path of each post and its publication date. Later
+	// versions start with a header naming their columns, which are more.
+	reader := csv.NewReader(&stdout)
+	reader.FieldsPerRecord = -1
 
-	if err != nil {
-		return errors.Wrap(err, "Error while cloning")
+	pathColumn, dateColumn := 0, 1
+	firstRecord := true
+
+	var next time.Time
+
+	for {
+		record, err := reader.Read()
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return time.Time{}, errors.Wrap(err, "Error while parsing Hugo output")
+		}
+
+		if firstRecord {
+			firstRecord = false
+
+			if headerPath, headerDate, ok := futureListColumns(record); ok {
+				pathColumn, dateColumn = headerPath, headerDate
+				continue
+			}
+		}
+
+		if len(record) <= pathColumn || len(record) <= dateColumn {
+			return time.Time{}, errors.Errorf("Unexpected line in Hugo output: %v", record)
+		}
+
+		if record[dateColumn] == "" {
+			continue
+		}
+
+		date, err := time.Parse(time.RFC3339, record[dateColumn])
+
+		if err != nil {
+			return time.Time{}, errors.Wrapf(err, "Invalid publication date for %s", record[pathColumn])
+		}
+
+		if date.IsZero() {
+			continue
+		}
+
+		if next.IsZero() || date.Before(next) {
+			next = date
+		}
 	}
 
-	return nil
+	return next, nil
 }
 
-func (w *Worker) cloneTheme(ctx context.Context) error {
-	themePath := path.Join(w.workDir, themeDirectory)
+// futureListColumns returns the columns holding the path and the publication
+// date of the posts listed by "hugo list future", if the given record is the
+// header that recent versions of Hugo print.
+func futureListColumns(header []string) (pathColumn, dateColumn int, ok bool) {
+	pathColumn, dateColumn = -1, -1
+
+	for i, name := range header {
+		switch name {
+		case "path":
+			pathColumn = i
+		case "publishDate":
+			dateColumn = i
+		case "date":
+			// The publication date defaults to the date of the post
+			if dateColumn < 0 {
+				dateColumn = i
+			}
+		}
+	}
 
-	stat, err := os.Stat(themePath)
+	return pathColumn, dateColumn, pathColumn >= 0 && dateColumn >= 0
+}
 
-	if os.IsNotExist(err) {
-		err := runGit(ctx, nil, "clone", w.themeRepositoryURL, themePath)
+func (s *slot) cloneBlog(ctx context.Context, buildLog *buildLog, job *jobs.RenderJob) error {
+	repoURL := s.gitServerURL + "/" + job.Username + "/" + job.Repository
+	repoPath := path.Join(s.dir, blogDirectory)
 
-		return errors.Wrap(err, "Error while cloning theme")
+	if err := os.RemoveAll(repoPath); err != nil {
+		return errors.Wrap(err, "Error while cleaning blog directory")
 	}
 
+	authHeader := "Authorization: " + grants.AuthorizationHeader(job.Grant)
+	err := runGit(ctx, buildLog, nil, "-c", gitExtraHeaderConfig+authHeader, "clone", "--depth", "1", repoURL, repoPath)
+
 	if err != nil {
-		return errors.Wrap(err, "Error while checking if theme directory exists")
+		return errors.Wrap(err, "Error while cloning")
 	}
 
-	if !stat.IsDir() {
-		return errors.New("Theme path exists but is not a directory")
+	return nil
+}
+
+func (s *slot) blogCommit(ctx context.Context, buildLog *buildLog) (string, error) {
+	var stdout bytes.Buffer
+
+	if err := runGit(ctx, buildLog, &stdout, "-C", path.Join(s.dir, blogDirectory), "rev-parse", "HEAD"); err != nil {
+		return "", err
 	}
 
-	return errors.Wrap(runGit(ctx, nil, "-C", themePath, "pull"), "Error while pulling in theme dir")
+	return strings.TrimSpace(stdout.String()), nil
 }
 
-func (w *Worker) generateConfigFile(configFilePath string, blog userstore.Blog) error {
+func (s *slot) generateConfigFile(configFilePath string, blog userstore.Blog) error {
 	configFile := struct {
 		BuildFuture            bool     `json:"buildFuture"`
 		DisableKinds           []string `json:"disableKinds"`
@@ -168,7 +327,7 @@ func (w *Worker) generateConfigFile(configFilePath string, blog userstore.Blog)
 		RSSLimit               uint     `json:"rssLimit"`
 		Title                  string   `json:"title"`
 	}{
-		BuildFuture:            true,
+		BuildFuture:            false,
 		DisableKinds:           []string{"section", "taxonomy", "taxonomyTerm", "sitemap", "robotsTXT", "404"},
 		EnableInlineShortcodes: false,
 		LanguageCode:           "en-us",
@@ -189,13 +348,20 @@ func (w *Worker) generateConfigFile(configFilePath string, blog userstore.Blog)
 	return nil
 }
 
-func (w *Worker) runHugo(ctx context.Context, configFilePath string) error {
-	destDirPath := path.Join(w.workDir, resultDirectory)
+func (s *slot) renderHugo(ctx context.Context, buildLog *buildLog, configFilePath string) error {
+	destDirPath := path.Join(s.dir, resultDirectory)
 
 	if err := os.RemoveAll(destDirPath); err != nil {
 		return errors.Wrap(err, "Error while cleaning destination directory")
 	}
 
+	return s.runHugo(ctx, buildLog, nil, configFilePath, "--destination", destDirPath, "--theme", themeCacheDirectory)
+}
+
+// runHugo runs hugo on the blog, writing its output to the build log as well
+// as to stdout if it is not nil. The arguments are followed by the ones
+// telling hugo where to find the blog.
+func (s *slot) runHugo(ctx context.Context, buildLog *buildLog, stdout io.Writer, configFilePath string, args ...string) error {
 	hugoPath, err := exec.LookPath("hugo")
 
 	if err != nil {
@@ -203,20 +369,23 @@ func (w *Worker) runHugo(ctx context.Context, configFilePath string) error {
 	}
 
 	var stderrBuffer bytes.Buffer
-	args := []string{
+	args = append(args,
 		"--config", configFilePath,
-		"--source", path.Join(w.workDir, blogDirectory),
-		"--destination", destDirPath,
-		"--themesDir", w.workDir,
-		"--theme", themeDirectory,
-	}
+		"--source", path.Join(s.dir, blogDirectory),
+		"--themesDir", s.themeCache.themesDir,
+	)
 	hugoCmd := exec.CommandContext(ctx, hugoPath, args...)
 	hugoCmd.Env = []string{}
 	hugoCmd.Stdin = nil
-	hugoCmd.Stdout = nil
-	hugoCmd.Stderr = &stderrBuffer
+	hugoCmd.Stdout = buildLog.teeWriter(stdout)
+	hugoCmd.Stderr = buildLog.teeWriter(&stderrBuffer)
 
 	log.Printf("Running hugo %v", args)
+	buildLog.Printf("$ hugo %s", strings.Join(args, " "))
+
+	// Other slots must not update the theme while Hugo reads it
+	s.themeCache.mutex.RLock()
+	defer s.themeCache.mutex.RUnlock()
 
 	if err := hugoCmd.Run(); err != nil {
 		return errors.Wrapf(err, "Hugo returned an error (stderr: %s)", strings.TrimSpace(stderrBuffer.String()))
@@ -224,64 +393,3 @@ func (w *Worker) runHugo(ctx context.Context, configFilePath string) error {
 
 	return nil
 }
-
-func (w *Worker) uploadHTMLFiles(ctx context.Context, username, slug string) error {
-	log.Printf("Uploading files to %s", w.blogOutputURL)
-
-	sourceDir := path.Join(w.workDir, resultDirectory)
-	bucket, err := blob.OpenBucket(ctx, w.blogOutputURL)
-
-	if err != nil {
-		return errors.Wrap(err, "Error while opening bucket")
-	}
-
-	copyFunc := func(p string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-
-		key := path.Join(username, slug, p[len(sourceDir):])
-
-		if info.IsDir() {
-			return nil // there are no directories in blob stores
-		} else if info.Mode().IsRegular() {
-			err = uploadFile(ctx, bucket, key, p)
-		} else {
-			err = errors.Errorf("Don't know how to copy %s: unknown file type", p)
-		}
-
-		return err
-	}
-
-	return errors.Wrap(filepath.Walk(sourceDir, copyFunc), "Error while copying files")
-}
-
-func uploadFile(ctx context.Context, bucket *blob.Bucket, key, srcPath string) (err error) {
-	srcFd, err := os.OpenFile(srcPath, os.O_RDONLY, 0)
-
-	if err != nil {
-		return errors.Wrap(err, "Error while opening source file")
-	}
-
-	defer srcFd.Close()
-
-	options := blob.WriterOptions{
-		ContentType: mime.TypeByExtension(path.Ext(srcPath)),
-	}
-
-	writer, err := bucket.NewWriter(ctx, key, &options)
-
-	if err != nil {
-		return errors.Wrap(err, "Error while creating writer")
-	}
-
-	if _, err = io.Copy(writer, srcFd); err != nil {
-		return errors.Wrap(err, "Error while copying file data")
-	}
-
-	if err = errors.Wrap(writer.Close(), "Error while finalizing upload"); err != nil {
-		return errors.Wrap(err, "Error while finalizing upload")
-	}
-
-	return nil
-}
@@ -2,19 +2,21 @@ package worker_test
 
 import (
 	"io/ioutil"
+	"net/http"
 	"net/http/httptest"
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/pkg/errors"
 
-	_ "gocloud.dev/blob/fileblob"
-
 	"github.com/abustany/moblog-cloud/pkg/adminserver"
+	"github.com/abustany/moblog-cloud/pkg/blogoutput"
 	"github.com/abustany/moblog-cloud/pkg/gitserver"
+	"github.com/abustany/moblog-cloud/pkg/jobs"
 	"github.com/abustany/moblog-cloud/pkg/testutils"
 	"github.com/abustany/moblog-cloud/pkg/userstore"
 	"github.com/abustany/moblog-cloud/pkg/worker"
@@ -24,9 +26,18 @@ import (
 func TestRenderBlog(t *testing.T) {
 	testutils.FlushDB(t)
 
-	adminServer := httptest.NewServer(testutils.NewAdminServer(t))
+	blogOutput := testutils.NewBlogOutput(t)
+	defer blogOutput.Close()
+
+	adminServer := httptest.NewServer(testutils.NewAdminServer(t, blogOutput))
 	defer adminServer.Close()
 
+	blogServer := httptest.NewServer(blogoutput.NewHandler(blogOutput))
+	defer blogServer.Close()
+
+	// Future posts are published by jobs scheduled in the work queue
+	workqueue.GroomInterval = 100 * time.Millisecond
+
 	queue, err := workqueue.NewMemoryQueue()
 
 	if err != nil {
@@ -38,7 +49,7 @@ func TestRenderBlog(t *testing.T) {
 	repositoriesDir := testutils.TempDir(t, "gitserver-repositories")
 	defer os.RemoveAll(repositoriesDir)
 
-	gitServerHandler, err := gitserver.New("/", repositoriesDir, adminServer.URL, queue)
+	gitServerHandler, err := gitserver.New("/", repositoriesDir, adminServer.URL, testutils.GrantSigner(t), queue)
 
 	if err != nil {
 		t.Fatalf("Error while creating git server: %s", err)
@@ -47,6 +58,13 @@ func TestRenderBlog(t *testing.T) {
 	gitServer := httptest.NewServer(gitServerHandler)
 	defer gitServer.Close()
 
+	// The git server posts the scheduled renders when they are due
+	repositoryQueue := testutils.NewMemoryQueue(t)
+	defer repositoryQueue.Stop()
+
+	cleaner := gitserver.NewCleaner(repositoriesDir, repositoryQueue, testutils.NewMemoryAuditLog(t), gitServerHandler)
+	defer cleaner.Stop()
+
 	workDir := testutils.TempDir(t, "worker-workdir")
 	defer os.RemoveAll(workDir)
 
@@ -56,10 +74,10 @@ func TestRenderBlog(t *testing.T) {
 		t.Fatalf("Error while getting blog theme path: %s", err)
 	}
 
-	destDir := testutils.TempDir(t, "worker-destdir")
-	defer os.RemoveAll(destDir)
+	// Run the jobs of the blog in several slots
+	worker.Concurrency = 2
 
-	w, err := worker.New(queue, adminServer.URL, gitServer.URL, workDir, "file://"+themesDirectory, "file://"+destDir)
+	w, err := worker.New(queue, adminServer.URL, gitServer.URL, workDir, "file://"+themesDirectory, blogOutput, repositoryQueue, testutils.NewMemoryAuditLog(t))
 
 	if err != nil {
 		t.Fatalf("Error creating worker: %s", err)
@@ -131,30 +149,257 @@ Hello world!
 	testutils.Git(t, "-C", blogDirectory, "-c", "user.name=Renderer", "-c", "user.email=renderer@qa.org", "commit", "-m", "Commit first post")
 	testutils.Git(t, "-c", "http.cookieFile="+authCookieFile, "-C", blogDirectory, "push", blogURL, "master")
 
-	indexHTMLPath := path.Join(destDir, user.Username, blog.Slug, "index.html")
+	blogPageURL := blogServer.URL + "/" + user.Username + "/" + blog.Slug + "/"
+	firstPostURL := blogPageURL + "post/first/"
+
+	if err := waitForPage(blogPageURL, http.StatusOK, 3*time.Second); err != nil {
+		t.Fatalf("Error while waiting for %s to be published: %s", blogPageURL, err)
+	}
+
+	if err := waitForPage(firstPostURL, http.StatusOK, 0); err != nil {
+		t.Fatalf("Error while checking first post output: %s", err)
+	}
+
+	firstCommit := strings.TrimSpace(testutils.Git(t, "-C", blogDirectory, "rev-parse", "HEAD"))
+
+	if err := waitForBuild(adminClient, blog.Slug, userstore.BuildSucceeded, 3*time.Second); err != nil {
+		t.Fatalf("Error while waiting for the build to succeed: %s", err)
+	}
+
+	if builds, err := adminClient.ListBuilds(blog.Slug, 0); err != nil {
+		t.Fatalf("Error while listing builds: %s", err)
+	} else if len(builds) != 1 || builds[0].Commit != firstCommit || builds[0].Started == nil || builds[0].Finished == nil {
+		t.Fatalf("Unexpected builds: %+v", builds)
+	}
+
+	// Replace the first post by a second one, the first post should go away
+	if err := os.Remove(path.Join(postsDirectory, "first.md")); err != nil {
+		t.Fatalf("Error while removing post file: %s", err)
+	}
+
+	if err := ioutil.WriteFile(path.Join(postsDirectory, "second.md"), []byte(postMardown), 0600); err != nil {
+		t.Fatalf("Error while creating post file: %s", err)
+	}
+
+	testutils.Git(t, "-C", blogDirectory, "add", "-A", ".")
+	testutils.Git(t, "-C", blogDirectory, "-c", "user.name=Renderer", "-c", "user.email=renderer@qa.org", "commit", "-m", "Replace first post")
+	testutils.Git(t, "-c", "http.cookieFile="+authCookieFile, "-C", blogDirectory, "push", blogURL, "master")
+
+	secondPostURL := blogPageURL + "post/second/"
+
+	if err := waitForPage(secondPostURL, http.StatusOK, 3*time.Second); err != nil {
+		t.Fatalf("Error while waiting for %s to be published: %s", secondPostURL, err)
+	}
+
+	if err := waitForPage(firstPostURL, http.StatusNotFound, 0); err != nil {
+		t.Fatalf("Error while checking that the first post was removed: %s", err)
+	}
+
+	// Roll back to the first render
+	versions, err := adminClient.ListBlogVersions(blog.Slug)
+
+	if err != nil {
+		t.Fatalf("Error while listing blog versions: %s", err)
+	}
+
+	if len(versions) != 2 {
+		t.Fatalf("Expected 2 blog versions, got %+v", versions)
+	}
+
+	if err := adminClient.RollbackBlog(blog.Slug, versions[1].ID); err != nil {
+		t.Fatalf("Error while rolling back blog: %s", err)
+	}
+
+	if err := waitForPage(firstPostURL, http.StatusOK, 0); err != nil {
+		t.Fatalf("Error while checking that the first post is back: %s", err)
+	}
+
+	// A post dated in the future gets published at its date
+	publishDate := time.Now().Add(5 * time.Second).Truncate(time.Second)
+	futurePostMarkdown := strings.Replace(postMardown, "2019-07-19T15:26:56+01:00", publishDate.Format(time.RFC3339), 1)
+
+	if err := ioutil.WriteFile(path.Join(postsDirectory, "future.md"), []byte(futurePostMarkdown), 0600); err != nil {
+		t.Fatalf("Error while creating post file: %s", err)
+	}
+
+	testutils.Git(t, "-C", blogDirectory, "add", "-A", ".")
+	testutils.Git(t, "-C", blogDirectory, "-c", "user.name=Renderer", "-c", "user.email=renderer@qa.org", "commit", "-m", "Add future post")
+	testutils.Git(t, "-c", "http.cookieFile="+authCookieFile, "-C", blogDirectory, "push", blogURL, "master")
+
+	futurePostURL := blogPageURL + "post/future/"
+
+	if err := waitForBuild(adminClient, blog.Slug, userstore.BuildSucceeded, 3*time.Second); err != nil {
+		t.Fatalf("Error while waiting for the build to succeed: %s", err)
+	}
+
+	if err := waitForPage(futurePostURL, http.StatusNotFound, 0); err != nil {
+		t.Fatalf("Error while checking that the future post is not published yet: %s", err)
+	}
+
+	if err := waitForPage(futurePostURL, http.StatusOK, 10*time.Second); err != nil {
+		t.Fatalf("Error while waiting for %s to be published: %s", futurePostURL, err)
+	}
+
+	if time.Now().Before(publishDate) {
+		t.Errorf("Future post was published before its date")
+	}
 
-	if err := waitForFile(indexHTMLPath, 3*time.Second); err != nil {
-		t.Fatalf("Error while waiting for %s to be produced: %s", indexHTMLPath, err)
+	if builds, err := adminClient.ListBuilds(blog.Slug, 0); err != nil {
+		t.Fatalf("Error while listing builds: %s", err)
+	} else if len(builds) != 4 {
+		t.Errorf("Expected a build for the scheduled render, got %+v", builds)
 	}
 }
 
-func waitForFile(filename string, timeout time.Duration) error {
-	start := time.Now()
+func TestShutdownReleasesJobs(t *testing.T) {
+	testutils.FlushDB(t)
 
-	for time.Since(start) < timeout {
-		_, err := os.Stat(filename)
+	blogOutput := testutils.NewBlogOutput(t)
+	defer blogOutput.Close()
+
+	adminServer := httptest.NewServer(testutils.NewAdminServer(t, blogOutput))
+	defer adminServer.Close()
 
-		if os.IsNotExist(err) {
-			time.Sleep(100 * time.Millisecond)
-			continue
+	// A git server that never replies, so that the job hangs while cloning
+	cloning := make(chan struct{}, 1)
+	blocked := make(chan struct{})
+
+	gitServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case cloning <- struct{}{}:
+		default:
 		}
 
+		<-blocked
+	}))
+	defer gitServer.Close()
+	defer close(blocked)
+
+	adminClient, err := adminserver.NewClient(adminServer.URL)
+
+	if err != nil {
+		t.Fatalf("Error while creating admin client: %s", err)
+	}
+
+	user := userstore.User{Username: "interrupted", Password: "in the middle"}
+
+	if err := adminClient.CreateUser(user); err != nil {
+		t.Fatalf("Error while creating test user: %s", err)
+	}
+
+	if err := adminClient.Login(user.Username, user.Password); err != nil {
+		t.Fatalf("Error while logging in: %s", err)
+	}
+
+	if err := adminClient.CreateBlog(userstore.Blog{Slug: "slow", DisplayName: "Slow"}); err != nil {
+		t.Fatalf("Error while creating blog: %s", err)
+	}
+
+	queue, err := workqueue.NewMemoryQueue()
+
+	if err != nil {
+		t.Fatalf("Error while creating work queue: %s", err)
+	}
+
+	defer queue.Stop()
+
+	grant, err := testutils.GrantSigner(t).Sign(user.Username, "slow", time.Hour)
+
+	if err != nil {
+		t.Fatalf("Error while signing grant: %s", err)
+	}
+
+	job := jobs.RenderJob{Username: user.Username, Repository: "slow", Grant: grant}
+
+	if err := queue.Post(job, time.Hour); err != nil {
+		t.Fatalf("Error while posting job: %s", err)
+	}
+
+	workDir := testutils.TempDir(t, "worker-workdir")
+	defer os.RemoveAll(workDir)
+
+	repositoryQueue := testutils.NewMemoryQueue(t)
+	defer repositoryQueue.Stop()
+
+	w, err := worker.New(queue, adminServer.URL, gitServer.URL, workDir, "file:///nonexistent", blogOutput, repositoryQueue, testutils.NewMemoryAuditLog(t))
+
+	if err != nil {
+		t.Fatalf("Error creating worker: %s", err)
+	}
+
+	select {
+	case <-cloning:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timeout waiting for the worker to clone the blog")
+	}
+
+	before := time.Now()
+	w.Shutdown(100 * time.Millisecond)
+
+	if elapsed := time.Since(before); elapsed > 5*time.Second {
+		t.Errorf("Shutdown took too long: %s", elapsed)
+	}
+
+	entry, err := queue.Pick(0)
+
+	if err != nil {
+		t.Fatalf("Error while picking job: %s", err)
+	}
+
+	if entry == nil {
+		t.Fatalf("Interrupted job was not handed back to the queue")
+	}
+
+	if entry.Attempts != 0 || entry.Data != job {
+		t.Errorf("Unexpected interrupted job: %+v", entry)
+	}
+}
+
+// waitForBuild waits until the last build of a blog has the expected status
+func waitForBuild(adminClient *adminserver.Client, slug string, expectedStatus userstore.BuildStatus, timeout time.Duration) error {
+	start := time.Now()
+
+	for {
+		builds, err := adminClient.ListBuilds(slug, 1)
+
 		if err != nil {
-			return errors.Wrap(err, "Error while waiting for file")
+			return errors.Wrap(err, "Error while listing builds")
 		}
 
-		return nil
+		if len(builds) > 0 && builds[0].Status == expectedStatus {
+			return nil
+		}
+
+		if time.Since(start) >= timeout {
+			return errors.Errorf("timeout, last builds were %+v", builds)
+		}
+
+		time.Sleep(100 * time.Millisecond)
 	}
+}
+
+// waitForPage waits until GETting url returns the expected status. A zero
+// timeout checks the status only once.
+func waitForPage(url string, expectedStatus int, timeout time.Duration) error {
+	start := time.Now()
+
+	for {
+		res, err := http.Get(url)
+
+		if err != nil {
+			return errors.Wrap(err, "Error while fetching page")
+		}
+
+		res.Body.Close()
+
+		if res.StatusCode == expectedStatus {
+			return nil
+		}
+
+		if time.Since(start) >= timeout {
+			return errors.Errorf("timeout, last status was %d", res.StatusCode)
+		}
 
-	return errors.New("timeout")
+		time.Sleep(100 * time.Millisecond)
+	}
 }
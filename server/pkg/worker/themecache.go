@@ -0,0 +1,55 @@
+package worker
+
+import (
+	"context"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Name of the theme checkout in the themes directory
+const themeCacheDirectory = "theme"
+
+// themeCache is a checkout of the blog theme shared by the job slots of a
+// worker. Hugo must hold a read lock on mutex while it reads the theme.
+type themeCache struct {
+	repositoryURL string
+	themesDir     string
+	mutex         sync.RWMutex
+}
+
+func newThemeCache(repositoryURL, themesDir string) *themeCache {
+	return &themeCache{
+		repositoryURL: repositoryURL,
+		themesDir:     themesDir,
+	}
+}
+
+// update clones the theme, or pulls its latest version if it was already
+// cloned
+func (c *themeCache) update(ctx context.Context, buildLog *buildLog) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	themePath := path.Join(c.themesDir, themeCacheDirectory)
+
+	stat, err := os.Stat(themePath)
+
+	if os.IsNotExist(err) {
+		err := runGit(ctx, buildLog, nil, "clone", c.repositoryURL, themePath)
+
+		return errors.Wrap(err, "Error while cloning theme")
+	}
+
+	if err != nil {
+		return errors.Wrap(err, "Error while checking if theme directory exists")
+	}
+
+	if !stat.IsDir() {
+		return errors.New("Theme path exists but is not a directory")
+	}
+
+	return errors.Wrap(runGit(ctx, buildLog, nil, "-C", themePath, "pull"), "Error while pulling in theme dir")
+}
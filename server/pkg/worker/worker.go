@@ -10,28 +10,63 @@ import (
 	"os/exec"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/pkg/errors"
 
+	"github.com/abustany/moblog-cloud/pkg/audit"
+	"github.com/abustany/moblog-cloud/pkg/blogoutput"
 	"github.com/abustany/moblog-cloud/pkg/jobs"
 	"github.com/abustany/moblog-cloud/pkg/workqueue"
 )
 
 var PickTimeout = time.Second
 
+// Number of jobs a worker runs at the same time
+var Concurrency = 1
+
+// errJobCancelled is returned by the jobs that got cancelled while running
+var errJobCancelled = errors.New("Job cancelled")
+
+// Maximum time a job can run. Jobs running longer than their TTR keep their
+// reservation by touching it, up to this limit.
+var MaxJobDuration = time.Hour
+
 type Worker struct {
-	queue              workqueue.Queue
-	adminServerURL     string
-	gitServerURL       string
-	workDir            string
-	themeRepositoryURL string
-	blogOutputURL      string
-	closeChannel       chan chan struct{}
+	queue          workqueue.Queue
+	adminServerURL string
+	gitServerURL   string
+	workDir        string
+	themeCache     *themeCache
+	blogOutput     *blogoutput.Output
+	// Queue of the gitservers, which post the scheduled renders when they are
+	// due since they sign the grants of render jobs
+	repositoryQueue workqueue.Queue
+	auditLog        audit.Log
+	stopChannel     chan struct{} // closed to ask the slots to stop
+	slotsDone       sync.WaitGroup
+	doneChannel     chan struct{} // closed once all the slots stopped
+
+	// Parent of the contexts of the jobs, cancelled to interrupt them
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
-func New(queue workqueue.Queue, adminServerURL, gitServerURL, workDir, themeRepositoryURL, blogOutputURL string) (*Worker, error) {
+// slot runs the jobs of a worker one at a time, in its own work directory
+type slot struct {
+	*Worker
+	dir string
+}
+
+func New(queue workqueue.Queue, adminServerURL, gitServerURL, workDir, themeRepositoryURL string, blogOutput *blogoutput.Output, repositoryQueue workqueue.Queue, auditLog audit.Log) (*Worker, error) {
+	if Concurrency < 1 {
+		return nil, errors.Errorf("Invalid concurrency: %d", Concurrency)
+	}
+
 	workDir, err := filepath.Abs(workDir)
 
 	if err != nil {
@@ -39,48 +74,101 @@ func New(queue workqueue.Queue, adminServerURL, gitServerURL, workDir, themeRepo
 		return nil, errors.Wrap(err, "Could not determine absolute path of work directory")
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
+
 	w := &Worker{
-		queue:              queue,
-		adminServerURL:     adminServerURL,
-		gitServerURL:       gitServerURL,
-		workDir:            workDir,
-		themeRepositoryURL: themeRepositoryURL,
-		blogOutputURL:      blogOutputURL,
-		closeChannel:       make(chan chan struct{}),
+		ctx:             ctx,
+		cancel:          cancel,
+		queue:           queue,
+		adminServerURL:  adminServerURL,
+		gitServerURL:    gitServerURL,
+		workDir:         workDir,
+		themeCache:      newThemeCache(themeRepositoryURL, workDir),
+		blogOutput:      blogOutput,
+		repositoryQueue: repositoryQueue,
+		auditLog:        auditLog,
+		stopChannel:     make(chan struct{}),
+		doneChannel:     make(chan struct{}),
+	}
+
+	slots := make([]*slot, Concurrency)
+
+	for i := range slots {
+		slots[i] = &slot{w, path.Join(workDir, "slot-"+strconv.Itoa(i))}
+
+		if err := os.MkdirAll(slots[i].dir, 0700); err != nil {
+			cancel()
+			return nil, errors.Wrap(err, "Error while creating slot directory")
+		}
 	}
 
-	go w.consumeJobs()
+	w.slotsDone.Add(len(slots))
+
+	for _, s := range slots {
+		go s.consumeJobs()
+	}
 
 	return w, nil
 }
 
 func (w *Worker) Wait() {
-	<-w.closeChannel
+	<-w.doneChannel
 }
 
+// Stop interrupts the running jobs, hands them back to the queue and stops
+// the worker
 func (w *Worker) Stop() {
-	ack := make(chan struct{})
-	w.closeChannel <- ack
-	<-ack
-	close(w.closeChannel)
+	w.Shutdown(0)
+}
+
+// Shutdown stops picking new jobs, and waits for the running jobs to
+// complete. Jobs still running after the grace period are interrupted and
+// handed back to the queue, so that another worker can pick them right away.
+func (w *Worker) Shutdown(gracePeriod time.Duration) {
+	close(w.stopChannel)
+
+	slotsDone := make(chan struct{})
+
+	go func() {
+		w.slotsDone.Wait()
+		close(slotsDone)
+	}()
+
+	select {
+	case <-slotsDone:
+	case <-time.After(gracePeriod):
+		log.Printf("Interrupting running jobs")
+		w.cancel()
+		<-slotsDone
+	}
+
+	w.cancel()
+	close(w.doneChannel)
+}
+
+// interrupted returns true if the worker is interrupting its running jobs
+func (w *Worker) interrupted() bool {
+	return w.ctx.Err() != nil
 }
 
-func (w *Worker) consumeJobs() {
+func (s *slot) consumeJobs() {
+	defer s.slotsDone.Done()
+
 	for {
 		select {
-		case ack := <-w.closeChannel:
-			close(ack)
+		case <-s.stopChannel:
+			return
 		default:
 		}
 
-		if err := w.consumeOneJob(); err != nil {
+		if err := s.consumeOneJob(); err != nil {
 			log.Printf("Error while consuming job :%s", err)
 		}
 	}
 }
 
-func (w *Worker) consumeOneJob() error {
-	job, err := w.queue.Pick(PickTimeout)
+func (s *slot) consumeOneJob() error {
+	job, err := s.queue.Pick(PickTimeout)
 
 	if err != nil {
 		return errors.Wrap(err, "Error while picking job")
@@ -90,39 +178,149 @@ func (w *Worker) consumeOneJob() error {
 		return nil
 	}
 
-	log.Printf("Handling job %s", job.ID)
+	log.Printf("Handling job %s (previous attempts: %d)", job.ID, job.Attempts)
 
-	ctx, cancel := context.WithTimeout(context.Background(), job.TTR)
+	ctx, cancel := context.WithTimeout(s.ctx, MaxJobDuration)
 	defer cancel()
 
-	defer func() {
-		if err := w.queue.Finish(job); err != nil {
-			log.Printf("Error while finishing job %s: %s", job.ID, err)
-		}
+	// Stop touching the job before finishing or failing it
+	keeperDone := make(chan struct{})
+
+	go func() {
+		s.keepReserved(ctx, cancel, job)
+		close(keeperDone)
 	}()
 
-	if err := clearDirectory(w.workDir); err != nil {
+	err = s.handleJob(ctx, job)
+	cancel()
+	<-keeperDone
+
+	if errors.Cause(err) == errJobCancelled {
+		log.Printf("Job %s cancelled", job.ID)
+
+		if err := s.queue.Finish(job); err != nil {
+			log.Printf("Error while finishing cancelled job %s: %s", job.ID, err)
+		}
+
+		return nil
+	}
+
+	if err != nil {
+		if s.interrupted() {
+			log.Printf("Job %s interrupted, handing it back to the queue", job.ID)
+
+			if err := s.queue.Release(job); err != nil {
+				log.Printf("Error while releasing job %s: %s", job.ID, err)
+			}
+
+			return nil
+		}
+
+		log.Printf("Job %s failed: %s", job.ID, err)
+
+		if job.LastAttempt() {
+			log.Printf("Job %s failed too many times, moving it to the dead-letter list", job.ID)
+		}
+
+		if err := s.queue.Fail(job, err); err != nil {
+			log.Printf("Error while failing job %s: %s", job.ID, err)
+		}
+
+		return nil
+	}
+
+	log.Printf("Job %s succeeded", job.ID)
+
+	if err := s.queue.Finish(job); err != nil {
+		log.Printf("Error while finishing job %s: %s", job.ID, err)
+	}
+
+	return nil
+}
+
+// keepReserved touches a job until ctx is done, so that the queue doesn't
+// hand it to another worker while it is running. The job is cancelled if its
+// reservation is lost.
+func (s *slot) keepReserved(ctx context.Context, cancel context.CancelFunc, job *workqueue.JobEntry) {
+	if job.TTR <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(job.TTR / 3)
+	defer ticker.Stop()
+
+	reservedUntil := time.Now().Add(job.TTR)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		err := s.queue.Touch(job)
+
+		if err == nil {
+			reservedUntil = time.Now().Add(job.TTR)
+			continue
+		}
+
+		log.Printf("Error while touching job %s: %s", job.ID, err)
+
+		if errors.Cause(err) == workqueue.ErrJobNotFound || time.Now().After(reservedUntil) {
+			log.Printf("Job %s is not reserved anymore, cancelling it", job.ID)
+			cancel()
+			return
+		}
+	}
+}
+
+func (s *slot) handleJob(ctx context.Context, job *workqueue.JobEntry) error {
+	if err := clearDirectory(s.dir); err != nil {
 		return errors.Wrap(err, "Error while clearing work directory")
 	}
 
+	if err := s.checkCancelled(job); err != nil {
+		return err
+	}
+
 	switch jobData := job.Data.(type) {
 	case jobs.RenderJob:
-		log.Printf("Handling render job %+v", jobData)
-		err = w.renderBlog(ctx, &jobData)
+		log.Printf("Handling render job %s for %s/%s", job.ID, jobData.Username, jobData.Repository)
+		return s.renderBlog(ctx, job, &jobData)
+	case jobs.ScheduledRenderJob:
+		// Workers used to post the renders of future posts to their own queue
+		log.Printf("Handing scheduled render job for %s/%s to the gitservers", jobData.Username, jobData.Repository)
+		_, err := s.repositoryQueue.PostUnique(jobs.RenderJobKey(jobData.Username, jobData.Repository), jobData, job.TTR)
+		return errors.Wrap(err, "Error while posting scheduled render job")
+	case jobs.CleanupJob:
+		log.Printf("Handling cleanup job for %s", jobData.Target())
+		return s.cleanupOutput(ctx, &jobData)
 	default:
 		return errors.Errorf("Unknown job type: %+v", job.Data)
 	}
+}
+
+// checkCancelled returns errJobCancelled if the job was cancelled since it was
+// picked. Errors while checking are logged, and the job carries on.
+func (s *slot) checkCancelled(job *workqueue.JobEntry) error {
+	cancelled, err := s.queue.Cancelled(job)
 
 	if err != nil {
-		log.Printf("Job %s failed: %s", job.ID, err)
-	} else {
-		log.Printf("Job %s succeeded", job.ID)
+		log.Printf("Error while checking if job %s is cancelled: %s", job.ID, err)
+		return nil
+	}
+
+	if cancelled {
+		return errJobCancelled
 	}
 
 	return nil
 }
 
-func runGit(ctx context.Context, stdout io.Writer, args ...string) error {
+// runGit runs git, writing its output to the build log as well as to stdout if
+// it is not nil.
+func runGit(ctx context.Context, buildLog *buildLog, stdout io.Writer, args ...string) error {
 	gitPath, err := exec.LookPath("git")
 
 	if err != nil {
@@ -130,21 +328,66 @@ func runGit(ctx context.Context, stdout io.Writer, args ...string) error {
 	}
 
 	var stderrBuffer bytes.Buffer
-	gitCmd := exec.CommandContext(ctx, gitPath, args...)
+	gitCmd := exec.Command(gitPath, args...)
 	gitCmd.Env = []string{"GIT_TERMINAL_PROMPT=0"}
 	gitCmd.Stdin = nil
-	gitCmd.Stdout = stdout
-	gitCmd.Stderr = &stderrBuffer
+	gitCmd.Stdout = buildLog.teeWriter(stdout)
+	gitCmd.Stderr = buildLog.teeWriter(&stderrBuffer)
 
-	log.Printf("Running git %v", args)
+	log.Printf("Running git %v", redactGitArgs(args))
+	buildLog.Printf("$ git %s", strings.Join(redactGitArgs(args), " "))
 
-	if err := gitCmd.Run(); err != nil {
+	if err := runProcessGroup(ctx, gitCmd); err != nil {
 		return errors.Wrapf(err, "Git returned an error (stderr: %s)", strings.TrimSpace(stderrBuffer.String()))
 	}
 
 	return nil
 }
 
+// runProcessGroup runs a command in its own process group, and kills the whole
+// group if the context is done before the command exits. Git leaves its remote
+// helpers running when only git itself is killed, and they hold its output
+// pipes open, which would block Wait until they are done.
+func runProcessGroup(ctx context.Context, cmd *exec.Cmd) error {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	exited := make(chan struct{})
+	defer close(exited)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			// A negative PID designates the process group
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		case <-exited:
+		}
+	}()
+
+	return cmd.Wait()
+}
+
+const gitExtraHeaderConfig = "http.extraHeader="
+
+// redactGitArgs hides the values of extra HTTP headers, which carry
+// credentials, before logging git arguments.
+func redactGitArgs(args []string) []string {
+	redacted := make([]string, len(args))
+
+	for i, arg := range args {
+		if strings.HasPrefix(arg, gitExtraHeaderConfig) {
+			arg = gitExtraHeaderConfig + "<redacted>"
+		}
+
+		redacted[i] = arg
+	}
+
+	return redacted
+}
+
 func clearDirectory(dir string) error {
 	entries, err := ioutil.ReadDir(dir)
 
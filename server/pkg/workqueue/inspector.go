@@ -0,0 +1,53 @@
+package workqueue
+
+// JobState is the state of a job in a queue, as reported by an Inspector
+type JobState string
+
+const (
+	JobPending  JobState = "pending"
+	JobDelayed  JobState = "delayed"  // scheduled, or waiting to be retried
+	JobFollowup JobState = "followup" // waiting for a job with the same key
+	JobReserved JobState = "reserved"
+	JobDead     JobState = "dead"
+)
+
+var JobStates = []JobState{JobPending, JobDelayed, JobFollowup, JobReserved, JobDead}
+
+// Inspector is implemented by the queues that can look at the jobs they
+// store, for monitoring and administration. The MemoryQueue doesn't implement
+// it.
+type Inspector interface {
+	// Counts returns the number of jobs in each state
+	Counts() (map[JobState]int, error)
+	// Jobs returns the jobs in the given state. Pending jobs are returned in
+	// the order they will be picked, delayed jobs in the order they become
+	// pending.
+	Jobs(state JobState) ([]*JobEntry, error)
+	// Job returns the job of the given ID and its state, or ErrJobNotFound
+	Job(id string) (*JobEntry, JobState, error)
+	// Cancel deletes a pending, delayed or follow-up job. Returns
+	// ErrJobNotFound if there is no such job.
+	Cancel(id string) error
+	// Requeue puts a reserved job back in the pending jobs, as if its TTR had
+	// elapsed. Returns ErrJobNotFound if there is no such job.
+	Requeue(id string) error
+}
+
+// findJob looks for a job in all the states of a queue
+func findJob(inspector Inspector, id string) (*JobEntry, JobState, error) {
+	for _, state := range JobStates {
+		entries, err := inspector.Jobs(state)
+
+		if err != nil {
+			return nil, "", err
+		}
+
+		for _, entry := range entries {
+			if entry.ID == id {
+				return entry, state, nil
+			}
+		}
+	}
+
+	return nil, "", ErrJobNotFound
+}
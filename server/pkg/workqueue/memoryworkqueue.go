@@ -10,15 +10,25 @@ import (
 const MemoryMaxPendingJobs = 1000
 
 type memoryEntryMetadata struct {
-	entry   *JobEntry
-	started time.Time
+	entry     *JobEntry
+	started   time.Time
+	cancelled bool
+}
+
+type memoryDelayedEntry struct {
+	entry *JobEntry
+	due   time.Time
 }
 
 type MemoryQueue struct {
 	idGenerator *idgenerator.StringIdGenerator
 	pendingChan chan *JobEntry
 	metadata    map[string]memoryEntryMetadata
-	mutex       sync.Mutex // protects reserved and metadata
+	delayed     []memoryDelayedEntry // scheduled jobs and failed jobs waiting to be retried
+	dead        []*JobEntry          // most recently failed first
+	pendingKeys map[string]*JobEntry // pending jobs posted with PostUnique
+	followups   map[string]*JobEntry // jobs posted while a job with the same key was running
+	mutex       sync.Mutex           // protects all of the above but pendingChan
 	groomTicker *time.Ticker
 }
 
@@ -28,6 +38,8 @@ func NewMemoryQueue() (*MemoryQueue, error) {
 		pendingChan: make(chan *JobEntry, MemoryMaxPendingJobs),
 		groomTicker: time.NewTicker(GroomInterval),
 		metadata:    map[string]memoryEntryMetadata{},
+		pendingKeys: map[string]*JobEntry{},
+		followups:   map[string]*JobEntry{},
 	}
 
 	go func() {
@@ -51,35 +63,192 @@ func (q *MemoryQueue) groom() {
 
 	for _, m := range q.metadata {
 		if now.After(m.started.Add(m.entry.TTR)) {
-			// Job took too long to run, put it back in the ready queue
+			// Job took too long to run, put it back in the ready queue. The
+			// worker running it still holds the old entry, so requeue a copy
+			// that PostUnique can modify.
 			delete(q.metadata, m.entry.ID)
-			q.pendingChan <- m.entry
+
+			if m.cancelled {
+				continue
+			}
+
+			requeued := *m.entry
+
+			select {
+			case q.pendingChan <- &requeued:
+				q.markPending(&requeued)
+			default:
+				// Queue is full, try again at the next grooming
+				q.delayed = append(q.delayed, memoryDelayedEntry{entry: &requeued, due: now})
+			}
+		}
+	}
+
+	stillDelayed := q.delayed[:0]
+
+	for _, d := range q.delayed {
+		if !now.After(d.due) {
+			stillDelayed = append(stillDelayed, d)
+			continue
+		}
+
+		if _, err := q.postUniqueEntry(d.entry); err != nil {
+			// Queue is full, try again at the next grooming
+			stillDelayed = append(stillDelayed, d)
 		}
 	}
+
+	q.delayed = stillDelayed
+
+	// Follow-ups are normally released when the running job finishes, but
+	// that can fail if the pending queue is full
+	for key := range q.followups {
+		q.releaseFollowup(key)
+	}
 }
 
-func (q *MemoryQueue) Post(job interface{}, ttr time.Duration) error {
-	entry := &JobEntry{
+// markPending records a job being added to the pending queue, so that
+// PostUnique can coalesce other jobs into it. The mutex must be held.
+func (q *MemoryQueue) markPending(entry *JobEntry) {
+	if entry.Key == "" {
+		return
+	}
+
+	if _, exists := q.pendingKeys[entry.Key]; !exists {
+		q.pendingKeys[entry.Key] = entry
+	}
+}
+
+// isRunning returns true if a job with the given key is reserved. The mutex
+// must be held.
+func (q *MemoryQueue) isRunning(key string) bool {
+	for _, m := range q.metadata {
+		if m.entry.Key == key {
+			return true
+		}
+	}
+
+	return false
+}
+
+// releaseFollowup makes the follow-up job of the given key pending, if there
+// is one and no other job with this key is running. The mutex must be held.
+func (q *MemoryQueue) releaseFollowup(key string) {
+	followup, exists := q.followups[key]
+
+	if !exists || q.isRunning(key) {
+		return
+	}
+
+	select {
+	case q.pendingChan <- followup:
+		delete(q.followups, key)
+		q.markPending(followup)
+	default:
+		// Queue is full, the groomer will try again later
+	}
+}
+
+func (q *MemoryQueue) newEntry(key string, job interface{}, ttr time.Duration) *JobEntry {
+	return &JobEntry{
 		ID:   q.idGenerator.Next(),
 		TTR:  ttr,
 		Data: job,
+		Key:  key,
 	}
+}
 
+func (q *MemoryQueue) Post(job interface{}, ttr time.Duration) error {
 	select {
-	case q.pendingChan <- entry:
+	case q.pendingChan <- q.newEntry("", job, ttr):
 		return nil
 	default:
 		return ErrQueueFull
 	}
 }
 
+func (q *MemoryQueue) PostAt(key string, job interface{}, ttr time.Duration, at time.Time) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.delayed = append(q.delayed, memoryDelayedEntry{
+		entry: q.newEntry(key, job, ttr),
+		due:   at,
+	})
+
+	return nil
+}
+
+func (q *MemoryQueue) PostAfter(key string, job interface{}, ttr time.Duration, delay time.Duration) error {
+	return q.PostAt(key, job, ttr, time.Now().Add(delay))
+}
+
+func (q *MemoryQueue) PostUnique(key string, job interface{}, ttr time.Duration) (interface{}, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return q.postUniqueEntry(q.newEntry(key, job, ttr))
+}
+
+// postUniqueEntry posts an entry following the rules of PostUnique. Entries
+// without a key are simply made pending. The mutex must be held.
+func (q *MemoryQueue) postUniqueEntry(entry *JobEntry) (interface{}, error) {
+	// Entries in pendingKeys and followups have not been returned by Pick
+	// yet, so nobody else is reading them.
+	replace := func(replacedEntry *JobEntry) interface{} {
+		replaced := replacedEntry.Data
+		replacedEntry.Data = entry.Data
+		replacedEntry.TTR = entry.TTR
+		return replaced
+	}
+
+	if pending, exists := q.pendingKeys[entry.Key]; entry.Key != "" && exists {
+		return replace(pending), nil
+	}
+
+	if entry.Key != "" && q.isRunning(entry.Key) {
+		if followup, exists := q.followups[entry.Key]; exists {
+			return replace(followup), nil
+		}
+
+		q.followups[entry.Key] = entry
+
+		return nil, nil
+	}
+
+	select {
+	case q.pendingChan <- entry:
+		q.markPending(entry)
+		return nil, nil
+	default:
+		return nil, ErrQueueFull
+	}
+}
+
 func (q *MemoryQueue) reserveEntry(entry *JobEntry) {
 	q.mutex.Lock()
+
+	if entry.Key != "" && q.pendingKeys[entry.Key] == entry {
+		delete(q.pendingKeys, entry.Key)
+	}
+
 	q.metadata[entry.ID] = memoryEntryMetadata{entry: entry, started: time.Now()}
 	q.mutex.Unlock()
 }
 
 func (q *MemoryQueue) Pick(timeout time.Duration) (*JobEntry, error) {
+	// MultiQueue polls its queues with a zero timeout, which must return a
+	// ready job rather than race it with an expired timer
+	if timeout <= 0 {
+		select {
+		case entry := <-q.pendingChan:
+			q.reserveEntry(entry)
+			return entry, nil
+		default:
+			return nil, nil
+		}
+	}
+
 	t := time.NewTimer(timeout)
 	defer t.Stop()
 
@@ -95,7 +264,197 @@ func (q *MemoryQueue) Pick(timeout time.Duration) (*JobEntry, error) {
 func (q *MemoryQueue) Finish(entry *JobEntry) error {
 	q.mutex.Lock()
 	delete(q.metadata, entry.ID)
+
+	if entry.Key != "" {
+		q.releaseFollowup(entry.Key)
+	}
+
 	q.mutex.Unlock()
 
 	return nil
 }
+
+func (q *MemoryQueue) Fail(entry *JobEntry, err error) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	m, reserved := q.metadata[entry.ID]
+
+	if !reserved {
+		// The job already expired and got requeued
+		return nil
+	}
+
+	delete(q.metadata, entry.ID)
+
+	if m.cancelled {
+		q.releaseFollowup(entry.Key)
+		return nil
+	}
+
+	failed := *entry
+	failed.Attempts++
+	failed.LastError = errorMessage(err)
+
+	if failed.Attempts >= MaxAttempts {
+		q.dead = append([]*JobEntry{&failed}, q.dead...)
+	} else {
+		q.delayed = append(q.delayed, memoryDelayedEntry{
+			entry: &failed,
+			due:   time.Now().Add(retryDelay(failed.Attempts)),
+		})
+	}
+
+	if entry.Key != "" {
+		q.releaseFollowup(entry.Key)
+	}
+
+	return nil
+}
+
+func (q *MemoryQueue) Release(entry *JobEntry) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	m, reserved := q.metadata[entry.ID]
+
+	if !reserved {
+		// The job already expired and got requeued
+		return nil
+	}
+
+	delete(q.metadata, entry.ID)
+
+	if m.cancelled {
+		q.releaseFollowup(entry.Key)
+		return nil
+	}
+
+	// The worker releasing the job still holds the old entry
+	released := *entry
+
+	select {
+	case q.pendingChan <- &released:
+		q.markPending(&released)
+	default:
+		// Queue is full, let the groomer requeue the job
+		q.delayed = append(q.delayed, memoryDelayedEntry{entry: &released, due: time.Now()})
+	}
+
+	return nil
+}
+
+func (q *MemoryQueue) Touch(entry *JobEntry) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	m, reserved := q.metadata[entry.ID]
+
+	if !reserved {
+		return ErrJobNotFound
+	}
+
+	m.started = time.Now()
+	q.metadata[entry.ID] = m
+
+	return nil
+}
+
+func (q *MemoryQueue) CancelKey(key string) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	// Pending jobs can only be filtered by emptying the channel. Jobs posted
+	// meanwhile can fill it again, the groomer requeues those that don't fit.
+	var kept []*JobEntry
+
+	for drained := false; !drained; {
+		select {
+		case entry := <-q.pendingChan:
+			if entry.Key != key {
+				kept = append(kept, entry)
+			}
+		default:
+			drained = true
+		}
+	}
+
+	for _, entry := range kept {
+		select {
+		case q.pendingChan <- entry:
+		default:
+			q.delayed = append(q.delayed, memoryDelayedEntry{entry: entry, due: time.Now()})
+		}
+	}
+
+	delete(q.pendingKeys, key)
+	delete(q.followups, key)
+
+	stillDelayed := q.delayed[:0]
+
+	for _, d := range q.delayed {
+		if d.entry.Key != key {
+			stillDelayed = append(stillDelayed, d)
+		}
+	}
+
+	q.delayed = stillDelayed
+
+	for id, m := range q.metadata {
+		if m.entry.Key == key {
+			m.cancelled = true
+			q.metadata[id] = m
+		}
+	}
+
+	return nil
+}
+
+func (q *MemoryQueue) Cancelled(entry *JobEntry) (bool, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return q.metadata[entry.ID].cancelled, nil
+}
+
+func (q *MemoryQueue) DeadJobs() ([]*JobEntry, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	entries := make([]*JobEntry, len(q.dead))
+
+	for i, entry := range q.dead {
+		entryCopy := *entry
+		entries[i] = &entryCopy
+	}
+
+	return entries, nil
+}
+
+func (q *MemoryQueue) RequeueDead(id string) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for i, entry := range q.dead {
+		if entry.ID != id {
+			continue
+		}
+
+		requeued := *entry
+		requeued.Attempts = 0
+		requeued.LastError = ""
+
+		select {
+		case q.pendingChan <- &requeued:
+			q.markPending(&requeued)
+		default:
+			return ErrQueueFull
+		}
+
+		q.dead = append(q.dead[:i], q.dead[i+1:]...)
+
+		return nil
+	}
+
+	return ErrJobNotFound
+}
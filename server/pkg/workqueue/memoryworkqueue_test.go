@@ -11,6 +11,7 @@ func TestMemoryQueue(t *testing.T) {
 	// Reduce groom interval at expense of CPU load so that tests don't take
 	// forever to run
 	workqueue.GroomInterval = 20 * time.Millisecond
+	workqueue.RetryBackoff = 100 * time.Millisecond
 
 	q, err := workqueue.NewMemoryQueue()
 
@@ -22,3 +23,59 @@ func TestMemoryQueue(t *testing.T) {
 
 	testWorkqueue(t, q)
 }
+
+func TestMemoryQueueFullGroom(t *testing.T) {
+	workqueue.GroomInterval = 20 * time.Millisecond
+
+	q, err := workqueue.NewMemoryQueue()
+
+	if err != nil {
+		t.Fatalf("Error while creating queue: %s", err)
+	}
+
+	defer q.Stop()
+
+	if err := q.Post("expiring", 10*time.Millisecond); err != nil {
+		t.Fatalf("Error while posting job: %s", err)
+	}
+
+	if entry, err := q.Pick(0); err != nil || entry == nil {
+		t.Fatalf("Error while picking job: %v", err)
+	}
+
+	for i := 0; i < workqueue.MemoryMaxPendingJobs; i++ {
+		if err := q.Post("filler", time.Hour); err != nil {
+			t.Fatalf("Error while posting job: %s", err)
+		}
+	}
+
+	// The expired job cannot be requeued while the queue is full, which must
+	// not block the queue
+	time.Sleep(100 * time.Millisecond)
+
+	done := make(chan error)
+
+	go func() {
+		done <- q.PostAfter("", "delayed", time.Hour, time.Hour)
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("PostAfter returned an error: %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Queue is blocked while full")
+	}
+
+	for i := 0; i < workqueue.MemoryMaxPendingJobs; i++ {
+		if entry, err := q.Pick(0); err != nil || entry == nil || entry.Data != "filler" {
+			t.Fatalf("Unexpected job %+v, %v", entry, err)
+		}
+	}
+
+	// Once there is room, the expired job gets requeued
+	if entry, err := q.Pick(time.Second); err != nil || entry == nil || entry.Data != "expiring" {
+		t.Errorf("Expected the expired job to be requeued, got %+v, %v", entry, err)
+	}
+}
@@ -0,0 +1,285 @@
+package workqueue
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// How often a MultiQueue checks its queues while waiting for a job. The
+// interval doubles while all the queues stay empty, up to MaxMultiPollInterval.
+// Jobs of the first queue are picked as soon as they are posted regardless.
+var MultiPollInterval = 100 * time.Millisecond
+var MaxMultiPollInterval = 5 * time.Second
+
+// WeightedQueue is a queue consumed by a MultiQueue, along with its share of
+// the picks
+type WeightedQueue struct {
+	Queue  Queue
+	Weight int
+}
+
+// MultiQueue consumes jobs from several queues. When all of them have pending
+// jobs, each queue gets a share of the picks proportional to its weight, so
+// that a busy queue cannot starve the others. Otherwise, jobs are picked from
+// the first queue that has some, in the order the queues were given.
+//
+// Jobs posted to a MultiQueue go to its first queue.
+type MultiQueue struct {
+	queues  []WeightedQueue
+	mutex   sync.Mutex          // protects current, picked and idlePoll
+	current []int               // state of the smooth weighted round-robin
+	picked  map[*JobEntry]Queue // queue of each job picked and not finished
+	// Interval between two checks of the queues, grows while they are empty
+	idlePoll time.Duration
+}
+
+func NewMultiQueue(queues ...WeightedQueue) (*MultiQueue, error) {
+	if len(queues) == 0 {
+		return nil, errors.New("At least one queue is required")
+	}
+
+	for _, q := range queues {
+		if q.Weight <= 0 {
+			return nil, errors.Errorf("Invalid queue weight: %d", q.Weight)
+		}
+	}
+
+	return &MultiQueue{
+		queues:   queues,
+		current:  make([]int, len(queues)),
+		picked:   map[*JobEntry]Queue{},
+		idlePoll: MultiPollInterval,
+	}, nil
+}
+
+func (q *MultiQueue) first() Queue {
+	return q.queues[0].Queue
+}
+
+func (q *MultiQueue) Post(job interface{}, ttr time.Duration) error {
+	return q.first().Post(job, ttr)
+}
+
+func (q *MultiQueue) PostAt(key string, job interface{}, ttr time.Duration, at time.Time) error {
+	return q.first().PostAt(key, job, ttr, at)
+}
+
+func (q *MultiQueue) PostAfter(key string, job interface{}, ttr time.Duration, delay time.Duration) error {
+	return q.first().PostAfter(key, job, ttr, delay)
+}
+
+func (q *MultiQueue) PostUnique(key string, job interface{}, ttr time.Duration) (interface{}, error) {
+	return q.first().PostUnique(key, job, ttr)
+}
+
+// pickOrder returns the queues in the order Pick should try them. The first
+// queue is chosen with a smooth weighted round-robin, the other ones follow in
+// order.
+func (q *MultiQueue) pickOrder() []Queue {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	total := 0
+	chosen := 0
+
+	for i, wq := range q.queues {
+		q.current[i] += wq.Weight
+		total += wq.Weight
+
+		if q.current[i] > q.current[chosen] {
+			chosen = i
+		}
+	}
+
+	q.current[chosen] -= total
+
+	order := make([]Queue, 0, len(q.queues))
+	order = append(order, q.queues[chosen].Queue)
+
+	for i, wq := range q.queues {
+		if i != chosen {
+			order = append(order, wq.Queue)
+		}
+	}
+
+	return order
+}
+
+// reserve records the queue a job was picked from, and resets the polling
+// interval since more jobs are likely to follow
+func (q *MultiQueue) reserve(entry *JobEntry, queue Queue) *JobEntry {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.picked[entry] = queue
+	q.idlePoll = MultiPollInterval
+
+	return entry
+}
+
+// nextIdlePoll returns how long to wait before checking the queues again,
+// and doubles the interval for the next time
+func (q *MultiQueue) nextIdlePoll() time.Duration {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	wait := q.idlePoll
+	q.idlePoll *= 2
+
+	if q.idlePoll > MaxMultiPollInterval {
+		q.idlePoll = MaxMultiPollInterval
+	}
+
+	return wait
+}
+
+func (q *MultiQueue) Pick(timeout time.Duration) (*JobEntry, error) {
+	deadline := time.Now().Add(timeout)
+	order := q.pickOrder()
+
+	for {
+		for _, queue := range order {
+			entry, err := queue.Pick(0)
+
+			if err != nil {
+				return nil, err
+			}
+
+			if entry != nil {
+				return q.reserve(entry, queue), nil
+			}
+		}
+
+		wait := time.Until(deadline)
+
+		if wait <= 0 {
+			return nil, nil
+		}
+
+		if idlePoll := q.nextIdlePoll(); wait > idlePoll {
+			wait = idlePoll
+		}
+
+		// Waiting on the first queue instead of sleeping lets its jobs through
+		// right away, the other queues are only polled
+		entry, err := q.first().Pick(wait)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if entry != nil {
+			return q.reserve(entry, q.first()), nil
+		}
+	}
+}
+
+// release returns the queue a job was picked from, and forgets about the job
+func (q *MultiQueue) release(entry *JobEntry) (Queue, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	queue, exists := q.picked[entry]
+
+	if !exists {
+		return nil, ErrUnknownEntry
+	}
+
+	delete(q.picked, entry)
+
+	return queue, nil
+}
+
+func (q *MultiQueue) Finish(entry *JobEntry) error {
+	queue, err := q.release(entry)
+
+	if err != nil {
+		return err
+	}
+
+	return queue.Finish(entry)
+}
+
+func (q *MultiQueue) Fail(entry *JobEntry, err error) error {
+	queue, releaseErr := q.release(entry)
+
+	if releaseErr != nil {
+		return releaseErr
+	}
+
+	return queue.Fail(entry, err)
+}
+
+func (q *MultiQueue) Release(entry *JobEntry) error {
+	queue, err := q.release(entry)
+
+	if err != nil {
+		return err
+	}
+
+	return queue.Release(entry)
+}
+
+func (q *MultiQueue) Touch(entry *JobEntry) error {
+	q.mutex.Lock()
+	queue, exists := q.picked[entry]
+	q.mutex.Unlock()
+
+	if !exists {
+		return ErrUnknownEntry
+	}
+
+	return queue.Touch(entry)
+}
+
+// CancelKey cancels the jobs of the given key in all the queues
+func (q *MultiQueue) CancelKey(key string) error {
+	for _, wq := range q.queues {
+		if err := wq.Queue.CancelKey(key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (q *MultiQueue) Cancelled(entry *JobEntry) (bool, error) {
+	q.mutex.Lock()
+	queue, exists := q.picked[entry]
+	q.mutex.Unlock()
+
+	if !exists {
+		return false, ErrUnknownEntry
+	}
+
+	return queue.Cancelled(entry)
+}
+
+// DeadJobs returns the dead jobs of all the queues, grouped by queue
+func (q *MultiQueue) DeadJobs() ([]*JobEntry, error) {
+	var entries []*JobEntry
+
+	for _, wq := range q.queues {
+		queueEntries, err := wq.Queue.DeadJobs()
+
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, queueEntries...)
+	}
+
+	return entries, nil
+}
+
+func (q *MultiQueue) RequeueDead(id string) error {
+	for _, wq := range q.queues {
+		if err := wq.Queue.RequeueDead(id); err != ErrJobNotFound {
+			return err
+		}
+	}
+
+	return ErrJobNotFound
+}
@@ -0,0 +1,141 @@
+package workqueue_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abustany/moblog-cloud/pkg/workqueue"
+)
+
+func newMemoryQueue(t *testing.T) *workqueue.MemoryQueue {
+	q, err := workqueue.NewMemoryQueue()
+
+	if err != nil {
+		t.Fatalf("Error while creating queue: %s", err)
+	}
+
+	return q
+}
+
+func TestMultiQueue(t *testing.T) {
+	workqueue.GroomInterval = 20 * time.Millisecond
+	workqueue.RetryBackoff = 100 * time.Millisecond
+	workqueue.MultiPollInterval = 10 * time.Millisecond
+	workqueue.MaxMultiPollInterval = 400 * time.Millisecond
+
+	high := newMemoryQueue(t)
+	defer high.Stop()
+
+	low := newMemoryQueue(t)
+	defer low.Stop()
+
+	q, err := workqueue.NewMultiQueue(
+		workqueue.WeightedQueue{Queue: high, Weight: 3},
+		workqueue.WeightedQueue{Queue: low, Weight: 1},
+	)
+
+	if err != nil {
+		t.Fatalf("Error while creating multi queue: %s", err)
+	}
+
+	testWorkqueue(t, q)
+
+	t.Run("Weighted picks", func(t *testing.T) {
+		for i := 0; i < 8; i++ {
+			if err := high.Post(fmt.Sprintf("high-%d", i), time.Hour); err != nil {
+				t.Fatalf("Error while posting job: %s", err)
+			}
+
+			if err := low.Post(fmt.Sprintf("low-%d", i), time.Hour); err != nil {
+				t.Fatalf("Error while posting job: %s", err)
+			}
+		}
+
+		picked := map[string]int{}
+
+		for i := 0; i < 16; i++ {
+			entry, err := q.Pick(0)
+
+			if err != nil || entry == nil {
+				t.Fatalf("Error while picking job: %v", err)
+			}
+
+			name := entry.Data.(string)
+			picked[name[:strings.Index(name, "-")]]++
+
+			// While both queues have jobs, the low priority queue gets one
+			// pick out of four
+			if i == 7 && (picked["high"] != 6 || picked["low"] != 2) {
+				t.Errorf("Unexpected picks while both queues are busy: %v", picked)
+			}
+
+			if err := q.Finish(entry); err != nil {
+				t.Errorf("Finish returned an error: %s", err)
+			}
+		}
+
+		// Once the high priority queue is empty, all picks go to the low
+		// priority one
+		if picked["high"] != 8 || picked["low"] != 8 {
+			t.Errorf("Unexpected picks: %v", picked)
+		}
+
+		pickData(t, q, nil)
+	})
+
+	t.Run("Idle polling", func(t *testing.T) {
+		// Let the polling interval grow to its maximum
+		if entry, err := q.Pick(800 * time.Millisecond); err != nil || entry != nil {
+			t.Fatalf("Expected no job, got %+v, %v", entry, err)
+		}
+
+		pickPosted := func(queue workqueue.Queue, data string, maxDelay time.Duration) {
+			t.Helper()
+
+			go func() {
+				time.Sleep(50 * time.Millisecond)
+
+				if err := queue.Post(data, time.Hour); err != nil {
+					t.Errorf("Error while posting job: %s", err)
+				}
+			}()
+
+			before := time.Now()
+			entry, err := q.Pick(5 * time.Second)
+
+			if err != nil || entry == nil || entry.Data != data {
+				t.Fatalf("Unexpected pick: %+v, %v", entry, err)
+			}
+
+			if delay := time.Since(before); delay > maxDelay {
+				t.Errorf("Picking %s took %s", data, delay)
+			}
+
+			if err := q.Finish(entry); err != nil {
+				t.Errorf("Finish returned an error: %s", err)
+			}
+		}
+
+		// The first queue is waited on, other queues are polled
+		pickPosted(high, "high", 50*time.Millisecond+workqueue.MaxMultiPollInterval/4)
+		pickPosted(low, "low", 50*time.Millisecond+workqueue.MaxMultiPollInterval+workqueue.MaxMultiPollInterval/4)
+	})
+
+	t.Run("Finish a job of another queue", func(t *testing.T) {
+		if err := high.Post("elsewhere", time.Hour); err != nil {
+			t.Fatalf("Error while posting job: %s", err)
+		}
+
+		entry := pickData(t, high, "elsewhere")
+
+		if err := q.Finish(entry); err != workqueue.ErrUnknownEntry {
+			t.Errorf("Expected ErrUnknownEntry, got %v", err)
+		}
+
+		if err := high.Finish(entry); err != nil {
+			t.Errorf("Finish returned an error: %s", err)
+		}
+	})
+}
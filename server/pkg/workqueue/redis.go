@@ -1,8 +1,7 @@
 package workqueue
 
 import (
-	"bytes"
-	"encoding/gob"
+	"encoding/base64"
 	"encoding/json"
 	"log"
 	"os"
@@ -16,26 +15,138 @@ import (
 	"github.com/abustany/moblog-cloud/pkg/idgenerator"
 )
 
-const redisKeyPending = "jobs-pending"
-const redisKeyReserved = "jobs-reserved"
+// Names of the Redis keys storing a queue, all prefixed by the queue name
+type redisKeys struct {
+	pending     string
+	reserved    string // list, jobs picked but not recorded as running yet
+	running     string // hash, job ID -> reserved entry
+	deadlines   string // sorted set of job IDs, scored by reservation expiry
+	runningKeys string // hash, job key -> number of reserved jobs
+	delayed     string // sorted set, scored by the time the job becomes pending
+	dead        string
+	followups   string // hash, job key -> follow-up entry
+	cancelled   string // set of the IDs of reserved jobs whose key was cancelled
+	pendingKeys string // hash, job key -> pending entry
+}
+
+func newRedisKeys(name string) redisKeys {
+	return redisKeys{
+		pending:     name + "-pending",
+		reserved:    name + "-reserved",
+		running:     name + "-running",
+		deadlines:   name + "-deadlines",
+		runningKeys: name + "-running-keys",
+		delayed:     name + "-delayed",
+		dead:        name + "-dead",
+		followups:   name + "-followups",
+		cancelled:   name + "-cancelled",
+		pendingKeys: name + "-pending-keys",
+	}
+}
+
+// all returns the keys in the order expected by keysLua
+func (k redisKeys) all() []string {
+	return []string{k.pending, k.reserved, k.running, k.deadlines, k.runningKeys, k.delayed, k.dead, k.followups, k.cancelled, k.pendingKeys}
+}
+
+// Declares the keys of the queue, for the scripts called with redisKeys.all(),
+// and the functions maintaining the index of the pending jobs by key.
+//
+// The pending entry of a key is found with the index instead of decoding the
+// whole pending list. An indexed entry may have been picked already, if the
+// reserve script didn't run yet: it is then missing from the pending list.
+// Pending lists written before the index existed are indexed the first time
+// the index is needed, the empty key marks that this was done.
+const keysLua = `
+local pendingList = KEYS[1]
+local reservedList = KEYS[2]
+local runningHash = KEYS[3]
+local deadlinesSet = KEYS[4]
+local runningKeysHash = KEYS[5]
+local delayedSet = KEYS[6]
+local deadList = KEYS[7]
+local followupsHash = KEYS[8]
+local cancelledSet = KEYS[9]
+local pendingKeysHash = KEYS[10]
+local redisTime = redis.call('time')
+local time = 1000000*redisTime[1]+redisTime[2]
+
+local function hasKey(key)
+	return key ~= nil and key ~= ''
+end
+
+local function indexPending()
+	if redis.call('hexists', pendingKeysHash, '') == 1 then
+		return
+	end
+
+	for _, entryData in ipairs(redis.call('lrange', pendingList, 0, -1)) do
+		local key = cjson.decode(entryData).Key
+
+		if hasKey(key) then
+			redis.call('hsetnx', pendingKeysHash, key, entryData)
+		end
+	end
+
+	redis.call('hset', pendingKeysHash, '', '')
+end
+
+local function pushPending(entryData, key, pushCommand)
+	redis.call(pushCommand or 'lpush', pendingList, entryData)
+
+	if hasKey(key) then
+		redis.call('hset', pendingKeysHash, key, entryData)
+	end
+end
+
+local function unindexPending(entryData, key)
+	if hasKey(key) and redis.call('hget', pendingKeysHash, key) == entryData then
+		redis.call('hdel', pendingKeysHash, key)
+	end
+end
+
+-- Returns the indexed pending entry of a key, or false
+local function indexedPending(key)
+	indexPending()
+	return redis.call('hget', pendingKeysHash, key)
+end
+`
 
 type RedisQueue struct {
-	client          *redis.Client
-	id              string
-	idGenerator     *idgenerator.StringIdGenerator
-	finishScriptSha string
-	groomScriptSha  string
-	groomLock       *distlock.Lock
-	groomTicker     *time.Ticker
+	client              *redis.Client
+	keys                redisKeys
+	id                  string
+	idGenerator         *idgenerator.StringIdGenerator
+	postUniqueScriptSha string
+	reserveScriptSha    string
+	finishScriptSha     string
+	failScriptSha       string
+	requeueScriptSha    string
+	releaseScriptSha    string
+	touchScriptSha      string
+	cancelScriptSha     string
+	cancelKeyScriptSha  string
+	groomScriptSha      string
+	groomLock           *distlock.Lock
+	groomTicker         *time.Ticker
 }
 
 type redisEntry struct {
-	ID    string
-	TTRus int64
-	Data  []byte // job data encoded with gob
+	ID        string
+	TTRus     int64
+	Data      string // job envelope, see jobs.Marshal
+	Key       string
+	Attempts  int
+	LastError string
 }
 
-func NewRedisQueue(redisURL string) (*RedisQueue, error) {
+// NewRedisQueue opens the queue of the given name. Queues of different names
+// stored in the same Redis server are independent.
+func NewRedisQueue(redisURL, name string) (*RedisQueue, error) {
+	if name == "" {
+		return nil, errors.New("Queue name cannot be empty")
+	}
+
 	options, err := redis.ParseURL(redisURL)
 
 	if err != nil {
@@ -56,6 +167,54 @@ func NewRedisQueue(redisURL string) (*RedisQueue, error) {
 		return nil, errors.Wrap(err, "Error while uploading finish script to Redis")
 	}
 
+	postUniqueScriptSha, err := client.ScriptLoad(postUniqueScript).Result()
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while uploading post unique script to Redis")
+	}
+
+	reserveScriptSha, err := client.ScriptLoad(reserveScript).Result()
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while uploading reserve script to Redis")
+	}
+
+	failScriptSha, err := client.ScriptLoad(failScript).Result()
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while uploading fail script to Redis")
+	}
+
+	requeueScriptSha, err := client.ScriptLoad(requeueScript).Result()
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while uploading requeue script to Redis")
+	}
+
+	releaseScriptSha, err := client.ScriptLoad(releaseScript).Result()
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while uploading release script to Redis")
+	}
+
+	touchScriptSha, err := client.ScriptLoad(touchScript).Result()
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while uploading touch script to Redis")
+	}
+
+	cancelScriptSha, err := client.ScriptLoad(cancelScript).Result()
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while uploading cancel script to Redis")
+	}
+
+	cancelKeyScriptSha, err := client.ScriptLoad(cancelKeyScript).Result()
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while uploading cancel key script to Redis")
+	}
+
 	groomScriptSha, err := client.ScriptLoad(groomScript).Result()
 
 	if err != nil {
@@ -63,7 +222,7 @@ func NewRedisQueue(redisURL string) (*RedisQueue, error) {
 	}
 
 	groomLock, err := distlock.New(distlock.Options{
-		Name:   "jobs",
+		Name:   name,
 		Client: client,
 	})
 
@@ -72,13 +231,22 @@ func NewRedisQueue(redisURL string) (*RedisQueue, error) {
 	}
 
 	q := &RedisQueue{
-		client:          client,
-		id:              hostname + "-" + uuid.NewV4().String(),
-		idGenerator:     &idgenerator.StringIdGenerator{},
-		finishScriptSha: finishScriptSha,
-		groomScriptSha:  groomScriptSha,
-		groomLock:       groomLock,
-		groomTicker:     time.NewTicker(GroomInterval),
+		client:              client,
+		keys:                newRedisKeys(name),
+		id:                  hostname + "-" + uuid.NewV4().String(),
+		idGenerator:         &idgenerator.StringIdGenerator{},
+		postUniqueScriptSha: postUniqueScriptSha,
+		reserveScriptSha:    reserveScriptSha,
+		finishScriptSha:     finishScriptSha,
+		failScriptSha:       failScriptSha,
+		requeueScriptSha:    requeueScriptSha,
+		releaseScriptSha:    releaseScriptSha,
+		touchScriptSha:      touchScriptSha,
+		cancelScriptSha:     cancelScriptSha,
+		cancelKeyScriptSha:  cancelKeyScriptSha,
+		groomScriptSha:      groomScriptSha,
+		groomLock:           groomLock,
+		groomTicker:         time.NewTicker(GroomInterval),
 	}
 
 	go func() {
@@ -95,17 +263,18 @@ func (q *RedisQueue) Stop() {
 	q.groomLock.Stop()
 }
 
-func encodeRedisEntry(id string, ttr time.Duration, data interface{}) ([]byte, error) {
-	encodedData := bytes.Buffer{}
+func encodeRedisEntry(id, key string, ttr time.Duration, data interface{}) ([]byte, error) {
+	encodedData, err := encodeJobData(data)
 
-	if err := gob.NewEncoder(&encodedData).Encode(&data); err != nil {
-		return nil, errors.Wrap(err, "Error while encoding entry data")
+	if err != nil {
+		return nil, err
 	}
 
 	encodedEntry, err := json.Marshal(&redisEntry{
 		ID:    id,
 		TTRus: int64(ttr / time.Microsecond),
-		Data:  encodedData.Bytes(),
+		Data:  string(encodedData),
+		Key:   key,
 	})
 
 	return encodedEntry, errors.Wrap(err, "Error while encoding entry")
@@ -119,35 +288,244 @@ func decodeRedisEntry(data []byte) (*JobEntry, error) {
 	}
 
 	decodedEntry := JobEntry{
-		ID:  decodedRedisEntry.ID,
-		TTR: time.Duration(decodedRedisEntry.TTRus) * time.Microsecond,
+		ID:        decodedRedisEntry.ID,
+		TTR:       time.Duration(decodedRedisEntry.TTRus) * time.Microsecond,
+		Key:       decodedRedisEntry.Key,
+		Attempts:  decodedRedisEntry.Attempts,
+		LastError: decodedRedisEntry.LastError,
 	}
 
-	if err := gob.NewDecoder(bytes.NewReader(decodedRedisEntry.Data)).Decode(&decodedEntry.Data); err != nil {
-		return nil, errors.Wrap(err, "Error while decoding entry data")
+	var err error
+
+	if decodedEntry.Data, err = decodeRedisData(decodedRedisEntry.Data); err != nil {
+		return nil, err
 	}
 
 	return &decodedEntry, nil
 }
 
+// decodeRedisData decodes the data of an entry. Older versions stored gob
+// data, which got encoded in base64 in the JSON entries. Job envelopes are
+// JSON objects, which are never valid base64.
+func decodeRedisData(data string) (interface{}, error) {
+	if legacyData, err := base64.StdEncoding.DecodeString(data); err == nil {
+		return decodeJobData(legacyData)
+	}
+
+	return decodeJobData([]byte(data))
+}
+
 func (q *RedisQueue) Post(job interface{}, ttr time.Duration) error {
 	entryID := q.id + "-" + q.idGenerator.Next()
-	data, err := encodeRedisEntry(entryID, ttr, job)
+	data, err := encodeRedisEntry(entryID, "", ttr, job)
+
+	if err != nil {
+		return errors.Wrap(err, "Error while encoding entry data")
+	}
+
+	return errors.Wrap(q.client.LPush(q.keys.pending, data).Err(), "Error while pushing job to Redis")
+}
+
+func (q *RedisQueue) PostAt(key string, job interface{}, ttr time.Duration, at time.Time) error {
+	entryID := q.id + "-" + q.idGenerator.Next()
+	data, err := encodeRedisEntry(entryID, key, ttr, job)
 
 	if err != nil {
 		return errors.Wrap(err, "Error while encoding entry data")
 	}
 
-	return errors.Wrap(q.client.LPush(redisKeyPending, data).Err(), "Error while pushing job to Redis")
+	// Scored in microseconds, like the retry times set by the fail script
+	member := redis.Z{Score: float64(at.UnixNano() / int64(time.Microsecond)), Member: data}
+
+	return errors.Wrap(q.client.ZAdd(q.keys.delayed, member).Err(), "Error while scheduling job in Redis")
+}
+
+func (q *RedisQueue) PostAfter(key string, job interface{}, ttr time.Duration, delay time.Duration) error {
+	return q.PostAt(key, job, ttr, time.Now().Add(delay))
 }
 
+// Replaces the data of a pending job or of a follow-up job with the same key,
+// and returns the replaced data. Returns nil if no data was replaced.
+const postUniqueScript = keysLua + isRunningLua + postUniqueLua + `
+return postUnique(ARGV[1], ARGV[2])
+`
+
+// Defines postUnique(key, newEntryData), which posts an entry following the
+// rules of PostUnique and returns the replaced data, or false if no data was
+// replaced. Requires isRunningLua.
+const postUniqueLua = `
+local function postUnique(key, newEntryData)
+	local newEntry = cjson.decode(newEntryData)
+
+	local function replace(entry)
+		local replaced = entry.Data
+		entry.Data = newEntry.Data
+		entry.TTRus = newEntry.TTRus
+		return replaced, cjson.encode(entry)
+	end
+
+	local pendingData = indexedPending(key)
+
+	if pendingData then
+		local replaced, replacedEntryData = replace(cjson.decode(pendingData))
+
+		-- Entries are unique, so the indexed entry is found by value. linsert
+		-- returns -1, or 0 if the list is empty, when it isn't pending anymore.
+		if redis.call('linsert', pendingList, 'BEFORE', pendingData, replacedEntryData) > 0 then
+			redis.call('lrem', pendingList, 1, pendingData)
+			redis.call('hset', pendingKeysHash, key, replacedEntryData)
+			return replaced
+		end
+
+		redis.call('hdel', pendingKeysHash, key)
+	end
+
+	if isRunning(key) then
+		local followupData = redis.call('hget', followupsHash, key)
+
+		if followupData then
+			local replaced, replacedEntryData = replace(cjson.decode(followupData))
+			redis.call('hset', followupsHash, key, replacedEntryData)
+			return replaced
+		end
+
+		redis.call('hset', followupsHash, key, newEntryData)
+		return false
+	end
+
+	pushPending(newEntryData, key)
+	return false
+end
+`
+
+// Defines isRunning(key), which returns true if a job with the given key is
+// reserved. Jobs stay in the reserved list only between Pick and the reserve
+// script, so that list is short.
+const isRunningLua = `
+local function isRunning(key)
+	if redis.call('hexists', runningKeysHash, key) == 1 then
+		return true
+	end
+
+	for _, entryData in ipairs(redis.call('lrange', reservedList, 0, -1)) do
+		if cjson.decode(entryData).Key == key then
+			return true
+		end
+	end
+
+	return false
+end
+`
+
+// Defines reserve(entryData, started), which records a job as running until
+// its TTR elapses, and unreserve(entryId), which removes a job from the
+// running jobs and returns it (or nil if it is not running anymore) along with
+// its cancellation flag.
+const reservationLua = `
+local function reserve(entryData, started)
+	local entry = cjson.decode(entryData)
+	unindexPending(entryData, entry.Key)
+	entry.Started = nil
+
+	redis.call('hset', runningHash, entry.ID, cjson.encode(entry))
+	redis.call('zadd', deadlinesSet, started + entry.TTRus, entry.ID)
+
+	if entry.Key ~= nil and entry.Key ~= '' then
+		redis.call('hincrby', runningKeysHash, entry.Key, 1)
+	end
+end
+
+local function unreserve(entryId)
+	local entryData = redis.call('hget', runningHash, entryId)
+
+	if not entryData then
+		return nil
+	end
+
+	local entry = cjson.decode(entryData)
+
+	redis.call('hdel', runningHash, entryId)
+	redis.call('zrem', deadlinesSet, entryId)
+
+	if entry.Key ~= nil and entry.Key ~= '' then
+		if redis.call('hincrby', runningKeysHash, entry.Key, -1) <= 0 then
+			redis.call('hdel', runningKeysHash, entry.Key)
+		end
+	end
+
+	return entry, redis.call('srem', cancelledSet, entryId) == 1
+end
+`
+
+// Defines releaseFollowup(key), which makes the follow-up job of a key
+// pending, unless another job with this key is running
+const releaseFollowupLua = isRunningLua + `
+local function releaseFollowup(key)
+	if key == nil or key == '' or isRunning(key) then
+		return
+	end
+
+	local followupData = redis.call('hget', followupsHash, key)
+
+	if followupData then
+		redis.call('hdel', followupsHash, key)
+		pushPending(followupData, key)
+	end
+end
+`
+
+func (q *RedisQueue) PostUnique(key string, job interface{}, ttr time.Duration) (interface{}, error) {
+	if key == "" {
+		return nil, q.Post(job, ttr)
+	}
+
+	entryID := q.id + "-" + q.idGenerator.Next()
+	data, err := encodeRedisEntry(entryID, key, ttr, job)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while encoding entry data")
+	}
+
+	replaced, err := q.client.EvalSha(q.postUniqueScriptSha, q.keys.all(), key, data).String()
+
+	if err == redis.Nil {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while pushing job to Redis")
+	}
+
+	// The script returns the Data field of the replaced entry
+	return decodeRedisData(replaced)
+}
+
+// Moves a job that Pick just put in the reserved list to the running jobs.
+// The groom script may have moved it already.
+const reserveScript = keysLua + reservationLua + `
+local entryData = ARGV[1]
+
+if redis.call('lrem', reservedList, 1, entryData) == 1 then
+	reserve(entryData, time)
+end
+`
+
 func (q *RedisQueue) Pick(timeout time.Duration) (*JobEntry, error) {
-	if timeout < time.Second {
+	if timeout > 0 && timeout < time.Second {
 		// Redis cannot wait less than a second
 		timeout = time.Second
 	}
 
-	entryData, err := q.client.BRPopLPush(redisKeyPending, redisKeyReserved, timeout).Bytes()
+	var entryData []byte
+	var err error
+
+	// Moving the job to the reserved list in the same command ensures that it
+	// doesn't get lost if the worker dies before reserving it
+	if timeout <= 0 {
+		entryData, err = q.client.RPopLPush(q.keys.pending, q.keys.reserved).Bytes()
+	} else {
+		entryData, err = q.client.BRPopLPush(q.keys.pending, q.keys.reserved, timeout).Bytes()
+	}
 
 	if err == redis.Nil {
 		return nil, nil
@@ -157,62 +535,429 @@ func (q *RedisQueue) Pick(timeout time.Duration) (*JobEntry, error) {
 		return nil, errors.Wrap(err, "Error while picking job from Redis")
 	}
 
+	if err := q.client.EvalSha(q.reserveScriptSha, q.keys.all(), entryData).Err(); err != nil && err != redis.Nil {
+		return nil, errors.Wrap(err, "Error while reserving job")
+	}
+
 	return decodeRedisEntry([]byte(entryData))
 }
 
-const finishScript = `
-local reservedList = KEYS[1]
+const finishScript = keysLua + reservationLua + releaseFollowupLua + `
 local entryId = ARGV[1]
-local entries = redis.call('lrange', reservedList, 0, -1)
-local finished = 'finished'
+local entry = unreserve(entryId)
+
+if entry then
+	releaseFollowup(entry.Key)
+end
+`
+
+func (q *RedisQueue) Finish(entry *JobEntry) error {
+	if err := q.client.EvalSha(q.finishScriptSha, q.keys.all(), entry.ID).Err(); err != nil && err != redis.Nil {
+		return errors.Wrap(err, "Error while removing entry from running jobs")
+	}
+
+	return nil
+}
+
+// The retry delay is computed by the caller, the script only needs to know if
+// the job should be retried at all (a delay of -1 means it shouldn't).
+const failScript = keysLua + reservationLua + releaseFollowupLua + `
+local entryId = ARGV[1]
+local attempts = tonumber(ARGV[2])
+local lastError = ARGV[3]
+local delayUs = tonumber(ARGV[4])
+local entry, cancelled = unreserve(entryId)
+
+if not entry then
+	return
+end
+
+if not cancelled then
+	entry.Attempts = attempts
+	entry.LastError = lastError
+
+	if delayUs < 0 then
+		redis.call('lpush', deadList, cjson.encode(entry))
+	else
+		redis.call('zadd', delayedSet, time + delayUs, cjson.encode(entry))
+	end
+end
+
+releaseFollowup(entry.Key)
+`
+
+func (q *RedisQueue) Fail(entry *JobEntry, err error) error {
+	attempts := entry.Attempts + 1
+	delayUs := int64(-1)
+
+	if attempts < MaxAttempts {
+		delayUs = int64(retryDelay(attempts) / time.Microsecond)
+	}
+
+	if err := q.client.EvalSha(q.failScriptSha, q.keys.all(), entry.ID, attempts, errorMessage(err), delayUs).Err(); err != nil && err != redis.Nil {
+		return errors.Wrap(err, "Error while moving failed entry out of running jobs")
+	}
+
+	return nil
+}
+
+// Jobs are picked from the right of the pending list, so the released job is
+// the next one to be picked.
+const releaseScript = keysLua + reservationLua + releaseFollowupLua + `
+local entryId = ARGV[1]
+local entry, cancelled = unreserve(entryId)
+
+if not entry then
+	return 0
+end
+
+if cancelled then
+	releaseFollowup(entry.Key)
+else
+	pushPending(cjson.encode(entry), entry.Key, 'rpush')
+end
+
+return 1
+`
+
+// release moves a job from the running jobs to the pending ones, and returns
+// false if the job was not running
+func (q *RedisQueue) release(id string) (bool, error) {
+	found, err := q.client.EvalSha(q.releaseScriptSha, q.keys.all(), id).Int64()
+
+	if err != nil {
+		return false, errors.Wrap(err, "Error while moving released entry out of running jobs")
+	}
+
+	return found == 1, nil
+}
+
+func (q *RedisQueue) Release(entry *JobEntry) error {
+	// Does nothing if the job already expired and got requeued
+	_, err := q.release(entry.ID)
+	return err
+}
+
+const touchScript = keysLua + `
+local entryId = ARGV[1]
+local entryData = redis.call('hget', runningHash, entryId)
+
+if not entryData then
+	return 0
+end
+
+redis.call('zadd', deadlinesSet, time + cjson.decode(entryData).TTRus, entryId)
+return 1
+`
+
+func (q *RedisQueue) Touch(entry *JobEntry) error {
+	found, err := q.client.EvalSha(q.touchScriptSha, q.keys.all(), entry.ID).Int64()
+
+	if err != nil {
+		return errors.Wrap(err, "Error while touching job")
+	}
+
+	if found == 0 {
+		return ErrJobNotFound
+	}
+
+	return nil
+}
+
+// Reserved jobs include the ones in the reserved list, which the reserve
+// script didn't move to the running jobs yet
+const cancelKeyScript = keysLua + `
+local key = ARGV[1]
+local pendingData = indexedPending(key)
+
+if pendingData then
+	redis.call('lrem', pendingList, 1, pendingData)
+	redis.call('hdel', pendingKeysHash, key)
+end
+
+for _, entryData in ipairs(redis.call('zrange', delayedSet, 0, -1)) do
+	if cjson.decode(entryData).Key == key then
+		redis.call('zrem', delayedSet, entryData)
+	end
+end
+
+redis.call('hdel', followupsHash, key)
+
+local reserved = redis.call('lrange', reservedList, 0, -1)
+
+if redis.call('hexists', runningKeysHash, key) == 1 then
+	for _, entryData in ipairs(redis.call('hvals', runningHash)) do
+		table.insert(reserved, entryData)
+	end
+end
+
+for _, entryData in ipairs(reserved) do
+	local entry = cjson.decode(entryData)
+
+	if entry.Key == key then
+		redis.call('sadd', cancelledSet, entry.ID)
+	end
+end
+`
+
+func (q *RedisQueue) CancelKey(key string) error {
+	if err := q.client.EvalSha(q.cancelKeyScriptSha, q.keys.all(), key).Err(); err != nil && err != redis.Nil {
+		return errors.Wrap(err, "Error while cancelling jobs")
+	}
+
+	return nil
+}
+
+func (q *RedisQueue) Cancelled(entry *JobEntry) (bool, error) {
+	cancelled, err := q.client.SIsMember(q.keys.cancelled, entry.ID).Result()
+	return cancelled, errors.Wrap(err, "Error while checking if job is cancelled")
+}
+
+func (q *RedisQueue) DeadJobs() ([]*JobEntry, error) {
+	entriesData, err := q.client.LRange(q.keys.dead, 0, -1).Result()
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while listing dead jobs")
+	}
+
+	entries := make([]*JobEntry, 0, len(entriesData))
+
+	for _, entryData := range entriesData {
+		entry, err := decodeRedisEntry([]byte(entryData))
+
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// If another job of the same key is pending, only the requeued one is found by
+// the index afterwards
+const requeueScript = keysLua + `
+local entryId = ARGV[1]
+local entries = redis.call('lrange', deadList, 0, -1)
+local requeued = 'requeued'
 
 for i, entryData in ipairs(entries) do
 	local entry = cjson.decode(entryData)
 
 	if entry.ID == entryId then
-		redis.call('lset', reservedList, i-1, finished)
+		redis.call('lset', deadList, i-1, requeued)
+		redis.call('lrem', deadList, 1, requeued)
+
+		entry.Attempts = 0
+		entry.LastError = ''
+
+		pushPending(cjson.encode(entry), entry.Key)
+
+		return 1
 	end
 end
 
-redis.call('lrem', reservedList, 1, finished)
+return 0
 `
 
-func (q *RedisQueue) Finish(entry *JobEntry) error {
-	if err := q.client.EvalSha(q.finishScriptSha, []string{redisKeyReserved}, entry.ID).Err(); err != nil && err != redis.Nil {
-		return errors.Wrap(err, "Error while removing entry from reserved list")
+func (q *RedisQueue) RequeueDead(id string) error {
+	found, err := q.client.EvalSha(q.requeueScriptSha, q.keys.all(), id).Int64()
+
+	if err != nil {
+		return errors.Wrap(err, "Error while requeuing dead job")
+	}
+
+	if found == 0 {
+		return ErrJobNotFound
 	}
 
 	return nil
 }
 
-func (q *RedisQueue) Clear() error {
-	return errors.Wrap(q.client.Del(redisKeyPending, redisKeyReserved).Err(), "Error while deleting keys")
+func (q *RedisQueue) Counts() (map[JobState]int, error) {
+	var pending, reserved, running, delayed, followups, dead *redis.IntCmd
+
+	_, err := q.client.Pipelined(func(pipe redis.Pipeliner) error {
+		pending = pipe.LLen(q.keys.pending)
+		reserved = pipe.LLen(q.keys.reserved)
+		running = pipe.HLen(q.keys.running)
+		delayed = pipe.ZCard(q.keys.delayed)
+		followups = pipe.HLen(q.keys.followups)
+		dead = pipe.LLen(q.keys.dead)
+		return nil
+	})
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while counting jobs")
+	}
+
+	return map[JobState]int{
+		JobPending:  int(pending.Val()),
+		JobDelayed:  int(delayed.Val()),
+		JobFollowup: int(followups.Val()),
+		JobReserved: int(reserved.Val() + running.Val()),
+		JobDead:     int(dead.Val()),
+	}, nil
 }
 
-const groomScript = `
-local pendingList = KEYS[1]
-local reservedList = KEYS[2]
-local redisTime = redis.call('time')
-local time = 1000000*redisTime[1]+redisTime[2]
-local entries = redis.call('lrange', reservedList, 0, -1)
-local expired = 'expired'
+func (q *RedisQueue) Jobs(state JobState) ([]*JobEntry, error) {
+	var entriesData []string
+	var err error
+
+	switch state {
+	case JobPending:
+		if entriesData, err = q.client.LRange(q.keys.pending, 0, -1).Result(); err == nil {
+			// Jobs are picked from the right of the list
+			for i, j := 0, len(entriesData)-1; i < j; i, j = i+1, j-1 {
+				entriesData[i], entriesData[j] = entriesData[j], entriesData[i]
+			}
+		}
+	case JobDelayed:
+		entriesData, err = q.client.ZRange(q.keys.delayed, 0, -1).Result()
+	case JobFollowup:
+		entriesData, err = q.client.HVals(q.keys.followups).Result()
+	case JobReserved:
+		var picked []string
+
+		if entriesData, err = q.client.HVals(q.keys.running).Result(); err == nil {
+			picked, err = q.client.LRange(q.keys.reserved, 0, -1).Result()
+			entriesData = append(entriesData, picked...)
+		}
+	case JobDead:
+		return q.DeadJobs()
+	default:
+		return nil, errors.Errorf("Unknown job state: %s", state)
+	}
 
-for i, entryData in ipairs(entries) do
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error while listing %s jobs", state)
+	}
+
+	entries := make([]*JobEntry, 0, len(entriesData))
+
+	for _, entryData := range entriesData {
+		entry, err := decodeRedisEntry([]byte(entryData))
+
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+func (q *RedisQueue) Job(id string) (*JobEntry, JobState, error) {
+	return findJob(q, id)
+}
+
+const cancelScript = keysLua + `
+local entryId = ARGV[1]
+local cancelled = 'cancelled'
+
+for i, entryData in ipairs(redis.call('lrange', pendingList, 0, -1)) do
 	local entry = cjson.decode(entryData)
 
-    if entry.Started == nil then
-		entry.Started = time
-		redis.call('lset', reservedList, i-1, cjson.encode(entry))
+	if entry.ID == entryId then
+		redis.call('lset', pendingList, i-1, cancelled)
+		redis.call('lrem', pendingList, 1, cancelled)
+		unindexPending(entryData, entry.Key)
+		return 1
 	end
-	
-	if time > (entry.Started + entry.TTRus) then
-		redis.call('lset', reservedList, i-1, expired)
-		entry.Started = nil
-		redis.call('lpush', pendingList, cjson.encode(entry))
+end
+
+for _, entryData in ipairs(redis.call('zrange', delayedSet, 0, -1)) do
+	if cjson.decode(entryData).ID == entryId then
+		redis.call('zrem', delayedSet, entryData)
+		return 1
 	end
 end
 
-redis.call('lrem', reservedList, 0, expired)
+local followups = redis.call('hgetall', followupsHash)
+
+for i = 1, #followups, 2 do
+	if cjson.decode(followups[i+1]).ID == entryId then
+		redis.call('hdel', followupsHash, followups[i])
+		return 1
+	end
+end
+
+return 0
+`
+
+func (q *RedisQueue) Cancel(id string) error {
+	found, err := q.client.EvalSha(q.cancelScriptSha, q.keys.all(), id).Int64()
+
+	if err != nil {
+		return errors.Wrap(err, "Error while cancelling job")
+	}
+
+	if found == 0 {
+		return ErrJobNotFound
+	}
+
+	return nil
+}
+
+func (q *RedisQueue) Requeue(id string) error {
+	found, err := q.release(id)
+
+	if err != nil {
+		return err
+	}
+
+	if !found {
+		return ErrJobNotFound
+	}
+
+	return nil
+}
+
+func (q *RedisQueue) Clear() error {
+	return errors.Wrap(q.client.Del(q.keys.all()...).Err(), "Error while deleting keys")
+}
+
+// The reserved list only holds the jobs being picked, unless a worker died
+// between picking and reserving a job. It can also hold jobs reserved before
+// running jobs were stored in a hash, which carry the time the groomer first
+// saw them running. Both get moved to the running jobs.
+const groomScript = keysLua + reservationLua + releaseFollowupLua + postUniqueLua + `
+for _, entryData in ipairs(redis.call('lrange', reservedList, 0, -1)) do
+	local started = cjson.decode(entryData).Started or time
+	redis.call('lrem', reservedList, 1, entryData)
+	reserve(entryData, started)
+end
+
+-- Jobs that took too long to run are put back in the pending list, unless
+-- they were cancelled
+for _, entryId in ipairs(redis.call('zrangebyscore', deadlinesSet, '-inf', time)) do
+	local entry, cancelled = unreserve(entryId)
+
+	if not entry then
+		redis.call('zrem', deadlinesSet, entryId)
+	elseif cancelled then
+		releaseFollowup(entry.Key)
+	else
+		pushPending(cjson.encode(entry), entry.Key)
+	end
+end
+
+-- Scheduled jobs and failed jobs whose retry delay elapsed are posted again,
+-- coalesced with the jobs of the same key
+local due = redis.call('zrangebyscore', delayedSet, '-inf', time)
+
+for i, entryData in ipairs(due) do
+	local key = cjson.decode(entryData).Key
+	redis.call('zrem', delayedSet, entryData)
+
+	if key == nil or key == '' then
+		redis.call('lpush', pendingList, entryData)
+	else
+		postUnique(key, entryData)
+	end
+end
 `
 
 func (q *RedisQueue) groom() {
@@ -220,7 +965,7 @@ func (q *RedisQueue) groom() {
 		return
 	}
 
-	if err := q.client.EvalSha(q.groomScriptSha, []string{redisKeyPending, redisKeyReserved}).Err(); err != nil && err != redis.Nil {
+	if err := q.client.EvalSha(q.groomScriptSha, q.keys.all()).Err(); err != nil && err != redis.Nil {
 		log.Printf("Error while running groom script: %s", err)
 	}
 }
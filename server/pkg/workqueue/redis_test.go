@@ -5,6 +5,8 @@ import (
 	"testing"
 	"time"
 
+	"github.com/go-redis/redis"
+
 	"github.com/abustany/moblog-cloud/pkg/workqueue"
 )
 
@@ -12,6 +14,7 @@ func TestRedisQueue(t *testing.T) {
 	// Reduce groom interval at expense of CPU load so that tests don't take
 	// forever to run
 	workqueue.GroomInterval = 20 * time.Millisecond
+	workqueue.RetryBackoff = 100 * time.Millisecond
 
 	redisURL := os.Getenv("REDIS_URL")
 
@@ -19,7 +22,7 @@ func TestRedisQueue(t *testing.T) {
 		t.Skip("REDIS_URL environment variable not defined")
 	}
 
-	q, err := workqueue.NewRedisQueue(redisURL)
+	q, err := workqueue.NewRedisQueue(redisURL, workqueue.PushQueueName)
 
 	if err != nil {
 		t.Fatalf("Error while creating queue: %s", err)
@@ -32,4 +35,97 @@ func TestRedisQueue(t *testing.T) {
 	}
 
 	testWorkqueue(t, q)
+
+	t.Run("Inspect jobs", func(t *testing.T) {
+		testInspector(t, q)
+	})
+
+	t.Run("Named queues are independent", func(t *testing.T) {
+		other, err := workqueue.NewRedisQueue(redisURL, "other-jobs")
+
+		if err != nil {
+			t.Fatalf("Error while creating queue: %s", err)
+		}
+
+		defer other.Stop()
+
+		if err := other.Clear(); err != nil {
+			t.Fatalf("Error while clearing queue: %s", err)
+		}
+
+		if err := other.Post("other", time.Hour); err != nil {
+			t.Fatalf("Error while posting job: %s", err)
+		}
+
+		pickData(t, q, nil)
+
+		if err := other.Finish(pickData(t, other, "other")); err != nil {
+			t.Errorf("Finish returned an error: %s", err)
+		}
+	})
+
+	t.Run("Jobs left in the reserved list expire", func(t *testing.T) {
+		options, err := redis.ParseURL(redisURL)
+
+		if err != nil {
+			t.Fatalf("Error while parsing Redis URL: %s", err)
+		}
+
+		client := redis.NewClient(options)
+		defer client.Close()
+
+		if err := q.Post("leftover", 50*time.Millisecond); err != nil {
+			t.Fatalf("Error while posting job: %s", err)
+		}
+
+		// Like a worker dying right after picking the job, or a job reserved
+		// before running jobs were stored in a hash
+		pendingKey := workqueue.PushQueueName + "-pending"
+		reservedKey := workqueue.PushQueueName + "-reserved"
+
+		if err := client.RPopLPush(pendingKey, reservedKey).Err(); err != nil {
+			t.Fatalf("Error while moving job to the reserved list: %s", err)
+		}
+
+		time.Sleep(200 * time.Millisecond)
+
+		if err := q.Finish(pickData(t, q, "leftover")); err != nil {
+			t.Errorf("Finish returned an error: %s", err)
+		}
+
+		if n, err := client.LLen(reservedKey).Result(); err != nil || n != 0 {
+			t.Errorf("Reserved list not empty (length: %d, error: %v)", n, err)
+		}
+	})
+
+	t.Run("Pending jobs posted before the key index get indexed", func(t *testing.T) {
+		options, err := redis.ParseURL(redisURL)
+
+		if err != nil {
+			t.Fatalf("Error while parsing Redis URL: %s", err)
+		}
+
+		client := redis.NewClient(options)
+		defer client.Close()
+
+		postUnique(t, q, "legacy", "legacy-1", nil)
+		postUnique(t, q, "cancelled-legacy", "cancelled", nil)
+
+		// Like jobs posted by a version that didn't index pending jobs
+		if err := client.Del(workqueue.PushQueueName + "-pending-keys").Err(); err != nil {
+			t.Fatalf("Error while deleting the key index: %s", err)
+		}
+
+		postUnique(t, q, "legacy", "legacy-2", "legacy-1")
+
+		if err := q.CancelKey("cancelled-legacy"); err != nil {
+			t.Fatalf("Error while cancelling key: %s", err)
+		}
+
+		if err := q.Finish(pickData(t, q, "legacy-2")); err != nil {
+			t.Errorf("Finish returned an error: %s", err)
+		}
+
+		pickData(t, q, nil)
+	})
 }
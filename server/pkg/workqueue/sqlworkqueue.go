@@ -0,0 +1,905 @@
+package workqueue
+
+import (
+	"database/sql"
+	"log"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	uuid "github.com/satori/go.uuid"
+)
+
+// How often Pick checks for new jobs while waiting, PostgreSQL has no
+// blocking equivalent of BRPOPLPUSH
+var SQLPollInterval = 250 * time.Millisecond
+
+const (
+	sqlStatePending  = "pending"
+	sqlStateDelayed  = "delayed"
+	sqlStateFollowup = "followup"
+	sqlStateDead     = "dead"
+)
+
+// SQLQueue is a queue stored in PostgreSQL. Workers reserve jobs with SELECT
+// ... FOR UPDATE SKIP LOCKED, so that they never wait for each other.
+type SQLQueue struct {
+	db          *sqlx.DB
+	name        string
+	groomTicker *time.Ticker
+
+	postStmt            *sql.Stmt
+	postAtStmt          *sql.Stmt
+	lockKeyStmt         *sql.Stmt
+	findPendingStmt     *sqlx.Stmt
+	findFollowupStmt    *sqlx.Stmt
+	replaceDataStmt     *sql.Stmt
+	isRunningStmt       *sql.Stmt
+	releaseFollowupStmt *sql.Stmt
+	pickStmt            *sqlx.Stmt
+	finishStmt          *sql.Stmt
+	failStmt            *sql.Stmt
+	releaseStmt         *sql.Stmt
+	touchStmt           *sql.Stmt
+	cancelStmt          *sql.Stmt
+	cancelKeyStmt       *sql.Stmt
+	flagCancelledStmt   *sql.Stmt
+	cancelledStmt       *sql.Stmt
+	deleteCancelledStmt *sql.Stmt
+	groomCancelledStmt  *sql.Stmt
+	groomStmt           *sql.Stmt
+	dueDelayedStmt      *sql.Stmt
+	findDelayedStmt     *sqlx.Stmt
+	setStateStmt        *sql.Stmt
+	deleteStmt          *sql.Stmt
+	deadJobsStmt        *sqlx.Stmt
+	requeueDeadStmt     *sql.Stmt
+}
+
+type jobRecord struct {
+	ID        string `db:"id"`
+	Key       string `db:"key"`
+	Data      []byte `db:"data"`
+	TTRus     int64  `db:"ttr"`
+	Attempts  int    `db:"attempts"`
+	LastError string `db:"last_error"`
+}
+
+func (r *jobRecord) entry() (*JobEntry, error) {
+	data, err := decodeJobData(r.Data)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &JobEntry{
+		ID:        r.ID,
+		TTR:       time.Duration(r.TTRus) * time.Microsecond,
+		Data:      data,
+		Key:       r.Key,
+		Attempts:  r.Attempts,
+		LastError: r.LastError,
+	}, nil
+}
+
+const jobColumns = `id, key, data, ttr, attempts, last_error`
+
+// NewSQLQueue opens the queue of the given name. All the queues are stored in
+// the same table.
+func NewSQLQueue(driverName, dbURL, name string) (*SQLQueue, error) {
+	if name == "" {
+		return nil, errors.New("Queue name cannot be empty")
+	}
+
+	db, err := sqlx.Connect(driverName, dbURL)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while connecting to the database")
+	}
+
+	postStmt, err := db.Prepare(`INSERT INTO jobs (id, queue, state, key, data, ttr, posted, available) VALUES ($1, $2, $3, $4, $5, $6, now(), now())`)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while preparing post statement")
+	}
+
+	postAtStmt, err := db.Prepare(`INSERT INTO jobs (id, queue, state, key, data, ttr, posted, available) VALUES ($1, $2, 'delayed', $3, $4, $5, now(), $6)`)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while preparing post at statement")
+	}
+
+	lockKeyStmt, err := db.Prepare(`SELECT pg_advisory_xact_lock(hashtext($1))`)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while preparing lock key statement")
+	}
+
+	findPendingStmt, err := db.Preparex(`SELECT ` + jobColumns + ` FROM jobs WHERE queue = $1 AND key = $2 AND state = 'pending' AND available <= now() ORDER BY posted LIMIT 1 FOR UPDATE`)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while preparing find pending statement")
+	}
+
+	findFollowupStmt, err := db.Preparex(`SELECT ` + jobColumns + ` FROM jobs WHERE queue = $1 AND key = $2 AND state = 'followup' FOR UPDATE`)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while preparing find follow-up statement")
+	}
+
+	replaceDataStmt, err := db.Prepare(`UPDATE jobs SET data = $1, ttr = $2 WHERE id = $3`)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while preparing replace data statement")
+	}
+
+	isRunningStmt, err := db.Prepare(`SELECT EXISTS (SELECT 1 FROM jobs WHERE queue = $1 AND key = $2 AND state = 'reserved')`)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while preparing is running statement")
+	}
+
+	releaseFollowupStmt, err := db.Prepare(`UPDATE jobs SET state = 'pending', posted = now(), available = now() WHERE queue = $1 AND key = $2 AND state = 'followup' AND NOT EXISTS (SELECT 1 FROM jobs WHERE queue = $1 AND key = $2 AND state = 'reserved')`)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while preparing release follow-up statement")
+	}
+
+	pickStmt, err := db.Preparex(`UPDATE jobs SET state = 'reserved', reserved_until = now() + ttr * interval '1 microsecond' WHERE id = (SELECT id FROM jobs WHERE queue = $1 AND state = 'pending' AND available <= now() ORDER BY posted LIMIT 1 FOR UPDATE SKIP LOCKED) RETURNING ` + jobColumns)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while preparing pick statement")
+	}
+
+	finishStmt, err := db.Prepare(`DELETE FROM jobs WHERE id = $1 AND state = 'reserved'`)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while preparing finish statement")
+	}
+
+	failStmt, err := db.Prepare(`UPDATE jobs SET state = $1, attempts = $2, last_error = $3, available = now() + $4::bigint * interval '1 microsecond', failed = now(), reserved_until = NULL WHERE id = $5 AND state = 'reserved' AND NOT cancelled`)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while preparing fail statement")
+	}
+
+	// Released jobs keep their posting time, so they are picked first
+	releaseStmt, err := db.Prepare(`UPDATE jobs SET state = 'pending', reserved_until = NULL WHERE id = $1 AND state = 'reserved' AND NOT cancelled`)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while preparing release statement")
+	}
+
+	touchStmt, err := db.Prepare(`UPDATE jobs SET reserved_until = now() + ttr * interval '1 microsecond' WHERE id = $1 AND state = 'reserved'`)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while preparing touch statement")
+	}
+
+	cancelStmt, err := db.Prepare(`DELETE FROM jobs WHERE id = $1 AND queue = $2 AND state IN ('pending', 'delayed', 'followup')`)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while preparing cancel statement")
+	}
+
+	cancelKeyStmt, err := db.Prepare(`DELETE FROM jobs WHERE queue = $1 AND key = $2 AND state IN ('pending', 'delayed', 'followup')`)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while preparing cancel key statement")
+	}
+
+	flagCancelledStmt, err := db.Prepare(`UPDATE jobs SET cancelled = true WHERE queue = $1 AND key = $2 AND state = 'reserved'`)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while preparing flag cancelled statement")
+	}
+
+	cancelledStmt, err := db.Prepare(`SELECT cancelled FROM jobs WHERE id = $1 AND state = 'reserved'`)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while preparing cancelled statement")
+	}
+
+	// Cancelled jobs are deleted instead of being retried or requeued
+	deleteCancelledStmt, err := db.Prepare(`DELETE FROM jobs WHERE id = $1 AND state = 'reserved' AND cancelled`)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while preparing delete cancelled statement")
+	}
+
+	groomCancelledStmt, err := db.Prepare(`DELETE FROM jobs WHERE queue = $1 AND state = 'reserved' AND cancelled AND reserved_until < now() RETURNING key`)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while preparing groom cancelled statement")
+	}
+
+	groomStmt, err := db.Prepare(`UPDATE jobs SET state = 'pending', reserved_until = NULL WHERE queue = $1 AND state = 'reserved' AND reserved_until < now()`)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while preparing groom statement")
+	}
+
+	dueDelayedStmt, err := db.Prepare(`SELECT id, key FROM jobs WHERE queue = $1 AND state = 'delayed' AND available <= now() ORDER BY available`)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while preparing due delayed statement")
+	}
+
+	findDelayedStmt, err := db.Preparex(`SELECT ` + jobColumns + ` FROM jobs WHERE id = $1 AND state = 'delayed' FOR UPDATE`)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while preparing find delayed statement")
+	}
+
+	setStateStmt, err := db.Prepare(`UPDATE jobs SET state = $1 WHERE id = $2`)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while preparing set state statement")
+	}
+
+	deleteStmt, err := db.Prepare(`DELETE FROM jobs WHERE id = $1`)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while preparing delete statement")
+	}
+
+	deadJobsStmt, err := db.Preparex(`SELECT ` + jobColumns + ` FROM jobs WHERE queue = $1 AND state = 'dead' ORDER BY failed DESC`)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while preparing dead jobs statement")
+	}
+
+	requeueDeadStmt, err := db.Prepare(`UPDATE jobs SET state = 'pending', attempts = 0, last_error = '', posted = now(), available = now() WHERE id = $1 AND queue = $2 AND state = 'dead'`)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while preparing requeue dead statement")
+	}
+
+	q := &SQLQueue{
+		db:          db,
+		name:        name,
+		groomTicker: time.NewTicker(GroomInterval),
+
+		postStmt:            postStmt,
+		postAtStmt:          postAtStmt,
+		lockKeyStmt:         lockKeyStmt,
+		findPendingStmt:     findPendingStmt,
+		findFollowupStmt:    findFollowupStmt,
+		replaceDataStmt:     replaceDataStmt,
+		isRunningStmt:       isRunningStmt,
+		releaseFollowupStmt: releaseFollowupStmt,
+		pickStmt:            pickStmt,
+		finishStmt:          finishStmt,
+		failStmt:            failStmt,
+		releaseStmt:         releaseStmt,
+		touchStmt:           touchStmt,
+		cancelStmt:          cancelStmt,
+		cancelKeyStmt:       cancelKeyStmt,
+		flagCancelledStmt:   flagCancelledStmt,
+		cancelledStmt:       cancelledStmt,
+		deleteCancelledStmt: deleteCancelledStmt,
+		groomCancelledStmt:  groomCancelledStmt,
+		groomStmt:           groomStmt,
+		dueDelayedStmt:      dueDelayedStmt,
+		findDelayedStmt:     findDelayedStmt,
+		setStateStmt:        setStateStmt,
+		deleteStmt:          deleteStmt,
+		deadJobsStmt:        deadJobsStmt,
+		requeueDeadStmt:     requeueDeadStmt,
+	}
+
+	go func() {
+		for range q.groomTicker.C {
+			q.groom()
+		}
+	}()
+
+	return q, nil
+}
+
+func (q *SQLQueue) Stop() {
+	q.groomTicker.Stop()
+
+	if err := q.db.Close(); err != nil {
+		log.Printf("Error while closing database connection: %s", err)
+	}
+}
+
+// groom puts back the jobs that exceeded their TTR in the pending jobs, and
+// promotes the delayed jobs that are due. Unlike with Redis, it doesn't matter
+// if several processes do it at the same time.
+func (q *SQLQueue) groom() {
+	q.groomCancelled()
+
+	if _, err := q.groomStmt.Exec(q.name); err != nil {
+		log.Printf("Error while requeuing expired jobs: %s", err)
+	}
+
+	q.groomDelayed()
+}
+
+// groomDelayed promotes the delayed jobs that are due, following the rules of
+// PostUnique for the jobs that have a key
+func (q *SQLQueue) groomDelayed() {
+	rows, err := q.dueDelayedStmt.Query(q.name)
+
+	if err != nil {
+		log.Printf("Error while listing due delayed jobs: %s", err)
+		return
+	}
+
+	type dueJob struct {
+		id  string
+		key string
+	}
+
+	var due []dueJob
+
+	for rows.Next() {
+		var job dueJob
+
+		if err := rows.Scan(&job.id, &job.key); err != nil {
+			log.Printf("Error while reading due delayed job: %s", err)
+			continue
+		}
+
+		due = append(due, job)
+	}
+
+	if err := rows.Err(); err != nil {
+		log.Printf("Error while listing due delayed jobs: %s", err)
+	}
+
+	rows.Close()
+
+	for _, job := range due {
+		err := q.inKeyTx(job.key, func(tx *sqlx.Tx) error {
+			return q.promoteDelayed(tx, job.id)
+		})
+
+		if err != nil {
+			log.Printf("Error while promoting delayed job %s: %s", job.id, err)
+		}
+	}
+}
+
+// promoteDelayed makes a delayed job pending. If it has a key, it gets merged
+// into the pending job or the follow-up job of that key, or becomes the
+// follow-up job if a job with the same key is running.
+func (q *SQLQueue) promoteDelayed(tx *sqlx.Tx, id string) error {
+	var delayed jobRecord
+
+	if err := tx.Stmtx(q.findDelayedStmt).Get(&delayed, id); err == sql.ErrNoRows {
+		// Cancelled or promoted by another groomer meanwhile
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "Error while retrieving delayed job")
+	}
+
+	if delayed.Key == "" {
+		_, err := tx.Stmt(q.setStateStmt).Exec(sqlStatePending, id)
+		return errors.Wrap(err, "Error while making delayed job pending")
+	}
+
+	record, state, err := q.findSameKeyJob(tx, delayed.Key)
+
+	if err != nil {
+		return err
+	}
+
+	if record == nil {
+		_, err := tx.Stmt(q.setStateStmt).Exec(state, id)
+		return errors.Wrap(err, "Error while promoting delayed job")
+	}
+
+	if _, err := tx.Stmt(q.replaceDataStmt).Exec(delayed.Data, delayed.TTRus, record.ID); err != nil {
+		return errors.Wrap(err, "Error while replacing job data")
+	}
+
+	_, err = tx.Stmt(q.deleteStmt).Exec(id)
+	return errors.Wrap(err, "Error while deleting merged delayed job")
+}
+
+// groomCancelled deletes the cancelled jobs that exceeded their TTR, instead
+// of requeuing them
+func (q *SQLQueue) groomCancelled() {
+	rows, err := q.groomCancelledStmt.Query(q.name)
+
+	if err != nil {
+		log.Printf("Error while deleting expired cancelled jobs: %s", err)
+		return
+	}
+
+	var keys []string
+
+	for rows.Next() {
+		var key string
+
+		if err := rows.Scan(&key); err != nil {
+			log.Printf("Error while reading key of expired cancelled job: %s", err)
+			continue
+		}
+
+		keys = append(keys, key)
+	}
+
+	if err := rows.Err(); err != nil {
+		log.Printf("Error while deleting expired cancelled jobs: %s", err)
+	}
+
+	rows.Close()
+
+	for _, key := range keys {
+		err := q.inKeyTx(key, func(tx *sqlx.Tx) error {
+			return q.releaseFollowup(tx, key)
+		})
+
+		if err != nil {
+			log.Printf("Error while releasing follow-up job after cancelled job: %s", err)
+		}
+	}
+}
+
+func (q *SQLQueue) Clear() error {
+	_, err := q.db.Exec(`DELETE FROM jobs WHERE queue = $1`, q.name)
+	return errors.Wrap(err, "Error while deleting jobs")
+}
+
+// inKeyTx runs do in a transaction, holding a lock on the given job key (if
+// not empty) so that jobs of the same key are coalesced consistently
+func (q *SQLQueue) inKeyTx(key string, do func(tx *sqlx.Tx) error) error {
+	tx, err := q.db.Beginx()
+
+	if err != nil {
+		return errors.Wrap(err, "Error while starting transaction")
+	}
+
+	lockAndDo := func() error {
+		// The lock is released at the end of the transaction
+		if key != "" {
+			if _, err := tx.Stmt(q.lockKeyStmt).Exec(q.name + "/" + key); err != nil {
+				return errors.Wrap(err, "Error while locking job key")
+			}
+		}
+
+		return do(tx)
+	}
+
+	if err := lockAndDo(); err != nil {
+		if rollbackError := tx.Rollback(); rollbackError != nil {
+			return errors.Wrapf(rollbackError, "Error while rolling back transaction because of error %s", err.Error())
+		}
+
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "Error while committing transaction")
+	}
+
+	return nil
+}
+
+func (q *SQLQueue) insert(stmt *sql.Stmt, state, key string, data []byte, ttr time.Duration) error {
+	_, err := stmt.Exec(uuid.NewV4().String(), q.name, state, key, data, int64(ttr/time.Microsecond))
+	return errors.Wrap(err, "Error while inserting job")
+}
+
+func (q *SQLQueue) Post(job interface{}, ttr time.Duration) error {
+	data, err := encodeJobData(job)
+
+	if err != nil {
+		return err
+	}
+
+	return q.insert(q.postStmt, sqlStatePending, "", data, ttr)
+}
+
+func (q *SQLQueue) PostAt(key string, job interface{}, ttr time.Duration, at time.Time) error {
+	data, err := encodeJobData(job)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = q.postAtStmt.Exec(uuid.NewV4().String(), q.name, key, data, int64(ttr/time.Microsecond), at)
+	return errors.Wrap(err, "Error while inserting job")
+}
+
+func (q *SQLQueue) PostAfter(key string, job interface{}, ttr time.Duration, delay time.Duration) error {
+	return q.PostAt(key, job, ttr, time.Now().Add(delay))
+}
+
+func (q *SQLQueue) PostUnique(key string, job interface{}, ttr time.Duration) (interface{}, error) {
+	if key == "" {
+		return nil, q.Post(job, ttr)
+	}
+
+	data, err := encodeJobData(job)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var replaced interface{}
+
+	err = q.inKeyTx(key, func(tx *sqlx.Tx) error {
+		record, state, err := q.findSameKeyJob(tx, key)
+
+		if err != nil {
+			return err
+		}
+
+		if record == nil {
+			return q.insert(tx.Stmt(q.postStmt), state, key, data, ttr)
+		}
+
+		if replaced, err = decodeJobData(record.Data); err != nil {
+			return err
+		}
+
+		_, err = tx.Stmt(q.replaceDataStmt).Exec(data, int64(ttr/time.Microsecond), record.ID)
+		return errors.Wrap(err, "Error while replacing job data")
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return replaced, nil
+}
+
+// findSameKeyJob returns the pending job of the given key, or its follow-up
+// job if a job with this key is running. If there is none, it returns the
+// state of a new job with this key. The key must be locked.
+func (q *SQLQueue) findSameKeyJob(tx *sqlx.Tx, key string) (*jobRecord, string, error) {
+	record, err := q.findJob(tx, q.findPendingStmt, key)
+
+	if err != nil || record != nil {
+		return record, sqlStatePending, err
+	}
+
+	var running bool
+
+	if err := tx.Stmt(q.isRunningStmt).QueryRow(q.name, key).Scan(&running); err != nil {
+		return nil, "", errors.Wrap(err, "Error while checking if a job with the same key is running")
+	}
+
+	if !running {
+		return nil, sqlStatePending, nil
+	}
+
+	record, err = q.findJob(tx, q.findFollowupStmt, key)
+
+	return record, sqlStateFollowup, err
+}
+
+// findJob returns the job of the given key returned by findStmt, or nil if
+// there is none
+func (q *SQLQueue) findJob(tx *sqlx.Tx, findStmt *sqlx.Stmt, key string) (*jobRecord, error) {
+	var record jobRecord
+
+	if err := tx.Stmtx(findStmt).Get(&record, q.name, key); err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "Error while looking for a job with the same key")
+	}
+
+	return &record, nil
+}
+
+func (q *SQLQueue) pickOne() (*JobEntry, error) {
+	var record jobRecord
+
+	if err := q.pickStmt.Get(&record, q.name); err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "Error while picking job")
+	}
+
+	return record.entry()
+}
+
+func (q *SQLQueue) Pick(timeout time.Duration) (*JobEntry, error) {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		entry, err := q.pickOne()
+
+		if err != nil || entry != nil {
+			return entry, err
+		}
+
+		wait := time.Until(deadline)
+
+		if wait <= 0 {
+			return nil, nil
+		}
+
+		if wait > SQLPollInterval {
+			wait = SQLPollInterval
+		}
+
+		time.Sleep(wait)
+	}
+}
+
+func (q *SQLQueue) Finish(entry *JobEntry) error {
+	return q.inKeyTx(entry.Key, func(tx *sqlx.Tx) error {
+		if _, err := tx.Stmt(q.finishStmt).Exec(entry.ID); err != nil {
+			return errors.Wrap(err, "Error while deleting finished job")
+		}
+
+		return q.releaseFollowup(tx, entry.Key)
+	})
+}
+
+func (q *SQLQueue) releaseFollowup(tx *sqlx.Tx, key string) error {
+	if key == "" {
+		return nil
+	}
+
+	_, err := tx.Stmt(q.releaseFollowupStmt).Exec(q.name, key)
+	return errors.Wrap(err, "Error while releasing follow-up job")
+}
+
+func (q *SQLQueue) Fail(entry *JobEntry, err error) error {
+	attempts := entry.Attempts + 1
+	state := sqlStateDelayed
+	delay := time.Duration(0)
+
+	if attempts >= MaxAttempts {
+		state = sqlStateDead
+	} else {
+		delay = retryDelay(attempts)
+	}
+
+	lastError := errorMessage(err)
+
+	return q.inKeyTx(entry.Key, func(tx *sqlx.Tx) error {
+		if _, err := tx.Stmt(q.deleteCancelledStmt).Exec(entry.ID); err != nil {
+			return errors.Wrap(err, "Error while deleting cancelled job")
+		}
+
+		// Does nothing if the job already expired and got requeued, or if it
+		// was cancelled
+		if _, err := tx.Stmt(q.failStmt).Exec(state, attempts, lastError, int64(delay/time.Microsecond), entry.ID); err != nil {
+			return errors.Wrap(err, "Error while failing job")
+		}
+
+		return q.releaseFollowup(tx, entry.Key)
+	})
+}
+
+func (q *SQLQueue) Release(entry *JobEntry) error {
+	return q.inKeyTx(entry.Key, func(tx *sqlx.Tx) error {
+		cancelled, err := execOne(tx.Stmt(q.deleteCancelledStmt), entry.ID)
+
+		if err != nil {
+			return errors.Wrap(err, "Error while deleting cancelled job")
+		}
+
+		if cancelled {
+			return q.releaseFollowup(tx, entry.Key)
+		}
+
+		// Does nothing if the job already expired and got requeued
+		_, err = tx.Stmt(q.releaseStmt).Exec(entry.ID)
+		return errors.Wrap(err, "Error while releasing job")
+	})
+}
+
+func (q *SQLQueue) CancelKey(key string) error {
+	return q.inKeyTx(key, func(tx *sqlx.Tx) error {
+		if _, err := tx.Stmt(q.cancelKeyStmt).Exec(q.name, key); err != nil {
+			return errors.Wrap(err, "Error while deleting cancelled jobs")
+		}
+
+		_, err := tx.Stmt(q.flagCancelledStmt).Exec(q.name, key)
+		return errors.Wrap(err, "Error while flagging cancelled jobs")
+	})
+}
+
+func (q *SQLQueue) Cancelled(entry *JobEntry) (bool, error) {
+	var cancelled bool
+
+	if err := q.cancelledStmt.QueryRow(entry.ID).Scan(&cancelled); err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, errors.Wrap(err, "Error while checking if job is cancelled")
+	}
+
+	return cancelled, nil
+}
+
+// Computes the JobState of a row. Pending jobs that are not available yet were
+// delayed before the delayed state existed.
+const jobStateSQL = `CASE WHEN state = 'pending' AND available > now() THEN 'delayed' ELSE state END`
+
+func (q *SQLQueue) Counts() (map[JobState]int, error) {
+	rows, err := q.db.Query(`SELECT `+jobStateSQL+` AS job_state, count(*) FROM jobs WHERE queue = $1 GROUP BY job_state`, q.name)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while counting jobs")
+	}
+
+	defer rows.Close()
+
+	counts := map[JobState]int{}
+
+	for _, state := range JobStates {
+		counts[state] = 0
+	}
+
+	for rows.Next() {
+		var state string
+		var count int
+
+		if err := rows.Scan(&state, &count); err != nil {
+			return nil, errors.Wrap(err, "Error while reading job counts")
+		}
+
+		counts[JobState(state)] = count
+	}
+
+	return counts, errors.Wrap(rows.Err(), "Error while reading job counts")
+}
+
+func (q *SQLQueue) Jobs(state JobState) ([]*JobEntry, error) {
+	order := "posted"
+
+	switch state {
+	case JobPending, JobFollowup, JobReserved:
+	case JobDelayed:
+		order = "available"
+	case JobDead:
+		return q.DeadJobs()
+	default:
+		return nil, errors.Errorf("Unknown job state: %s", state)
+	}
+
+	var records []jobRecord
+
+	if err := q.db.Select(&records, `SELECT `+jobColumns+` FROM jobs WHERE queue = $1 AND `+jobStateSQL+` = $2 ORDER BY `+order, q.name, string(state)); err != nil {
+		return nil, errors.Wrapf(err, "Error while listing %s jobs", state)
+	}
+
+	entries := make([]*JobEntry, 0, len(records))
+
+	for _, record := range records {
+		entry, err := record.entry()
+
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+func (q *SQLQueue) Job(id string) (*JobEntry, JobState, error) {
+	var record struct {
+		jobRecord
+		State string `db:"job_state"`
+	}
+
+	err := q.db.Get(&record, `SELECT `+jobColumns+`, `+jobStateSQL+` AS job_state FROM jobs WHERE id = $1 AND queue = $2`, id, q.name)
+
+	if err == sql.ErrNoRows {
+		return nil, "", ErrJobNotFound
+	} else if err != nil {
+		return nil, "", errors.Wrap(err, "Error while retrieving job")
+	}
+
+	entry, err := record.entry()
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	return entry, JobState(record.State), nil
+}
+
+// execOne runs a statement that should affect a single job, and returns
+// false if it didn't affect any
+func execOne(stmt *sql.Stmt, args ...interface{}) (bool, error) {
+	res, err := stmt.Exec(args...)
+
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+
+	if err != nil {
+		return false, errors.Wrap(err, "Error while counting affected rows")
+	}
+
+	return rowsAffected == 1, nil
+}
+
+func (q *SQLQueue) Cancel(id string) error {
+	found, err := execOne(q.cancelStmt, id, q.name)
+
+	if err != nil {
+		return errors.Wrap(err, "Error while cancelling job")
+	}
+
+	if !found {
+		return ErrJobNotFound
+	}
+
+	return nil
+}
+
+func (q *SQLQueue) Requeue(id string) error {
+	found, err := execOne(q.releaseStmt, id)
+
+	if err != nil {
+		return errors.Wrap(err, "Error while requeuing job")
+	}
+
+	if !found {
+		return ErrJobNotFound
+	}
+
+	return nil
+}
+
+func (q *SQLQueue) Touch(entry *JobEntry) error {
+	found, err := execOne(q.touchStmt, entry.ID)
+
+	if err != nil {
+		return errors.Wrap(err, "Error while touching job")
+	}
+
+	if !found {
+		return ErrJobNotFound
+	}
+
+	return nil
+}
+
+func (q *SQLQueue) DeadJobs() ([]*JobEntry, error) {
+	var records []jobRecord
+
+	if err := q.deadJobsStmt.Select(&records, q.name); err != nil {
+		return nil, errors.Wrap(err, "Error while listing dead jobs")
+	}
+
+	entries := make([]*JobEntry, 0, len(records))
+
+	for _, record := range records {
+		entry, err := record.entry()
+
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+func (q *SQLQueue) RequeueDead(id string) error {
+	res, err := q.requeueDeadStmt.Exec(id, q.name)
+
+	if err != nil {
+		return errors.Wrap(err, "Error while requeuing dead job")
+	}
+
+	rowsAffected, err := res.RowsAffected()
+
+	if err != nil {
+		return errors.Wrap(err, "Error while counting affected rows")
+	}
+
+	if rowsAffected != 1 {
+		return ErrJobNotFound
+	}
+
+	return nil
+}
@@ -0,0 +1,42 @@
+package workqueue_test
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	_ "github.com/lib/pq"
+
+	"github.com/abustany/moblog-cloud/pkg/testutils"
+	"github.com/abustany/moblog-cloud/pkg/workqueue"
+)
+
+func TestSQLQueue(t *testing.T) {
+	// Reduce groom and poll intervals at expense of CPU load so that tests
+	// don't take forever to run
+	workqueue.GroomInterval = 20 * time.Millisecond
+	workqueue.RetryBackoff = 100 * time.Millisecond
+	workqueue.SQLPollInterval = 20 * time.Millisecond
+
+	dbURL := os.Getenv(testutils.DBURLEnvVar)
+
+	if dbURL == "" {
+		t.Skip(testutils.DBURLEnvVar + " environment variable not defined")
+	}
+
+	testutils.FlushDB(t)
+
+	q, err := workqueue.NewSQLQueue("postgres", dbURL, workqueue.PushQueueName)
+
+	if err != nil {
+		t.Fatalf("Error while creating queue: %s", err)
+	}
+
+	defer q.Stop()
+
+	testWorkqueue(t, q)
+
+	t.Run("Inspect jobs", func(t *testing.T) {
+		testInspector(t, q)
+	})
+}
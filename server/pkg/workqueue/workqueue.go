@@ -1,25 +1,161 @@
 package workqueue
 
 import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
 	"time"
 
 	"github.com/pkg/errors"
+
+	"github.com/abustany/moblog-cloud/pkg/jobs"
 )
 
 type JobEntry struct {
 	ID   string
 	TTR  time.Duration
 	Data interface{}
+	// Deduplication key given to PostUnique, empty for jobs posted with Post
+	Key string
+
+	// Number of times the job failed before this delivery
+	Attempts int
+	// Error message of the last failure, empty if the job never failed
+	LastError string
+}
+
+// LastAttempt returns true if failing the job will move it to the dead-letter
+// list instead of retrying it.
+func (e *JobEntry) LastAttempt() bool {
+	return e.Attempts+1 >= MaxAttempts
 }
 
 type Queue interface {
 	Post(job interface{}, ttr time.Duration) error
+	// PostAt posts a job that stays delayed until the given time. Jobs
+	// scheduled in the past become pending at the next grooming. The key can
+	// be empty. When the job becomes due, it is posted like with PostUnique:
+	// it replaces the data of the pending job with the same key, or becomes
+	// the follow-up job if a job with this key is running. Failed jobs
+	// waiting to be retried are promoted the same way.
+	PostAt(key string, job interface{}, ttr time.Duration, at time.Time) error
+	// PostAfter posts a job that stays delayed for the given duration
+	PostAfter(key string, job interface{}, ttr time.Duration, delay time.Duration) error
+	// PostUnique posts a job that gets coalesced with the other jobs posted
+	// with the same key. If a job with this key is pending, its data is
+	// replaced by the new job, and the replaced data is returned. If a job
+	// with this key is running, a single follow-up job is kept aside and
+	// becomes pending once the running job finishes or fails.
+	PostUnique(key string, job interface{}, ttr time.Duration) (replaced interface{}, err error)
 
-	// Gets a job from the queue and reserves it
+	// Gets a job from the queue and reserves it. Returns nil if no job was
+	// posted before the timeout, a zero timeout doesn't wait.
 	Pick(timeout time.Duration) (*JobEntry, error)
 	Finish(entry *JobEntry) error
+	// Fail releases a reserved job that could not be completed. The job is
+	// delivered again after a delay growing exponentially with the number of
+	// attempts, or moved to the dead-letter list after MaxAttempts attempts.
+	Fail(entry *JobEntry, err error) error
+	// Release puts a reserved job back in the pending jobs right away, without
+	// counting an attempt. Workers use it to hand back the jobs they could not
+	// complete before shutting down.
+	Release(entry *JobEntry) error
+	// Touch extends the reservation of a job, so that it expires TTR after
+	// the call instead of TTR after the job was picked. Workers call it
+	// periodically while running long jobs. Returns ErrJobNotFound if the job
+	// is not reserved anymore.
+	Touch(entry *JobEntry) error
+
+	// CancelKey cancels the jobs of the given key. Pending, delayed and
+	// follow-up jobs are deleted. Reserved jobs are flagged, workers should
+	// check Cancelled and stop them. A cancelled job is never retried nor put
+	// back in the pending jobs.
+	CancelKey(key string) error
+	// Cancelled returns true if the key of a reserved job was cancelled
+	// after it was picked.
+	Cancelled(entry *JobEntry) (bool, error)
+
+	// DeadJobs returns the jobs in the dead-letter list, most recently failed
+	// first.
+	DeadJobs() ([]*JobEntry, error)
+	// RequeueDead moves a job from the dead-letter list back to the pending
+	// jobs, resetting its attempt counter.
+	RequeueDead(id string) error
 }
 
+// Name of the queue the gitserver posts the render jobs of pushes to. Users
+// are waiting for those, so workers consume it first. Each backend stores
+// several named queues independently.
+const PushQueueName = "jobs"
+
+// Name of the queue for the jobs nobody is waiting for, like re-rendering all
+// the blogs after a theme update. Workers consume it after the push queue.
+const RebuildQueueName = "rebuilds"
+
+// Default list of the queues consumed by the workers: while both queues have
+// pending jobs, four jobs out of five come from the push queue.
+const DefaultWorkerQueues = PushQueueName + ":4," + RebuildQueueName
+
+// Name of the queue consumed by the gitservers, for the jobs that work on the
+// repositories they store
+const RepositoryQueueName = "repositories"
+
 var ErrQueueFull = errors.New("Queue is full")
+var ErrJobNotFound = errors.New("No job with this ID")
+var ErrUnknownEntry = errors.New("Job was not picked from this queue")
 
 var GroomInterval = 5 * time.Second
+
+// Number of times a job can fail before being moved to the dead-letter list
+var MaxAttempts = 5
+
+// Delay before retrying a job that failed once. The delay doubles with each
+// further attempt, up to MaxRetryBackoff.
+var RetryBackoff = 30 * time.Second
+var MaxRetryBackoff = 30 * time.Minute
+
+// retryDelay returns how long to wait before delivering again a job that
+// failed the given number of times.
+func retryDelay(attempts int) time.Duration {
+	delay := RetryBackoff
+
+	for i := 1; i < attempts && delay < MaxRetryBackoff; i++ {
+		delay *= 2
+	}
+
+	if delay > MaxRetryBackoff {
+		delay = MaxRetryBackoff
+	}
+
+	return delay
+}
+
+func errorMessage(err error) string {
+	if err == nil {
+		return "Unknown error"
+	}
+
+	return err.Error()
+}
+
+// encodeJobData serializes the data of a job. The type of the data must have
+// been registered with jobs.Register.
+func encodeJobData(data interface{}) ([]byte, error) {
+	return jobs.Marshal(data)
+}
+
+// decodeJobData decodes the data of a job. Data that is not JSON was encoded
+// with gob by older versions.
+func decodeJobData(data []byte) (interface{}, error) {
+	if json.Valid(data) {
+		return jobs.Unmarshal(data)
+	}
+
+	var decodedData interface{}
+
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&decodedData); err != nil {
+		return nil, errors.Wrap(err, "Error while decoding entry data")
+	}
+
+	return decodedData, nil
+}
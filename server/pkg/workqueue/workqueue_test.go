@@ -4,9 +4,17 @@ import (
 	"testing"
 	"time"
 
+	"github.com/pkg/errors"
+
+	"github.com/abustany/moblog-cloud/pkg/jobs"
 	"github.com/abustany/moblog-cloud/pkg/workqueue"
 )
 
+func init() {
+	// The tests post strings as job data
+	jobs.Register("test-string", 1, "")
+}
+
 func testWorkqueue(t *testing.T, q workqueue.Queue) {
 	withQueue := func(f func(*testing.T, workqueue.Queue)) func(*testing.T) {
 		return func(t *testing.T) {
@@ -17,8 +25,17 @@ func testWorkqueue(t *testing.T, q workqueue.Queue) {
 	t.Run("Pick on an empty queue", withQueue(testPickEmpty))
 	t.Run("Post a job and pick it", withQueue(testPostPick))
 	t.Run("Pick times out", withQueue(testPickTimeout))
+	t.Run("Pick without waiting", withQueue(testPickNoWait))
 	t.Run("TTR", withQueue(testTTR))
 	t.Run("Post with Pick running", withQueue(testPostAfterPick))
+	t.Run("Fail and retry", withQueue(testFailRetry))
+	t.Run("Scheduled jobs", withQueue(testPostAt))
+	t.Run("Release a job", withQueue(testRelease))
+	t.Run("Touch a job", withQueue(testTouch))
+	t.Run("Coalesce jobs with the same key", withQueue(testPostUnique))
+	t.Run("Coalesce scheduled jobs with the same key", withQueue(testPostAtUnique))
+	t.Run("Cancel the jobs of a key", withQueue(testCancelKey))
+	t.Run("Dead-letter list", withQueue(testDeadLetter))
 }
 
 func testPickEmpty(t *testing.T, q workqueue.Queue) {
@@ -89,6 +106,38 @@ func testPickTimeout(t *testing.T, q workqueue.Queue) {
 	}
 }
 
+func testPickNoWait(t *testing.T, q workqueue.Queue) {
+	for i := 0; i < 20; i++ {
+		if err := q.Post("testPickNoWait", time.Hour); err != nil {
+			t.Fatalf("Posting a job failed: %s", err)
+		}
+
+		entry, err := q.Pick(0)
+
+		if err != nil {
+			t.Fatalf("Pick returned an error: %s", err)
+		}
+
+		if entry == nil {
+			t.Fatalf("Pick without waiting didn't return the pending job")
+		}
+
+		if err := q.Finish(entry); err != nil {
+			t.Errorf("Finish returned an error: %s", err)
+		}
+	}
+
+	before := time.Now()
+
+	if entry, err := q.Pick(0); err != nil || entry != nil {
+		t.Errorf("Expected no job, got %+v, %v", entry, err)
+	}
+
+	if time.Since(before) > 500*time.Millisecond {
+		t.Errorf("Pick without a timeout waited")
+	}
+}
+
 func testTTR(t *testing.T, q workqueue.Queue) {
 	data := "hello"
 
@@ -174,3 +223,513 @@ func testPostAfterPick(t *testing.T, q workqueue.Queue) {
 		}
 	}
 }
+
+// pickAfterFailure fails a job and picks it again once it gets retried
+func pickAfterFailure(t *testing.T, q workqueue.Queue, entry *workqueue.JobEntry, failure error) *workqueue.JobEntry {
+	before := time.Now()
+
+	if err := q.Fail(entry, failure); err != nil {
+		t.Fatalf("Fail returned an error: %s", err)
+	}
+
+	retried, err := q.Pick(5 * time.Second)
+
+	if err != nil {
+		t.Fatalf("Error while picking job: %s", err)
+	}
+
+	if retried == nil {
+		t.Fatalf("Failed job was not retried")
+	}
+
+	if time.Since(before) < workqueue.RetryBackoff {
+		t.Errorf("Failed job was retried before its backoff delay")
+	}
+
+	return retried
+}
+
+func testFailRetry(t *testing.T, q workqueue.Queue) {
+	data := "testFailRetry"
+
+	if err := q.Post(data, 1*time.Hour); err != nil {
+		t.Fatalf("Error while posting job: %s", err)
+	}
+
+	entry, err := q.Pick(1 * time.Millisecond)
+
+	if err != nil {
+		t.Fatalf("Error while picking job: %s", err)
+	}
+
+	if entry == nil {
+		t.Fatalf("Didn't pick any job")
+	}
+
+	if entry.Attempts != 0 || entry.LastError != "" {
+		t.Errorf("New job has non zero attempts: %+v", entry)
+	}
+
+	retried := pickAfterFailure(t, q, entry, errors.New("boom"))
+
+	if retried.ID != entry.ID {
+		t.Errorf("Unexpected job picked, expected %s, got %s", entry.ID, retried.ID)
+	}
+
+	if str, ok := retried.Data.(string); !ok || str != data {
+		t.Errorf("Unexpected job data, got %v, expected %v", retried.Data, data)
+	}
+
+	if retried.Attempts != 1 || retried.LastError != "boom" {
+		t.Errorf("Unexpected attempts after a failure: %+v", retried)
+	}
+
+	if err := q.Finish(retried); err != nil {
+		t.Errorf("Finish returned an error: %s", err)
+	}
+
+	dead, err := q.DeadJobs()
+
+	if err != nil {
+		t.Fatalf("Error while listing dead jobs: %s", err)
+	}
+
+	if len(dead) != 0 {
+		t.Errorf("Dead-letter list should be empty, got %+v", dead)
+	}
+}
+
+func testDeadLetter(t *testing.T, q workqueue.Queue) {
+	oldMaxAttempts := workqueue.MaxAttempts
+	workqueue.MaxAttempts = 2
+	defer func() { workqueue.MaxAttempts = oldMaxAttempts }()
+
+	if err := q.Post("testDeadLetter", 1*time.Hour); err != nil {
+		t.Fatalf("Error while posting job: %s", err)
+	}
+
+	entry, err := q.Pick(1 * time.Millisecond)
+
+	if err != nil || entry == nil {
+		t.Fatalf("Error while picking job: %v", err)
+	}
+
+	if entry.LastAttempt() {
+		t.Errorf("First attempt should not be the last one")
+	}
+
+	entry = pickAfterFailure(t, q, entry, errors.New("first failure"))
+
+	if !entry.LastAttempt() {
+		t.Errorf("Second attempt should be the last one")
+	}
+
+	if err := q.Fail(entry, errors.New("second failure")); err != nil {
+		t.Fatalf("Fail returned an error: %s", err)
+	}
+
+	if picked, err := q.Pick(1 * time.Millisecond); err != nil {
+		t.Fatalf("Error while picking job: %s", err)
+	} else if picked != nil {
+		t.Fatalf("Dead job was picked again: %+v", picked)
+	}
+
+	dead, err := q.DeadJobs()
+
+	if err != nil {
+		t.Fatalf("Error while listing dead jobs: %s", err)
+	}
+
+	if len(dead) != 1 || dead[0].ID != entry.ID || dead[0].Attempts != 2 || dead[0].LastError != "second failure" {
+		t.Fatalf("Unexpected dead-letter list: %+v", dead)
+	}
+
+	if err := q.RequeueDead(entry.ID); err != nil {
+		t.Fatalf("Error while requeuing dead job: %s", err)
+	}
+
+	if err := q.RequeueDead(entry.ID); err != workqueue.ErrJobNotFound {
+		t.Errorf("Expected ErrJobNotFound when requeuing a job twice, got %v", err)
+	}
+
+	requeued, err := q.Pick(1 * time.Millisecond)
+
+	if err != nil {
+		t.Fatalf("Error while picking job: %s", err)
+	}
+
+	if requeued == nil || requeued.ID != entry.ID || requeued.Attempts != 0 {
+		t.Fatalf("Unexpected requeued job: %+v", requeued)
+	}
+
+	if err := q.Finish(requeued); err != nil {
+		t.Errorf("Finish returned an error: %s", err)
+	}
+}
+
+func testPostAt(t *testing.T, q workqueue.Queue) {
+	before := time.Now()
+
+	if err := q.PostAfter("", "later", 1*time.Hour, 2*time.Second); err != nil {
+		t.Fatalf("Error while scheduling job: %s", err)
+	}
+
+	if err := q.PostAt("", "much later", 1*time.Hour, time.Now().Add(1*time.Hour)); err != nil {
+		t.Fatalf("Error while scheduling job: %s", err)
+	}
+
+	pickData(t, q, nil)
+
+	entry, err := q.Pick(5 * time.Second)
+
+	if err != nil {
+		t.Fatalf("Error while picking job: %s", err)
+	}
+
+	if entry == nil {
+		t.Fatalf("Scheduled job was not picked")
+	}
+
+	if str, ok := entry.Data.(string); !ok || str != "later" {
+		t.Errorf("Unexpected job data, got %v, expected later", entry.Data)
+	}
+
+	if time.Since(before) < 2*time.Second {
+		t.Errorf("Scheduled job was picked too early")
+	}
+
+	if err := q.Finish(entry); err != nil {
+		t.Errorf("Finish returned an error: %s", err)
+	}
+
+	pickData(t, q, nil)
+}
+
+func testRelease(t *testing.T, q workqueue.Queue) {
+	if err := q.Post("testRelease", 1*time.Hour); err != nil {
+		t.Fatalf("Error while posting job: %s", err)
+	}
+
+	entry := pickData(t, q, "testRelease")
+
+	if err := q.Release(entry); err != nil {
+		t.Fatalf("Release returned an error: %s", err)
+	}
+
+	// The released job can be picked again right away, and doesn't count as
+	// a failed attempt
+	released := pickData(t, q, "testRelease")
+
+	if released.ID != entry.ID || released.Attempts != 0 {
+		t.Errorf("Unexpected released job: %+v", released)
+	}
+
+	if err := q.Finish(released); err != nil {
+		t.Errorf("Finish returned an error: %s", err)
+	}
+
+	pickData(t, q, nil)
+}
+
+func testTouch(t *testing.T, q workqueue.Queue) {
+	if err := q.Post("testTouch", 100*time.Millisecond); err != nil {
+		t.Fatalf("Error while posting job: %s", err)
+	}
+
+	entry := pickData(t, q, "testTouch")
+
+	// The job runs for longer than its TTR, but keeps getting touched
+	for i := 0; i < 5; i++ {
+		time.Sleep(50 * time.Millisecond)
+
+		if err := q.Touch(entry); err != nil {
+			t.Fatalf("Touch returned an error: %s", err)
+		}
+	}
+
+	pickData(t, q, nil)
+
+	// Once not touched anymore, the job expires
+	time.Sleep(250 * time.Millisecond)
+
+	if err := q.Touch(entry); errors.Cause(err) != workqueue.ErrJobNotFound {
+		t.Errorf("Touching an expired job returned %v, expected ErrJobNotFound", err)
+	}
+
+	if err := q.Finish(pickData(t, q, "testTouch")); err != nil {
+		t.Errorf("Finish returned an error: %s", err)
+	}
+}
+
+func postUnique(t *testing.T, q workqueue.Queue, key, data string, expectedReplaced interface{}) {
+	replaced, err := q.PostUnique(key, data, 1*time.Hour)
+
+	if err != nil {
+		t.Fatalf("Error while posting job %s: %s", data, err)
+	}
+
+	if replaced != expectedReplaced {
+		t.Errorf("Unexpected replaced data when posting %s: expected %v, got %v", data, expectedReplaced, replaced)
+	}
+}
+
+func pickData(t *testing.T, q workqueue.Queue, expectedData interface{}) *workqueue.JobEntry {
+	entry, err := q.Pick(1 * time.Millisecond)
+
+	if err != nil {
+		t.Fatalf("Error while picking job: %s", err)
+	}
+
+	if entry == nil {
+		if expectedData != nil {
+			t.Fatalf("Didn't pick any job, expected %v", expectedData)
+		}
+
+		return nil
+	}
+
+	if entry.Data != expectedData {
+		t.Fatalf("Unexpected job data, expected %v, got %v", expectedData, entry.Data)
+	}
+
+	return entry
+}
+
+func testPostUnique(t *testing.T, q workqueue.Queue) {
+	// Jobs of the same key collapse while pending
+	postUnique(t, q, "blog", "first", nil)
+	postUnique(t, q, "other-blog", "other", nil)
+	postUnique(t, q, "blog", "second", "first")
+
+	running := pickData(t, q, "second")
+	other := pickData(t, q, "other")
+	pickData(t, q, nil)
+
+	if running.Key != "blog" {
+		t.Errorf("Unexpected job key: %s", running.Key)
+	}
+
+	if err := q.Finish(other); err != nil {
+		t.Errorf("Finish returned an error: %s", err)
+	}
+
+	// Only one follow-up is kept while a job of the same key is running, and
+	// it doesn't get picked before the running job is done
+	postUnique(t, q, "blog", "third", nil)
+	postUnique(t, q, "blog", "fourth", "third")
+	pickData(t, q, nil)
+
+	if err := q.Finish(running); err != nil {
+		t.Errorf("Finish returned an error: %s", err)
+	}
+
+	followup := pickData(t, q, "fourth")
+
+	if err := q.Finish(followup); err != nil {
+		t.Errorf("Finish returned an error: %s", err)
+	}
+
+	pickData(t, q, nil)
+}
+
+func testPostAtUnique(t *testing.T, q workqueue.Queue) {
+	postUnique(t, q, "blog", "running", nil)
+	running := pickData(t, q, "running")
+
+	// A scheduled job whose key is running becomes the follow-up job
+	if err := q.PostAfter("blog", "scheduled", 1*time.Hour, 0); err != nil {
+		t.Fatalf("Error while scheduling job: %s", err)
+	}
+
+	time.Sleep(10 * workqueue.GroomInterval)
+	pickData(t, q, nil)
+	postUnique(t, q, "blog", "posted", "scheduled")
+
+	if err := q.Finish(running); err != nil {
+		t.Errorf("Finish returned an error: %s", err)
+	}
+
+	// A scheduled job whose key is pending gets merged into the pending job
+	if err := q.PostAfter("blog", "scheduled again", 1*time.Hour, 0); err != nil {
+		t.Fatalf("Error while scheduling job: %s", err)
+	}
+
+	time.Sleep(10 * workqueue.GroomInterval)
+
+	followup := pickData(t, q, "scheduled again")
+	pickData(t, q, nil)
+
+	if err := q.Finish(followup); err != nil {
+		t.Errorf("Finish returned an error: %s", err)
+	}
+
+	pickData(t, q, nil)
+}
+
+func checkCancelled(t *testing.T, q workqueue.Queue, entry *workqueue.JobEntry, expected bool) {
+	cancelled, err := q.Cancelled(entry)
+
+	if err != nil {
+		t.Fatalf("Error while checking if job is cancelled: %s", err)
+	}
+
+	if cancelled != expected {
+		t.Errorf("Unexpected cancellation flag, expected %v, got %v", expected, cancelled)
+	}
+}
+
+func testCancelKey(t *testing.T, q workqueue.Queue) {
+	postUnique(t, q, "blog", "running", nil)
+	running := pickData(t, q, "running")
+
+	postUnique(t, q, "blog", "followup", nil)
+	postUnique(t, q, "other-blog", "other", nil)
+
+	if err := q.PostAfter("blog", "scheduled", 1*time.Hour, 500*time.Millisecond); err != nil {
+		t.Fatalf("Error while scheduling job: %s", err)
+	}
+
+	checkCancelled(t, q, running, false)
+
+	if err := q.CancelKey("blog"); err != nil {
+		t.Fatalf("Error while cancelling jobs: %s", err)
+	}
+
+	checkCancelled(t, q, running, true)
+
+	// Jobs of other keys are left alone
+	other := pickData(t, q, "other")
+
+	if err := q.Finish(other); err != nil {
+		t.Errorf("Finish returned an error: %s", err)
+	}
+
+	// A cancelled job is not handed back to the queue
+	if err := q.Release(running); err != nil {
+		t.Errorf("Release returned an error: %s", err)
+	}
+
+	time.Sleep(time.Second)
+	pickData(t, q, nil)
+
+	// New jobs can be posted for the key
+	postUnique(t, q, "blog", "new", nil)
+	entry := pickData(t, q, "new")
+	checkCancelled(t, q, entry, false)
+
+	if err := q.Finish(entry); err != nil {
+		t.Errorf("Finish returned an error: %s", err)
+	}
+
+	pickData(t, q, nil)
+}
+
+type inspectableQueue interface {
+	workqueue.Queue
+	workqueue.Inspector
+	Clear() error
+}
+
+// jobOfState returns the only job in the given state
+func jobOfState(t *testing.T, q workqueue.Inspector, state workqueue.JobState, expectedData interface{}) *workqueue.JobEntry {
+	entries, err := q.Jobs(state)
+
+	if err != nil {
+		t.Fatalf("Error while listing %s jobs: %s", state, err)
+	}
+
+	if len(entries) != 1 || entries[0].Data != expectedData {
+		t.Fatalf("Unexpected %s jobs: %+v", state, entries)
+	}
+
+	entry, entryState, err := q.Job(entries[0].ID)
+
+	if err != nil {
+		t.Fatalf("Error while retrieving job %s: %s", entries[0].ID, err)
+	}
+
+	if entryState != state || entry.Data != expectedData {
+		t.Fatalf("Unexpected job %+v in state %s", entry, entryState)
+	}
+
+	return entry
+}
+
+func checkCounts(t *testing.T, q workqueue.Inspector, expected map[workqueue.JobState]int) {
+	counts, err := q.Counts()
+
+	if err != nil {
+		t.Fatalf("Error while counting jobs: %s", err)
+	}
+
+	for _, state := range workqueue.JobStates {
+		if counts[state] != expected[state] {
+			t.Errorf("Unexpected number of %s jobs, expected %d, got %d", state, expected[state], counts[state])
+		}
+	}
+}
+
+func testInspector(t *testing.T, q inspectableQueue) {
+	if err := q.Clear(); err != nil {
+		t.Fatalf("Error while clearing queue: %s", err)
+	}
+
+	postUnique(t, q, "inspect", "reserved", nil)
+	reserved := pickData(t, q, "reserved")
+	postUnique(t, q, "inspect", "followup", nil)
+
+	if err := q.Post("pending", 1*time.Hour); err != nil {
+		t.Fatalf("Error while posting job: %s", err)
+	}
+
+	if err := q.PostAfter("", "delayed", 1*time.Hour, 1*time.Hour); err != nil {
+		t.Fatalf("Error while posting job: %s", err)
+	}
+
+	checkCounts(t, q, map[workqueue.JobState]int{
+		workqueue.JobPending:  1,
+		workqueue.JobDelayed:  1,
+		workqueue.JobFollowup: 1,
+		workqueue.JobReserved: 1,
+	})
+
+	if jobOfState(t, q, workqueue.JobReserved, "reserved").ID != reserved.ID {
+		t.Errorf("Unexpected ID for the reserved job")
+	}
+
+	if _, _, err := q.Job("nonexistent"); err != workqueue.ErrJobNotFound {
+		t.Errorf("Retrieving an unknown job returned %v, expected ErrJobNotFound", err)
+	}
+
+	if err := q.Cancel(reserved.ID); err != workqueue.ErrJobNotFound {
+		t.Errorf("Cancelling a reserved job returned %v, expected ErrJobNotFound", err)
+	}
+
+	for _, state := range []workqueue.JobState{workqueue.JobPending, workqueue.JobDelayed, workqueue.JobFollowup} {
+		entry := jobOfState(t, q, state, string(state))
+
+		if err := q.Cancel(entry.ID); err != nil {
+			t.Errorf("Error while cancelling %s job: %s", state, err)
+		}
+
+		if err := q.Cancel(entry.ID); err != workqueue.ErrJobNotFound {
+			t.Errorf("Cancelling a job twice returned %v, expected ErrJobNotFound", err)
+		}
+	}
+
+	checkCounts(t, q, map[workqueue.JobState]int{workqueue.JobReserved: 1})
+
+	if err := q.Requeue(reserved.ID); err != nil {
+		t.Fatalf("Error while requeuing reserved job: %s", err)
+	}
+
+	if err := q.Requeue(reserved.ID); err != workqueue.ErrJobNotFound {
+		t.Errorf("Requeuing a pending job returned %v, expected ErrJobNotFound", err)
+	}
+
+	if err := q.Finish(pickData(t, q, "reserved")); err != nil {
+		t.Errorf("Finish returned an error: %s", err)
+	}
+
+	checkCounts(t, q, map[workqueue.JobState]int{})
+}
@@ -0,0 +1,13 @@
+-- Only hashes made with the former algorithm and parameters can be converted
+-- back, users with other hashes will have to reset their password.
+ALTER TABLE users ADD COLUMN salt BYTEA;
+ALTER TABLE users ADD COLUMN password BYTEA;
+
+UPDATE users SET
+  salt = decode(rpad(split_part(password_hash, '$', 5), (length(split_part(password_hash, '$', 5)) + 3) / 4 * 4, '='), 'base64'),
+  password = decode(rpad(split_part(password_hash, '$', 6), (length(split_part(password_hash, '$', 6)) + 3) / 4 * 4, '='), 'base64')
+WHERE password_hash LIKE '$argon2i$v=19$m=32768,t=3,p=4$%';
+
+ALTER TABLE users DROP COLUMN password_hash;
+
+/* vim:set et ts=2 sw=2: */
@@ -0,0 +1,13 @@
+-- Passwords are now stored as PHC strings, that include the algorithm and its
+-- parameters. Existing hashes were made with Argon2i and fixed parameters.
+ALTER TABLE users ADD COLUMN password_hash TEXT;
+
+UPDATE users SET password_hash = '$argon2i$v=19$m=32768,t=3,p=4$'
+  || rtrim(encode(salt, 'base64'), '=') || '$'
+  || rtrim(encode(password, 'base64'), '=');
+
+ALTER TABLE users ALTER COLUMN password_hash SET NOT NULL;
+ALTER TABLE users DROP COLUMN salt;
+ALTER TABLE users DROP COLUMN password;
+
+/* vim:set et ts=2 sw=2: */
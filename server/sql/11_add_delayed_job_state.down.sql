@@ -0,0 +1,3 @@
+UPDATE jobs SET state = 'pending' WHERE state = 'delayed';
+
+/* vim:set et ts=2 sw=2: */
@@ -0,0 +1,6 @@
+-- Scheduled jobs and jobs waiting to be retried used to be pending jobs that
+-- were not available yet. They now wait in their own state, until the groomer
+-- coalesces them with the other jobs of the same key.
+UPDATE jobs SET state = 'delayed' WHERE state = 'pending' AND available > now();
+
+/* vim:set et ts=2 sw=2: */
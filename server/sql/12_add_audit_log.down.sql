@@ -0,0 +1,3 @@
+DROP TABLE audit_log;
+
+/* vim:set et ts=2 sw=2: */
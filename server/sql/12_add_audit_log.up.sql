@@ -0,0 +1,13 @@
+-- Append-only record of the security relevant events. Usernames aren't
+-- foreign keys, since the events must outlive the purged users.
+CREATE TABLE audit_log (
+  id BIGSERIAL PRIMARY KEY,
+  type TEXT NOT NULL,
+  time TIMESTAMP WITH TIME ZONE NOT NULL,
+  username TEXT NOT NULL DEFAULT '',
+  repository TEXT NOT NULL DEFAULT '',
+  address TEXT NOT NULL DEFAULT '',
+  duration BIGINT NOT NULL DEFAULT 0 -- microseconds
+);
+
+/* vim:set et ts=2 sw=2: */
@@ -0,0 +1,12 @@
+CREATE TABLE tokens (
+  id TEXT NOT NULL PRIMARY KEY,
+  username TEXT NOT NULL REFERENCES users(username) ON DELETE CASCADE,
+  name TEXT NOT NULL,
+  scopes TEXT NOT NULL,
+  hash BYTEA NOT NULL UNIQUE,
+  created TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX tokens_username ON tokens(username);
+
+/* vim:set et ts=2 sw=2: */
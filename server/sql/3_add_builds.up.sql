@@ -0,0 +1,16 @@
+CREATE TABLE builds (
+  id TEXT NOT NULL PRIMARY KEY,
+  username TEXT NOT NULL,
+  blog TEXT NOT NULL,
+  status TEXT NOT NULL,
+  commit_sha TEXT NOT NULL DEFAULT '',
+  queued TIMESTAMP WITH TIME ZONE NOT NULL,
+  started TIMESTAMP WITH TIME ZONE,
+  finished TIMESTAMP WITH TIME ZONE,
+  error TEXT NOT NULL DEFAULT '',
+  FOREIGN KEY (username, blog) REFERENCES blogs(username, slug) ON DELETE CASCADE
+);
+
+CREATE INDEX builds_username_blog_queued ON builds(username, blog, queued);
+
+/* vim:set et ts=2 sw=2: */
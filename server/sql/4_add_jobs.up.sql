@@ -0,0 +1,18 @@
+CREATE TABLE jobs (
+  id TEXT NOT NULL PRIMARY KEY,
+  state TEXT NOT NULL, -- pending, reserved, followup or dead
+  key TEXT NOT NULL DEFAULT '',
+  data BYTEA NOT NULL,
+  ttr BIGINT NOT NULL, -- microseconds
+  attempts INTEGER NOT NULL DEFAULT 0,
+  last_error TEXT NOT NULL DEFAULT '',
+  posted TIMESTAMP WITH TIME ZONE NOT NULL,
+  available TIMESTAMP WITH TIME ZONE NOT NULL, -- pending jobs can't be picked before
+  reserved_until TIMESTAMP WITH TIME ZONE, -- set for reserved jobs
+  failed TIMESTAMP WITH TIME ZONE -- set for dead jobs
+);
+
+CREATE INDEX jobs_state_posted ON jobs(state, posted);
+CREATE INDEX jobs_key ON jobs(key) WHERE key <> '';
+
+/* vim:set et ts=2 sw=2: */
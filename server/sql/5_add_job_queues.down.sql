@@ -0,0 +1,4 @@
+DROP INDEX jobs_queue_state_posted;
+CREATE INDEX jobs_state_posted ON jobs(state, posted);
+
+ALTER TABLE jobs DROP COLUMN queue;
@@ -0,0 +1,6 @@
+ALTER TABLE jobs ADD COLUMN queue TEXT NOT NULL DEFAULT 'jobs';
+
+DROP INDEX jobs_state_posted;
+CREATE INDEX jobs_queue_state_posted ON jobs(queue, state, posted);
+
+/* vim:set et ts=2 sw=2: */
@@ -0,0 +1,3 @@
+ALTER TABLE jobs DROP COLUMN cancelled;
+
+/* vim:set et ts=2 sw=2: */
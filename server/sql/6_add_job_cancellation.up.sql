@@ -0,0 +1,3 @@
+ALTER TABLE jobs ADD COLUMN cancelled BOOLEAN NOT NULL DEFAULT false; -- set on reserved jobs by CancelKey
+
+/* vim:set et ts=2 sw=2: */
@@ -0,0 +1,7 @@
+DELETE FROM blogs WHERE deleted_at IS NOT NULL;
+DELETE FROM users WHERE deleted_at IS NOT NULL;
+
+ALTER TABLE blogs DROP COLUMN deleted_at;
+ALTER TABLE users DROP COLUMN deleted_at;
+
+/* vim:set et ts=2 sw=2: */
@@ -0,0 +1,5 @@
+-- Deleted users and blogs are kept until they get purged
+ALTER TABLE users ADD COLUMN deleted_at TIMESTAMP WITH TIME ZONE;
+ALTER TABLE blogs ADD COLUMN deleted_at TIMESTAMP WITH TIME ZONE;
+
+/* vim:set et ts=2 sw=2: */
@@ -0,0 +1,6 @@
+DROP TABLE one_time_tokens;
+
+ALTER TABLE users DROP COLUMN email_verified;
+ALTER TABLE users DROP COLUMN email;
+
+/* vim:set et ts=2 sw=2: */
@@ -0,0 +1,15 @@
+ALTER TABLE users ADD COLUMN email TEXT NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN email_verified BOOLEAN NOT NULL DEFAULT false;
+
+-- Secrets sent by email for verifying addresses and resetting passwords. Each
+-- user has at most one valid token per purpose.
+CREATE TABLE one_time_tokens (
+  username TEXT NOT NULL REFERENCES users(username) ON DELETE CASCADE,
+  purpose TEXT NOT NULL,
+  hash BYTEA NOT NULL,
+  email TEXT NOT NULL,
+  expires TIMESTAMP WITH TIME ZONE NOT NULL,
+  PRIMARY KEY (username, purpose)
+);
+
+/* vim:set et ts=2 sw=2: */
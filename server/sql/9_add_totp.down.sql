@@ -0,0 +1,7 @@
+DROP TABLE recovery_codes;
+
+ALTER TABLE users DROP COLUMN totp_last_step;
+ALTER TABLE users DROP COLUMN totp_pending_secret;
+ALTER TABLE users DROP COLUMN totp_secret;
+
+/* vim:set et ts=2 sw=2: */
@@ -0,0 +1,13 @@
+-- Two-factor authentication is enabled when totp_secret is set. Enrolled
+-- secrets wait in totp_pending_secret until a code confirms them.
+ALTER TABLE users ADD COLUMN totp_secret TEXT NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN totp_pending_secret TEXT NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN totp_last_step BIGINT NOT NULL DEFAULT 0;
+
+CREATE TABLE recovery_codes (
+  username TEXT NOT NULL REFERENCES users(username) ON DELETE CASCADE,
+  hash BYTEA NOT NULL,
+  PRIMARY KEY (username, hash)
+);
+
+/* vim:set et ts=2 sw=2: */